@@ -22,6 +22,7 @@ func CmdConnect(f cmdutil.Factory) *cobra.Command {
 	var connect = &handler.ConnectOptions{}
 	var sshConf = &util.SshConfig{}
 	var transferImage bool
+	var workload = &workloadFlags{}
 	cmd := &cobra.Command{
 		Use:   "connect",
 		Short: i18n.T("Connect to kubernetes cluster network"),
@@ -30,6 +31,9 @@ func CmdConnect(f cmdutil.Factory) *cobra.Command {
 		# Connect to k8s cluster network
 		kubevpn connect
 
+		# Connect to k8s cluster network from namespace test, using cluster-wide traffic manager in namespace kubevpn
+		kubevpn connect -n test --manager-namespace kubevpn
+
 		# Connect to api-server behind of bastion host or ssh jump host
 		kubevpn connect --ssh-addr 192.168.1.100:22 --ssh-username root --ssh-keyfile /Users/naison/.ssh/ssh.pem
 
@@ -59,6 +63,10 @@ func CmdConnect(f cmdutil.Factory) *cobra.Command {
 			if err := connect.InitClient(f); err != nil {
 				return err
 			}
+			var err error
+			if connect.Workload, err = workload.toWorkloadConfig(); err != nil {
+				return err
+			}
 			if err := connect.DoConnect(); err != nil {
 				log.Errorln(err)
 				handler.Cleanup(syscall.SIGQUIT)
@@ -70,10 +78,18 @@ func CmdConnect(f cmdutil.Factory) *cobra.Command {
 	}
 	cmd.Flags().BoolVar(&config.Debug, "debug", false, "enable debug mode or not, true or false")
 	cmd.Flags().StringVar(&config.Image, "image", config.Image, "use this image to startup container")
+	cmd.Flags().StringVar(&connect.ManagerNamespace, "manager-namespace", "", "Namespace of cluster-wide traffic manager, all namespaces share one traffic manager, if not special, create traffic manager in current namespace")
 	cmd.Flags().StringArrayVar(&connect.ExtraCIDR, "extra-cidr", []string{}, "Extra cidr string, eg: --extra-cidr 192.168.0.159/24 --extra-cidr 192.168.1.160/32")
 	cmd.Flags().StringArrayVar(&connect.ExtraDomain, "extra-domain", []string{}, "Extra domain string, the resolved ip will add to route table, eg: --extra-domain test.abc.com --extra-domain foo.test.com")
+	cmd.Flags().BoolVar(&connect.ForwardDNSOnly, "forward-dns-only", false, "Forward all DNS queries to cluster DNS through tunnel, by default service, pod, headless and SRV records of cluster domain are answered locally from informers")
+	cmd.Flags().StringVar(&connect.DNSRulesFile, "dns-rules-file", "", "YAML file of split DNS rules, fields: rules[{match, upstream, address, route}], match supports wildcard like *.internal.corp, upstream is cluster or ip:port, route adds route of resolved ip through tunnel")
+	cmd.Flags().StringSliceVar(&connect.DNSNamespaces, "dns-namespaces", nil, "Also dump services of these namespaces into hosts, eg: --dns-namespaces=ns1,ns2, if service names conflict, current namespace wins, then namespaces in order")
+	cmd.Flags().StringArrayVar(&connect.ClusterCIDR, "cluster-cidr", []string{}, "Pod and service cidr of cluster, skip detecting cidr, eg: --cluster-cidr 10.244.0.0/16 --cluster-cidr 10.96.0.0/12")
+	cmd.Flags().BoolVar(&connect.RefreshCIDR, "refresh-cidr", false, "Detect cidr of cluster again instead of using cached cidr, eg: cluster adds new ip pool")
+	cmd.Flags().BoolVar(&connect.NoPrivilegedProbe, "no-privileged-probe", false, "Never create privileged pod with host /etc/cni and /proc mounts for detecting cidr, only detect cidr from api objects, eg: namespace enforces restricted pod security")
 	cmd.Flags().BoolVar(&transferImage, "transfer-image", false, "transfer image to remote registry, it will transfer image "+config.OriginImage+" to flags `--image` special image, default: "+config.Image)
 
 	addSshFlags(cmd, sshConf)
+	addWorkloadFlags(cmd, workload)
 	return cmd
 }
@@ -1,6 +1,8 @@
 package cmds
 
 import (
+	"os"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
@@ -10,7 +12,7 @@ import (
 	"github.com/wencaiwulue/kubevpn/pkg/util"
 )
 
-func CmdControlPlane(_ cmdutil.Factory) *cobra.Command {
+func CmdControlPlane(f cmdutil.Factory) *cobra.Command {
 	var (
 		watchDirectoryFilename string
 		port                   uint = 9002
@@ -19,14 +21,31 @@ func CmdControlPlane(_ cmdutil.Factory) *cobra.Command {
 		Use:    "control-plane",
 		Hidden: true,
 		Short:  "Control-plane is a envoy xds server",
-		Long:   `Control-plane is a envoy xds server, distribute envoy route configuration`,
-		Run: func(cmd *cobra.Command, args []string) {
+		Long:   `Control-plane is a envoy xds server, watch configmap kubevpn-traffic-manager and distribute envoy route configuration`,
+		RunE: func(cmd *cobra.Command, args []string) error {
 			util.InitLogger(config.Debug)
 			go util.StartupPProf(0)
-			controlplane.Main(watchDirectoryFilename, port, log.StandardLogger())
+			clientset, err := f.KubernetesClientSet()
+			if err != nil {
+				return err
+			}
+			namespace := os.Getenv(config.EnvPodNamespace)
+			if namespace == "" {
+				if namespace, _, err = f.ToRawKubeConfigLoader().Namespace(); err != nil {
+					return err
+				}
+			}
+			tlsConfig, err := util.ServerTLSConfig(config.TLSMountPath, true)
+			if err != nil {
+				return err
+			}
+			controlplane.Main(clientset, namespace, port, tlsConfig, log.StandardLogger())
+			return nil
 		},
 	}
 	cmd.Flags().StringVarP(&watchDirectoryFilename, "watchDirectoryFilename", "w", "/etc/envoy/envoy-config.yaml", "full path to directory to watch for files")
+	// keep it for traffic manager deployed by old version
+	_ = cmd.Flags().MarkDeprecated("watchDirectoryFilename", "control-plane watches configmap directly")
 	cmd.Flags().BoolVar(&config.Debug, "debug", false, "true/false")
 	return cmd
 }
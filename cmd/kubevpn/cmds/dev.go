@@ -1,6 +1,7 @@
 package cmds
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/docker/cli/cli"
@@ -13,6 +14,7 @@ import (
 	"k8s.io/kubectl/pkg/util/templates"
 
 	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/controlplane"
 	"github.com/wencaiwulue/kubevpn/pkg/dev"
 	"github.com/wencaiwulue/kubevpn/pkg/handler"
 	"github.com/wencaiwulue/kubevpn/pkg/util"
@@ -30,6 +32,7 @@ func CmdDev(f cmdutil.Factory) *cobra.Command {
 	}
 	var sshConf = &util.SshConfig{}
 	var transferImage bool
+	var headers []string
 	cmd := &cobra.Command{
 		Use:   "dev [OPTIONS] RESOURCE [COMMAND] [ARG...]",
 		Short: i18n.T("Startup your kubernetes workloads in local Docker container with same volume、env、and network"),
@@ -81,7 +84,10 @@ Startup your kubernetes workloads in local Docker container with same volume、e
 			}
 			return handler.SshJump(sshConf, cmd.Flags())
 		},
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if devOptions.Headers, err = controlplane.ParseHeaders(headers); err != nil {
+				return fmt.Errorf("invalid headers, err: %v", err)
+			}
 			devOptions.Workload = args[0]
 			if len(args) > 1 {
 				devOptions.Copts.Args = args[1:]
@@ -90,15 +96,20 @@ Startup your kubernetes workloads in local Docker container with same volume、e
 		},
 	}
 	cmd.Flags().SortFlags = false
-	cmd.Flags().StringToStringVarP(&devOptions.Headers, "headers", "H", map[string]string{}, "Traffic with special headers with reverse it to local PC, you should startup your service after reverse workloads successfully, If not special, redirect all traffic to local PC, format is k=v, like: k1=v1,k2=v2")
+	cmd.Flags().IntVar(&devOptions.Weight, "weight", 0, "Percentage of traffic hit local PC, others go to origin workloads, combined with --headers only matched traffic is split, 0 means all, eg: --weight 10")
+	cmd.Flags().StringArrayVarP(&headers, "headers", "H", []string{}, "Traffic with special headers with reverse it to local PC, you should startup your service after reverse workloads successfully, If not special, redirect all traffic to local PC, format is k=v, repeat it for multiple headers, like: --headers k1=v1 --headers k2=v2, value can be prefixed with exact:, prefix:, regex:, present: or absent:, key can be :path, query:<name> or cookie:<name>, like: --headers x-request-user=prefix:alice --headers :path=regex:/tenant/[0-9]+/.*")
 	cmd.Flags().BoolVar(&config.Debug, "debug", false, "enable debug mode or not, true or false")
 	cmd.Flags().StringVar(&config.Image, "image", config.Image, "use this image to startup container")
 	cmd.Flags().BoolVar(&devOptions.NoProxy, "no-proxy", false, "Whether proxy remote workloads traffic into local or not, true: just startup container on local without inject containers to intercept traffic, false: intercept traffic and forward to local")
 	cmdutil.AddContainerVarFlags(cmd, &devOptions.ContainerName, devOptions.ContainerName)
 	cmdutil.CheckErr(cmd.RegisterFlagCompletionFunc("container", completion.ContainerCompletionFunc(f)))
+	cmd.Flags().StringVar(&devOptions.ManagerNamespace, "manager-namespace", "", "Namespace of cluster-wide traffic manager, all namespaces share one traffic manager, if not special, create traffic manager in current namespace")
 	cmd.Flags().StringArrayVar(&devOptions.ExtraCIDR, "extra-cidr", []string{}, "Extra cidr string, eg: --extra-cidr 192.168.0.159/24 --extra-cidr 192.168.1.160/32")
 	cmd.Flags().StringArrayVar(&devOptions.ExtraDomain, "extra-domain", []string{}, "Extra domain string, the resolved ip will add to route table, eg: --extra-domain test.abc.com --extra-domain foo.test.com")
 	cmd.Flags().StringVar((*string)(&devOptions.ConnectMode), "connect-mode", string(dev.ConnectModeHost), "Connect to kubernetes network in container or in host, eg: ["+string(dev.ConnectModeContainer)+"|"+string(dev.ConnectModeHost)+"]")
+	cmd.Flags().StringArrayVar(&devOptions.ClusterCIDR, "cluster-cidr", []string{}, "Pod and service cidr of cluster, skip detecting cidr, eg: --cluster-cidr 10.244.0.0/16 --cluster-cidr 10.96.0.0/12")
+	cmd.Flags().BoolVar(&devOptions.RefreshCIDR, "refresh-cidr", false, "Detect cidr of cluster again instead of using cached cidr, eg: cluster adds new ip pool")
+	cmd.Flags().BoolVar(&devOptions.NoPrivilegedProbe, "no-privileged-probe", false, "Never create privileged pod with host /etc/cni and /proc mounts for detecting cidr, only detect cidr from api objects, eg: namespace enforces restricted pod security")
 	cmd.Flags().BoolVar(&transferImage, "transfer-image", false, "transfer image to remote registry, it will transfer image "+config.OriginImage+" to flags `--image` special image, default: "+config.Image)
 
 	// diy docker options
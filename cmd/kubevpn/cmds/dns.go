@@ -0,0 +1,132 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	miekgdns "github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/dns"
+	"github.com/wencaiwulue/kubevpn/pkg/handler"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+func CmdDNS(factory cmdutil.Factory) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dns",
+		Short: i18n.T("Manage DNS of KubeVPN"),
+		Long:  templates.LongDesc(i18n.T(`Manage DNS server which KubeVPN runs on local PC for resolving names of cluster`)),
+	}
+	cmd.AddCommand(cmdDNSFlush(factory))
+	cmd.AddCommand(cmdDNSQuery(factory))
+	return cmd
+}
+
+func cmdDNSFlush(cmdutil.Factory) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "flush",
+		Short: i18n.T("Flush DNS cache"),
+		Long: templates.LongDesc(i18n.T(`
+		Flush answer cache of DNS server of running KubeVPN, include negative cached NXDOMAIN answers,
+		and flush DNS cache of system, eg: service is just created but still resolves NXDOMAIN.`)),
+		Example: templates.Examples(i18n.T(`
+		# Flush DNS cache
+		  kubevpn dns flush
+`)),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if !util.IsAdmin() {
+				util.RunWithElevated()
+				os.Exit(0)
+			}
+			util.InitLogger(config.Debug)
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := dns.FlushCache(); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintln(os.Stdout, "Done")
+		},
+	}
+	cmd.Flags().BoolVar(&config.Debug, "debug", false, "Enable debug mode or not, true or false")
+	return cmd
+}
+
+func cmdDNSQuery(factory cmdutil.Factory) *cobra.Command {
+	var connect = handler.ConnectOptions{}
+	var qtype string
+	cmd := &cobra.Command{
+		Use:   "query <name>",
+		Short: i18n.T("Resolve name and print trace"),
+		Long: templates.LongDesc(i18n.T(`
+		Resolve name in process by same logic of DNS server which KubeVPN runs on local PC,
+		print expanded names with search domains, answer of authority and every upstream, and which one wins.
+		Queries forwarded to cluster DNS go through tunnel, so kubevpn connect should be running.`)),
+		Example: templates.Examples(i18n.T(`
+		# Resolve A record of service
+		  kubevpn dns query productpage
+
+		# Resolve SRV record of headless service
+		  kubevpn dns query _tcp-client._tcp.kafka-headless.kafka --type SRV
+`)),
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			util.InitLogger(config.Debug)
+			if _, ok := miekgdns.StringToType[strings.ToUpper(qtype)]; !ok {
+				return fmt.Errorf("unknown dns type %s", qtype)
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := connect.InitClient(factory); err != nil {
+				log.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(cmd.Context(), time.Second*30)
+			defer cancel()
+			trace, err := connect.QueryDNS(ctx, args[0], miekgdns.StringToType[strings.ToUpper(qtype)])
+			if err != nil {
+				log.Fatal(err)
+			}
+			printTrace(trace)
+		},
+	}
+	cmd.Flags().BoolVar(&config.Debug, "debug", false, "Enable debug mode or not, true or false")
+	cmd.Flags().StringVar(&qtype, "type", "A", "DNS record type, eg: A, AAAA, SRV, CNAME, TXT")
+	cmd.Flags().StringVar(&connect.ManagerNamespace, "manager-namespace", "", "Namespace of cluster-wide traffic manager, same as kubevpn connect")
+	cmd.Flags().BoolVar(&connect.ForwardDNSOnly, "forward-dns-only", false, "Forward all DNS queries to cluster DNS through tunnel, same as kubevpn connect")
+	cmd.Flags().StringVar(&connect.DNSRulesFile, "dns-rules-file", "", "YAML file of split DNS rules, same as kubevpn connect")
+	return cmd
+}
+
+func printTrace(trace *dns.Trace) {
+	fmt.Fprintf(os.Stdout, "Query:    %s %s\n", trace.Name, trace.Qtype)
+	fmt.Fprintf(os.Stdout, "Tried:    %s\n", strings.Join(trace.Tried, ", "))
+	fmt.Fprintln(os.Stdout, "Attempts:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "  NAME\tUPSTREAM\tRCODE\tANSWERS\tLATENCY\tERROR")
+	for _, a := range trace.Attempts {
+		var errStr string
+		if a.Err != nil {
+			errStr = a.Err.Error()
+		}
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\t%d\t%s\t%s\n", a.Name, a.Upstream, a.Rcode, a.Answers, a.Latency.Round(time.Millisecond), errStr)
+	}
+	_ = w.Flush()
+	fmt.Fprintf(os.Stdout, "Upstream: %s\n", trace.Upstream)
+	fmt.Fprintf(os.Stdout, "Rcode:    %s\n", trace.Rcode)
+	fmt.Fprintf(os.Stdout, "Latency:  %s\n", trace.Latency.Round(time.Millisecond))
+	fmt.Fprintln(os.Stdout, "Answer:")
+	for _, rr := range trace.Answer {
+		fmt.Fprintf(os.Stdout, "  %s\n", rr.String())
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"k8s.io/kubectl/pkg/util/templates"
 
 	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/controlplane"
 	"github.com/wencaiwulue/kubevpn/pkg/dev"
 	"github.com/wencaiwulue/kubevpn/pkg/handler"
 	"github.com/wencaiwulue/kubevpn/pkg/util"
@@ -27,6 +28,7 @@ func CmdDuplicate(f cmdutil.Factory) *cobra.Command {
 	var duplicateOptions = handler.DuplicateOptions{}
 	var sshConf = &util.SshConfig{}
 	var transferImage bool
+	var headers []string
 	cmd := &cobra.Command{
 		Use:   "duplicate",
 		Short: i18n.T("Duplicate workloads to target-kubeconfig cluster with same volume、env、and network"),
@@ -88,15 +90,26 @@ func CmdDuplicate(f cmdutil.Factory) *cobra.Command {
 			// special empty string, eg: --target-registry ""
 			duplicateOptions.IsChangeTargetRegistry = cmd.Flags().Changed("target-registry")
 
+			var err error
+			if duplicateOptions.Headers, err = controlplane.ParseHeaders(headers); err != nil {
+				return fmt.Errorf("invalid headers, err: %v", err)
+			}
+			if duplicateOptions.Weight < 0 || duplicateOptions.Weight > 100 {
+				return fmt.Errorf("invalid weight %d, it should be in range [0, 100]", duplicateOptions.Weight)
+			}
 			connectOptions := handler.ConnectOptions{
-				Namespace: duplicateOptions.Namespace,
-				Workloads: args,
-				ExtraCIDR: duplicateOptions.ExtraCIDR,
+				Namespace:         duplicateOptions.Namespace,
+				Workloads:         args,
+				ExtraCIDR:         duplicateOptions.ExtraCIDR,
+				ManagerNamespace:  duplicateOptions.ManagerNamespace,
+				NoPrivilegedProbe: duplicateOptions.NoPrivilegedProbe,
+				ClusterCIDR:       duplicateOptions.ClusterCIDR,
+				RefreshCIDR:       duplicateOptions.RefreshCIDR,
 			}
-			if err := connectOptions.InitClient(f); err != nil {
+			if err = connectOptions.InitClient(f); err != nil {
 				return err
 			}
-			err := connectOptions.PreCheckResource()
+			err = connectOptions.PreCheckResource()
 			if err != nil {
 				return err
 			}
@@ -119,11 +132,16 @@ func CmdDuplicate(f cmdutil.Factory) *cobra.Command {
 			select {}
 		},
 	}
-	cmd.Flags().StringToStringVarP(&duplicateOptions.Headers, "headers", "H", map[string]string{}, "Traffic with special headers with reverse it to duplicate workloads, you should startup your service after reverse workloads successfully, If not special, redirect all traffic to duplicate workloads, format is k=v, like: k1=v1,k2=v2")
+	cmd.Flags().IntVar(&duplicateOptions.Weight, "weight", 0, "Percentage of traffic hit duplicate workloads, others go to origin workloads, combined with --headers only matched traffic is split, 0 means all, eg: --weight 10")
+	cmd.Flags().StringArrayVarP(&headers, "headers", "H", []string{}, "Traffic with special headers with reverse it to duplicate workloads, you should startup your service after reverse workloads successfully, If not special, redirect all traffic to duplicate workloads, format is k=v, repeat it for multiple headers, like: --headers k1=v1 --headers k2=v2, value can be prefixed with exact:, prefix:, regex:, present: or absent:, key can be :path, query:<name> or cookie:<name>, like: --headers x-request-user=prefix:alice --headers :path=regex:/tenant/[0-9]+/.*")
 	cmd.Flags().BoolVar(&config.Debug, "debug", false, "Enable debug mode or not, true or false")
 	cmd.Flags().StringVar(&config.Image, "image", config.Image, "Use this image to startup container")
+	cmd.Flags().StringVar(&duplicateOptions.ManagerNamespace, "manager-namespace", "", "Namespace of cluster-wide traffic manager, all namespaces share one traffic manager, if not special, create traffic manager in current namespace")
 	cmd.Flags().StringArrayVar(&duplicateOptions.ExtraCIDR, "extra-cidr", []string{}, "Extra cidr string, eg: --extra-cidr 192.168.0.159/24 --extra-cidr 192.168.1.160/32")
 	cmd.Flags().StringArrayVar(&duplicateOptions.ExtraDomain, "extra-domain", []string{}, "Extra domain string, the resolved ip will add to route table, eg: --extra-domain test.abc.com --extra-domain foo.test.com")
+	cmd.Flags().StringArrayVar(&duplicateOptions.ClusterCIDR, "cluster-cidr", []string{}, "Pod and service cidr of cluster, skip detecting cidr, eg: --cluster-cidr 10.244.0.0/16 --cluster-cidr 10.96.0.0/12")
+	cmd.Flags().BoolVar(&duplicateOptions.RefreshCIDR, "refresh-cidr", false, "Detect cidr of cluster again instead of using cached cidr, eg: cluster adds new ip pool")
+	cmd.Flags().BoolVar(&duplicateOptions.NoPrivilegedProbe, "no-privileged-probe", false, "Never create privileged pod with host /etc/cni and /proc mounts for detecting cidr, only detect cidr from api objects, eg: namespace enforces restricted pod security")
 	cmd.Flags().BoolVar(&transferImage, "transfer-image", false, "transfer image to remote registry, it will transfer image "+config.OriginImage+" to flags `--image` special image, default: "+config.Image)
 
 	cmd.Flags().StringVar(&duplicateOptions.TargetImage, "target-image", "", "Duplicate container use this image to startup container, if not special, use origin origin image")
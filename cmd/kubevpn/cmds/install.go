@@ -0,0 +1,101 @@
+package cmds
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/printers"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/handler"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+func CmdInstall(factory cmdutil.Factory) *cobra.Command {
+	var dryRun, clusterWide bool
+	var output, chartDir string
+	var namespaces []string
+	var workload = &workloadFlags{}
+	cmd := &cobra.Command{
+		Use:   "install",
+		Short: "Pre-install traffic manager",
+		Long: `Pre-install traffic manager, connect will reuse it and never delete it, so user who connect needs no permission to create it.
+Also can render manifests or generate helm chart for GitOps`,
+		Example: templates.Examples(i18n.T(`
+		# Install traffic manager into namespace test
+		  kubevpn install -n test
+
+		# Render manifests of traffic manager, apply it by GitOps tools like Argo CD
+		  kubevpn install -n test --dry-run -o yaml
+
+		# Install cluster-wide traffic manager, and label namespace test and dev to use it, connect with --manager-namespace kubevpn
+		  kubevpn install -n kubevpn --cluster-wide --namespaces test,dev
+
+		# Generate helm chart into directory charts/kubevpn
+		  kubevpn install --chart-dir charts/kubevpn
+`)),
+		Run: func(cmd *cobra.Command, args []string) {
+			if chartDir != "" {
+				if err := handler.GenHelmChart(chartDir); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+			namespace, _, err := factory.ToRawKubeConfigLoader().Namespace()
+			if err != nil {
+				log.Fatal(err)
+			}
+			conf, err := workload.toWorkloadConfig()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if dryRun {
+				var printer printers.ResourcePrinter
+				switch output {
+				case "yaml":
+					printer = &printers.YAMLPrinter{}
+				case "json":
+					printer = &printers.JSONPrinter{}
+				default:
+					log.Fatalf("unsupported output format %s, only support yaml and json", output)
+				}
+				certs, err := util.GenCertBundle(namespace)
+				if err != nil {
+					log.Fatal(err)
+				}
+				manager := handler.GenTrafficManager(namespace, config.Image, clusterWide, true, conf, certs)
+				for _, object := range manager.Objects() {
+					if err = printer.PrintObj(object, os.Stdout); err != nil {
+						log.Fatal(err)
+					}
+				}
+				return
+			}
+			clientset, err := factory.KubernetesClientSet()
+			if err != nil {
+				log.Fatal(err)
+			}
+			base, err := util.GetWorkloadConfig(cmd.Context(), clientset.CoreV1().ConfigMaps(namespace))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err = handler.InstallTrafficManager(cmd.Context(), factory, clientset, namespace, clusterWide, namespaces, base.Merge(conf)); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintln(os.Stdout, "Done")
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only print manifests of traffic manager, not install it")
+	cmd.Flags().StringVarP(&output, "output", "o", "yaml", "Output format of --dry-run, one of yaml|json")
+	cmd.Flags().BoolVar(&clusterWide, "cluster-wide", false, "Install cluster-wide traffic manager, namespace labeled with "+config.LabelTrafficManager+"=<namespace> can use it")
+	cmd.Flags().StringSliceVar(&namespaces, "namespaces", nil, "Label these namespaces with "+config.LabelTrafficManager+"=<namespace> to use cluster-wide traffic manager, only works with --cluster-wide, eg: --namespaces=ns1,ns2")
+	cmd.Flags().StringVar(&chartDir, "chart-dir", "", "Generate helm chart into directory, which renders same manifests as --dry-run")
+	cmd.Flags().StringVar(&config.Image, "image", config.Image, "Use this image to startup traffic manager")
+	addWorkloadFlags(cmd, workload)
+	return cmd
+}
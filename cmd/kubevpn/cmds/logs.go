@@ -0,0 +1,70 @@
+package cmds
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/controlplane"
+	"github.com/wencaiwulue/kubevpn/pkg/handler"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+func CmdLogs(factory cmdutil.Factory) *cobra.Command {
+	var options = handler.LogsOptions{}
+	var requests bool
+	cmd := &cobra.Command{
+		Use:   "logs",
+		Short: i18n.T("Tail requests handled by envoy sidecar of proxied workloads"),
+		Long: templates.LongDesc(i18n.T(`
+		Tail requests handled by envoy sidecar of workloads which proxied in mesh mode (proxy with --headers, --weight or --mirror),
+		show whether each request matched your rule and went to local PC, or went to origin workloads.
+		Requests which matched rules of others are hidden.`)),
+		Example: templates.Examples(i18n.T(`
+		# Tail requests of deployment foo
+		  kubevpn logs --requests deployment/foo
+
+		# Tail requests of workloads proxied with cluster-wide traffic manager
+		  kubevpn logs --requests deployment/foo --manager-namespace kubevpn
+`)),
+		Args: cobra.MinimumNArgs(1),
+		PreRunE: func(*cobra.Command, []string) error {
+			util.InitLogger(config.Debug)
+			if !requests {
+				return fmt.Errorf("only support request logs of envoy sidecar now, please add flag --requests")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.InitClient(factory); err != nil {
+				log.Fatal(err)
+			}
+			options.Workloads = args
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+			err := options.DoLogs(ctx, func(l *controlplane.AccessLog) {
+				target := "origin"
+				if l.Matched() {
+					target = "local"
+				}
+				fmt.Fprintf(os.Stdout, "%s %s %-6s %s%s %d %s -> %s (route: %s, cluster: %s)\n",
+					l.Time.Local().Format("15:04:05.000"), l.Node, l.Method, l.Authority, l.Path, l.Status, l.Duration, target, l.Route, l.Cluster)
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&requests, "requests", false, "Tail requests handled by envoy sidecar, show which requests hit local PC")
+	cmd.Flags().StringVar(&options.ManagerNamespace, "manager-namespace", "", "Namespace of cluster-wide traffic manager, if not special, traffic manager in current namespace")
+	cmd.Flags().BoolVar(&config.Debug, "debug", false, "Enable debug mode or not, true or false")
+	return cmd
+}
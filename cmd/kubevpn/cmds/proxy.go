@@ -15,6 +15,7 @@ import (
 	"k8s.io/kubectl/pkg/util/templates"
 
 	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/controlplane"
 	"github.com/wencaiwulue/kubevpn/pkg/dev"
 	"github.com/wencaiwulue/kubevpn/pkg/handler"
 	"github.com/wencaiwulue/kubevpn/pkg/util"
@@ -24,6 +25,8 @@ func CmdProxy(f cmdutil.Factory) *cobra.Command {
 	var connect = handler.ConnectOptions{}
 	var sshConf = &util.SshConfig{}
 	var transferImage bool
+	var headers []string
+	var workload = &workloadFlags{}
 	cmd := &cobra.Command{
 		Use:   "proxy",
 		Short: i18n.T("Proxy kubernetes workloads inbound traffic into local PC"),
@@ -44,6 +47,25 @@ func CmdProxy(f cmdutil.Factory) *cobra.Command {
 		# Reverse proxy with mesh, traffic with header a=1, will hit local PC, otherwise no effect
 		kubevpn proxy service/productpage --headers a=1
 
+		# Reverse proxy with mesh, traffic with header x-request-user prefixed with alice and path of tenant 1 will hit local PC
+		kubevpn proxy service/productpage --headers x-request-user=prefix:alice --headers :path=regex:/tenant/1/.*
+
+		# Reverse proxy with mesh, 10 percent of traffic will hit local PC, it also can be combined with --headers
+		kubevpn proxy service/productpage --weight 10
+
+		# Mirror 20 percent of traffic with header a=1 to local PC, callers still get response from origin workloads
+		kubevpn proxy service/productpage --mirror --mirror-percent 20 --headers a=1
+
+		# Delay half of traffic with header a=1 for 2 seconds, abort 10 percent of it with 503
+		kubevpn proxy service/productpage --headers a=1 --fault delay=2s,delay-percent=50,abort=503,abort-percent=10
+
+		# Return canned responses for traffic with header a=1, rules.yaml:
+		#   directResponses:
+		#     - path: prefix:/api/v1/reviews
+		#       status: 200
+		#       body: '{"reviews": []}'
+		kubevpn proxy service/productpage --headers a=1 --rules-file rules.yaml
+
 		# Connect to api-server behind of bastion host or ssh jump host and proxy kubernetes resource traffic into local PC
 		kubevpn proxy deployment/productpage --ssh-addr 192.168.1.100:22 --ssh-username root --ssh-keyfile /Users/naison/.ssh/ssh.pem --headers a=1
 
@@ -73,6 +95,13 @@ func CmdProxy(f cmdutil.Factory) *cobra.Command {
 			if err := connect.InitClient(f); err != nil {
 				return err
 			}
+			var err error
+			if connect.Workload, err = workload.toWorkloadConfig(); err != nil {
+				return err
+			}
+			if connect.Headers, err = controlplane.ParseHeaders(headers); err != nil {
+				return fmt.Errorf("invalid headers, err: %v", err)
+			}
 			if len(args) == 0 {
 				fmt.Fprintf(os.Stdout, "You must specify the type of resource to proxy. %s\n\n", cmdutil.SuggestAPIResources("kubevpn"))
 				fullCmdName := cmd.Parent().CommandPath()
@@ -83,7 +112,7 @@ func CmdProxy(f cmdutil.Factory) *cobra.Command {
 				return cmdutil.UsageErrorf(cmd, usageString)
 			}
 			connect.Workloads = args
-			err := connect.PreCheckResource()
+			err = connect.PreCheckResource()
 			if err != nil {
 				return err
 			}
@@ -96,14 +125,28 @@ func CmdProxy(f cmdutil.Factory) *cobra.Command {
 			select {}
 		},
 	}
-	cmd.Flags().StringToStringVarP(&connect.Headers, "headers", "H", map[string]string{}, "Traffic with special headers with reverse it to local PC, you should startup your service after reverse workloads successfully, If not special, redirect all traffic to local PC, format is k=v, like: k1=v1,k2=v2")
+	cmd.Flags().StringArrayVarP(&headers, "headers", "H", []string{}, "Traffic with special headers with reverse it to local PC, you should startup your service after reverse workloads successfully, If not special, redirect all traffic to local PC, format is k=v, repeat it for multiple headers, like: --headers k1=v1 --headers k2=v2, value can be prefixed with exact:, prefix:, regex:, present: or absent:, key can be :path, query:<name> or cookie:<name>, like: --headers x-request-user=prefix:alice --headers :path=regex:/tenant/[0-9]+/.*")
+	cmd.Flags().IntVar(&connect.Weight, "weight", 0, "Percentage of traffic hit local PC, others go to origin workloads, combined with --headers only matched traffic is split, 0 means all, eg: --weight 10")
+	cmd.Flags().BoolVar(&connect.Mirror, "mirror", false, "Mirror traffic to local PC, traffic still go to origin workloads, response of local PC is ignored, --headers filters mirrored traffic")
+	cmd.Flags().IntVar(&connect.MirrorPercent, "mirror-percent", 0, "Percentage of traffic mirrored to local PC, only works with --mirror, combined with --headers only matched traffic is sampled, 0 means all, eg: --mirror-percent 20")
+	cmd.Flags().StringToStringVar(&connect.Fault, "fault", map[string]string{}, "Inject fault into traffic matched --headers, keys are delay, delay-percent, abort and abort-percent, percent 0 means all, eg: --fault delay=2s,abort=503,abort-percent=10")
+	cmd.Flags().StringVar(&connect.RulesFile, "rules-file", "", "YAML file of fault and direct responses for traffic matched --headers, fields: fault{delay, delayPercent, abortStatus, abortPercent}, directResponses[{path, status, body}], --fault overrides fault in it")
+	cmd.Flags().StringVar(&connect.HealthCheckPath, "health-check-path", "", "HTTP health check path of local service in mesh mode, eg: /healthz, traffic fallback to origin workloads if local PC is unhealthy, default is tcp health check")
 	cmd.Flags().BoolVar(&config.Debug, "debug", false, "Enable debug mode or not, true or false")
 	cmd.Flags().StringVar(&config.Image, "image", config.Image, "Use this image to startup container")
+	cmd.Flags().StringVar(&connect.ManagerNamespace, "manager-namespace", "", "Namespace of cluster-wide traffic manager, all namespaces share one traffic manager, if not special, create traffic manager in current namespace")
 	cmd.Flags().StringArrayVar(&connect.ExtraCIDR, "extra-cidr", []string{}, "Extra cidr string, eg: --extra-cidr 192.168.0.159/24 --extra-cidr 192.168.1.160/32")
 	cmd.Flags().StringArrayVar(&connect.ExtraDomain, "extra-domain", []string{}, "Extra domain string, the resolved ip will add to route table, eg: --extra-domain test.abc.com --extra-domain foo.test.com")
+	cmd.Flags().BoolVar(&connect.ForwardDNSOnly, "forward-dns-only", false, "Forward all DNS queries to cluster DNS through tunnel, by default service, pod, headless and SRV records of cluster domain are answered locally from informers")
+	cmd.Flags().StringVar(&connect.DNSRulesFile, "dns-rules-file", "", "YAML file of split DNS rules, fields: rules[{match, upstream, address, route}], match supports wildcard like *.internal.corp, upstream is cluster or ip:port, route adds route of resolved ip through tunnel")
+	cmd.Flags().StringSliceVar(&connect.DNSNamespaces, "dns-namespaces", nil, "Also dump services of these namespaces into hosts, eg: --dns-namespaces=ns1,ns2, if service names conflict, current namespace wins, then namespaces in order")
+	cmd.Flags().StringArrayVar(&connect.ClusterCIDR, "cluster-cidr", []string{}, "Pod and service cidr of cluster, skip detecting cidr, eg: --cluster-cidr 10.244.0.0/16 --cluster-cidr 10.96.0.0/12")
+	cmd.Flags().BoolVar(&connect.RefreshCIDR, "refresh-cidr", false, "Detect cidr of cluster again instead of using cached cidr, eg: cluster adds new ip pool")
+	cmd.Flags().BoolVar(&connect.NoPrivilegedProbe, "no-privileged-probe", false, "Never create privileged pod with host /etc/cni and /proc mounts for detecting cidr, only detect cidr from api objects, eg: namespace enforces restricted pod security")
 	cmd.Flags().BoolVar(&transferImage, "transfer-image", false, "transfer image to remote registry, it will transfer image "+config.OriginImage+" to flags `--image` special image, default: "+config.Image)
 
 	addSshFlags(cmd, sshConf)
+	addWorkloadFlags(cmd, workload)
 	cmd.ValidArgsFunction = utilcomp.ResourceTypeAndNameCompletionFunc(f)
 	return cmd
 }
@@ -0,0 +1,101 @@
+package cmds
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/tap"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+func CmdRecord(factory cmdutil.Factory) *cobra.Command {
+	var options = tap.RecordOptions{}
+	cmd := &cobra.Command{
+		Use:   "record",
+		Short: i18n.T("Record requests and responses of proxied workloads into local file"),
+		Long: templates.LongDesc(i18n.T(`
+		Record requests and responses of workloads which proxied in mesh mode (proxy with --headers, --weight or --mirror),
+		envoy sidecar streams full requests and responses back, write them into HAR file or JSONL file (one HAR entry per line).
+		Only requests which hit rules of this PC are recorded.
+		Stop recording with Ctrl+C.`)),
+		Example: templates.Examples(i18n.T(`
+		# Record requests of deployment foo into foo.har
+		  kubevpn record deployment/foo -o foo.har
+
+		# Record requests of multiple workloads into jsonl file
+		  kubevpn record deployment/foo deployment/bar -o requests.jsonl
+
+		# Replay recorded requests against local process
+		  kubevpn replay foo.har --to localhost:8080
+`)),
+		Args: cobra.MinimumNArgs(1),
+		PreRun: func(*cobra.Command, []string) {
+			util.InitLogger(config.Debug)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.InitClient(factory); err != nil {
+				log.Fatal(err)
+			}
+			options.Workloads = args
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+			if err := options.DoRecord(ctx); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(os.Stdout, "Requests are recorded into %s\n", options.Output)
+		},
+	}
+	cmd.Flags().StringVarP(&options.Output, "output", "o", "kubevpn.har", "Output file, .har file is HAR format, others are JSONL format")
+	cmd.Flags().IntVar(&options.MaxBodyBytes, "max-body-bytes", 1<<20, "Body larger than it will be truncated")
+	cmd.Flags().BoolVar(&config.Debug, "debug", false, "Enable debug mode or not, true or false")
+	return cmd
+}
+
+func CmdReplay(_ cmdutil.Factory) *cobra.Command {
+	var options = tap.ReplayOptions{}
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: i18n.T("Replay recorded requests against local process"),
+		Long: templates.LongDesc(i18n.T(`
+		Replay requests recorded by kubevpn record against local process one by one,
+		keep original method, path, query, headers and body, print status and latency of each request.`)),
+		Example: templates.Examples(i18n.T(`
+		# Replay requests in foo.har against localhost:8080
+		  kubevpn replay foo.har --to localhost:8080
+`)),
+		Args: cobra.ExactArgs(1),
+		PreRun: func(*cobra.Command, []string) {
+			util.InitLogger(config.Debug)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			options.File = args[0]
+			var total, failed int
+			err := options.DoReplay(cmd.Context(), func(result tap.ReplayResult) {
+				total++
+				if result.Err != nil {
+					failed++
+					fmt.Fprintf(os.Stdout, "%s %s error: %v\n", result.Entry.Request.Method, result.Entry.Request.URL, result.Err)
+					return
+				}
+				fmt.Fprintf(os.Stdout, "%s %s %d (recorded %d) %s\n", result.Entry.Request.Method, result.Entry.Request.URL, result.Status, result.Entry.Response.Status, result.Duration)
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(os.Stdout, "Replayed %d requests, %d failed\n", total, failed)
+		},
+	}
+	cmd.Flags().StringVar(&options.To, "to", "", "Address of local process, eg: localhost:8080")
+	_ = cmd.MarkFlagRequired("to")
+	cmd.Flags().BoolVar(&config.Debug, "debug", false, "Enable debug mode or not, true or false")
+	return cmd
+}
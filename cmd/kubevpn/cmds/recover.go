@@ -0,0 +1,78 @@
+package cmds
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/handler"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+func CmdRecover(factory cmdutil.Factory) *cobra.Command {
+	var connect = handler.ConnectOptions{}
+	var id string
+	var list bool
+	cmd := &cobra.Command{
+		Use:   "recover",
+		Short: "Recover changes made by killed KubeVPN process",
+		Long: templates.LongDesc(i18n.T(`
+		Recover changes made by killed KubeVPN process, eg: killed by SIGKILL, kernel panic or laptop battery dying.
+
+		KubeVPN records every change into journal on disk and in cluster, recover replays journal to rollback them.
+		It also runs automatically at next connect.`)),
+		Example: templates.Examples(i18n.T(`
+		# Recover journals of this machine which process is not running anymore
+		  kubevpn recover
+
+		# List all journals, include journals from other machines
+		  kubevpn recover --list
+
+		# Recover journal from other machine, eg: laptop is broken
+		  kubevpn recover --id 5b1e2a7c-0f8e-4c1d-9d6b-3a1f2e4d5c6b
+`)),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if !util.IsAdmin() && !list {
+				util.RunWithElevated()
+				os.Exit(0)
+			}
+			util.InitLogger(config.Debug)
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := connect.InitClient(factory); err != nil {
+				log.Fatal(err)
+			}
+			if list {
+				journals, err := connect.ListJournals(cmd.Context())
+				if err != nil {
+					log.Fatal(err)
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				_, _ = fmt.Fprintln(w, "ID\tHOSTNAME\tPID\tALIVE\tCREATED\tENTRIES")
+				for _, j := range journals {
+					_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%v\t%s\t%d\n", j.ID, j.Hostname, j.PID, j.Alive(), j.CreateTime.Format(time.RFC3339), len(j.Entries))
+				}
+				_ = w.Flush()
+				return
+			}
+			if err := connect.Recover(cmd.Context(), id); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintln(os.Stdout, "Done")
+		},
+	}
+	cmd.Flags().StringVar(&id, "id", "", "Recover journal with this id, even if it comes from other machine")
+	cmd.Flags().BoolVar(&list, "list", false, "List journals on disk and in cluster")
+	cmd.Flags().StringVar(&connect.ManagerNamespace, "manager-namespace", "", "Namespace of cluster-wide traffic manager, all namespaces share one traffic manager, if not special, create traffic manager in current namespace")
+	cmd.Flags().BoolVar(&config.Debug, "debug", false, "Enable debug mode or not, true or false")
+	return cmd
+}
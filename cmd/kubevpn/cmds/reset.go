@@ -53,6 +53,8 @@ func CmdReset(factory cmdutil.Factory) *cobra.Command {
 		},
 	}
 
+	cmd.Flags().StringVar(&connect.ManagerNamespace, "manager-namespace", "", "Namespace of cluster-wide traffic manager, all namespaces share one traffic manager, if not special, create traffic manager in current namespace")
+
 	// for ssh jumper host
 	cmd.Flags().StringVar(&sshConf.Addr, "ssh-addr", "", "Optional ssh jump server address to dial as <hostname>:<port>, eg: 127.0.0.1:22")
 	cmd.Flags().StringVar(&sshConf.User, "ssh-username", "", "Optional username for ssh jump server")
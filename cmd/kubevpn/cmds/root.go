@@ -56,6 +56,13 @@ func NewKubeVPNCommand() *cobra.Command {
 				CmdCp(factory),
 				CmdUpgrade(factory),
 				CmdReset(factory),
+				CmdInstall(factory),
+				CmdRecover(factory),
+				CmdRecord(factory),
+				CmdReplay(factory),
+				CmdLogs(factory),
+				CmdDNS(factory),
+				CmdStatus(factory),
 				CmdVersion(factory),
 				// Hidden, Server Commands (DO NOT USE IT !!!)
 				CmdControlPlane(factory),
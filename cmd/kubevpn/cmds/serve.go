@@ -44,6 +44,10 @@ func CmdServe(_ cmdutil.Factory) *cobra.Command {
 				<-stopChan
 				cancelFunc()
 			}()
+			// mesh sidecar, envoy needs client cert to talk to control-plane
+			if dir := os.Getenv(config.EnvEnvoyTLSDir); dir != "" {
+				go handler.RenewEnvoyCert(ctx, dir)
+			}
 			servers, err := handler.Parse(*route)
 			if err != nil {
 				return err
@@ -0,0 +1,74 @@
+package cmds
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/handler"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+func CmdStatus(factory cmdutil.Factory) *cobra.Command {
+	var connect = handler.ConnectOptions{}
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: i18n.T("Show status of running KubeVPN on this machine"),
+		Long: templates.LongDesc(i18n.T(`
+		Show status of running KubeVPN on this machine which connects to current cluster,
+		include current ips of --extra-domain, routes of them follow ttl of dns records.`)),
+		Example: templates.Examples(i18n.T(`
+		# Show status
+		  kubevpn status
+`)),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			util.InitLogger(config.Debug)
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := connect.InitClient(factory); err != nil {
+				log.Fatal(err)
+			}
+			journals, err := connect.Status()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(journals) == 0 {
+				fmt.Fprintln(os.Stdout, "No running KubeVPN connects to this cluster")
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "ID\tPID\tCREATED\tEXTRA DOMAIN\tIPS")
+			for _, j := range journals {
+				var domains []string
+				for domain := range j.ExtraDomains {
+					domains = append(domains, domain)
+				}
+				sort.Strings(domains)
+				if len(domains) == 0 {
+					domains = []string{""}
+				}
+				for i, domain := range domains {
+					id, pid, created := "", "", ""
+					if i == 0 {
+						id, pid, created = j.ID, fmt.Sprint(j.PID), j.CreateTime.Format(time.RFC3339)
+					}
+					_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", id, pid, created, domain, strings.Join(j.ExtraDomains[domain], ","))
+				}
+			}
+			_ = w.Flush()
+		},
+	}
+	cmd.Flags().BoolVar(&config.Debug, "debug", false, "Enable debug mode or not, true or false")
+	return cmd
+}
@@ -0,0 +1,96 @@
+package cmds
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+// workloadFlags flags of scheduling and resources, they override configmap config.ConfigMapWorkload
+type workloadFlags struct {
+	requests          map[string]string
+	limits            map[string]string
+	sidecarRequests   map[string]string
+	sidecarLimits     map[string]string
+	nodeSelector      map[string]string
+	tolerations       []string
+	priorityClassName string
+	annotations       map[string]string
+	imagePullSecrets  []string
+	idleTimeout       time.Duration
+	replicas          int32
+	flags             *pflag.FlagSet
+}
+
+func addWorkloadFlags(cmd *cobra.Command, w *workloadFlags) {
+	w.flags = cmd.Flags()
+	cmd.Flags().StringToStringVar(&w.requests, "manager-requests", nil, "Resource requests of traffic manager containers, eg: cpu=500m,memory=512Mi")
+	cmd.Flags().StringToStringVar(&w.limits, "manager-limits", nil, "Resource limits of traffic manager containers, eg: cpu=2,memory=2Gi")
+	cmd.Flags().StringToStringVar(&w.sidecarRequests, "sidecar-requests", nil, "Resource requests of sidecar containers, eg: cpu=128m,memory=128Mi")
+	cmd.Flags().StringToStringVar(&w.sidecarLimits, "sidecar-limits", nil, "Resource limits of sidecar containers, eg: cpu=256m,memory=256Mi")
+	cmd.Flags().StringToStringVar(&w.nodeSelector, "node-selector", nil, "Node selector of traffic manager, eg: kubernetes.io/os=linux")
+	cmd.Flags().StringArrayVar(&w.tolerations, "toleration", nil, "Toleration of traffic manager, format is key[=value][:effect], eg: --toleration dedicated=infra:NoSchedule")
+	cmd.Flags().StringVar(&w.priorityClassName, "priority-class", "", "Priority class name of traffic manager and sidecar, default is system-cluster-critical")
+	cmd.Flags().StringToStringVar(&w.annotations, "manager-annotations", nil, "Annotations of traffic manager pod, eg: sidecar.istio.io/inject=false")
+	cmd.Flags().StringSliceVar(&w.imagePullSecrets, "image-pull-secrets", nil, "Image pull secrets of traffic manager and sidecar, secrets must exist in namespace of pod, eg: regcred")
+	cmd.Flags().Int32Var(&w.replicas, "manager-replicas", 1, "Replicas of traffic manager, traffic manager scales back to it after scaled down to zero because of idle")
+	cmd.Flags().DurationVar(&w.idleTimeout, "idle-timeout", 0, fmt.Sprintf("Traffic manager scales down to zero after no client for this duration, 0 means never, default is %s", config.DefaultIdleTimeout))
+}
+
+func (w *workloadFlags) toWorkloadConfig() (*util.WorkloadConfig, error) {
+	var err error
+	var conf = &util.WorkloadConfig{
+		NodeSelector:      w.nodeSelector,
+		PriorityClassName: w.priorityClassName,
+		Annotations:       w.annotations,
+	}
+	if conf.Resources, err = toResources(w.requests, w.limits); err != nil {
+		return nil, err
+	}
+	if conf.SidecarResources, err = toResources(w.sidecarRequests, w.sidecarLimits); err != nil {
+		return nil, err
+	}
+	for _, s := range w.tolerations {
+		var toleration corev1.Toleration
+		if toleration, err = util.ParseToleration(s); err != nil {
+			return nil, err
+		}
+		conf.Tolerations = append(conf.Tolerations, toleration)
+	}
+	for _, name := range w.imagePullSecrets {
+		conf.ImagePullSecrets = append(conf.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+	}
+	if w.flags.Changed("idle-timeout") {
+		conf.IdleTimeout = &metav1.Duration{Duration: w.idleTimeout}
+	}
+	if w.flags.Changed("manager-replicas") {
+		if w.replicas < 1 {
+			return nil, fmt.Errorf("invalid replicas %d of traffic manager, it should be at least 1", w.replicas)
+		}
+		conf.Replicas = pointer.Int32(w.replicas)
+	}
+	return conf, nil
+}
+
+func toResources(requests, limits map[string]string) (*corev1.ResourceRequirements, error) {
+	if len(requests) == 0 && len(limits) == 0 {
+		return nil, nil
+	}
+	var err error
+	var resources corev1.ResourceRequirements
+	if resources.Requests, err = util.ParseResourceList(requests); err != nil {
+		return nil, err
+	}
+	if resources.Limits, err = util.ParseResourceList(limits); err != nil {
+		return nil, err
+	}
+	return &resources, nil
+}
@@ -2,35 +2,67 @@ package config
 
 import (
 	"net"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"k8s.io/client-go/util/homedir"
 	"sigs.k8s.io/kustomize/api/konfig"
 )
 
 const (
 	// configmap name
 	ConfigMapPodTrafficManager = "kubevpn-traffic-manager"
+	// ConfigMapWorkload scheduling and resources of traffic manager and sidecars, set by cluster admin
+	ConfigMapWorkload = "kubevpn-workload-config"
 
 	// config map keys
 	KeyDHCP             = "DHCP"
 	KeyDHCP6            = "DHCP6"
+	KeyDHCPLease        = "DHCP_LEASE"
 	KeyEnvoy            = "ENVOY_CONFIG"
 	KeyClusterIPv4POOLS = "IPv4_POOLS"
-	KeyRefCount         = "REF_COUNT"
+	KeyWorkload         = "WORKLOAD"
+	// KeyJournalPrefix journal of client, key is JOURNAL.<id>
+	KeyJournalPrefix = "JOURNAL."
 
 	// secret keys
 	// TLSCertKey is the key for tls certificates in a TLS secret.
 	TLSCertKey = "tls_crt"
 	// TLSPrivateKeyKey is the key for the private key field in a TLS secret.
 	TLSPrivateKeyKey = "tls_key"
+	// TLSCACertKey is the key for cert of internal CA, it signs cert of webhook, control-plane and envoy sidecars
+	TLSCACertKey = "ca_crt"
+	// TLSCAKeyKey is the key for private key of internal CA, only traffic manager mounts it
+	TLSCAKeyKey = "ca_key"
 
 	// container name
 	ContainerSidecarEnvoyProxy   = "envoy-proxy"
 	ContainerSidecarControlPlane = "control-plane"
 	ContainerSidecarVPN          = "vpn"
 
-	VolumeEnvoyConfig = "envoy-config"
+	VolumeToken    = "kubevpn-token"
+	VolumeTLS      = "kubevpn-tls"
+	VolumeEnvoyTLS = "envoy-tls"
+
+	// secret of traffic manager is mounted into traffic manager, file name is secret key
+	TLSMountPath = "/etc/kubevpn/tls"
+	// EnvoyTLSMountPath client cert of envoy sidecar, vpn sidecar issues it from traffic manager and renews it before expiry
+	EnvoyTLSMountPath = "/etc/envoy/tls"
+	// EnvoyTLSCertFile and EnvoyTLSCAFile are envoy sds files in EnvoyTLSMountPath, same as pkg/mesh/envoy.yaml
+	EnvoyTLSCertFile = "cert.json"
+	EnvoyTLSCAFile   = "ca.json"
+	// ServerCertValidity validity of cert of webhook and control-plane, rotated after two thirds of it
+	ServerCertValidity = 90 * 24 * time.Hour
+	// ClientCertValidity validity of cert of envoy sidecar, renewed after two thirds of it
+	ClientCertValidity = 24 * time.Hour
+
+	// projected service account token, used by sidecar to authenticate itself to traffic manager
+	TokenMountPath = "/var/run/secrets/kubevpn"
+	TokenFilename  = "token"
+	// TokenAudience is the audience of projected service account token
+	TokenAudience          = ConfigMapPodTrafficManager
+	TokenExpirationSeconds = 3600
 
 	innerIPv4Pool = "223.254.0.100/16"
 	// 原因：在docker环境中，设置docker的 gateway 和 subnet，不能 inner 的冲突，也不能和 docker的 172.17 冲突
@@ -65,24 +97,61 @@ const (
 	EnvInboundPodTunIPv6 = "TunIPv6"
 	EnvPodName           = "POD_NAME"
 	EnvPodNamespace      = "POD_NAMESPACE"
+	// EnvTrafficManagerNamespace is the namespace of cluster-wide traffic manager
+	EnvTrafficManagerNamespace = "TrafficManagerNamespace"
+	// EnvIdleTimeout traffic manager scales down to zero after idle timeout without any client, zero means never
+	EnvIdleTimeout = "IdleTimeout"
+	// EnvClusterWide traffic manager serves namespaces labeled with LabelTrafficManager, not only its own namespace
+	EnvClusterWide = "ClusterWide"
+	// EnvEnvoyTLSDir vpn sidecar writes client cert of envoy into it
+	EnvEnvoyTLSDir = "EnvoyTLSDir"
 
 	// header name
-	HeaderPodName      = "POD_NAME"
-	HeaderPodNamespace = "POD_NAMESPACE"
-	HeaderIPv4         = "IPv4"
-	HeaderIPv6         = "IPv6"
+	HeaderPodName       = "POD_NAME"
+	HeaderPodNamespace  = "POD_NAMESPACE"
+	HeaderIPv4          = "IPv4"
+	HeaderIPv6          = "IPv6"
+	HeaderAuthorization = "Authorization"
 
 	// api
 	APIRentIP    = "/rent/ip"
 	APIReleaseIP = "/release/ip"
+	APIIssueCert = "/issue/cert"
 
 	KUBECONFIG = "kubeconfig"
 
 	// labels
 	ManageBy = konfig.ManagedbyLabelKey
+	// LabelTrafficManager label namespace which using cluster-wide traffic manager, value is namespace of traffic manager
+	LabelTrafficManager = "kubevpn.io/traffic-manager"
+	// LabelClientLease label lease of client, each client holds one lease in namespace of traffic manager
+	LabelClientLease = "kubevpn.io/client"
+
+	// annotations
+	// AnnotationPreInstalled mark traffic manager is installed by `kubevpn install` or GitOps, client only reuse it, never delete it
+	AnnotationPreInstalled = "kubevpn.io/pre-installed"
+	// AnnotationClientIPs ip of client which rent from dhcp, release them if lease of client expired
+	AnnotationClientIPs = "kubevpn.io/client-ips"
+	// AnnotationDHCPLease owner of ip which webhook rents for pod when admitting, it is uid of admission request,
+	// because name and uid of pod may be not assigned yet
+	AnnotationDHCPLease = "kubevpn.io/dhcp-lease"
+	// AnnotationReplicas replicas of traffic manager before gc loop scales it down to zero because of idle
+	AnnotationReplicas = "kubevpn.io/replicas"
+
+	// client lease, expired if not renewed in LeaseDurationSeconds
+	LeaseDurationSeconds = 60
+	LeaseRenewSeconds    = 15
+	// DefaultIdleTimeout default idle timeout of traffic manager
+	DefaultIdleTimeout = time.Hour
 
 	// pprof port
 	PProfPort = 32345
+	// EnvoyAdminPort admin port of envoy sidecar, same as pkg/mesh/envoy.yaml
+	EnvoyAdminPort = 9003
+	// AccessLogPort http port of control-plane on loopback, stream access log of envoy sidecar to client by port-forward
+	AccessLogPort = 9004
+	// AccessLogName log name of envoy grpc access log
+	AccessLogName = "kubevpn"
 
 	// startup by KubeVPN
 	EnvStartSudoKubeVPNByKubeVPN = "DEPTH_SIGNED_BY_NAISON"
@@ -116,6 +185,16 @@ func init() {
 
 var Debug bool
 
+// GetJournalDir dir of rollback journal, not in temp dir, it needs to survive from reboot
+func GetJournalDir() string {
+	return filepath.Join(homedir.HomeDir(), ".kubevpn", "journal")
+}
+
+// GetDNSFlushFile kubevpn dns flush touches it, dns server of running kubevpn flushes cache once it changes
+func GetDNSFlushFile() string {
+	return filepath.Join(homedir.HomeDir(), ".kubevpn", "dns_flush")
+}
+
 var (
 	SmallBufferSize  = (1 << 13) - 1 // 8KB small buffer
 	MediumBufferSize = (1 << 15) - 1 // 32KB medium buffer
@@ -0,0 +1,156 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	accesslogdata "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	accesslogservice "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// DefaultRouteName name of route which not match any rule, traffic goes to origin workloads
+const DefaultRouteName = "default"
+
+// AccessLog one request handled by envoy sidecar
+type AccessLog struct {
+	Time      time.Time     `json:"time"`
+	Node      string        `json:"node"`
+	Method    string        `json:"method"`
+	Authority string        `json:"authority"`
+	Path      string        `json:"path"`
+	Status    uint32        `json:"status"`
+	Duration  time.Duration `json:"duration"`
+	// Route name of matched route, it is cluster name of rule, eg: 223.254.0.100_9080
+	Route string `json:"route"`
+	// Cluster upstream cluster which request is sent to
+	Cluster string `json:"cluster"`
+}
+
+// Matched request hit rule of local PC or not
+func (l *AccessLog) Matched() bool {
+	return l.Route != "" && l.Route != DefaultRouteName
+}
+
+// MatchIP request hit rule of local PC with ip
+func (l *AccessLog) MatchIP(ips ...string) bool {
+	for _, ip := range ips {
+		if ip != "" && strings.HasPrefix(l.Route, ip+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+func ToAccessLog(nodeID string, entry *accesslogdata.HTTPAccessLogEntry) *AccessLog {
+	common := entry.GetCommonProperties()
+	return &AccessLog{
+		Time:      common.GetStartTime().AsTime(),
+		Node:      nodeID,
+		Method:    entry.GetRequest().GetRequestMethod().String(),
+		Authority: entry.GetRequest().GetAuthority(),
+		Path:      entry.GetRequest().GetPath(),
+		Status:    entry.GetResponse().GetResponseCode().GetValue(),
+		Duration:  common.GetTimeToLastDownstreamTxByte().AsDuration(),
+		Route:     common.GetRouteName(),
+		Cluster:   common.GetUpstreamCluster(),
+	}
+}
+
+// AccessLogServer receive access log from envoy sidecar, and broadcast to clients
+type AccessLogServer struct {
+	lock        sync.RWMutex
+	subscribers map[chan *AccessLog]struct{}
+}
+
+func NewAccessLogServer() *AccessLogServer {
+	return &AccessLogServer{subscribers: map[chan *AccessLog]struct{}{}}
+}
+
+func (s *AccessLogServer) StreamAccessLogs(stream accesslogservice.AccessLogService_StreamAccessLogsServer) error {
+	var nodeID string
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// identifier only sends in first message of stream
+		if msg.GetIdentifier() != nil {
+			nodeID = msg.GetIdentifier().GetNode().GetId()
+		}
+		for _, entry := range msg.GetHttpLogs().GetLogEntry() {
+			s.publish(ToAccessLog(nodeID, entry))
+		}
+	}
+}
+
+func (s *AccessLogServer) publish(l *AccessLog) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- l:
+		default:
+			// client is too slow, drop it
+		}
+	}
+}
+
+func (s *AccessLogServer) subscribe() chan *AccessLog {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ch := make(chan *AccessLog, 100)
+	s.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (s *AccessLogServer) unsubscribe(ch chan *AccessLog) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.subscribers, ch)
+}
+
+// ServeHTTP stream access log as json lines, filter by query node and ip of local PC, eg: /logs?node=deployments.apps.foo&ip=223.254.0.100
+func (s *AccessLogServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nodes := sets.New[string](r.URL.Query()["node"]...)
+	ips := r.URL.Query()["ip"]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case l := <-ch:
+			if nodes.Len() != 0 && !nodes.Has(l.Node) {
+				continue
+			}
+			// hide requests which hit rules of others, keep requests of own rules and go to origin workloads
+			if len(ips) != 0 && l.Matched() && !l.MatchIP(ips...) {
+				continue
+			}
+			if err := encoder.Encode(l); err != nil {
+				log.Debugf("failed to write access log, err: %v", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -4,39 +4,74 @@ import (
 	"fmt"
 	"time"
 
+	accesslogv3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	grpcaccesslogv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	aggregatev3 "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/aggregate/v3"
+	commontapv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/tap/v3"
 	corsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	faultv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/fault/v3"
 	grpcwebv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_web/v3"
 	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	tapv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/tap/v3"
 	httpinspector "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/http_inspector/v3"
 	httpconnectionmanager "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	tcpproxy "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
 	httpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
-	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 	corev1 "k8s.io/api/core/v1"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
 )
 
+// TapConfigID config id of tap filter, `kubevpn record` uses it to start tap session
+const TapConfigID = "kubevpn"
+
+// HeaderRoute response header of traffic matched by rule, value is route name, `kubevpn record` only taps traffic of its own rule by it
+const HeaderRoute = "x-kubevpn-route"
+
 type Virtual struct {
-	Uid   string // group.resource.name
-	Ports []corev1.ContainerPort
-	Rules []*Rule
+	Uid string // group.resource.name
+	// Namespace of workloads, only set if using cluster-wide traffic manager, Uid is namespace.group.resource.name
+	Namespace string `json:",omitempty"`
+	Ports     []corev1.ContainerPort
+	Rules     []*Rule
 }
 
 type Rule struct {
+	// Headers conditions of rule, syntax see ParseMatch
 	Headers      map[string]string
 	LocalTunIPv4 string
 	LocalTunIPv6 string
+	// Weight percentage of matched traffic to local PC, others go to origin cluster, 0 means all
+	Weight uint32 `json:",omitempty"`
+	// Mirror matched traffic still go to origin cluster, and shadow copy to local PC, response of local PC is ignored
+	Mirror bool `json:",omitempty"`
+	// MirrorPercent percentage of matched traffic mirrored to local PC if Mirror is true, 0 means all
+	MirrorPercent uint32 `json:",omitempty"`
+	// HealthCheckPath http health check path of local PC, empty means tcp health check
+	HealthCheckPath string `json:",omitempty"`
+	// Fault inject delay or abort into matched traffic
+	Fault *Fault `json:",omitempty"`
+	// DirectResponses return canned response for matched traffic with special path
+	DirectResponses []*DirectResponse `json:",omitempty"`
+}
+
+// Matches parse Headers to envoy route conditions
+func (r *Rule) Matches() ([]*Match, error) {
+	return ParseMatches(r.Headers)
 }
 
 func (a *Virtual) To() (
@@ -52,12 +87,37 @@ func (a *Virtual) To() (
 		listeners = append(listeners, ToListener(listenerName, routeName, port.ContainerPort, port.Protocol))
 
 		var rr []*route.Route
+		if len(a.Rules) != 0 {
+			clusters = append(clusters, ToLocalOriginCluster(port.ContainerPort))
+		}
 		for _, rule := range a.Rules {
+			matches, err := rule.Matches()
+			if err != nil {
+				log.Errorf("invalid rule of %s, ignore it, err: %v", a.Uid, err)
+				continue
+			}
 			for _, ip := range []string{rule.LocalTunIPv4, rule.LocalTunIPv6} {
 				clusterName := fmt.Sprintf("%s_%v", ip, port.ContainerPort)
-				clusters = append(clusters, ToCluster(clusterName))
+				clusters = append(clusters, ToCluster(clusterName, rule.HealthCheckPath), ToFailoverCluster(clusterName, port.ContainerPort))
 				endpoints = append(endpoints, ToEndPoint(clusterName, ip, port.ContainerPort))
-				rr = append(rr, ToRoute(clusterName, rule.Headers))
+				var r *route.Route
+				if rule.Mirror {
+					r = ToMirrorRoute(clusterName, matches, rule.MirrorPercent)
+				} else {
+					r = ToRoute(FailoverClusterName(clusterName), matches, rule.Weight)
+				}
+				// access log is tagged with route name, client finds its own requests by it
+				r.Name = clusterName
+				r.TypedPerFilterConfig = ToFaultFilterConfig(rule.Fault)
+				tagRoute(r, clusterName)
+				for _, response := range rule.DirectResponses {
+					direct := ToDirectResponseRoute(matches, response)
+					direct.Name = clusterName
+					direct.TypedPerFilterConfig = ToFaultFilterConfig(rule.Fault)
+					tagRoute(direct, clusterName)
+					rr = append(rr, direct)
+				}
+				rr = append(rr, r)
 			}
 		}
 		rr = append(rr, DefaultRoute())
@@ -100,12 +160,32 @@ func ToEndPoint(clusterName string, localTunIP string, port int32) *endpoint.Clu
 	}
 }
 
-func ToCluster(clusterName string) *cluster.Cluster {
+// ToCluster cluster of local PC, local PC is ejected if health check failed, laptop may sleep or tunnel may drop
+func ToCluster(clusterName string, healthCheckPath string) *cluster.Cluster {
 	anyFunc := func(m proto.Message) *anypb.Any {
 		pbst, _ := anypb.New(m)
 		return pbst
 	}
+	healthCheck := &core.HealthCheck{
+		Timeout:            durationpb.New(time.Second * 2),
+		Interval:           durationpb.New(time.Second * 3),
+		UnhealthyThreshold: wrapperspb.UInt32(2),
+		HealthyThreshold:   wrapperspb.UInt32(1),
+		HealthChecker:      &core.HealthCheck_TcpHealthCheck_{TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{}},
+	}
+	if healthCheckPath != "" {
+		healthCheck.HealthChecker = &core.HealthCheck_HttpHealthCheck_{HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{Path: healthCheckPath}}
+	}
 	return &cluster.Cluster{
+		HealthChecks: []*core.HealthCheck{healthCheck},
+		OutlierDetection: &cluster.OutlierDetection{
+			ConsecutiveGatewayFailure:          wrapperspb.UInt32(3),
+			EnforcingConsecutiveGatewayFailure: wrapperspb.UInt32(100),
+			BaseEjectionTime:                   durationpb.New(time.Second * 10),
+			MaxEjectionPercent:                 wrapperspb.UInt32(100),
+		},
+		// only one endpoint, not send traffic to it if it is unhealthy
+		CommonLbConfig:       &cluster.Cluster_CommonLbConfig{HealthyPanicThreshold: &typev3.Percent{Value: 0}},
 		Name:                 clusterName,
 		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
 		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
@@ -129,6 +209,50 @@ func ToCluster(clusterName string) *cluster.Cluster {
 	}
 }
 
+// FailoverClusterName name of aggregate cluster of local PC and origin cluster
+func FailoverClusterName(clusterName string) string {
+	return clusterName + "_failover"
+}
+
+// LocalOriginClusterName name of static cluster of original container
+func LocalOriginClusterName(port int32) string {
+	return fmt.Sprintf("origin_%d", port)
+}
+
+// ToLocalOriginCluster static cluster of original container in same pod, aggregate cluster can not contain
+// ORIGINAL_DST cluster like origin_cluster, so failover to it instead
+func ToLocalOriginCluster(port int32) *cluster.Cluster {
+	return &cluster.Cluster{
+		Name:                 LocalOriginClusterName(port),
+		ConnectTimeout:       durationpb.New(time.Second * 5),
+		LbPolicy:             cluster.Cluster_ROUND_ROBIN,
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_STATIC},
+		LoadAssignment:       ToEndPoint(LocalOriginClusterName(port), "127.0.0.1", port),
+	}
+}
+
+// ToFailoverCluster aggregate cluster, traffic goes to local PC first, fallback to original container if local PC is unhealthy
+func ToFailoverCluster(clusterName string, port int32) *cluster.Cluster {
+	anyFunc := func(m proto.Message) *anypb.Any {
+		pbst, _ := anypb.New(m)
+		return pbst
+	}
+	return &cluster.Cluster{
+		Name:           FailoverClusterName(clusterName),
+		ConnectTimeout: durationpb.New(5 * time.Second),
+		LbPolicy:       cluster.Cluster_CLUSTER_PROVIDED,
+		ClusterDiscoveryType: &cluster.Cluster_ClusterType{
+			ClusterType: &cluster.Cluster_CustomClusterType{
+				Name: "envoy.clusters.aggregate",
+				TypedConfig: anyFunc(&aggregatev3.ClusterConfig{
+					Clusters: []string{clusterName, LocalOriginClusterName(port)},
+				}),
+			},
+		},
+		CommonLbConfig: &cluster.Cluster_CommonLbConfig{HealthyPanicThreshold: &typev3.Percent{Value: 0}},
+	}
+}
+
 func OriginCluster() *cluster.Cluster {
 	return &cluster.Cluster{
 		Name:           "origin_cluster",
@@ -140,63 +264,82 @@ func OriginCluster() *cluster.Cluster {
 	}
 }
 
-func ToRoute(clusterName string, headers map[string]string) *route.Route {
-	var r []*route.HeaderMatcher
-	for k, v := range headers {
-		r = append(r, &route.HeaderMatcher{
-			Name: k,
-			HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
-				StringMatch: &matcher.StringMatcher{
-					MatchPattern: &matcher.StringMatcher_Exact{
-						Exact: v,
-					},
-					IgnoreCase: true,
+func ToRoute(clusterName string, matches []*Match, weight uint32) *route.Route {
+	action := toRouteAction(clusterName)
+	if weight > 0 && weight < 100 {
+		action.ClusterSpecifier = &route.RouteAction_WeightedClusters{
+			WeightedClusters: &route.WeightedCluster{
+				Clusters: []*route.WeightedCluster_ClusterWeight{
+					{Name: clusterName, Weight: wrapperspb.UInt32(weight)},
+					{Name: "origin_cluster", Weight: wrapperspb.UInt32(100 - weight)},
 				},
 			},
-		})
+		}
 	}
 	return &route.Route{
-		Match: &route.RouteMatch{
-			PathSpecifier: &route.RouteMatch_Prefix{
-				Prefix: "/",
-			},
-			Headers: r,
-		},
-		Action: &route.Route_Route{
-			Route: &route.RouteAction{
-				ClusterSpecifier: &route.RouteAction_Cluster{
-					Cluster: clusterName,
-				},
-				Timeout:     durationpb.New(0),
-				IdleTimeout: durationpb.New(0),
-				MaxStreamDuration: &route.RouteAction_MaxStreamDuration{
-					MaxStreamDuration:    durationpb.New(0),
-					GrpcTimeoutHeaderMax: durationpb.New(0),
-				},
+		Match:  ToRouteMatch(matches),
+		Action: &route.Route_Route{Route: action},
+	}
+}
+
+// ToMirrorRoute route matched traffic to origin cluster, and mirror percent of it to cluster, 0 means all
+func ToMirrorRoute(clusterName string, matches []*Match, percent uint32) *route.Route {
+	if percent == 0 || percent > 100 {
+		percent = 100
+	}
+	action := toRouteAction("origin_cluster")
+	action.RequestMirrorPolicies = []*route.RouteAction_RequestMirrorPolicy{{
+		Cluster: clusterName,
+		RuntimeFraction: &core.RuntimeFractionalPercent{
+			DefaultValue: &typev3.FractionalPercent{
+				Numerator:   percent,
+				Denominator: typev3.FractionalPercent_HUNDRED,
 			},
 		},
+	}}
+	return &route.Route{
+		Match:  ToRouteMatch(matches),
+		Action: &route.Route_Route{Route: action},
 	}
 }
 
+// tagRoute add response header HeaderRoute to traffic of route, if route is weighted, only tag traffic goes to local PC
+func tagRoute(r *route.Route, name string) {
+	header := []*core.HeaderValueOption{{
+		Header:       &core.HeaderValue{Key: HeaderRoute, Value: name},
+		AppendAction: core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}}
+	if action, ok := r.Action.(*route.Route_Route); ok {
+		if weighted := action.Route.GetWeightedClusters(); weighted != nil {
+			weighted.Clusters[0].ResponseHeadersToAdd = header
+			return
+		}
+	}
+	r.ResponseHeadersToAdd = header
+}
+
 func DefaultRoute() *route.Route {
 	return &route.Route{
+		Name: DefaultRouteName,
 		Match: &route.RouteMatch{
 			PathSpecifier: &route.RouteMatch_Prefix{
 				Prefix: "/",
 			},
 		},
-		Action: &route.Route_Route{
-			Route: &route.RouteAction{
-				ClusterSpecifier: &route.RouteAction_Cluster{
-					Cluster: "origin_cluster",
-				},
-				Timeout:     durationpb.New(0),
-				IdleTimeout: durationpb.New(0),
-				MaxStreamDuration: &route.RouteAction_MaxStreamDuration{
-					MaxStreamDuration:    durationpb.New(0),
-					GrpcTimeoutHeaderMax: durationpb.New(0),
-				},
-			},
+		Action: &route.Route_Route{Route: toRouteAction("origin_cluster")},
+	}
+}
+
+func toRouteAction(clusterName string) *route.RouteAction {
+	return &route.RouteAction{
+		ClusterSpecifier: &route.RouteAction_Cluster{
+			Cluster: clusterName,
+		},
+		Timeout:     durationpb.New(0),
+		IdleTimeout: durationpb.New(0),
+		MaxStreamDuration: &route.RouteAction_MaxStreamDuration{
+			MaxStreamDuration:    durationpb.New(0),
+			GrpcTimeoutHeaderMax: durationpb.New(0),
 		},
 	}
 }
@@ -254,6 +397,26 @@ func ToListener(listenerName string, routeName string, port int32, p corev1.Prot
 					TypedConfig: anyFunc(&corsv3.Cors{}),
 				},
 			},
+			{
+				// no effect by default, fault of rule is configured per route
+				Name: wellknown.Fault,
+				ConfigType: &httpconnectionmanager.HttpFilter_TypedConfig{
+					TypedConfig: anyFunc(&faultv3.HTTPFault{}),
+				},
+			},
+			{
+				// only works when `kubevpn record` starts a tap session by envoy admin api
+				Name: "envoy.filters.http.tap",
+				ConfigType: &httpconnectionmanager.HttpFilter_TypedConfig{
+					TypedConfig: anyFunc(&tapv3.Tap{
+						CommonConfig: &commontapv3.CommonExtensionConfig{
+							ConfigType: &commontapv3.CommonExtensionConfig_AdminConfig{
+								AdminConfig: &commontapv3.AdminConfig{ConfigId: TapConfigID},
+							},
+						},
+					}),
+				},
+			},
 			{
 				Name: wellknown.Router,
 				ConfigType: &httpconnectionmanager.HttpFilter_TypedConfig{
@@ -261,6 +424,23 @@ func ToListener(listenerName string, routeName string, port int32, p corev1.Prot
 				},
 			},
 		},
+		// send access log to control-plane, `kubevpn logs --requests` streams it
+		AccessLog: []*accesslogv3.AccessLog{{
+			Name: wellknown.HTTPGRPCAccessLog,
+			ConfigType: &accesslogv3.AccessLog_TypedConfig{
+				TypedConfig: anyFunc(&grpcaccesslogv3.HttpGrpcAccessLogConfig{
+					CommonConfig: &grpcaccesslogv3.CommonGrpcAccessLogConfig{
+						LogName:             config.AccessLogName,
+						TransportApiVersion: resource.DefaultAPIVersion,
+						GrpcService: &core.GrpcService{
+							TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+								EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: "xds_cluster"},
+							},
+						},
+					},
+				}),
+			},
+		}},
 		StreamIdleTimeout: durationpb.New(0),
 		UpgradeConfigs: []*httpconnectionmanager.HttpConnectionManager_UpgradeConfig{{
 			UpgradeType: "websocket",
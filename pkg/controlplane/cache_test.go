@@ -0,0 +1,99 @@
+package controlplane
+
+import (
+	"testing"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestVirtualToMirror(t *testing.T) {
+	testDatas := []struct {
+		name    string
+		rule    *Rule
+		mirror  bool
+		percent uint32
+	}{
+		{name: "route all", rule: &Rule{Headers: map[string]string{"a": "1"}}},
+		{name: "mirror all", rule: &Rule{Headers: map[string]string{"a": "1"}, Mirror: true}, mirror: true, percent: 100},
+		{name: "mirror percent", rule: &Rule{Headers: map[string]string{"a": "1"}, Mirror: true, MirrorPercent: 20}, mirror: true, percent: 20},
+		// weight is percentage of routed traffic, not mirrored traffic
+		{name: "weight not mirror percent", rule: &Rule{Headers: map[string]string{"a": "1"}, Mirror: true, Weight: 20}, mirror: true, percent: 100},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			data.rule.LocalTunIPv4 = "223.254.0.100"
+			data.rule.LocalTunIPv6 = "efff:ffff:ffff:ffff:ffff:ffff:ffff:9999"
+			virtual := &Virtual{
+				Uid:   "deployments.apps.productpage",
+				Ports: []corev1.ContainerPort{{ContainerPort: 9080, Protocol: corev1.ProtocolTCP}},
+				Rules: []*Rule{data.rule},
+			}
+			_, _, routes, _ := virtual.To()
+			if len(routes) != 1 {
+				t.Fatalf("expect one route config, but got: %d", len(routes))
+			}
+			rr := routes[0].(*route.RouteConfiguration).VirtualHosts[0].Routes
+			// route of ipv4, ipv6 and default route
+			if len(rr) != 3 {
+				t.Fatalf("expect 3 routes, but got: %d", len(rr))
+			}
+			for _, r := range rr[:2] {
+				policies := r.GetRoute().GetRequestMirrorPolicies()
+				if mirror := len(policies) != 0; mirror != data.mirror {
+					t.Fatalf("expect mirror: %v, but got: %v", data.mirror, mirror)
+				}
+				if !data.mirror {
+					continue
+				}
+				if r.GetRoute().GetCluster() != "origin_cluster" {
+					t.Errorf("mirrored traffic should go to origin cluster, but got: %s", r.GetRoute().GetCluster())
+				}
+				if n := policies[0].RuntimeFraction.DefaultValue.Numerator; n != data.percent {
+					t.Errorf("expect mirror percent: %d, but got: %d", data.percent, n)
+				}
+			}
+		})
+	}
+}
+
+func TestTagRoute(t *testing.T) {
+	testDatas := []struct {
+		name string
+		rule *Rule
+		// tag on weighted cluster of local PC instead of route
+		weighted bool
+	}{
+		{name: "route all", rule: &Rule{Headers: map[string]string{"a": "1"}}},
+		{name: "mirror", rule: &Rule{Headers: map[string]string{"a": "1"}, Mirror: true}},
+		{name: "weight", rule: &Rule{Headers: map[string]string{"a": "1"}, Weight: 20}, weighted: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			data.rule.LocalTunIPv4 = "223.254.0.100"
+			data.rule.LocalTunIPv6 = "efff:ffff:ffff:ffff:ffff:ffff:ffff:9999"
+			virtual := &Virtual{
+				Uid:   "deployments.apps.productpage",
+				Ports: []corev1.ContainerPort{{ContainerPort: 9080, Protocol: corev1.ProtocolTCP}},
+				Rules: []*Rule{data.rule},
+			}
+			_, _, routes, _ := virtual.To()
+			rr := routes[0].(*route.RouteConfiguration).VirtualHosts[0].Routes
+			for _, r := range rr[:2] {
+				headers := r.ResponseHeadersToAdd
+				if data.weighted {
+					if len(headers) != 0 {
+						t.Errorf("traffic of route %s goes to origin cluster is tagged", r.Name)
+					}
+					headers = r.GetRoute().GetWeightedClusters().GetClusters()[0].ResponseHeadersToAdd
+				}
+				if len(headers) != 1 || headers[0].Header.Key != HeaderRoute || headers[0].Header.Value != r.Name {
+					t.Errorf("expect header %s: %s, but got: %v", HeaderRoute, r.Name, headers)
+				}
+			}
+			if len(rr[2].ResponseHeadersToAdd) != 0 {
+				t.Errorf("default route is tagged")
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package controlplane
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	commonfaultv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/common/fault/v3"
+	faultv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/fault/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// keys of --fault, eg: --fault delay=2s,delay-percent=50,abort=503,abort-percent=10
+const (
+	FaultDelay        = "delay"
+	FaultDelayPercent = "delay-percent"
+	FaultAbort        = "abort"
+	FaultAbortPercent = "abort-percent"
+)
+
+// Fault inject delay or abort into matched requests, percent 0 means all
+type Fault struct {
+	Delay        *metav1.Duration `json:",omitempty"`
+	DelayPercent uint32           `json:",omitempty"`
+	// AbortStatus http status code of aborted requests, eg: 503
+	AbortStatus  uint32 `json:",omitempty"`
+	AbortPercent uint32 `json:",omitempty"`
+}
+
+// DirectResponse return canned response for matched requests, not send to local PC or origin workloads
+type DirectResponse struct {
+	// Path same syntax as value of :path in ParseMatch, eg: prefix:/api/users
+	Path   string
+	Status uint32
+	Body   string `json:",omitempty"`
+}
+
+// RulesFile content of --rules-file
+type RulesFile struct {
+	Fault           *Fault            `json:",omitempty"`
+	DirectResponses []*DirectResponse `json:",omitempty"`
+}
+
+// ParseFault parse --fault
+func ParseFault(m map[string]string) (*Fault, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	var f Fault
+	for k, v := range m {
+		switch k {
+		case FaultDelay:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delay %s, err: %v", v, err)
+			}
+			f.Delay = &metav1.Duration{Duration: d}
+		case FaultDelayPercent, FaultAbort, FaultAbortPercent:
+			i, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s, err: %v", k, v, err)
+			}
+			switch k {
+			case FaultDelayPercent:
+				f.DelayPercent = uint32(i)
+			case FaultAbort:
+				f.AbortStatus = uint32(i)
+			case FaultAbortPercent:
+				f.AbortPercent = uint32(i)
+			}
+		default:
+			return nil, fmt.Errorf("unknown fault key %s, support %s, %s, %s and %s", k, FaultDelay, FaultDelayPercent, FaultAbort, FaultAbortPercent)
+		}
+	}
+	return &f, f.Validate()
+}
+
+// ParseRulesFile parse yaml file of fault and direct responses
+func ParseRulesFile(path string) (*RulesFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r RulesFile
+	if err = yaml.UnmarshalStrict(content, &r); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %s, err: %v", path, err)
+	}
+	if err = r.Fault.Validate(); err != nil {
+		return nil, err
+	}
+	for _, response := range r.DirectResponses {
+		if err = response.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &r, nil
+}
+
+func (f *Fault) Validate() error {
+	if f == nil {
+		return nil
+	}
+	if f.Delay == nil && f.AbortStatus == 0 {
+		return fmt.Errorf("fault needs delay or abort")
+	}
+	if f.Delay != nil && f.Delay.Duration <= 0 {
+		return fmt.Errorf("invalid delay %s, it should be positive", f.Delay.Duration)
+	}
+	if f.AbortStatus != 0 && (f.AbortStatus < 200 || f.AbortStatus > 599) {
+		return fmt.Errorf("invalid abort status %d, it should be in range [200, 599]", f.AbortStatus)
+	}
+	if f.DelayPercent > 100 || f.AbortPercent > 100 {
+		return fmt.Errorf("invalid percent of fault, it should be in range [0, 100]")
+	}
+	return nil
+}
+
+func (d *DirectResponse) Validate() error {
+	if d.Status < 200 || d.Status > 599 {
+		return fmt.Errorf("invalid status %d of direct response, it should be in range [200, 599]", d.Status)
+	}
+	if _, err := ParseMatch(KeyPath, d.Path); err != nil {
+		return fmt.Errorf("invalid path %s of direct response, err: %v", d.Path, err)
+	}
+	return nil
+}
+
+// ToFaultFilterConfig per route config of fault filter
+func ToFaultFilterConfig(f *Fault) map[string]*anypb.Any {
+	if f == nil {
+		return nil
+	}
+	var fault faultv3.HTTPFault
+	if f.Delay != nil {
+		fault.Delay = &commonfaultv3.FaultDelay{
+			FaultDelaySecifier: &commonfaultv3.FaultDelay_FixedDelay{FixedDelay: durationpb.New(f.Delay.Duration)},
+			Percentage:         toFractionalPercent(f.DelayPercent),
+		}
+	}
+	if f.AbortStatus != 0 {
+		fault.Abort = &faultv3.FaultAbort{
+			ErrorType:  &faultv3.FaultAbort_HttpStatus{HttpStatus: f.AbortStatus},
+			Percentage: toFractionalPercent(f.AbortPercent),
+		}
+	}
+	config, _ := anypb.New(&fault)
+	return map[string]*anypb.Any{wellknown.Fault: config}
+}
+
+// ToDirectResponseRoute route returns canned response, path of direct response overrides :path of matches
+func ToDirectResponseRoute(matches []*Match, d *DirectResponse) *route.Route {
+	var ms []*Match
+	for _, m := range matches {
+		if m.Key != KeyPath {
+			ms = append(ms, m)
+		}
+	}
+	if m, err := ParseMatch(KeyPath, d.Path); err == nil {
+		ms = append(ms, m)
+	}
+	return &route.Route{
+		Match: ToRouteMatch(ms),
+		Action: &route.Route_DirectResponse{
+			DirectResponse: &route.DirectResponseAction{
+				Status: d.Status,
+				Body:   &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: d.Body}},
+			},
+		},
+	}
+}
+
+func toFractionalPercent(percent uint32) *typev3.FractionalPercent {
+	if percent == 0 || percent > 100 {
+		percent = 100
+	}
+	return &typev3.FractionalPercent{Numerator: percent, Denominator: typev3.FractionalPercent_HUNDRED}
+}
@@ -0,0 +1,66 @@
+package controlplane
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseFault(t *testing.T) {
+	testDatas := []struct {
+		name      string
+		fault     map[string]string
+		expect    *Fault
+		expectErr bool
+	}{
+		{name: "empty", fault: nil, expect: nil},
+		{name: "delay", fault: map[string]string{"delay": "2s"}, expect: &Fault{Delay: &metav1.Duration{Duration: 2 * time.Second}}},
+		{
+			name:   "delay and abort",
+			fault:  map[string]string{"delay": "500ms", "delay-percent": "50", "abort": "503", "abort-percent": "10"},
+			expect: &Fault{Delay: &metav1.Duration{Duration: 500 * time.Millisecond}, DelayPercent: 50, AbortStatus: 503, AbortPercent: 10},
+		},
+		{name: "abort", fault: map[string]string{"abort": "429"}, expect: &Fault{AbortStatus: 429}},
+		{name: "only percent", fault: map[string]string{"delay-percent": "50"}, expectErr: true},
+		{name: "invalid delay", fault: map[string]string{"delay": "2"}, expectErr: true},
+		{name: "negative delay", fault: map[string]string{"delay": "-1s"}, expectErr: true},
+		{name: "invalid abort", fault: map[string]string{"abort": "600"}, expectErr: true},
+		{name: "abort not number", fault: map[string]string{"abort": "unavailable"}, expectErr: true},
+		{name: "percent out of range", fault: map[string]string{"abort": "503", "abort-percent": "101"}, expectErr: true},
+		{name: "negative percent", fault: map[string]string{"abort": "503", "abort-percent": "-1"}, expectErr: true},
+		{name: "unknown key", fault: map[string]string{"abort": "503", "reset": "true"}, expectErr: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			f, err := ParseFault(data.fault)
+			if (err != nil) != data.expectErr {
+				t.Fatalf("expect error: %v, but got: %v", data.expectErr, err)
+			}
+			if !data.expectErr && !reflect.DeepEqual(f, data.expect) {
+				t.Errorf("expect: %+v, but got: %+v", data.expect, f)
+			}
+		})
+	}
+}
+
+func TestDirectResponseValidate(t *testing.T) {
+	testDatas := []struct {
+		response  DirectResponse
+		expectErr bool
+	}{
+		{response: DirectResponse{Path: "prefix:/api", Status: 200}},
+		{response: DirectResponse{Path: "/healthz", Status: 503, Body: "down"}},
+		{response: DirectResponse{Path: "regex:/api/(", Status: 200}, expectErr: true},
+		{response: DirectResponse{Path: "present:", Status: 200}, expectErr: true},
+		{response: DirectResponse{Path: "/api", Status: 0}, expectErr: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.response.Path, func(t *testing.T) {
+			if err := data.response.Validate(); (err != nil) != data.expectErr {
+				t.Errorf("expect error: %v, but got: %v", data.expectErr, err)
+			}
+		})
+	}
+}
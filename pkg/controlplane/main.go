@@ -2,47 +2,42 @@ package controlplane
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net/http"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
-	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
 )
 
-func Main(filename string, port uint, logger *log.Logger) {
+func Main(clientset *kubernetes.Clientset, namespace string, port uint, tlsConfig *tls.Config, logger *log.Logger) {
 	snapshotCache := cache.NewSnapshotCache(false, cache.IDHash{}, logger)
 	proc := NewProcessor(snapshotCache, logger)
 
+	als := NewAccessLogServer()
 	go func() {
 		ctx := context.Background()
 		server := serverv3.NewServer(ctx, snapshotCache, nil)
-		RunServer(ctx, server, port)
+		RunServer(ctx, server, als, port, tlsConfig)
 	}()
-
-	notifyCh := make(chan NotifyMessage, 100)
-
-	notifyCh <- NotifyMessage{
-		Operation: Create,
-		FilePath:  filename,
-	}
-
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatal(fmt.Errorf("failed to create file watcher, err: %v", err))
-	}
-	defer watcher.Close()
-	if err = watcher.Add(filename); err != nil {
-		log.Fatal(fmt.Errorf("failed to add file: %s to wather, err: %v", filename, err))
-	}
 	go func() {
-		log.Fatal(Watch(watcher, filename, notifyCh))
+		mux := http.NewServeMux()
+		mux.Handle("/logs", als)
+		// access log contains headers of requests, only listen on loopback, client reads it by port-forward
+		log.Fatal(http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", config.AccessLogPort), mux))
 	}()
 
+	notifyCh := make(chan []*Virtual, 100)
+	go Watch(context.Background(), clientset, namespace, notifyCh)
+
 	for {
 		select {
-		case msg := <-notifyCh:
-			proc.ProcessFile(msg)
+		case virtuals := <-notifyCh:
+			proc.ProcessConfig(virtuals)
 		}
 	}
 }
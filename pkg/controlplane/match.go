@@ -0,0 +1,188 @@
+package controlplane
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+)
+
+// syntax of --headers, key is header name, or special key:
+//
+//	:path          match request path
+//	query:<name>   match query parameter <name>
+//	cookie:<name>  match cookie <name>
+//
+// value is exact value, or prefixed with match type:
+//
+//	exact:<value>   exact match, same as no prefix, header is case-insensitive
+//	prefix:<value>  prefix match
+//	regex:<value>   RE2 regex match, full match
+//	present:        key is present
+//	absent:         key is absent, not support query
+const (
+	KeyPath         = ":path"
+	KeyQueryPrefix  = "query:"
+	KeyCookiePrefix = "cookie:"
+
+	MatchExact   = "exact"
+	MatchPrefix  = "prefix"
+	MatchRegex   = "regex"
+	MatchPresent = "present"
+	MatchAbsent  = "absent"
+)
+
+// Match is one condition of rule, all matches of rule are ANDed
+type Match struct {
+	Key   string
+	Type  string
+	Value string
+}
+
+// ParseMatch parse one k=v of --headers
+func ParseMatch(key, value string) (*Match, error) {
+	m := &Match{Key: key, Type: MatchExact, Value: value}
+	if t, v, found := strings.Cut(value, ":"); found {
+		switch t {
+		case MatchExact, MatchPrefix, MatchRegex, MatchPresent, MatchAbsent:
+			m.Type, m.Value = t, v
+		}
+	}
+	switch {
+	case key == "":
+		return nil, fmt.Errorf("key of match %q is empty", value)
+	case key == KeyPath:
+		if m.Type == MatchPresent || m.Type == MatchAbsent {
+			return nil, fmt.Errorf("path not support match type %s", m.Type)
+		}
+	case strings.HasPrefix(key, KeyQueryPrefix):
+		if strings.TrimPrefix(key, KeyQueryPrefix) == "" {
+			return nil, fmt.Errorf("name of query parameter is empty")
+		}
+		if m.Type == MatchAbsent {
+			return nil, fmt.Errorf("query parameter not support match type %s", m.Type)
+		}
+	case strings.HasPrefix(key, KeyCookiePrefix):
+		if strings.TrimPrefix(key, KeyCookiePrefix) == "" {
+			return nil, fmt.Errorf("name of cookie is empty")
+		}
+	}
+	if m.Type == MatchRegex {
+		if _, err := regexp.Compile(m.Value); err != nil {
+			return nil, fmt.Errorf("invalid regex %s of %s, err: %v", m.Value, key, err)
+		}
+	}
+	return m, nil
+}
+
+// ParseHeaders parse repeated --headers k=v, only split on first '=', value like regex may contain ',' or '='
+func ParseHeaders(values []string) (map[string]string, error) {
+	var result = make(map[string]string, len(values))
+	for _, value := range values {
+		k, v, found := strings.Cut(value, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid header %q, format is k=v", value)
+		}
+		if _, ok := result[k]; ok {
+			return nil, fmt.Errorf("duplicate header %s", k)
+		}
+		if _, err := ParseMatch(k, v); err != nil {
+			return nil, err
+		}
+		result[k] = v
+	}
+	return result, nil
+}
+
+// ParseMatches parse --headers, sorted by key, so generated route is stable
+func ParseMatches(headers map[string]string) ([]*Match, error) {
+	var keys []string
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var result []*Match
+	for _, k := range keys {
+		m, err := ParseMatch(k, headers[k])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// ToRouteMatch convert matches to envoy route match, default path is prefix /
+func ToRouteMatch(matches []*Match) *route.RouteMatch {
+	r := &route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"}}
+	for _, m := range matches {
+		switch {
+		case m.Key == KeyPath:
+			switch m.Type {
+			case MatchPrefix:
+				r.PathSpecifier = &route.RouteMatch_Prefix{Prefix: m.Value}
+			case MatchRegex:
+				r.PathSpecifier = &route.RouteMatch_SafeRegex{SafeRegex: &matcher.RegexMatcher{Regex: m.Value}}
+			default:
+				r.PathSpecifier = &route.RouteMatch_Path{Path: m.Value}
+			}
+		case strings.HasPrefix(m.Key, KeyQueryPrefix):
+			q := &route.QueryParameterMatcher{Name: strings.TrimPrefix(m.Key, KeyQueryPrefix)}
+			if m.Type == MatchPresent {
+				q.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_PresentMatch{PresentMatch: true}
+			} else {
+				q.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_StringMatch{StringMatch: toStringMatcher(m.Type, m.Value, false)}
+			}
+			r.QueryParameters = append(r.QueryParameters, q)
+		case strings.HasPrefix(m.Key, KeyCookiePrefix):
+			r.Headers = append(r.Headers, toCookieMatcher(strings.TrimPrefix(m.Key, KeyCookiePrefix), m.Type, m.Value))
+		default:
+			h := &route.HeaderMatcher{Name: m.Key}
+			switch m.Type {
+			case MatchPresent, MatchAbsent:
+				h.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+				h.InvertMatch = m.Type == MatchAbsent
+			default:
+				h.HeaderMatchSpecifier = &route.HeaderMatcher_StringMatch{StringMatch: toStringMatcher(m.Type, m.Value, true)}
+			}
+			r.Headers = append(r.Headers, h)
+		}
+	}
+	return r
+}
+
+func toStringMatcher(t, value string, ignoreCase bool) *matcher.StringMatcher {
+	switch t {
+	case MatchPrefix:
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Prefix{Prefix: value}}
+	case MatchRegex:
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_SafeRegex{SafeRegex: &matcher.RegexMatcher{Regex: value}}}
+	default:
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: value}, IgnoreCase: ignoreCase}
+	}
+}
+
+// toCookieMatcher envoy route not support cookie, match header cookie by regex, eg: a=1; name=value; b=2
+func toCookieMatcher(name, t, value string) *route.HeaderMatcher {
+	var v string
+	switch t {
+	case MatchPrefix:
+		v = regexp.QuoteMeta(value) + "[^;]*"
+	case MatchRegex:
+		v = "(?:" + value + ")"
+	case MatchPresent, MatchAbsent:
+		v = "[^;]*"
+	default:
+		v = regexp.QuoteMeta(value)
+	}
+	return &route.HeaderMatcher{
+		Name: "cookie",
+		HeaderMatchSpecifier: &route.HeaderMatcher_SafeRegexMatch{
+			SafeRegexMatch: &matcher.RegexMatcher{Regex: fmt.Sprintf(`(.*;\s*)?%s=%s(;.*)?`, regexp.QuoteMeta(name), v)},
+		},
+		InvertMatch: t == MatchAbsent,
+	}
+}
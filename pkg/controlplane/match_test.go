@@ -0,0 +1,197 @@
+package controlplane
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+)
+
+func TestParseHeaders(t *testing.T) {
+	testDatas := []struct {
+		name      string
+		values    []string
+		expect    map[string]string
+		expectErr bool
+	}{
+		{name: "plain", values: []string{"a=1", "b=2"}, expect: map[string]string{"a": "1", "b": "2"}},
+		{name: "regex with comma", values: []string{":path=regex:/tenant/(1|2),3/.*"}, expect: map[string]string{":path": "regex:/tenant/(1|2),3/.*"}},
+		{name: "value with equal", values: []string{"query:token=exact:a=b"}, expect: map[string]string{"query:token": "exact:a=b"}},
+		{name: "empty value", values: []string{"a="}, expect: map[string]string{"a": ""}},
+		{name: "no equal", values: []string{"a"}, expectErr: true},
+		{name: "duplicate key", values: []string{"a=1", "a=2"}, expectErr: true},
+		{name: "invalid match", values: []string{":path=present:"}, expectErr: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			headers, err := ParseHeaders(data.values)
+			if (err != nil) != data.expectErr {
+				t.Fatalf("expect error: %v, but got: %v", data.expectErr, err)
+			}
+			if !data.expectErr && !reflect.DeepEqual(headers, data.expect) {
+				t.Errorf("expect: %v, but got: %v", data.expect, headers)
+			}
+		})
+	}
+}
+
+func TestParseMatch(t *testing.T) {
+	testDatas := []struct {
+		key, value string
+		expect     *Match
+		expectErr  bool
+	}{
+		{key: "a", value: "1", expect: &Match{Key: "a", Type: MatchExact, Value: "1"}},
+		{key: "a", value: "prefix:al", expect: &Match{Key: "a", Type: MatchPrefix, Value: "al"}},
+		{key: "a", value: "present:", expect: &Match{Key: "a", Type: MatchPresent}},
+		// unknown type is part of value
+		{key: "a", value: "http://b", expect: &Match{Key: "a", Type: MatchExact, Value: "http://b"}},
+		{key: ":path", value: "regex:/tenant/[0-9]+/.*", expect: &Match{Key: ":path", Type: MatchRegex, Value: "/tenant/[0-9]+/.*"}},
+		{key: ":path", value: "absent:", expectErr: true},
+		{key: "query:q", value: "present:", expect: &Match{Key: "query:q", Type: MatchPresent}},
+		{key: "query:q", value: "absent:", expectErr: true},
+		{key: "query:", value: "1", expectErr: true},
+		{key: "cookie:", value: "1", expectErr: true},
+		{key: "cookie:c", value: "regex:(", expectErr: true},
+		{key: "", value: "1", expectErr: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.key+"="+data.value, func(t *testing.T) {
+			m, err := ParseMatch(data.key, data.value)
+			if (err != nil) != data.expectErr {
+				t.Fatalf("expect error: %v, but got: %v", data.expectErr, err)
+			}
+			if !data.expectErr && !reflect.DeepEqual(m, data.expect) {
+				t.Errorf("expect: %v, but got: %v", data.expect, m)
+			}
+		})
+	}
+}
+
+func TestToRouteMatchPath(t *testing.T) {
+	testDatas := []struct {
+		value  string
+		expect string
+	}{
+		{value: "", expect: "prefix:/"},
+		{value: "/api", expect: "path:/api"},
+		{value: "prefix:/api", expect: "prefix:/api"},
+		{value: "regex:/api/.*", expect: "regex:/api/.*"},
+	}
+	for _, data := range testDatas {
+		t.Run(data.value, func(t *testing.T) {
+			var matches []*Match
+			if data.value != "" {
+				m, err := ParseMatch(KeyPath, data.value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				matches = append(matches, m)
+			}
+			var got string
+			switch p := ToRouteMatch(matches).PathSpecifier.(type) {
+			case *route.RouteMatch_Prefix:
+				got = "prefix:" + p.Prefix
+			case *route.RouteMatch_Path:
+				got = "path:" + p.Path
+			case *route.RouteMatch_SafeRegex:
+				got = "regex:" + p.SafeRegex.Regex
+			}
+			if got != data.expect {
+				t.Errorf("expect: %s, but got: %s", data.expect, got)
+			}
+		})
+	}
+}
+
+func TestToRouteMatchHeader(t *testing.T) {
+	testDatas := []struct {
+		value      string
+		exact      string
+		ignoreCase bool
+		invert     bool
+		present    bool
+	}{
+		{value: "Alice", exact: "Alice", ignoreCase: true},
+		{value: "present:", present: true},
+		{value: "absent:", present: true, invert: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.value, func(t *testing.T) {
+			m, err := ParseMatch("x-request-user", data.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := ToRouteMatch([]*Match{m})
+			if len(r.Headers) != 1 {
+				t.Fatalf("expect one header matcher, but got: %v", r.Headers)
+			}
+			h := r.Headers[0]
+			if h.Name != "x-request-user" || h.InvertMatch != data.invert || h.GetPresentMatch() != data.present {
+				t.Errorf("unexpected header matcher: %v", h)
+			}
+			if s := h.GetStringMatch(); data.exact != "" && (s.GetExact() != data.exact || s.IgnoreCase != data.ignoreCase) {
+				t.Errorf("unexpected string matcher: %v", s)
+			}
+		})
+	}
+}
+
+func TestToRouteMatchCookie(t *testing.T) {
+	testDatas := []struct {
+		name, value string
+		cookie      string
+		expect      bool
+	}{
+		{name: "user", value: "alice", cookie: "user=alice", expect: true},
+		{name: "user", value: "alice", cookie: "a=1; user=alice; b=2", expect: true},
+		{name: "user", value: "alice", cookie: "user=alice2", expect: false},
+		{name: "user", value: "alice", cookie: "xuser=alice", expect: false},
+		// meta chars of name and exact value are escaped
+		{name: "user.id", value: "a.b", cookie: "user.id=a.b", expect: true},
+		{name: "user.id", value: "a.b", cookie: "userXid=a.b", expect: false},
+		{name: "user.id", value: "a.b", cookie: "user.id=aXb", expect: false},
+		{name: "v", value: "1+1", cookie: "v=1+1", expect: true},
+		{name: "v", value: "1+1", cookie: "v=11", expect: false},
+		{name: "user", value: "prefix:al", cookie: "user=alice; b=2", expect: true},
+		{name: "user", value: "prefix:al", cookie: "user=bob; b=al", expect: false},
+		{name: "user", value: "prefix:a.", cookie: "user=ab", expect: false},
+		{name: "user", value: "regex:al|bob", cookie: "user=bob", expect: true},
+		{name: "user", value: "regex:al|bob", cookie: "user=al", expect: true},
+		{name: "user", value: "regex:al|bob", cookie: "other=bob", expect: false},
+		{name: "user", value: "present:", cookie: "a=1; user=", expect: true},
+		{name: "user", value: "present:", cookie: "a=1", expect: false},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name+"="+data.value+" "+data.cookie, func(t *testing.T) {
+			m, err := ParseMatch(KeyCookiePrefix+data.name, data.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := ToRouteMatch([]*Match{m})
+			if len(r.Headers) != 1 || r.Headers[0].Name != "cookie" {
+				t.Fatalf("expect one cookie header matcher, but got: %v", r.Headers)
+			}
+			// envoy safe regex is full match
+			re, err := regexp.Compile("^(?:" + r.Headers[0].GetSafeRegexMatch().Regex + ")$")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := re.MatchString(data.cookie); got != data.expect {
+				t.Errorf("regex %s match %q, expect: %v, but got: %v", re, data.cookie, data.expect, got)
+			}
+		})
+	}
+}
+
+func TestToRouteMatchCookieAbsent(t *testing.T) {
+	m, err := ParseMatch(KeyCookiePrefix+"user", "absent:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ToRouteMatch([]*Match{m}).Headers[0]
+	if !h.InvertMatch {
+		t.Errorf("expect inverted cookie matcher, but got: %v", h)
+	}
+}
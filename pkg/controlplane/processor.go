@@ -3,10 +3,8 @@ package controlplane
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"math"
 	"math/rand"
-	"os"
 	"reflect"
 	"strconv"
 	"time"
@@ -16,6 +14,7 @@ import (
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/sirupsen/logrus"
 	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
@@ -25,6 +24,8 @@ type Processor struct {
 	version int64
 
 	expireCache *utilcache.Expiring
+	// nodes node id which has snapshot
+	nodes sets.Set[string]
 }
 
 func NewProcessor(cache cache.SnapshotCache, log *logrus.Logger) *Processor {
@@ -33,6 +34,7 @@ func NewProcessor(cache cache.SnapshotCache, log *logrus.Logger) *Processor {
 		logger:      log,
 		version:     rand.Int63n(1000),
 		expireCache: utilcache.NewExpiring(),
+		nodes:       sets.New[string](),
 	}
 }
 
@@ -44,12 +46,22 @@ func (p *Processor) newVersion() string {
 	return strconv.FormatInt(p.version, 10)
 }
 
-func (p *Processor) ProcessFile(file NotifyMessage) {
-	configList, err := ParseYaml(file.FilePath)
-	if err != nil {
-		p.logger.Errorf("error parsing yaml file: %+v", err)
-		return
+// ProcessConfig set snapshot of each virtual, clear snapshot of node which is not in configList anymore
+func (p *Processor) ProcessConfig(configList []*Virtual) {
+	var err error
+	current := sets.New[string]()
+	for _, config := range configList {
+		if len(config.Uid) != 0 {
+			current.Insert(config.Uid)
+		}
+	}
+	for _, uid := range sets.List(p.nodes.Difference(current)) {
+		p.logger.Debugf("config of nodeID: %s is removed, clear snapshot", uid)
+		p.cache.ClearSnapshot(uid)
+		p.expireCache.Delete(uid)
 	}
+	p.nodes = current
+
 	for _, config := range configList {
 		if len(config.Uid) == 0 {
 			continue
@@ -93,15 +105,10 @@ func (p *Processor) ProcessFile(file NotifyMessage) {
 	}
 }
 
-func ParseYaml(file string) ([]*Virtual, error) {
+func ParseYaml(str string) ([]*Virtual, error) {
 	var virtualList = make([]*Virtual, 0)
 
-	yamlFile, err := os.ReadFile(file)
-	if err != nil {
-		return nil, fmt.Errorf("Error reading YAML file: %s\n", err)
-	}
-
-	err = yaml.Unmarshal(yamlFile, &virtualList)
+	err := yaml.Unmarshal([]byte(str), &virtualList)
 	if err != nil {
 		return nil, err
 	}
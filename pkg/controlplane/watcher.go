@@ -1,62 +1,48 @@
 package controlplane
 
 import (
-	"fmt"
-	"time"
+	"context"
 
-	"github.com/fsnotify/fsnotify"
-)
-
-type OperationType int
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 
-const (
-	Create OperationType = iota
-	Remove
-	Modify
+	"github.com/wencaiwulue/kubevpn/pkg/config"
 )
 
-type NotifyMessage struct {
-	Operation OperationType
-	FilePath  string
-}
-
-func Watch(watcher *fsnotify.Watcher, filename string, notifyCh chan<- NotifyMessage) error {
-	ticker := time.NewTicker(time.Second * 5)
-	defer ticker.Stop()
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return fmt.Errorf("watcher has closed")
-			}
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				notifyCh <- NotifyMessage{
-					Operation: Modify,
-					FilePath:  event.Name,
-				}
-			} else if event.Op&fsnotify.Create == fsnotify.Create {
-				notifyCh <- NotifyMessage{
-					Operation: Create,
-					FilePath:  event.Name,
-				}
-			} else if event.Op&fsnotify.Remove == fsnotify.Remove {
-				notifyCh <- NotifyMessage{
-					Operation: Remove,
-					FilePath:  event.Name,
-				}
-			}
-
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return fmt.Errorf("watcher error closed")
-			}
-			return err
-
-		case <-ticker.C:
-			notifyCh <- NotifyMessage{
-				Operation: Modify,
-				FilePath:  filename,
-			}
+// Watch watch configmap kubevpn-traffic-manager through informer, send all virtuals in ENVOY_CONFIG to notifyCh once it changed
+func Watch(ctx context.Context, clientset *kubernetes.Clientset, namespace string, notifyCh chan<- []*Virtual) {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(namespace),
+		// only has permission of configmap kubevpn-traffic-manager
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", config.ConfigMapPodTrafficManager).String()
+		}),
+	)
+	notify := func(obj interface{}) {
+		cm, ok := obj.(*v1.ConfigMap)
+		if !ok {
+			return
+		}
+		virtuals, err := ParseYaml(cm.Data[config.KeyEnvoy])
+		if err != nil {
+			log.Errorf("failed to parse %s of configmap %s, err: %v", config.KeyEnvoy, cm.Name, err)
+			return
 		}
+		notifyCh <- virtuals
 	}
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, newObj interface{}) { notify(newObj) },
+		// configmap is deleted, all envoy rules are gone
+		DeleteFunc: func(interface{}) { notifyCh <- nil },
+	})
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	<-ctx.Done()
 }
@@ -220,8 +220,8 @@ func GetVolume(ctx context.Context, f util.Factory, ns, pod string) (map[string]
 			if volumeMount.SubPath != "" {
 				join = filepath.Join(join, volumeMount.SubPath)
 			}
-			handler.RollbackFuncList = append(handler.RollbackFuncList, func() {
-				_ = os.RemoveAll(join)
+			handler.RollbackFuncList = append(handler.RollbackFuncList, func() error {
+				return os.RemoveAll(join)
 			})
 			// pod-namespace/pod-name:path
 			remotePath := fmt.Sprintf("%s/%s:%s", ns, pod, volumeMount.MountPath)
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -59,6 +60,7 @@ const (
 
 type Options struct {
 	Headers       map[string]string
+	Weight        int
 	Namespace     string
 	Workload      string
 	Factory       cmdutil.Factory
@@ -67,6 +69,14 @@ type Options struct {
 	ExtraCIDR     []string
 	ExtraDomain   []string
 	ConnectMode   ConnectMode
+	// ManagerNamespace is namespace of cluster-wide traffic manager
+	ManagerNamespace string
+	// NoPrivilegedProbe never create privileged pod for detecting cidr
+	NoPrivilegedProbe bool
+	// ClusterCIDR pod and service cidr supplied by user, skip detecting cidr
+	ClusterCIDR []string
+	// RefreshCIDR detect cidr again instead of using cached cidr
+	RefreshCIDR bool
 
 	// docker options
 	DockerImage string
@@ -198,8 +208,8 @@ func (d *Options) Main(ctx context.Context, cli *client.Client, dockerCli *comma
 		}
 	}
 
-	handler.RollbackFuncList = append(handler.RollbackFuncList, func() {
-		_ = runConfigList.Remove(ctx, cli)
+	handler.RollbackFuncList = append(handler.RollbackFuncList, func() error {
+		return runConfigList.Remove(ctx, cli)
 	})
 	err = runConfigList.Run(ctx, volume, cli, dockerCli)
 	if err != nil {
@@ -369,10 +379,15 @@ func checkOutOfMemory(spec *v1.PodTemplateSpec, cli *client.Client) (outOfMemory
 
 func DoDev(devOptions *Options, flags *pflag.FlagSet, f cmdutil.Factory) error {
 	connect := handler.ConnectOptions{
-		Headers:     devOptions.Headers,
-		Workloads:   []string{devOptions.Workload},
-		ExtraCIDR:   devOptions.ExtraCIDR,
-		ExtraDomain: devOptions.ExtraDomain,
+		Headers:           devOptions.Headers,
+		Weight:            devOptions.Weight,
+		Workloads:         []string{devOptions.Workload},
+		ExtraCIDR:         devOptions.ExtraCIDR,
+		ExtraDomain:       devOptions.ExtraDomain,
+		ManagerNamespace:  devOptions.ManagerNamespace,
+		NoPrivilegedProbe: devOptions.NoPrivilegedProbe,
+		ClusterCIDR:       devOptions.ClusterCIDR,
+		RefreshCIDR:       devOptions.RefreshCIDR,
 	}
 	cli, dockerCli, err := GetClient()
 	if err != nil {
@@ -420,8 +435,8 @@ func DoDev(devOptions *Options, flags *pflag.FlagSet, f cmdutil.Factory) error {
 	devOptions.Workload = connect.Workloads[0]
 	// if no-proxy is true, not needs to intercept traffic
 	if devOptions.NoProxy {
-		if len(connect.Headers) != 0 {
-			return fmt.Errorf("not needs to provide headers if is no-proxy mode")
+		if len(connect.Headers) != 0 || connect.Weight != 0 {
+			return fmt.Errorf("not needs to provide headers or weight if is no-proxy mode")
 		}
 		connect.Workloads = []string{}
 	}
@@ -522,6 +537,9 @@ func createConnectContainer(devOptions Options, connect handler.ConnectOptions,
 		for k, v := range connect.Headers {
 			entrypoint = append(entrypoint, "--headers", fmt.Sprintf("%s=%s", k, v))
 		}
+		if connect.Weight != 0 {
+			entrypoint = append(entrypoint, "--weight", strconv.Itoa(connect.Weight))
+		}
 		for _, v := range connect.ExtraCIDR {
 			entrypoint = append(entrypoint, "--extra-cidr", v)
 		}
@@ -529,6 +547,18 @@ func createConnectContainer(devOptions Options, connect handler.ConnectOptions,
 			entrypoint = append(entrypoint, "--extra-domain", v)
 		}
 	}
+	if connect.ManagerNamespace != "" {
+		entrypoint = append(entrypoint, "--manager-namespace", connect.ManagerNamespace)
+	}
+	if connect.NoPrivilegedProbe {
+		entrypoint = append(entrypoint, "--no-privileged-probe")
+	}
+	for _, v := range connect.ClusterCIDR {
+		entrypoint = append(entrypoint, "--cluster-cidr", v)
+	}
+	if connect.RefreshCIDR {
+		entrypoint = append(entrypoint, "--refresh-cidr")
+	}
 
 	runConfig := &container.Config{
 		User:            "root",
@@ -0,0 +1,350 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	miekgdns "github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// DefaultClusterDomain used if cluster domain can not be found in search list
+	DefaultClusterDomain = "cluster.local"
+	// DefaultTTL same as default ttl of coredns kubernetes plugin
+	DefaultTTL uint32 = 5
+
+	podIPIndex = "podIP"
+)
+
+// Authority answers svc, pod, headless and SRV records of cluster domain from informers,
+// like coredns kubernetes plugin does, names it can not answer should be forwarded
+type Authority struct {
+	domain string
+	ttl    uint32
+
+	serviceLister corelisters.ServiceLister
+	sliceLister   discoverylisters.EndpointSliceLister
+	podIndexer    cache.Indexer
+	synced        []cache.InformerSynced
+}
+
+// NewAuthority start informers of Service, EndpointSlice and Pod in all namespaces
+func NewAuthority(ctx context.Context, clientset kubernetes.Interface, domain string) (*Authority, error) {
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	serviceInformer := factory.Core().V1().Services()
+	sliceInformer := factory.Discovery().V1().EndpointSlices()
+	podInformer := factory.Core().V1().Pods()
+	err := podInformer.Informer().AddIndexers(cache.Indexers{podIPIndex: func(obj interface{}) ([]string, error) {
+		pod, ok := obj.(*v1.Pod)
+		if !ok || pod.Spec.HostNetwork {
+			return nil, nil
+		}
+		var ips []string
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, pod.Namespace+"/"+ip.IP)
+		}
+		return ips, nil
+	}})
+	if err != nil {
+		return nil, err
+	}
+	// only keeps fields needed for answering, pods of big cluster take a lot of memory
+	err = podInformer.Informer().SetTransform(func(obj interface{}) (interface{}, error) {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return obj, nil
+		}
+		return &v1.Pod{
+			ObjectMeta: pod.ObjectMeta,
+			Spec:       v1.PodSpec{HostNetwork: pod.Spec.HostNetwork},
+			Status:     v1.PodStatus{PodIP: pod.Status.PodIP, PodIPs: pod.Status.PodIPs},
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a := &Authority{
+		domain:        strings.Trim(domain, "."),
+		ttl:           DefaultTTL,
+		serviceLister: serviceInformer.Lister(),
+		sliceLister:   sliceInformer.Lister(),
+		podIndexer:    podInformer.Informer().GetIndexer(),
+		synced: []cache.InformerSynced{
+			serviceInformer.Informer().HasSynced,
+			sliceInformer.Informer().HasSynced,
+			podInformer.Informer().HasSynced,
+		},
+	}
+	factory.Start(ctx.Done())
+	return a, nil
+}
+
+// ClusterDomain get cluster domain from search list of resolv.conf, eg: default.svc.cluster.local
+func ClusterDomain(search []string) string {
+	for _, s := range search {
+		if strings.HasPrefix(s, "svc.") {
+			return strings.Trim(strings.TrimPrefix(s, "svc."), ".")
+		}
+	}
+	return DefaultClusterDomain
+}
+
+// Synced whether informers are synced, answers of unsynced informers are not authoritative
+func (a *Authority) Synced() bool {
+	for _, synced := range a.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// InDomain whether name is in cluster domain
+func (a *Authority) InDomain(name string) bool {
+	return strings.HasSuffix(strings.ToLower(miekgdns.Fqdn(name)), "."+a.domain+".")
+}
+
+// Answer returns answer of question, ok is false if it can not answer, should forward it to cluster dns
+func (a *Authority) Answer(q miekgdns.Question) (answer []miekgdns.RR, rcode int, ok bool) {
+	if q.Qclass != miekgdns.ClassINET || !a.InDomain(q.Name) || !a.Synced() {
+		return nil, 0, false
+	}
+	name := strings.ToLower(miekgdns.Fqdn(q.Name))
+	parts := miekgdns.SplitDomainName(strings.TrimSuffix(name, "."+a.domain+"."))
+	if len(parts) < 2 {
+		return nil, 0, false
+	}
+	var err error
+	switch parts[len(parts)-1] {
+	case "svc":
+		answer, err = a.answerService(q, parts[:len(parts)-1])
+	case "pod":
+		answer, err = a.answerPod(q, parts[:len(parts)-1])
+	default:
+		return nil, 0, false
+	}
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil, miekgdns.RcodeNameError, true
+	case err != nil:
+		return nil, 0, false
+	}
+	return answer, miekgdns.RcodeSuccess, true
+}
+
+// answerService parts are labels before svc.<domain>, support:
+// <service>.<ns>, <endpoint>.<service>.<ns> and _<port>._<protocol>.<service>.<ns>
+func (a *Authority) answerService(q miekgdns.Question, parts []string) ([]miekgdns.RR, error) {
+	if len(parts) < 2 || len(parts) > 4 {
+		return nil, apierrors.NewNotFound(v1.Resource("services"), strings.Join(parts, "."))
+	}
+	namespace, name := parts[len(parts)-1], parts[len(parts)-2]
+	svc, err := a.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	// let cluster dns answer CNAME of external name service
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return nil, fmt.Errorf("external name service %s/%s", namespace, name)
+	}
+	headless := svc.Spec.ClusterIP == v1.ClusterIPNone
+	switch len(parts) {
+	case 2:
+		if q.Qtype == miekgdns.TypeSRV {
+			return a.srv(q, svc, "", ""), nil
+		}
+		if !headless {
+			return a.addresses(q, svc.Spec.ClusterIPs), nil
+		}
+		var ips []string
+		for _, endpoint := range a.endpoints(svc) {
+			ips = append(ips, endpoint.Addresses...)
+		}
+		return a.addresses(q, ips), nil
+	case 3:
+		if !headless {
+			return nil, apierrors.NewNotFound(v1.Resource("services"), strings.Join(parts, "."))
+		}
+		var ips []string
+		for _, endpoint := range a.endpoints(svc) {
+			if endpointHostname(endpoint) == parts[0] {
+				ips = append(ips, endpoint.Addresses...)
+			}
+		}
+		if len(ips) == 0 {
+			return nil, apierrors.NewNotFound(v1.Resource("endpoints"), strings.Join(parts, "."))
+		}
+		return a.addresses(q, ips), nil
+	default:
+		if !strings.HasPrefix(parts[0], "_") || !strings.HasPrefix(parts[1], "_") {
+			return nil, apierrors.NewNotFound(v1.Resource("services"), strings.Join(parts, "."))
+		}
+		answer := a.srv(q, svc, strings.TrimPrefix(parts[0], "_"), strings.TrimPrefix(parts[1], "_"))
+		if len(answer) == 0 {
+			return nil, apierrors.NewNotFound(v1.Resource("services"), strings.Join(parts, "."))
+		}
+		return answer, nil
+	}
+}
+
+// answerPod parts are labels before pod.<domain>, like 1-2-3-4.<ns>, only answers pod which exists
+func (a *Authority) answerPod(q miekgdns.Question, parts []string) ([]miekgdns.RR, error) {
+	if len(parts) != 2 {
+		return nil, apierrors.NewNotFound(v1.Resource("pods"), strings.Join(parts, "."))
+	}
+	ip := net.ParseIP(strings.ReplaceAll(parts[0], "-", "."))
+	if ip == nil {
+		ip = net.ParseIP(strings.ReplaceAll(parts[0], "-", ":"))
+	}
+	if ip == nil {
+		return nil, apierrors.NewNotFound(v1.Resource("pods"), strings.Join(parts, "."))
+	}
+	pods, err := a.podIndexer.ByIndex(podIPIndex, parts[1]+"/"+ip.String())
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, apierrors.NewNotFound(v1.Resource("pods"), strings.Join(parts, "."))
+	}
+	return a.addresses(q, []string{ip.String()}), nil
+}
+
+type endpoint struct {
+	Hostname  string
+	Addresses []string
+	// Ports port name to port of endpoint slice
+	Ports map[string]int32
+}
+
+// soa of cluster domain, negative answer carries it for negative caching
+func (a *Authority) soa() miekgdns.RR {
+	return &miekgdns.SOA{
+		Hdr:     miekgdns.RR_Header{Name: a.domain + ".", Rrtype: miekgdns.TypeSOA, Class: miekgdns.ClassINET, Ttl: a.ttl},
+		Ns:      "ns.dns." + a.domain + ".",
+		Mbox:    "hostmaster." + a.domain + ".",
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  a.ttl,
+	}
+}
+
+// endpoints ready endpoints of service from endpoint slices
+func (a *Authority) endpoints(svc *v1.Service) []endpoint {
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: svc.Name})
+	slices, err := a.sliceLister.EndpointSlices(svc.Namespace).List(selector)
+	if err != nil {
+		return nil
+	}
+	var result []endpoint
+	var seen = sets.New[string]()
+	for _, slice := range slices {
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready && !svc.Spec.PublishNotReadyAddresses {
+				continue
+			}
+			var ep = endpoint{Ports: map[string]int32{}}
+			for _, port := range slice.Ports {
+				if port.Name != nil && port.Port != nil {
+					ep.Ports[*port.Name] = *port.Port
+				}
+			}
+			if e.Hostname != nil {
+				ep.Hostname = *e.Hostname
+			}
+			for _, address := range e.Addresses {
+				if !seen.Has(address) {
+					seen.Insert(address)
+					ep.Addresses = append(ep.Addresses, address)
+				}
+			}
+			if len(ep.Addresses) != 0 {
+				result = append(result, ep)
+			}
+		}
+	}
+	return result
+}
+
+// endpointHostname hostname of endpoint, or ip with dash if no hostname
+func endpointHostname(e endpoint) string {
+	if e.Hostname != "" {
+		return e.Hostname
+	}
+	return strings.NewReplacer(".", "-", ":", "-").Replace(e.Addresses[0])
+}
+
+func (a *Authority) addresses(q miekgdns.Question, ips []string) []miekgdns.RR {
+	return addressRecords(q, ips, a.ttl)
+}
+
+// addressRecords A or AAAA records of ips which matches type of question
+func addressRecords(q miekgdns.Question, ips []string, ttl uint32) (answer []miekgdns.RR) {
+	header := func(rrtype uint16) miekgdns.RR_Header {
+		return miekgdns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: miekgdns.ClassINET, Ttl: ttl}
+	}
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		switch {
+		case ip.To4() != nil && (q.Qtype == miekgdns.TypeA || q.Qtype == miekgdns.TypeANY):
+			answer = append(answer, &miekgdns.A{Hdr: header(miekgdns.TypeA), A: ip.To4()})
+		case ip.To4() == nil && (q.Qtype == miekgdns.TypeAAAA || q.Qtype == miekgdns.TypeANY):
+			answer = append(answer, &miekgdns.AAAA{Hdr: header(miekgdns.TypeAAAA), AAAA: ip})
+		}
+	}
+	return
+}
+
+// srv answers named ports of service, target is service for cluster ip service, and endpoint for headless service
+func (a *Authority) srv(q miekgdns.Question, svc *v1.Service, port, protocol string) (answer []miekgdns.RR) {
+	if q.Qtype != miekgdns.TypeSRV && q.Qtype != miekgdns.TypeANY {
+		return nil
+	}
+	base := fmt.Sprintf("%s.%s.svc.%s.", svc.Name, svc.Namespace, a.domain)
+	newSRV := func(port int32, target string) miekgdns.RR {
+		return &miekgdns.SRV{
+			Hdr:    miekgdns.RR_Header{Name: q.Name, Rrtype: miekgdns.TypeSRV, Class: miekgdns.ClassINET, Ttl: a.ttl},
+			Weight: 100,
+			Port:   uint16(port),
+			Target: target,
+		}
+	}
+	headless := svc.Spec.ClusterIP == v1.ClusterIPNone
+	var endpoints []endpoint
+	if headless {
+		endpoints = a.endpoints(svc)
+	}
+	for _, p := range svc.Spec.Ports {
+		if port != "" && (!strings.EqualFold(p.Name, port) || !strings.EqualFold(string(p.Protocol), protocol)) {
+			continue
+		}
+		if !headless {
+			answer = append(answer, newSRV(p.Port, base))
+			continue
+		}
+		// port of headless service is port of endpoint
+		for _, e := range endpoints {
+			if v, ok := e.Ports[p.Name]; ok {
+				answer = append(answer, newSRV(v, endpointHostname(e)+"."+base))
+			}
+		}
+	}
+	return
+}
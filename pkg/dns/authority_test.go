@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	miekgdns "github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/pointer"
+)
+
+func newFakeAuthority(t *testing.T) *Authority {
+	objects := []runtime.Object{
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				ClusterIP:  "10.96.0.10",
+				ClusterIPs: []string{"10.96.0.10", "fd00::10"},
+				Ports:      []v1.ServicePort{{Name: "http", Protocol: v1.ProtocolTCP, Port: 80}},
+			},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				ClusterIP: v1.ClusterIPNone,
+				Ports:     []v1.ServicePort{{Name: "mysql", Protocol: v1.ProtocolTCP, Port: 3306}},
+			},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "ext", Namespace: "default"},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "example.com"},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Name: "db-abcde", Namespace: "default", Labels: map[string]string{discoveryv1.LabelServiceName: "db"}},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.0.0.5"}, Hostname: pointer.String("db-0"), Conditions: discoveryv1.EndpointConditions{Ready: pointer.Bool(true)}},
+				{Addresses: []string{"10.0.0.6"}, Hostname: pointer.String("db-1"), Conditions: discoveryv1.EndpointConditions{Ready: pointer.Bool(false)}},
+				{Addresses: []string{"10.0.0.8"}},
+			},
+			Ports: []discoveryv1.EndpointPort{{Name: pointer.String("mysql"), Port: pointer.Int32(3307)}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"},
+			Status:     v1.PodStatus{PodIP: "10.0.0.7", PodIPs: []v1.PodIP{{IP: "10.0.0.7"}}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "host", Namespace: "default"},
+			Spec:       v1.PodSpec{HostNetwork: true},
+			Status:     v1.PodStatus{PodIP: "192.168.0.2", PodIPs: []v1.PodIP{{IP: "192.168.0.2"}}},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	a, err := NewAuthority(ctx, fake.NewSimpleClientset(objects...), "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), a.synced...) {
+		t.Fatal("failed to sync informers")
+	}
+	return a
+}
+
+// values of records, ip for A and AAAA, port and target for SRV
+func recordValues(answer []miekgdns.RR) (result []string) {
+	for _, rr := range answer {
+		switch r := rr.(type) {
+		case *miekgdns.A:
+			result = append(result, r.A.String())
+		case *miekgdns.AAAA:
+			result = append(result, r.AAAA.String())
+		case *miekgdns.SRV:
+			result = append(result, fmt.Sprintf("%d %s", r.Port, r.Target))
+		}
+	}
+	return
+}
+
+func TestAuthorityAnswer(t *testing.T) {
+	a := newFakeAuthority(t)
+	testDatas := []struct {
+		name   string
+		qtype  uint16
+		ok     bool
+		rcode  int
+		expect []string
+	}{
+		{name: "web.default.svc.cluster.local.", qtype: miekgdns.TypeA, ok: true, expect: []string{"10.96.0.10"}},
+		{name: "WEB.default.svc.cluster.local.", qtype: miekgdns.TypeAAAA, ok: true, expect: []string{"fd00::10"}},
+		{name: "missing.default.svc.cluster.local.", qtype: miekgdns.TypeA, ok: true, rcode: miekgdns.RcodeNameError},
+		{name: "web.other.svc.cluster.local.", qtype: miekgdns.TypeA, ok: true, rcode: miekgdns.RcodeNameError},
+		{name: "_http._tcp.web.default.svc.cluster.local.", qtype: miekgdns.TypeSRV, ok: true, expect: []string{"80 web.default.svc.cluster.local."}},
+		{name: "_grpc._tcp.web.default.svc.cluster.local.", qtype: miekgdns.TypeSRV, ok: true, rcode: miekgdns.RcodeNameError},
+		// not ready endpoint is not answered
+		{name: "db.default.svc.cluster.local.", qtype: miekgdns.TypeA, ok: true, expect: []string{"10.0.0.5", "10.0.0.8"}},
+		{name: "db-0.db.default.svc.cluster.local.", qtype: miekgdns.TypeA, ok: true, expect: []string{"10.0.0.5"}},
+		{name: "db-1.db.default.svc.cluster.local.", qtype: miekgdns.TypeA, ok: true, rcode: miekgdns.RcodeNameError},
+		{name: "10-0-0-8.db.default.svc.cluster.local.", qtype: miekgdns.TypeA, ok: true, expect: []string{"10.0.0.8"}},
+		{name: "web-0.web.default.svc.cluster.local.", qtype: miekgdns.TypeA, ok: true, rcode: miekgdns.RcodeNameError},
+		{
+			name:   "_mysql._tcp.db.default.svc.cluster.local.",
+			qtype:  miekgdns.TypeSRV,
+			ok:     true,
+			expect: []string{"3307 db-0.db.default.svc.cluster.local.", "3307 10-0-0-8.db.default.svc.cluster.local."},
+		},
+		{name: "10-0-0-7.default.pod.cluster.local.", qtype: miekgdns.TypeA, ok: true, expect: []string{"10.0.0.7"}},
+		{name: "10-0-0-9.default.pod.cluster.local.", qtype: miekgdns.TypeA, ok: true, rcode: miekgdns.RcodeNameError},
+		{name: "192-168-0-2.default.pod.cluster.local.", qtype: miekgdns.TypeA, ok: true, rcode: miekgdns.RcodeNameError},
+		{name: "default.svc.cluster.local.", qtype: miekgdns.TypeA, ok: true, rcode: miekgdns.RcodeNameError},
+		// forward to cluster dns
+		{name: "ext.default.svc.cluster.local.", qtype: miekgdns.TypeA},
+		{name: "cluster.local.", qtype: miekgdns.TypeSOA},
+		{name: "www.example.com.", qtype: miekgdns.TypeA},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name+" "+miekgdns.TypeToString[data.qtype], func(t *testing.T) {
+			answer, rcode, ok := a.Answer(miekgdns.Question{Name: data.name, Qtype: data.qtype, Qclass: miekgdns.ClassINET})
+			if ok != data.ok {
+				t.Fatalf("expect ok: %v, but got: %v", data.ok, ok)
+			}
+			if rcode != data.rcode {
+				t.Errorf("expect rcode: %s, but got: %s", miekgdns.RcodeToString[data.rcode], miekgdns.RcodeToString[rcode])
+			}
+			if got := recordValues(answer); !reflect.DeepEqual(got, data.expect) {
+				t.Errorf("expect: %v, but got: %v", data.expect, got)
+			}
+		})
+	}
+}
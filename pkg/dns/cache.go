@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	miekgdns "github.com/miekg/dns"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	cacheSize   = 10000
+	maxCacheTTL = time.Hour
+	// prefetch hot entry which is hit at least prefetchHits times, when remaining ttl is less than prefetchPercentage of ttl
+	prefetchHits       = 3
+	prefetchPercentage = 10
+)
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	msg         *miekgdns.Msg
+	stored      time.Time
+	ttl         time.Duration
+	hits        atomic.Int32
+	prefetching atomic.Bool
+}
+
+// answerCache caches answers keyed by (name, qtype), expires with ttl of records,
+// and negative caches NXDOMAIN and NODATA with ttl of SOA, see RFC 2308
+type answerCache struct {
+	lru *cache.LRUExpireCache
+}
+
+func newAnswerCache() *answerCache {
+	return &answerCache{lru: cache.NewLRUExpireCache(cacheSize)}
+}
+
+func keyOf(q miekgdns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+}
+
+// get returns copy of cached answer with decreased ttl, prefetch is true if entry is hot and about to expire
+func (c *answerCache) get(r *miekgdns.Msg) (msg *miekgdns.Msg, prefetch bool, ok bool) {
+	v, ok := c.lru.Get(keyOf(r.Question[0]))
+	if !ok {
+		return nil, false, false
+	}
+	entry := v.(*cacheEntry)
+	elapsed := time.Since(entry.stored)
+	remaining := entry.ttl - elapsed
+	if remaining <= 0 {
+		return nil, false, false
+	}
+	msg = entry.msg.Copy()
+	msg.Id = r.Id
+	msg.Question = r.Question
+	for _, rrs := range [][]miekgdns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == miekgdns.TypeOPT {
+				continue
+			}
+			// only whole seconds elapsed, otherwise ttl of fresh answer is one second less
+			rr.Header().Ttl = uint32(math.Max(float64(rr.Header().Ttl)-math.Floor(elapsed.Seconds()), 0))
+		}
+	}
+	if entry.hits.Add(1) >= prefetchHits && remaining*100 <= entry.ttl*prefetchPercentage {
+		prefetch = entry.prefetching.CompareAndSwap(false, true)
+	}
+	return msg, prefetch, true
+}
+
+func (c *answerCache) add(msg *miekgdns.Msg) {
+	if len(msg.Question) == 0 {
+		return
+	}
+	ttl := cacheTTL(msg)
+	if ttl <= 0 {
+		return
+	}
+	c.lru.Add(keyOf(msg.Question[0]), &cacheEntry{msg: msg.Copy(), stored: time.Now(), ttl: ttl}, ttl)
+}
+
+func (c *answerCache) flush() {
+	for _, key := range c.lru.Keys() {
+		c.lru.Remove(key)
+	}
+}
+
+// cacheTTL min ttl of answers, or ttl of SOA for negative answer, 0 means not cacheable
+func cacheTTL(msg *miekgdns.Msg) time.Duration {
+	if msg.Truncated {
+		return 0
+	}
+	var ttl time.Duration
+	switch {
+	case msg.Rcode == miekgdns.RcodeSuccess && len(msg.Answer) != 0:
+		ttl = minTTL(msg.Answer)
+	case msg.Rcode == miekgdns.RcodeSuccess || msg.Rcode == miekgdns.RcodeNameError:
+		// negative answer without SOA should not be cached
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*miekgdns.SOA); ok {
+				ttl = time.Duration(math.Min(float64(soa.Hdr.Ttl), float64(soa.Minttl))) * time.Second
+				break
+			}
+		}
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+	return ttl
+}
+
+// minTTL min ttl of records, cache expires with it
+func minTTL(answer []miekgdns.RR) time.Duration {
+	var ttl uint32 = math.MaxUint32
+	for _, rr := range answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	miekgdns "github.com/miekg/dns"
+)
+
+func newAnswer(name string, rcode int, answer []miekgdns.RR, ns []miekgdns.RR) *miekgdns.Msg {
+	msg := new(miekgdns.Msg)
+	msg.SetQuestion(name, miekgdns.TypeA)
+	msg.Response = true
+	msg.Rcode = rcode
+	msg.Answer = answer
+	msg.Ns = ns
+	return msg
+}
+
+func newA(name string, ttl uint32, ip string) miekgdns.RR {
+	return &miekgdns.A{
+		Hdr: miekgdns.RR_Header{Name: name, Rrtype: miekgdns.TypeA, Class: miekgdns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP(ip).To4(),
+	}
+}
+
+func newSOA(ttl, minttl uint32) miekgdns.RR {
+	return &miekgdns.SOA{
+		Hdr:    miekgdns.RR_Header{Name: "example.com.", Rrtype: miekgdns.TypeSOA, Class: miekgdns.ClassINET, Ttl: ttl},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: minttl,
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	truncated := newAnswer("a.example.com.", miekgdns.RcodeSuccess, []miekgdns.RR{newA("a.example.com.", 30, "1.1.1.1")}, nil)
+	truncated.Truncated = true
+	testDatas := []struct {
+		name   string
+		msg    *miekgdns.Msg
+		expect time.Duration
+	}{
+		{
+			name:   "min ttl of answers",
+			msg:    newAnswer("a.example.com.", miekgdns.RcodeSuccess, []miekgdns.RR{newA("a.example.com.", 30, "1.1.1.1"), newA("a.example.com.", 10, "1.1.1.2")}, nil),
+			expect: 10 * time.Second,
+		},
+		{
+			name:   "max ttl",
+			msg:    newAnswer("a.example.com.", miekgdns.RcodeSuccess, []miekgdns.RR{newA("a.example.com.", 86400, "1.1.1.1")}, nil),
+			expect: maxCacheTTL,
+		},
+		{name: "zero ttl", msg: newAnswer("a.example.com.", miekgdns.RcodeSuccess, []miekgdns.RR{newA("a.example.com.", 0, "1.1.1.1")}, nil)},
+		{
+			name:   "nxdomain with soa",
+			msg:    newAnswer("a.example.com.", miekgdns.RcodeNameError, nil, []miekgdns.RR{newSOA(60, 5)}),
+			expect: 5 * time.Second,
+		},
+		{
+			name:   "nodata with soa",
+			msg:    newAnswer("a.example.com.", miekgdns.RcodeSuccess, nil, []miekgdns.RR{newSOA(3, 60)}),
+			expect: 3 * time.Second,
+		},
+		{name: "nxdomain without soa", msg: newAnswer("a.example.com.", miekgdns.RcodeNameError, nil, nil)},
+		{name: "servfail", msg: newAnswer("a.example.com.", miekgdns.RcodeServerFailure, nil, []miekgdns.RR{newSOA(60, 60)})},
+		{name: "truncated", msg: truncated},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			if got := cacheTTL(data.msg); got != data.expect {
+				t.Errorf("expect ttl: %s, but got: %s", data.expect, got)
+			}
+		})
+	}
+}
+
+func TestAnswerCache(t *testing.T) {
+	testDatas := []struct {
+		name string
+		msg  *miekgdns.Msg
+		// elapsed since answer is cached
+		elapsed time.Duration
+		ok      bool
+		ttl     uint32
+	}{
+		{name: "fresh", msg: newAnswer("a.example.com.", miekgdns.RcodeSuccess, []miekgdns.RR{newA("a.example.com.", 10, "1.1.1.1")}, nil), ok: true, ttl: 10},
+		{name: "ttl decreases", msg: newAnswer("a.example.com.", miekgdns.RcodeSuccess, []miekgdns.RR{newA("a.example.com.", 10, "1.1.1.1")}, nil), elapsed: 3 * time.Second, ok: true, ttl: 7},
+		{name: "expired", msg: newAnswer("a.example.com.", miekgdns.RcodeSuccess, []miekgdns.RR{newA("a.example.com.", 10, "1.1.1.1")}, nil), elapsed: 10 * time.Second},
+		{name: "negative", msg: newAnswer("a.example.com.", miekgdns.RcodeNameError, nil, []miekgdns.RR{newSOA(5, 5)}), elapsed: 2 * time.Second, ok: true, ttl: 3},
+		{name: "negative expired", msg: newAnswer("a.example.com.", miekgdns.RcodeNameError, nil, []miekgdns.RR{newSOA(5, 5)}), elapsed: 5 * time.Second},
+		{name: "not cacheable", msg: newAnswer("a.example.com.", miekgdns.RcodeServerFailure, nil, nil)},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			c := newAnswerCache()
+			c.add(data.msg)
+			if v, ok := c.lru.Get(keyOf(data.msg.Question[0])); ok {
+				v.(*cacheEntry).stored = time.Now().Add(-data.elapsed)
+			}
+			// name is case-insensitive, answer has id and question of request
+			r := new(miekgdns.Msg)
+			r.SetQuestion("A.Example.com.", miekgdns.TypeA)
+			msg, _, ok := c.get(r)
+			if ok != data.ok {
+				t.Fatalf("expect hit: %v, but got: %v", data.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			if msg.Id != r.Id || msg.Question[0].Name != r.Question[0].Name {
+				t.Errorf("expect id %d and question %s, but got: %d %s", r.Id, r.Question[0].Name, msg.Id, msg.Question[0].Name)
+			}
+			for _, rr := range append(msg.Answer, msg.Ns...) {
+				if rr.Header().Ttl != data.ttl {
+					t.Errorf("expect ttl: %d, but got: %d", data.ttl, rr.Header().Ttl)
+				}
+			}
+		})
+	}
+}
+
+func TestAnswerCacheNotShared(t *testing.T) {
+	c := newAnswerCache()
+	c.add(newAnswer("a.example.com.", miekgdns.RcodeSuccess, []miekgdns.RR{newA("a.example.com.", 10, "1.1.1.1")}, nil))
+	r := new(miekgdns.Msg)
+	r.SetQuestion("a.example.com.", miekgdns.TypeA)
+	msg, _, _ := c.get(r)
+	msg.Answer[0].Header().Ttl = 0
+	// caller modifies copy of cached answer
+	if msg, _, _ = c.get(r); msg.Answer[0].Header().Ttl == 0 {
+		t.Errorf("cached answer is modified by caller")
+	}
+	// other type of same name is not cached
+	r.SetQuestion("a.example.com.", miekgdns.TypeAAAA)
+	if _, _, ok := c.get(r); ok {
+		t.Errorf("expect miss of AAAA")
+	}
+}
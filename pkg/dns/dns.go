@@ -6,26 +6,30 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
 	miekgdns "github.com/miekg/dns"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	v12 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
-	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/sets"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	v13 "k8s.io/client-go/kubernetes/typed/core/v1"
+	v14 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/flowcontrol"
-	"k8s.io/utils/pointer"
 
+	"github.com/wencaiwulue/kubevpn/pkg/config"
 	"github.com/wencaiwulue/kubevpn/pkg/util"
 )
 
@@ -82,75 +86,103 @@ func GetDNSIPFromDnsPod(clientset *kubernetes.Clientset) (ips []string, err erro
 	return
 }
 
-func AddServiceNameToHosts(ctx context.Context, serviceInterface v13.ServiceInterface) {
+// AddServiceNameToHosts dump services of namespaces into hosts for support DNS resolve service:port,
+// if services in different namespaces have same name, the former namespace wins, like search domains
+func AddServiceNameToHosts(ctx context.Context, clientset kubernetes.Interface, namespaces []string) {
 	rateLimiter := flowcontrol.NewTokenBucketRateLimiter(0.2, 1)
 	defer rateLimiter.Stop()
-	var last string
 
-	serviceList, err := serviceInterface.List(ctx, v1.ListOptions{})
-	if err == nil && len(serviceList.Items) != 0 {
-		entry := generateHostsEntry(serviceList.Items)
-		if err = updateHosts(entry); err == nil {
-			last = entry
-		}
+	var notify = make(chan struct{}, 1)
+	var handler = cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { trigger(notify) },
+		UpdateFunc: func(interface{}, interface{}) { trigger(notify) },
+		DeleteFunc: func(interface{}) { trigger(notify) },
+	}
+	var listers = map[string]v14.ServiceLister{}
+	var synced []cache.InformerSynced
+	for _, ns := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(ns))
+		informer := factory.Core().V1().Services()
+		_, _ = informer.Informer().AddEventHandler(handler)
+		listers[ns] = informer.Lister()
+		synced = append(synced, informer.Informer().HasSynced)
+		factory.Start(ctx.Done())
 	}
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return
+	}
+
+	var last string
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			func() {
-				w, err := serviceInterface.Watch(ctx, v1.ListOptions{
-					Watch: true, TimeoutSeconds: pointer.Int64(30), ResourceVersion: serviceList.ResourceVersion,
-				})
-				if err != nil {
-					if utilnet.IsConnectionRefused(err) || apierrors.IsTooManyRequests(err) {
-						time.Sleep(time.Second * 5)
-					}
-					return
-				}
-				defer w.Stop()
-				for {
-					select {
-					case c, ok := <-w.ResultChan():
-						if !ok {
-							return
-						}
-						if watch.Error == c.Type || watch.Bookmark == c.Type {
-							continue
-						}
-						if !rateLimiter.TryAccept() {
-							return
-						}
-						list, err := serviceInterface.List(ctx, v1.ListOptions{})
-						if err != nil {
-							return
-						}
-						entry := generateHostsEntry(list.Items)
-						if entry == last {
-							continue
-						}
-						if err = updateHosts(entry); err != nil {
-							return
-						}
-						last = entry
-					}
-				}
-			}()
+		case <-notify:
+		}
+		if err := rateLimiter.Wait(ctx); err != nil {
+			return
+		}
+		var services = map[string][]*v12.Service{}
+		for ns, lister := range listers {
+			list, err := lister.Services(ns).List(labels.Everything())
+			if err != nil {
+				continue
+			}
+			services[ns] = list
+		}
+		entry := generateHostsEntry(ctx, namespaces, services, net.DefaultResolver.LookupHost)
+		if entry == last {
+			continue
 		}
+		if err := updateHosts(entry); err != nil {
+			log.Warnf("failed to update hosts, err: %v", err)
+			trigger(notify)
+			continue
+		}
+		last = entry
+	}
+}
+
+func trigger(notify chan struct{}) {
+	select {
+	case notify <- struct{}{}:
+	default:
 	}
 }
 
+const (
+	hostsMarker = "KubeVPN"
+	// hostsLockTimeout lock of hosts which is held longer than it is treated as stale
+	hostsLockTimeout = 30 * time.Second
+)
+
+var hostsMarkerRegexp = regexp.MustCompile(`# Add by KubeVPN \(pid (\d+)\)`)
+
+// updateHosts replace hosts block of this process with str, blocks of other running kubevpn are kept,
+// blocks of crashed kubevpn are removed, so first update when startup and CancelDNS clean them up.
+// hosts is locked and replaced by rename, hosts without any block of kubevpn is backed up once,
+// if hosts is lost or empty, eg: crashed when writing it, restore it from backup
 func updateHosts(str string) error {
 	path := GetHostFile()
+	unlock, err := lockHosts(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	file, err := os.ReadFile(path)
+	backup := getHostsBackupFilename(path)
+	origin, err := os.ReadFile(path)
+	file := origin
+	if (os.IsNotExist(err) || err == nil && len(bytes.TrimSpace(origin)) == 0) && fileExists(backup) {
+		log.Warnf("hosts %s is lost or empty, restore it from backup %s", path, backup)
+		file, err = os.ReadFile(backup)
+	}
 	if err != nil {
 		return err
 	}
 	split := strings.Split(string(file), "\n")
 	for i := 0; i < len(split); i++ {
-		if strings.Contains(split[i], "KubeVPN") {
+		if strings.Contains(split[i], hostsMarker) && !ownedByOthers(split[i]) {
 			split = append(split[:i], split[i+1:]...)
 			i--
 		}
@@ -177,10 +209,110 @@ func updateHosts(str string) error {
 		break
 	}
 
-	return os.WriteFile(path, []byte(strings.Join(strList, "\n")), 0644)
+	content := []byte(strings.Join(strList, "\n"))
+	if bytes.Equal(content, origin) {
+		return nil
+	}
+	if !strings.Contains(string(content), hostsMarker) {
+		// no kubevpn is running, nothing needs to restore
+		_ = os.Remove(backup)
+	} else if !fileExists(backup) {
+		if err = os.WriteFile(backup, []byte(stripHostsBlocks(string(content))), 0644); err != nil {
+			return fmt.Errorf("failed to backup hosts, err: %v", err)
+		}
+	}
+	// replace by rename, hosts is never half written. but hosts may be bind mounted in container, can not rename
+	temp := path + ".kubevpn.tmp"
+	if err = os.WriteFile(temp, content, 0644); err == nil {
+		if err = os.Rename(temp, path); err == nil {
+			return nil
+		}
+		_ = os.Remove(temp)
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// stripHostsBlocks remove all lines added by kubevpn
+func stripHostsBlocks(content string) string {
+	var result []string
+	for _, line := range strings.Split(content, "\n") {
+		if !strings.Contains(line, hostsMarker) {
+			result = append(result, line)
+		}
+	}
+	return strings.Join(result, "\n")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// ownedByOthers whether hosts line is added by other kubevpn which is still running
+func ownedByOthers(line string) bool {
+	match := hostsMarkerRegexp.FindStringSubmatch(line)
+	if len(match) != 2 {
+		return false
+	}
+	pid, err := strconv.Atoi(match[1])
+	if err != nil || pid == os.Getpid() {
+		return false
+	}
+	return util.ProcessAlive(pid)
+}
+
+// lockHosts lock hosts with lock file, lock of crashed process or held too long is treated as stale
+func lockHosts(path string) (func(), error) {
+	lock := path + ".kubevpn.lock"
+	deadline := time.Now().Add(hostsLockTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, _ = f.WriteString(strconv.Itoa(os.Getpid()))
+			_ = f.Close()
+			return func() { _ = os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if isStaleLock(lock) {
+			_ = os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout to lock hosts, lock file %s is held by other process", lock)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func isStaleLock(lock string) bool {
+	info, err := os.Stat(lock)
+	if err != nil {
+		return false
+	}
+	if time.Since(info.ModTime()) > hostsLockTimeout {
+		return true
+	}
+	content, err := os.ReadFile(lock)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	// maybe lock file is just created and pid is not written yet
+	if err != nil {
+		return false
+	}
+	return !util.ProcessAlive(pid)
+}
+
+func getHostsBackupFilename(path string) string {
+	return path + ".kubevpn_backup"
 }
 
-func generateHostsEntry(list []v12.Service) string {
+// generateHostsEntry generate hosts entries of services in namespaces order, former namespace wins if names conflict,
+// ExternalName service resolves to ip of its target
+func generateHostsEntry(ctx context.Context, namespaces []string, services map[string][]*v12.Service, lookup func(ctx context.Context, host string) ([]string, error)) string {
 	type entry struct {
 		IP     string
 		Domain string
@@ -189,19 +321,41 @@ func generateHostsEntry(list []v12.Service) string {
 	const ServiceKubernetes = "kubernetes"
 
 	var entryList []entry
+	var owner = map[string]string{}
 
-	for _, item := range list {
-		if strings.EqualFold(item.Name, ServiceKubernetes) {
-			continue
-		}
-		ipList := sets.New[string](item.Spec.ClusterIPs...).Insert(item.Spec.ExternalIPs...).UnsortedList()
-		domainList := sets.New[string](item.Name).Insert(item.Spec.ExternalName).UnsortedList()
-		for _, ip := range ipList {
-			for _, domain := range domainList {
-				if net.ParseIP(ip) == nil || domain == "" {
+	for _, ns := range namespaces {
+		list := services[ns]
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		for _, item := range list {
+			if strings.EqualFold(item.Name, ServiceKubernetes) {
+				continue
+			}
+			if o, ok := owner[item.Name]; ok {
+				log.Debugf("service %s/%s is shadowed by service in namespace %s", ns, item.Name, o)
+				continue
+			}
+			var ipList []string
+			if item.Spec.Type == v12.ServiceTypeExternalName {
+				if item.Spec.ExternalName == "" {
 					continue
 				}
-				entryList = append(entryList, entry{IP: ip, Domain: domain})
+				lookupCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+				ips, err := lookup(lookupCtx, item.Spec.ExternalName)
+				cancel()
+				if err != nil {
+					log.Debugf("failed to resolve external name %s of service %s/%s, err: %v", item.Spec.ExternalName, ns, item.Name, err)
+					continue
+				}
+				ipList = ips
+			} else {
+				ipList = sets.New[string](item.Spec.ClusterIPs...).Insert(item.Spec.ExternalIPs...).UnsortedList()
+			}
+			owner[item.Name] = ns
+			for _, ip := range ipList {
+				if net.ParseIP(ip) == nil {
+					continue
+				}
+				entryList = append(entryList, entry{IP: ip, Domain: item.Name})
 			}
 		}
 	}
@@ -215,8 +369,33 @@ func generateHostsEntry(list []v12.Service) string {
 	var sb = new(bytes.Buffer)
 	w := tabwriter.NewWriter(sb, 1, 1, 1, ' ', 0)
 	for _, e := range entryList {
-		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.IP, e.Domain, "", "# Add by KubeVPN")
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.IP, e.Domain, "", fmt.Sprintf("# Add by KubeVPN (pid %d)", os.Getpid()))
 	}
 	_ = w.Flush()
 	return sb.String()
 }
+
+// FlushCache flushes cache of dns server of running kubevpn and system dns cache
+func FlushCache() error {
+	filename := config.GetDNSFlushFile()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := os.WriteFile(filename, []byte(now.Format(time.RFC3339Nano)), 0644); err != nil {
+		return err
+	}
+	if err := os.Chtimes(filename, now, now); err != nil {
+		return err
+	}
+	flushSystemCache()
+	return nil
+}
+
+func flushFileModTime() time.Time {
+	info, err := os.Stat(config.GetDNSFlushFile())
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -9,7 +9,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 
 	"github.com/docker/docker/libnetwork/resolvconf"
 	miekgdns "github.com/miekg/dns"
@@ -18,38 +17,33 @@ import (
 	"github.com/wencaiwulue/kubevpn/pkg/config"
 )
 
-// systemd-resolve --status, systemd-resolve --flush-caches
-func SetupDNS(clientConfig *miekgdns.ClientConfig, _ []string) error {
+// SetupDNS configures dns on tun link through systemd-resolved if it is active, queries of cluster domain and
+// namespaces go to cluster dns, others still go to dns of other links, otherwise rewrites /etc/resolv.conf
+func SetupDNS(clientConfig *miekgdns.ClientConfig, ns []string, opts *Options) error {
 	tunName := os.Getenv(config.EnvTunNameOrLUID)
 	if len(tunName) == 0 {
 		tunName = "tun0"
 	}
-	// TODO consider use https://wiki.debian.org/NetworkManager and nmcli to config DNS
-	// try to solve:
-	// sudo systemd-resolve --set-dns 172.28.64.10 --interface tun0 --set-domain=vke-system.svc.cluster.local --set-domain=svc.cluster.local --set-domain=cluster.local
-	//Failed to set DNS configuration: Unit dbus-org.freedesktop.resolve1.service not found.
-	// ref: https://superuser.com/questions/1427311/activation-via-systemd-failed-for-unit-dbus-org-freedesktop-resolve1-service
-	// systemctl enable systemd-resolved.service
-	_ = exec.Command("systemctl", "enable", "systemd-resolved.service").Run()
-	// systemctl start systemd-resolved.service
-	_ = exec.Command("systemctl", "start", "systemd-resolved.service").Run()
-	//systemctl status systemd-resolved.service
-	_ = exec.Command("systemctl", "status", "systemd-resolved.service").Run()
-
-	cmd := exec.Command("systemd-resolve", []string{
-		"--set-dns",
-		clientConfig.Servers[0],
-		"--interface",
-		tunName,
-		"--set-domain=" + clientConfig.Search[0],
-		"--set-domain=" + clientConfig.Search[1],
-		"--set-domain=" + clientConfig.Search[2],
-	}...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Debugf("failed to exec cmd: %s, message: %s, ignore", strings.Join(cmd.Args, " "), string(output))
+
+	var servers = clientConfig.Servers
+	// authority answers cluster domain locally, rules split names to their upstreams, forwards others to cluster dns
+	if opts.local() {
+		if err := serveLocal(clientConfig, opts); err != nil {
+			log.Warnf("failed to start local dns server, forward all queries to cluster dns, err: %v", err)
+		} else {
+			servers = append([]string{localDNSServer}, servers...)
+		}
+	}
+
+	if resolvedActive() {
+		err := setupResolved(tunName, clientConfig, append(ns, opts.ruleDomains()...), servers)
+		if err == nil {
+			return nil
+		}
+		log.Warnf("failed to configure dns by systemd-resolved, fallback to modify resolv.conf, err: %v", err)
 	}
 
+	clientConfig.Servers = servers
 	filename := filepath.Join("/", "etc", "resolv.conf")
 	readFile, err := os.ReadFile(filename)
 	if err == nil {
@@ -67,8 +61,18 @@ func SetupDNS(clientConfig *miekgdns.ClientConfig, _ []string) error {
 	return WriteResolvConf(*clientConfig)
 }
 
+// flushSystemCache flush cache of systemd-resolved if it is running
+func flushSystemCache() {
+	if err := flushResolved(); err != nil {
+		_ = exec.Command("resolvectl", "flush-caches").Run()
+	}
+}
+
 func CancelDNS() {
 	updateHosts("")
+	if cancelResolved() {
+		return
+	}
 
 	filename := filepath.Join("/", "etc", "resolv.conf")
 	_ = os.Rename(getBackupFilename(filename), filename)
@@ -2,22 +2,18 @@ package dns
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"math"
 	"math/rand"
+	"net"
 	"os"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 
 	miekgdns "github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/semaphore"
 	"golang.org/x/time/rate"
-	"k8s.io/apimachinery/pkg/util/cache"
 )
 
 var (
@@ -25,27 +21,120 @@ var (
 	logInterval         = 2 * time.Second
 )
 
+const localDNSServer = "127.0.0.1"
+
+// ednsBufferSize udp payload size advertised to cluster dns, avoids ip fragmentation through tunnel, see dns flag day 2020
+const ednsBufferSize = 1232
+
 // github.com/docker/docker@v23.0.1+incompatible/libnetwork/network_windows.go:53
 type server struct {
-	dnsCache   *cache.LRUExpireCache
-	forwardDNS *miekgdns.ClientConfig
-	client     *miekgdns.Client
+	answerCache *answerCache
+	forwardDNS  *miekgdns.ClientConfig
+	client      *miekgdns.Client
+	// tcpClient retries truncated answers, large headless services have more records than udp payload
+	tcpClient *miekgdns.Client
+	// authority answers names of cluster domain from informers, nil means forward all queries
+	authority *Authority
+	rules     []Rule
+	routeFunc func(domain string, qtype uint16, ips ...net.IP)
 
 	fwdSem      *semaphore.Weighted // Limit the number of concurrent external DNS requests in-flight
 	logInverval rate.Sometimes      // Rate-limit logging about hitting the fwdSem limit
+
+	flushCheck rate.Sometimes // Rate-limit checking flush file which kubevpn dns flush touches
+	flushTime  time.Time
+}
+
+// Options of dns server on local PC
+type Options struct {
+	// Authority answers names of cluster domain from informers, nil means forward all queries to cluster dns
+	Authority *Authority
+	// Rules split dns rules, see Rule
+	Rules []Rule
+	// RouteFunc routes ips of answer through tunnel, used by rules with route, ips replace ips of last answer with same qtype
+	RouteFunc func(domain string, qtype uint16, ips ...net.IP)
+}
+
+// local whether needs dns server on local PC, or system resolver can ask cluster dns directly
+func (o *Options) local() bool {
+	return o != nil && (o.Authority != nil || len(o.Rules) != 0)
+}
+
+// ruleDomains domains of rules, system resolver routes them to dns server on local PC
+func (o *Options) ruleDomains() (domains []string) {
+	if o == nil {
+		return nil
+	}
+	for i := range o.Rules {
+		domains = append(domains, o.Rules[i].Domain())
+	}
+	return
+}
+
+// NewDNSServer serves both udp and tcp on address, client retries over tcp if udp answer is truncated
+func NewDNSServer(address string, forwardDNS *miekgdns.ClientConfig, opts *Options) error {
+	handler := newServer(forwardDNS, opts)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Warnf("failed to listen tcp of dns server, large answers will be truncated, err: %v", err)
+	} else {
+		tcpServer := &miekgdns.Server{Listener: listener, Handler: handler}
+		defer tcpServer.Shutdown()
+		go func() {
+			log.Debugln(tcpServer.ActivateAndServe())
+		}()
+	}
+	return miekgdns.ListenAndServe(address, "udp", handler)
 }
 
-func NewDNSServer(network, address string, forwardDNS *miekgdns.ClientConfig) error {
-	return miekgdns.ListenAndServe(address, network, &server{
-		dnsCache:    cache.NewLRUExpireCache(1000),
+func newServer(forwardDNS *miekgdns.ClientConfig, opts *Options) *server {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return &server{
+		answerCache: newAnswerCache(),
 		forwardDNS:  forwardDNS,
-		client:      &miekgdns.Client{Net: "udp", SingleInflight: true, Timeout: time.Second * 30},
+		client:      &miekgdns.Client{Net: "udp", UDPSize: ednsBufferSize, SingleInflight: true, Timeout: time.Second * 30},
+		tcpClient:   &miekgdns.Client{Net: "tcp", SingleInflight: true, Timeout: time.Second * 30},
+		authority:   opts.Authority,
+		rules:       opts.Rules,
+		routeFunc:   opts.RouteFunc,
 		fwdSem:      semaphore.NewWeighted(maxConcurrent),
 		logInverval: rate.Sometimes{Interval: logInterval},
-	})
+		flushCheck:  rate.Sometimes{Interval: time.Second},
+		flushTime:   flushFileModTime(),
+	}
 }
 
-// ServeDNS consider using a cache
+// serveLocal start dns server on 127.0.0.1:53 for system resolver which can not special port,
+// returns error if port is already in use
+func serveLocal(forwardDNS *miekgdns.ClientConfig, opts *Options) error {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(localDNSServer, "53"))
+	if err != nil {
+		return err
+	}
+	// truncated answer can not retry over tcp without it, but udp still works
+	listener, err := net.Listen("tcp", net.JoinHostPort(localDNSServer, "53"))
+	if err != nil {
+		log.Warnf("failed to listen tcp of local dns server, large answers will be truncated, err: %v", err)
+	}
+	// system resolver config will be changed, keeps cluster dns servers only
+	forward := *forwardDNS
+	forward.Servers = append([]string{}, forwardDNS.Servers...)
+	forward.Search = append([]string{}, forwardDNS.Search...)
+	handler := newServer(&forward, opts)
+	go func() {
+		log.Errorln((&miekgdns.Server{PacketConn: conn, Handler: handler}).ActivateAndServe())
+	}()
+	if listener != nil {
+		go func() {
+			log.Errorln((&miekgdns.Server{Listener: listener, Handler: handler}).ActivateAndServe())
+		}()
+	}
+	return nil
+}
+
+// ServeDNS answers from cache, or resolves it and caches answer
 // eg: nslookup -port=56571 code.byted.org 127.0.0.1
 func (s *server) ServeDNS(w miekgdns.ResponseWriter, r *miekgdns.Msg) {
 	defer w.Close()
@@ -54,6 +143,19 @@ func (s *server) ServeDNS(w miekgdns.ResponseWriter, r *miekgdns.Msg) {
 		_ = w.WriteMsg(r)
 		return
 	}
+	s.flushCheck.Do(s.checkFlush)
+
+	trace := newTrace(r.Question[0])
+	defer trace.log()
+	if msg, prefetch, ok := s.answerCache.get(r); ok {
+		if prefetch {
+			go s.prefetch(r.Copy())
+		}
+		trace.CacheHit = true
+		trace.finish(upstreamCache, msg)
+		s.writeMsg(w, r, msg)
+		return
+	}
 
 	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancelFunc()
@@ -64,96 +166,267 @@ func (s *server) ServeDNS(w miekgdns.ResponseWriter, r *miekgdns.Msg) {
 			log.Errorf("dns-server more than %v concurrent queries", maxConcurrent)
 		})
 		r.SetRcode(r, miekgdns.RcodeRefused)
+		trace.finish("", r)
+		_ = w.WriteMsg(r)
 		return
 	}
 	defer s.fwdSem.Release(1)
 
-	var wg = &sync.WaitGroup{}
+	msg := s.resolve(ctx, r, trace)
+	s.answerCache.add(msg)
+	s.writeMsg(w, r, msg)
+}
 
-	var done = &atomic.Value{}
-	done.Store(false)
-	var q = r.Question[0]
-	var originName = q.Name
+// writeMsg answers EDNS0 if request has, and truncates answer to size client can receive,
+// udp payload size of client EDNS0 or 512 bytes, client retries over tcp if answer is truncated
+func (s *server) writeMsg(w miekgdns.ResponseWriter, r *miekgdns.Msg, msg *miekgdns.Msg) {
+	size := miekgdns.MaxMsgSize
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if udp {
+		size = miekgdns.MinMsgSize
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		if udp && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		msg.SetEdns0(miekgdns.DefaultMsgSize, opt.Do())
+	}
+	msg.Truncate(size)
+	_ = w.WriteMsg(msg)
+}
 
-	searchList := fix(originName, s.forwardDNS.Search)
-	if v, ok := s.dnsCache.Get(originName); ok {
-		searchList = []string{v.(string)}
+// exchange asks upstream over udp with EDNS0 of request, retries over tcp if answer is truncated
+func (s *server) exchange(ctx context.Context, msg *miekgdns.Msg, addr string) (*miekgdns.Msg, error) {
+	setEdns0(msg, ednsBufferSize)
+	answer, _, err := s.client.ExchangeContext(ctx, msg, addr)
+	if err != nil {
+		return nil, err
 	}
+	if answer.Truncated {
+		answer, _, err = s.tcpClient.ExchangeContext(ctx, msg, addr)
+	}
+	return answer, err
+}
+
+// setEdns0 keeps EDNS0 options of request, like client subnet and DO bit, but advertises size as udp payload size
+func setEdns0(msg *miekgdns.Msg, size uint16) {
+	if opt := msg.IsEdns0(); opt != nil {
+		opt.SetUDPSize(size)
+		return
+	}
+	msg.SetEdns0(size, false)
+}
 
+// prefetch resolves hot entry before it expires
+func (s *server) prefetch(r *miekgdns.Msg) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancelFunc()
+	if !s.fwdSem.TryAcquire(1) {
+		return
+	}
+	defer s.fwdSem.Release(1)
+	s.answerCache.add(s.resolve(ctx, r, newTrace(r.Question[0])))
+}
+
+// checkFlush flushes cache if kubevpn dns flush touched flush file
+func (s *server) checkFlush() {
+	if t := flushFileModTime(); t.After(s.flushTime) {
+		s.flushTime = t
+		s.answerCache.flush()
+		log.Debugf("dns cache flushed")
+	}
+}
+
+type exchangeResult struct {
+	name   string
+	addr   string
+	answer *miekgdns.Msg
+	err    error
+}
+
+// resolve tries name with each search suffix, answers names of cluster domain by authority,
+// and forwards others to cluster dns in parallel, first non-empty answer wins, trace records how it resolves
+func (s *server) resolve(ctx context.Context, r *miekgdns.Msg, trace *Trace) *miekgdns.Msg {
+	var q = r.Question[0]
+	if rule := matchRule(s.rules, q.Name); rule != nil {
+		return s.resolveRule(ctx, r, rule, trace)
+	}
+	var searchList = fix(q.Name, s.forwardDNS.Search)
+
+	// negative and nodata answer, used if no name has answer
+	var negative, nodata *miekgdns.Msg
+	var negativeAddr, nodataAddr string
+	var forward []string
 	for _, name := range searchList {
-		// only should have dot [5,6]
+		if s.authority == nil {
+			forward = append(forward, name)
+			continue
+		}
+		start := time.Now()
+		answer, rcode, ok := s.authority.Answer(miekgdns.Question{Name: name, Qtype: q.Qtype, Qclass: q.Qclass})
+		if !ok {
+			forward = append(forward, name)
+			continue
+		}
+		trace.Tried = append(trace.Tried, name)
+		msg := &miekgdns.Msg{Answer: answer, Ns: []miekgdns.RR{s.authority.soa()}}
+		msg.Rcode = rcode
+		msg.Authoritative = true
+		trace.attempt(name, upstreamAuthority, msg, start, nil)
+		// name not exists, try next search domain
+		if rcode == miekgdns.RcodeNameError {
+			if negative == nil {
+				negative, negativeAddr = msg, upstreamAuthority
+			}
+			continue
+		}
+		if len(answer) != 0 {
+			msg.Ns = nil
+		}
+		return trace.reply(upstreamAuthority, reply(r, msg))
+	}
+
+	var results = make(chan exchangeResult, len(forward)*len(s.forwardDNS.Servers))
+	var count int
+	for _, name := range forward {
+		// without authority, only should have dot [5,6]
 		// productpage.default.svc.cluster.local.
 		// mongo-headless.mongodb.default.svc.cluster.local.
-		count := strings.Count(name, ".")
-		if count < 5 || count > 6 {
+		if c := strings.Count(name, "."); s.authority == nil && (c < 5 || c > 6) {
 			continue
 		}
-
+		trace.Tried = append(trace.Tried, name)
 		for _, dnsAddr := range s.forwardDNS.Servers {
-			wg.Add(1)
+			count++
 			go func(name, dnsAddr string) {
-				defer wg.Done()
-				var msg miekgdns.Msg
-				marshal, _ := json.Marshal(r)
-				_ = json.Unmarshal(marshal, &msg)
+				msg := r.Copy()
 				for i := 0; i < len(msg.Question); i++ {
 					msg.Question[i].Name = name
 				}
 				msg.Ns = nil
-				msg.Extra = nil
+				msg.Extra = optOf(msg)
 				msg.Id = uint16(rand.Intn(math.MaxUint16 + 1))
-				answer, _, err := s.client.ExchangeContext(context.Background(), &msg, fmt.Sprintf("%s:%s", dnsAddr, s.forwardDNS.Port))
-
-				if err == nil && len(answer.Answer) != 0 {
-					s.dnsCache.Add(originName, name, time.Hour*24*365*100) // never expire
-
-					for i := 0; i < len(answer.Answer); i++ {
-						answer.Answer[i].Header().Name = originName
-					}
-					for i := 0; i < len(answer.Question); i++ {
-						answer.Question[i].Name = originName
-					}
-
-					r.Answer = answer.Answer
-					r.Response = answer.Response
-					r.Authoritative = answer.Authoritative
-					r.AuthenticatedData = answer.AuthenticatedData
-					r.CheckingDisabled = answer.CheckingDisabled
-					r.Rcode = answer.Rcode
-					r.Truncated = answer.Truncated
-					r.RecursionDesired = answer.RecursionDesired
-					r.RecursionAvailable = answer.RecursionAvailable
-					r.Opcode = answer.Opcode
-					r.Zero = answer.Zero
-
-					select {
-					case <-ctx.Done():
-						return
-					default:
-						done.Store(true)
-						err = w.WriteMsg(r)
-						cancelFunc()
-						return
-					}
-				}
-				if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
-					log.Debugf(err.Error())
-				}
+				addr := net.JoinHostPort(dnsAddr, s.forwardDNS.Port)
+				start := time.Now()
+				answer, err := s.exchange(ctx, msg, addr)
+				trace.attempt(name, addr, answer, start, err)
+				results <- exchangeResult{name: name, addr: addr, answer: answer, err: err}
 			}(name, dnsAddr)
 		}
 	}
-	go func() {
-		wg.Wait()
-		cancelFunc()
-	}()
 
-	select {
-	case <-ctx.Done():
+loop:
+	for i := 0; i < count; i++ {
+		var res exchangeResult
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			break loop
+		}
+		if res.err != nil {
+			if !errors.Is(res.err, os.ErrDeadlineExceeded) && !errors.Is(res.err, context.Canceled) {
+				log.Debugf(res.err.Error())
+			}
+			continue
+		}
+		switch {
+		case len(res.answer.Answer) != 0:
+			return trace.reply(res.addr, reply(r, res.answer))
+		case res.answer.Rcode == miekgdns.RcodeSuccess && nodata == nil:
+			nodata, nodataAddr = res.answer, res.addr
+		case res.answer.Rcode == miekgdns.RcodeNameError && negative == nil:
+			negative, negativeAddr = res.answer, res.addr
+		}
+	}
+
+	switch {
+	case nodata != nil:
+		return trace.reply(nodataAddr, reply(r, nodata))
+	case negative != nil:
+		return trace.reply(negativeAddr, reply(r, negative))
+	default:
+		msg := new(miekgdns.Msg)
+		msg.SetRcode(r, miekgdns.RcodeServerFailure)
+		msg.RecursionAvailable = true
+		return trace.reply("", msg)
 	}
-	if !done.Load().(bool) {
-		r.Response = true
-		_ = w.WriteMsg(r)
+}
+
+// resolveRule answers by address of rule, or asks upstream of rule without search domains,
+// adds route of answers through tunnel if rule needs
+func (s *server) resolveRule(ctx context.Context, r *miekgdns.Msg, rule *Rule, trace *Trace) *miekgdns.Msg {
+	var q = r.Question[0]
+	trace.Tried = []string{q.Name}
+	if len(rule.Address) != 0 {
+		msg := &miekgdns.Msg{Answer: addressRecords(q, rule.Address, DefaultTTL)}
+		msg.Authoritative = true
+		return trace.reply("rule "+rule.Match, reply(r, msg))
+	}
+	var servers []string
+	if addr := rule.upstreamAddr(); addr != "" {
+		servers = []string{addr}
+	} else {
+		for _, dnsAddr := range s.forwardDNS.Servers {
+			servers = append(servers, net.JoinHostPort(dnsAddr, s.forwardDNS.Port))
+		}
+	}
+	for _, addr := range servers {
+		msg := r.Copy()
+		msg.Extra = optOf(msg)
+		msg.Id = uint16(rand.Intn(math.MaxUint16 + 1))
+		start := time.Now()
+		answer, err := s.exchange(ctx, msg, addr)
+		trace.attempt(q.Name, addr, answer, start, err)
+		if err != nil {
+			log.Debugf("failed to resolve %s by %s, err: %v", q.Name, addr, err)
+			continue
+		}
+		// error rcode or empty answer keeps routes of last answer
+		if ips := answerIPs(answer.Answer); rule.Route && s.routeFunc != nil && answer.Rcode == miekgdns.RcodeSuccess && len(ips) != 0 {
+			s.routeFunc(q.Name, q.Qtype, ips...)
+		}
+		return trace.reply(addr, reply(r, answer))
+	}
+	msg := new(miekgdns.Msg)
+	msg.SetRcode(r, miekgdns.RcodeServerFailure)
+	msg.RecursionAvailable = true
+	return trace.reply("", msg)
+}
+
+// optOf OPT record of msg, nil if msg has no EDNS0
+func optOf(msg *miekgdns.Msg) []miekgdns.RR {
+	if opt := msg.IsEdns0(); opt != nil {
+		return []miekgdns.RR{opt}
+	}
+	return nil
+}
+
+// reply answer of request, records are renamed to name of question, additional records are kept,
+// like A records of SRV targets, but OPT of answer is not, writeMsg adds it per request
+func reply(r *miekgdns.Msg, answer *miekgdns.Msg) *miekgdns.Msg {
+	var originName = r.Question[0].Name
+	msg := new(miekgdns.Msg)
+	msg.SetRcode(r, answer.Rcode)
+	msg.Authoritative = answer.Authoritative
+	msg.AuthenticatedData = answer.AuthenticatedData
+	msg.Truncated = answer.Truncated
+	msg.RecursionAvailable = true
+	msg.Answer = answer.Answer
+	msg.Ns = answer.Ns
+	msg.Compress = true
+	for _, rr := range answer.Extra {
+		if rr.Header().Rrtype != miekgdns.TypeOPT {
+			msg.Extra = append(msg.Extra, rr)
+		}
+	}
+	// asked with origin name, keeps cname chain as it is
+	if len(answer.Question) != 0 && strings.EqualFold(answer.Question[0].Name, originName) {
+		return msg
+	}
+	for i := 0; i < len(msg.Answer); i++ {
+		msg.Answer[i].Header().Name = originName
 	}
+	return msg
 }
 
 func fix(domain string, suffix []string) (result []string) {
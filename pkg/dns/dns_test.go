@@ -0,0 +1,100 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGenerateHostsEntry(t *testing.T) {
+	service := func(ns, name string, ips ...string) *v12.Service {
+		return &v12.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			Spec:       v12.ServiceSpec{ClusterIPs: ips},
+		}
+	}
+	external := func(ns, name, host string) *v12.Service {
+		return &v12.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			Spec:       v12.ServiceSpec{Type: v12.ServiceTypeExternalName, ExternalName: host},
+		}
+	}
+	lookup := func(ctx context.Context, host string) ([]string, error) {
+		if host == "db.example.com" {
+			return []string{"1.2.3.4"}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	testDatas := []struct {
+		name       string
+		namespaces []string
+		services   map[string][]*v12.Service
+		expect     []string
+	}{
+		{
+			name:       "former namespace wins",
+			namespaces: []string{"test", "default"},
+			services: map[string][]*v12.Service{
+				"default": {service("default", "web", "10.96.0.2"), service("default", "api", "10.96.0.3")},
+				"test":    {service("test", "web", "10.96.0.1")},
+			},
+			expect: []string{"10.96.0.1 web", "10.96.0.3 api"},
+		},
+		{
+			name:       "order of namespaces",
+			namespaces: []string{"default", "test"},
+			services: map[string][]*v12.Service{
+				"default": {service("default", "web", "10.96.0.2")},
+				"test":    {service("test", "web", "10.96.0.1")},
+			},
+			expect: []string{"10.96.0.2 web"},
+		},
+		{
+			name:       "kubernetes is skipped",
+			namespaces: []string{"default"},
+			services:   map[string][]*v12.Service{"default": {service("default", "kubernetes", "10.96.0.1")}},
+		},
+		{
+			name:       "dual stack and invalid ip",
+			namespaces: []string{"default"},
+			services:   map[string][]*v12.Service{"default": {service("default", "web", "10.96.0.2", "fd00::2", "None")}},
+			expect:     []string{"fd00::2 web", "10.96.0.2 web"},
+		},
+		{
+			name:       "external name",
+			namespaces: []string{"test", "default"},
+			services: map[string][]*v12.Service{
+				"test":    {external("test", "db", "db.example.com")},
+				"default": {service("default", "db", "10.96.0.2")},
+			},
+			expect: []string{"1.2.3.4 db"},
+		},
+		{
+			name:       "unresolved external name does not shadow",
+			namespaces: []string{"test", "default"},
+			services: map[string][]*v12.Service{
+				"test":    {external("test", "db", "unknown.example.com")},
+				"default": {service("default", "db", "10.96.0.2")},
+			},
+			expect: []string{"10.96.0.2 db"},
+		},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(generateHostsEntry(context.Background(), data.namespaces, data.services, lookup)), "\n") {
+				if fields := strings.Fields(line); len(fields) >= 2 {
+					got = append(got, fields[0]+" "+fields[1])
+				}
+			}
+			if !reflect.DeepEqual(got, data.expect) {
+				t.Errorf("expect: %v, but got: %v", data.expect, got)
+			}
+		})
+	}
+}
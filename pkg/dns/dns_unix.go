@@ -31,15 +31,19 @@ var resolv = "/etc/resolv.conf"
 // service.namespace.svc:port
 // service.namespace.svc.cluster:port
 // service.namespace.svc.cluster.local:port
-func SetupDNS(config *miekgdns.ClientConfig, ns []string) error {
-	usingResolver(config, ns)
+func SetupDNS(config *miekgdns.ClientConfig, ns []string, opts *Options) error {
+	usingResolver(config, ns, opts)
 	_ = exec.Command("killall", "mDNSResponderHelper").Run()
+	flushSystemCache()
+	return nil
+}
+
+func flushSystemCache() {
 	_ = exec.Command("killall", "-HUP", "mDNSResponder").Run()
 	_ = exec.Command("dscacheutil", "-flushcache").Run()
-	return nil
 }
 
-func usingResolver(clientConfig *miekgdns.ClientConfig, ns []string) {
+func usingResolver(clientConfig *miekgdns.ClientConfig, ns []string, opts *Options) {
 	var err error
 	_ = os.RemoveAll(filepath.Join("/", "etc", "resolver"))
 	if err = os.MkdirAll(filepath.Join("/", "etc", "resolver"), fs.ModePerm); err != nil {
@@ -51,17 +55,22 @@ func usingResolver(clientConfig *miekgdns.ClientConfig, ns []string) {
 		Ndots:   5,
 		Timeout: 2,
 	}
-	// for support like: service:port, service.namespace.svc.cluster.local:port
-	filename := filepath.Join("/", "etc", "resolver", "local")
-	_ = os.WriteFile(filename, []byte(toString(config)), 0644)
-
 	// for support like: service.namespace:port, service.namespace.svc:port, service.namespace.svc.cluster:port
 	port := util.GetAvailableUDPPortOrDie()
 	go func(port int, clientConfig *miekgdns.ClientConfig) {
 		for {
-			log.Errorln(NewDNSServer("udp", "127.0.0.1:"+strconv.Itoa(port), clientConfig))
+			log.Errorln(NewDNSServer("127.0.0.1:"+strconv.Itoa(port), clientConfig, opts))
 		}
 	}(port, clientConfig)
+	// authority answers cluster domain locally, no need to go through tunnel
+	if opts != nil && opts.Authority != nil {
+		config.Servers = []string{localDNSServer}
+		config.Port = strconv.Itoa(port)
+	}
+	// for support like: service:port, service.namespace.svc.cluster.local:port
+	filename := filepath.Join("/", "etc", "resolver", "local")
+	_ = os.WriteFile(filename, []byte(toString(config)), 0644)
+
 	config = miekgdns.ClientConfig{
 		Servers: []string{"127.0.0.1"},
 		Search:  clientConfig.Search,
@@ -69,7 +78,7 @@ func usingResolver(clientConfig *miekgdns.ClientConfig, ns []string) {
 		Ndots:   clientConfig.Ndots,
 		Timeout: 2,
 	}
-	for _, s := range sets.New[string](strings.Split(clientConfig.Search[0], ".")...).Insert(ns...).UnsortedList() {
+	for _, s := range sets.New[string](strings.Split(clientConfig.Search[0], ".")...).Insert(ns...).Insert(opts.ruleDomains()...).UnsortedList() {
 		filename = filepath.Join("/", "etc", "resolver", s)
 		_ = os.WriteFile(filename, []byte(toString(config)), 0644)
 	}
@@ -18,7 +18,7 @@ import (
 	"github.com/wencaiwulue/kubevpn/pkg/config"
 )
 
-func SetupDNS(clientConfig *miekgdns.ClientConfig, _ []string) error {
+func SetupDNS(clientConfig *miekgdns.ClientConfig, _ []string, opts *Options) error {
 	env := os.Getenv(config.EnvTunNameOrLUID)
 	parseUint, err := strconv.ParseUint(env, 10, 64)
 	if err != nil {
@@ -26,8 +26,17 @@ func SetupDNS(clientConfig *miekgdns.ClientConfig, _ []string) error {
 		return err
 	}
 	luid := winipcfg.LUID(parseUint)
+	var serverList = clientConfig.Servers
+	// authority answers cluster domain locally, rules split names to their upstreams, forwards others to cluster dns
+	if opts.local() {
+		if err = serveLocal(clientConfig, opts); err != nil {
+			log.Warnf("failed to start local dns server, forward all queries to cluster dns, err: %v", err)
+		} else {
+			serverList = append([]string{localDNSServer}, serverList...)
+		}
+	}
 	var servers []netip.Addr
-	for _, s := range clientConfig.Servers {
+	for _, s := range serverList {
 		var addr netip.Addr
 		addr, err = netip.ParseAddr(s)
 		if err != nil {
@@ -63,6 +72,10 @@ func CancelDNS() {
 	_ = luid.FlushRoutes(windows.AF_INET)
 }
 
+func flushSystemCache() {
+	_ = exec.Command("ipconfig", "/flushdns").Run()
+}
+
 func updateNicMetric(name string) error {
 	cmd := exec.Command("PowerShell", []string{
 		"Set-NetIPInterface",
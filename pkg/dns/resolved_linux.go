@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	miekgdns "github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// systemd-resolved D-Bus API, same as resolvectl dns/domain, see org.freedesktop.resolve1(5)
+const (
+	resolvedBusName     = "org.freedesktop.resolve1"
+	resolvedObjectPath  = "/org/freedesktop/resolve1"
+	resolvedManager     = "org.freedesktop.resolve1.Manager"
+	resolvedSetDNS      = resolvedManager + ".SetLinkDNS"
+	resolvedSetDomains  = resolvedManager + ".SetLinkDomains"
+	resolvedSetDefault  = resolvedManager + ".SetLinkDefaultRoute"
+	resolvedRevertLink  = resolvedManager + ".RevertLink"
+	resolvedFlushCaches = resolvedManager + ".FlushCaches"
+)
+
+// resolvedLink index of tun link which dns configured on by systemd-resolved, 0 means not configured
+var resolvedLink int
+
+type resolvedAddress struct {
+	Family  int32
+	Address []byte
+}
+
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// resolvedActive whether systemd-resolved is running and owns its bus name
+func resolvedActive() bool {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false
+	}
+	var has bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, resolvedBusName).Store(&has)
+	return err == nil && has
+}
+
+// setupResolved registers cluster dns and search domains on tun link, queries of cluster domain and namespaces
+// are routed to it, others still go to dns of other links. resolved forgets it once tun link is gone,
+// so nothing left if process dies
+func setupResolved(tunName string, clientConfig *miekgdns.ClientConfig, ns []string, servers []string) error {
+	iface, err := net.InterfaceByName(tunName)
+	if err != nil {
+		return err
+	}
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	var addresses []resolvedAddress
+	for _, s := range servers {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+			continue
+		case ip.To4() != nil:
+			addresses = append(addresses, resolvedAddress{Family: unix.AF_INET, Address: ip.To4()})
+		default:
+			addresses = append(addresses, resolvedAddress{Family: unix.AF_INET6, Address: ip.To16()})
+		}
+	}
+	if len(addresses) == 0 {
+		return fmt.Errorf("no valid dns server in %v", servers)
+	}
+	// search domains, eg: default.svc.cluster.local, svc.cluster.local, cluster.local
+	var domains []resolvedDomain
+	var seen = sets.New[string]()
+	for _, s := range clientConfig.Search {
+		s = strings.Trim(s, ".")
+		if s != "" && !seen.Has(s) {
+			seen.Insert(s)
+			domains = append(domains, resolvedDomain{Domain: s})
+		}
+	}
+	// routing only domains, eg: service.namespace
+	for _, s := range ns {
+		if s != "" && !seen.Has(s) {
+			seen.Insert(s)
+			domains = append(domains, resolvedDomain{Domain: s, RoutingOnly: true})
+		}
+	}
+
+	obj := conn.Object(resolvedBusName, resolvedObjectPath)
+	if err = obj.Call(resolvedSetDNS, 0, int32(iface.Index), addresses).Err; err != nil {
+		return fmt.Errorf("failed to set dns of link %s, err: %v", tunName, err)
+	}
+	if err = obj.Call(resolvedSetDomains, 0, int32(iface.Index), domains).Err; err != nil {
+		_ = obj.Call(resolvedRevertLink, 0, int32(iface.Index)).Err
+		return fmt.Errorf("failed to set domains of link %s, err: %v", tunName, err)
+	}
+	// only resolves routing domains by tun link, not supported before systemd 240
+	if err = obj.Call(resolvedSetDefault, 0, int32(iface.Index), false).Err; err != nil {
+		log.Debugf("failed to set default route of link %s, err: %v", tunName, err)
+	}
+	resolvedLink = iface.Index
+	_ = obj.Call(resolvedFlushCaches, 0).Err
+	log.Debugf("dns of link %s is configured by systemd-resolved", tunName)
+	return nil
+}
+
+// cancelResolved revert dns config of tun link
+func cancelResolved() bool {
+	if resolvedLink == 0 {
+		return false
+	}
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false
+	}
+	obj := conn.Object(resolvedBusName, resolvedObjectPath)
+	if err = obj.Call(resolvedRevertLink, 0, int32(resolvedLink)).Err; err != nil {
+		log.Debugf("failed to revert dns of link %d, err: %v", resolvedLink, err)
+	}
+	resolvedLink = 0
+	return true
+}
+
+func flushResolved() error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	return conn.Object(resolvedBusName, resolvedObjectPath).Call(resolvedFlushCaches, 0).Err
+}
@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	miekgdns "github.com/miekg/dns"
+	"sigs.k8s.io/yaml"
+)
+
+// UpstreamCluster resolves by cluster dns through tunnel
+const UpstreamCluster = "cluster"
+
+// Rule split dns rule, first matched rule wins, eg:
+//
+//	rules:
+//	- match: "*.internal.corp"
+//	  upstream: cluster
+//	- match: "*.rds.amazonaws.com"
+//	  upstream: cluster
+//	  route: true
+//	- match: foo.local
+//	  address: [127.0.0.1]
+type Rule struct {
+	// Match domain, wildcard *.example.com matches subdomains of example.com, but not itself
+	Match string `json:"match"`
+	// Upstream cluster means cluster dns through tunnel, or address of dns server, like 10.0.0.2:53, default is cluster
+	Upstream string `json:"upstream,omitempty"`
+	// Address answers with these ip directly, not ask upstream
+	Address []string `json:"address,omitempty"`
+	// Route adds route of resolved ip through tunnel, routes follow answers once they change
+	Route bool `json:"route,omitempty"`
+}
+
+// RulesFile yaml file of split dns rules
+type RulesFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// ParseRulesFile parse and validate split dns rules file
+func ParseRulesFile(path string) ([]Rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r RulesFile
+	if err = yaml.UnmarshalStrict(content, &r); err != nil {
+		return nil, fmt.Errorf("failed to parse dns rules file %s, err: %v", path, err)
+	}
+	for i := range r.Rules {
+		if err = r.Rules[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return r.Rules, nil
+}
+
+func (r *Rule) Validate() error {
+	domain := strings.TrimPrefix(r.Match, "*.")
+	if domain == "" || strings.Contains(domain, "*") {
+		return fmt.Errorf("invalid match %q of dns rule, only supports domain or wildcard like *.example.com", r.Match)
+	}
+	if _, ok := miekgdns.IsDomainName(domain); !ok {
+		return fmt.Errorf("invalid match %q of dns rule", r.Match)
+	}
+	if len(r.Address) != 0 && r.Upstream != "" {
+		return fmt.Errorf("dns rule %s can not have both upstream and address", r.Match)
+	}
+	for _, address := range r.Address {
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("invalid address %q of dns rule %s", address, r.Match)
+		}
+	}
+	if r.Upstream != "" && r.Upstream != UpstreamCluster && r.upstreamAddr() == "" {
+		return fmt.Errorf("invalid upstream %q of dns rule %s, should be cluster or ip:port", r.Upstream, r.Match)
+	}
+	return nil
+}
+
+// Matches whether name matches rule
+func (r *Rule) Matches(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	match := strings.ToLower(strings.TrimSuffix(r.Match, "."))
+	if strings.HasPrefix(match, "*.") {
+		return strings.HasSuffix(name, match[1:])
+	}
+	return name == match
+}
+
+// Domain domain of rule without wildcard, system resolver routes queries of it to kubevpn
+func (r *Rule) Domain() string {
+	return strings.TrimSuffix(strings.TrimPrefix(r.Match, "*."), ".")
+}
+
+// upstreamAddr address of custom upstream, empty if upstream is cluster dns or invalid
+func (r *Rule) upstreamAddr() string {
+	if r.Upstream == "" || r.Upstream == UpstreamCluster {
+		return ""
+	}
+	if ip := net.ParseIP(r.Upstream); ip != nil {
+		return net.JoinHostPort(ip.String(), "53")
+	}
+	host, port, err := net.SplitHostPort(r.Upstream)
+	if err != nil || net.ParseIP(host) == nil || port == "" {
+		return ""
+	}
+	return r.Upstream
+}
+
+// matchRule first rule matches name, nil if no rule matches
+func matchRule(rules []Rule, name string) *Rule {
+	for i := range rules {
+		if rules[i].Matches(name) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// answerIPs ip of A and AAAA records
+func answerIPs(answer []miekgdns.RR) (ips []net.IP) {
+	for _, rr := range answer {
+		switch a := rr.(type) {
+		case *miekgdns.A:
+			ips = append(ips, a.A)
+		case *miekgdns.AAAA:
+			ips = append(ips, a.AAAA)
+		}
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package dns
+
+import (
+	"testing"
+)
+
+func TestRuleValidate(t *testing.T) {
+	testDatas := []struct {
+		name      string
+		rule      Rule
+		expectErr bool
+	}{
+		{name: "domain", rule: Rule{Match: "foo.local"}},
+		{name: "wildcard", rule: Rule{Match: "*.internal.corp", Upstream: UpstreamCluster}},
+		{name: "upstream ip", rule: Rule{Match: "*.corp", Upstream: "10.0.0.2"}},
+		{name: "upstream ip and port", rule: Rule{Match: "*.corp", Upstream: "10.0.0.2:5353"}},
+		{name: "upstream ipv6 and port", rule: Rule{Match: "*.corp", Upstream: "[fd00::2]:53"}},
+		{name: "address", rule: Rule{Match: "foo.local", Address: []string{"127.0.0.1", "::1"}}},
+		{name: "empty match", rule: Rule{Match: ""}, expectErr: true},
+		{name: "only wildcard", rule: Rule{Match: "*."}, expectErr: true},
+		{name: "wildcard in middle", rule: Rule{Match: "foo.*.corp"}, expectErr: true},
+		{name: "invalid domain", rule: Rule{Match: "foo..corp"}, expectErr: true},
+		{name: "both upstream and address", rule: Rule{Match: "foo.local", Upstream: "10.0.0.2", Address: []string{"127.0.0.1"}}, expectErr: true},
+		{name: "invalid address", rule: Rule{Match: "foo.local", Address: []string{"localhost"}}, expectErr: true},
+		{name: "upstream hostname", rule: Rule{Match: "*.corp", Upstream: "dns.corp:53"}, expectErr: true},
+		{name: "upstream without port", rule: Rule{Match: "*.corp", Upstream: "10.0.0.2:"}, expectErr: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			if err := data.rule.Validate(); (err != nil) != data.expectErr {
+				t.Errorf("expect error: %v, but got: %v", data.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	testDatas := []struct {
+		match, name string
+		expect      bool
+	}{
+		{match: "foo.local", name: "foo.local.", expect: true},
+		{match: "foo.local", name: "FOO.Local", expect: true},
+		{match: "foo.local.", name: "foo.local", expect: true},
+		{match: "foo.local", name: "bar.foo.local", expect: false},
+		{match: "*.internal.corp", name: "db.internal.corp.", expect: true},
+		{match: "*.internal.corp", name: "a.b.internal.corp", expect: true},
+		{match: "*.internal.corp", name: "internal.corp", expect: false},
+		{match: "*.internal.corp", name: "xinternal.corp", expect: false},
+	}
+	for _, data := range testDatas {
+		t.Run(data.match+" "+data.name, func(t *testing.T) {
+			r := Rule{Match: data.match}
+			if got := r.Matches(data.name); got != data.expect {
+				t.Errorf("expect: %v, but got: %v", data.expect, got)
+			}
+		})
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rules := []Rule{
+		{Match: "db.internal.corp", Address: []string{"127.0.0.1"}},
+		{Match: "*.internal.corp", Upstream: "10.0.0.2"},
+		{Match: "*.corp", Route: true},
+	}
+	testDatas := []struct {
+		name   string
+		expect string
+	}{
+		{name: "db.internal.corp.", expect: "db.internal.corp"},
+		{name: "web.internal.corp.", expect: "*.internal.corp"},
+		{name: "web.corp.", expect: "*.corp"},
+		{name: "example.com.", expect: ""},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			var got string
+			if r := matchRule(rules, data.name); r != nil {
+				got = r.Match
+			}
+			if got != data.expect {
+				t.Errorf("expect rule: %q, but got: %q", data.expect, got)
+			}
+		})
+	}
+}
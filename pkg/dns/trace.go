@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	miekgdns "github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	upstreamCache     = "cache"
+	upstreamAuthority = "authority"
+)
+
+// Trace of resolving a query, every query is logged with it, and kubevpn dns query prints it
+type Trace struct {
+	Name  string
+	Qtype string
+	// Tried expanded names with search domains which are asked, in order
+	Tried []string
+	// Attempts every answer of authority, rule and upstreams
+	Attempts []Attempt
+	// Upstream which answer wins, cache, authority, or address of dns server
+	Upstream string
+	Rcode    string
+	Answer   []miekgdns.RR
+	Latency  time.Duration
+	CacheHit bool
+
+	lock     sync.Mutex
+	start    time.Time
+	finished bool
+}
+
+// Attempt one answer of expanded name from authority or upstream
+type Attempt struct {
+	Name     string
+	Upstream string
+	Rcode    string
+	Answers  int
+	Latency  time.Duration
+	Err      error
+}
+
+func newTrace(q miekgdns.Question) *Trace {
+	return &Trace{Name: q.Name, Qtype: miekgdns.TypeToString[q.Qtype], start: time.Now()}
+}
+
+// attempt records answer of name from upstream, safe for concurrent use,
+// answers come after query is replied are dropped
+func (t *Trace) attempt(name, upstream string, answer *miekgdns.Msg, start time.Time, err error) {
+	a := Attempt{Name: name, Upstream: upstream, Latency: time.Since(start), Err: err}
+	if answer != nil {
+		a.Rcode = miekgdns.RcodeToString[answer.Rcode]
+		a.Answers = len(answer.Answer)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.finished {
+		t.Attempts = append(t.Attempts, a)
+	}
+}
+
+// finish records answer which is replied
+func (t *Trace) finish(upstream string, msg *miekgdns.Msg) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.finished = true
+	t.Upstream = upstream
+	t.Rcode = miekgdns.RcodeToString[msg.Rcode]
+	t.Answer = msg.Answer
+	t.Latency = time.Since(t.start)
+}
+
+// reply records msg as answer from upstream, and returns msg
+func (t *Trace) reply(upstream string, msg *miekgdns.Msg) *miekgdns.Msg {
+	t.finish(upstream, msg)
+	return msg
+}
+
+// log structured query log, only shows on debug mode
+func (t *Trace) log() {
+	log.WithFields(log.Fields{
+		"name":     t.Name,
+		"qtype":    t.Qtype,
+		"tried":    strings.Join(t.Tried, ","),
+		"upstream": t.Upstream,
+		"rcode":    t.Rcode,
+		"answers":  len(t.Answer),
+		"latency":  t.Latency,
+		"cache":    t.CacheHit,
+	}).Debugf("dns query")
+}
+
+// Query resolves name by same logic of dns server without cache, for debugging why name can not resolve
+func Query(ctx context.Context, forwardDNS *miekgdns.ClientConfig, opts *Options, name string, qtype uint16) *Trace {
+	s := newServer(forwardDNS, opts)
+	if s.authority != nil {
+		cache.WaitForCacheSync(ctx.Done(), s.authority.synced...)
+	}
+	r := new(miekgdns.Msg)
+	r.SetQuestion(miekgdns.Fqdn(name), qtype)
+	r.SetEdns0(ednsBufferSize, false)
+	trace := newTrace(r.Question[0])
+	s.resolve(ctx, r, trace)
+	return trace
+}
@@ -1,6 +1,8 @@
 package exchange
 
 import (
+	"strconv"
+
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/utils/pointer"
@@ -16,22 +18,17 @@ func RemoveContainer(spec *corev1.PodSpec) {
 			i--
 		}
 	}
+	util.RemoveTokenVolume(spec)
 }
 
 func AddContainer(spec *corev1.PodSpec, c util.PodRouteConfig) {
 	// remove vpn container if already exist
 	RemoveContainer(spec)
+	env := c.TrafficManagerEnv()
 	spec.Containers = append(spec.Containers, corev1.Container{
 		Name:  config.ContainerSidecarVPN,
 		Image: config.Image,
-		EnvFrom: []corev1.EnvFromSource{{
-			SecretRef: &corev1.SecretEnvSource{
-				LocalObjectReference: corev1.LocalObjectReference{
-					Name: config.ConfigMapPodTrafficManager,
-				},
-			},
-		}},
-		Env: []corev1.EnvVar{
+		Env: append(env, []corev1.EnvVar{
 			{
 				Name:  "LocalTunIPv4",
 				Value: c.LocalTunIPv4,
@@ -58,10 +55,37 @@ func AddContainer(spec *corev1.PodSpec, c util.PodRouteConfig) {
 			},
 			{
 				Name:  "TrafficManagerService",
-				Value: config.ConfigMapPodTrafficManager,
+				Value: c.TrafficManagerService(),
 			},
-		},
-		Command: []string{"/bin/sh", "-c"},
+			{
+				// fallback to original container after local PC is unreachable for 3 times
+				Name:  "FallbackThreshold",
+				Value: "3",
+			},
+			{
+				// tcp port which is probed through tunnel to check local PC is reachable, empty means ping
+				Name:  "ProbePort",
+				Value: probePort(spec),
+			},
+			{
+				Name: config.EnvPodNamespace,
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: "metadata.namespace",
+					},
+				},
+			},
+			{
+				Name: config.EnvPodName,
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: "metadata.name",
+					},
+				},
+			},
+		}...),
+		VolumeMounts: []corev1.VolumeMount{util.TokenVolumeMount()},
+		Command:      []string{"/bin/sh", "-c"},
 		// https://www.netfilter.org/documentation/HOWTO/NAT-HOWTO-6.html#ss6.2
 		Args: []string{`
 sysctl -w net.ipv4.ip_forward=1
@@ -75,13 +99,45 @@ iptables -P INPUT ACCEPT
 ip6tables -P INPUT ACCEPT
 iptables -P FORWARD ACCEPT
 ip6tables -P FORWARD ACCEPT
-iptables -t nat -A PREROUTING ! -p icmp -j DNAT --to ${LocalTunIPv4}
-ip6tables -t nat -A PREROUTING ! -p icmp -j DNAT --to ${LocalTunIPv6}
+iptables -t nat -N KUBEVPN
+ip6tables -t nat -N KUBEVPN
+iptables -t nat -A KUBEVPN ! -p icmp -j DNAT --to ${LocalTunIPv4}
+ip6tables -t nat -A KUBEVPN ! -p icmp -j DNAT --to ${LocalTunIPv6}
 iptables -t nat -A POSTROUTING ! -p icmp -j MASQUERADE
 ip6tables -t nat -A POSTROUTING ! -p icmp -j MASQUERADE
 # for curl -g -6 [efff:ffff:ffff:ffff:ffff:ffff:ffff:999a]:9080/health or curl 127.0.0.1:9080/health hit local PC 
-iptables -t nat -A OUTPUT -o lo ! -p icmp -j DNAT --to-destination ${LocalTunIPv4}
-ip6tables -t nat -A OUTPUT -o lo ! -p icmp -j DNAT --to-destination ${LocalTunIPv6}
+iptables -t nat -N KUBEVPN_OUTPUT
+ip6tables -t nat -N KUBEVPN_OUTPUT
+iptables -t nat -A KUBEVPN_OUTPUT -o lo ! -p icmp -j DNAT --to-destination ${LocalTunIPv4}
+ip6tables -t nat -A KUBEVPN_OUTPUT -o lo ! -p icmp -j DNAT --to-destination ${LocalTunIPv6}
+# fallback to original container if local PC is unreachable, eg: laptop sleeps or tunnel drops,
+# only DNAT traffic to local PC when it is reachable, probe proxied tcp port through tunnel, ICMP may be blocked by local PC,
+# ipv4 and ipv6 are probed separately
+probe() {
+  if [ -n "${ProbePort}" ]; then
+    timeout 2 bash -c "exec 3<>/dev/tcp/$1/${ProbePort}" >/dev/null 2>&1
+  else
+    ping -c 1 -W 2 $1 >/dev/null 2>&1
+  fi
+}
+follow() {
+  cmd=$1; ip=$2; failed=0
+  while true; do
+    if probe ${ip}; then
+      failed=0
+      ${cmd} -t nat -C PREROUTING -j KUBEVPN 2>/dev/null || { ${cmd} -t nat -I PREROUTING -j KUBEVPN; ${cmd} -t nat -I OUTPUT -j KUBEVPN_OUTPUT; echo "local PC ${ip} is reachable, traffic goes to local PC"; }
+    else
+      failed=$((failed+1))
+      if [ ${failed} -ge ${FallbackThreshold} ] && ${cmd} -t nat -C PREROUTING -j KUBEVPN 2>/dev/null; then
+        ${cmd} -t nat -D PREROUTING -j KUBEVPN; ${cmd} -t nat -D OUTPUT -j KUBEVPN_OUTPUT
+        echo "local PC ${ip} is unreachable, fallback to original container"
+      fi
+    fi
+    sleep 2
+  done
+}
+follow iptables ${LocalTunIPv4} &
+follow ip6tables ${LocalTunIPv6} &
 kubevpn serve -L "tun:/127.0.0.1:8422?net=${TunIPv4}&route=${CIDR4}" -F "tcp://${TrafficManagerService}:10800"`,
 		},
 		SecurityContext: &corev1.SecurityContext{
@@ -94,7 +150,7 @@ kubevpn serve -L "tun:/127.0.0.1:8422?net=${TunIPv4}&route=${CIDR4}" -F "tcp://$
 			RunAsUser:  pointer.Int64(0),
 			Privileged: pointer.Bool(true),
 		},
-		Resources: corev1.ResourceRequirements{
+		Resources: c.Workload.SidecarResourcesOrDefault(corev1.ResourceRequirements{
 			Requests: map[corev1.ResourceName]resource.Quantity{
 				corev1.ResourceCPU:    resource.MustParse("128m"),
 				corev1.ResourceMemory: resource.MustParse("128Mi"),
@@ -103,10 +159,27 @@ kubevpn serve -L "tun:/127.0.0.1:8422?net=${TunIPv4}&route=${CIDR4}" -F "tcp://$
 				corev1.ResourceCPU:    resource.MustParse("256m"),
 				corev1.ResourceMemory: resource.MustParse("256Mi"),
 			},
-		},
+		}),
 		ImagePullPolicy: corev1.PullIfNotPresent,
 	})
+	util.AddTokenVolume(spec)
+	c.Workload.AddImagePullSecrets(spec)
 	if len(spec.PriorityClassName) == 0 {
 		spec.PriorityClassName = "system-cluster-critical"
+		if c.Workload != nil && c.Workload.PriorityClassName != "" {
+			spec.PriorityClassName = c.Workload.PriorityClassName
+		}
+	}
+}
+
+// probePort first tcp port of containers, local PC is reachable if it is connectable through tunnel
+func probePort(spec *corev1.PodSpec) string {
+	for _, container := range spec.Containers {
+		for _, port := range container.Ports {
+			if port.Protocol == "" || port.Protocol == corev1.ProtocolTCP {
+				return strconv.Itoa(int(port.ContainerPort))
+			}
+		}
 	}
+	return ""
 }
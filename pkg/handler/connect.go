@@ -4,8 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"math"
-	"math/rand"
 	"net"
 	"net/netip"
 	"net/url"
@@ -47,7 +45,6 @@ import (
 	"k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/tools/clientcmd/api/latest"
 	clientcmdlatest "k8s.io/client-go/tools/clientcmd/api/latest"
-	"k8s.io/client-go/util/retry"
 	"k8s.io/kubectl/pkg/cmd/set"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 	"k8s.io/kubectl/pkg/polymorphichelpers"
@@ -57,6 +54,7 @@ import (
 	pkgclient "sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/controlplane"
 	"github.com/wencaiwulue/kubevpn/pkg/core"
 	"github.com/wencaiwulue/kubevpn/pkg/dns"
 	"github.com/wencaiwulue/kubevpn/pkg/driver"
@@ -65,11 +63,39 @@ import (
 )
 
 type ConnectOptions struct {
-	Namespace   string
-	Headers     map[string]string
-	Workloads   []string
-	ExtraCIDR   []string
-	ExtraDomain []string
+	Namespace string
+	Headers   map[string]string
+	// Weight percentage of traffic to local PC, combined with Headers, 0 means all
+	Weight int
+	// Mirror traffic still go to origin workloads, and shadow copy to local PC
+	Mirror bool
+	// MirrorPercent percentage of traffic mirrored to local PC, combined with Headers, 0 means all
+	MirrorPercent int
+	// HealthCheckPath http health check path of local PC in mesh mode, traffic fallback to origin workloads if unhealthy
+	HealthCheckPath string
+	// Fault inject delay or abort into traffic matched Headers in mesh mode
+	Fault map[string]string
+	// RulesFile yaml file of fault and direct responses, see controlplane.RulesFile
+	RulesFile string
+	// ForwardDNSOnly forward all DNS queries to cluster dns through tunnel, instead of answering cluster domain from informers
+	ForwardDNSOnly bool
+	// DNSRulesFile yaml file of split dns rules, see dns.RulesFile
+	DNSRulesFile string
+	// DNSNamespaces services of these namespaces are dumped into hosts too, current namespace wins if names conflict
+	DNSNamespaces []string
+	// ClusterCIDR pod and service cidr supplied by user, skips detecting cidr
+	ClusterCIDR []string
+	// RefreshCIDR detects cidr again, instead of using cached IPv4_POOLS
+	RefreshCIDR bool
+	// NoPrivilegedProbe refuses to create privileged pod for detecting cidr, only detects from api objects
+	NoPrivilegedProbe bool
+	Workloads         []string
+	ExtraCIDR         []string
+	ExtraDomain       []string
+	// ManagerNamespace is namespace of cluster-wide traffic manager, empty means create traffic manager in Namespace
+	ManagerNamespace string
+	// Workload scheduling and resources of traffic manager and sidecars, it overrides configmap config.ConfigMapWorkload
+	Workload *util.WorkloadConfig
 
 	clientset  *kubernetes.Clientset
 	restclient *rest.RESTClient
@@ -82,22 +108,51 @@ type ConnectOptions struct {
 	localTunIPv6 *net.IPNet
 
 	apiServerIPs []net.IP
+	// extraDomains current ips of ExtraDomain, routes follow them
+	extraDomains *extraDomains
+	// leaseName lease of this client, traffic manager collects ip and envoy rules of it if not renewed
+	leaseName string
 }
 
 func (c *ConnectOptions) createRemoteInboundPod(ctx context.Context) (err error) {
-	c.localTunIPv4, c.localTunIPv6, err = c.dhcp.RentIPBaseNICAddress(ctx)
+	// lease ip to lease of client, so gc loop and recover only release ip which is still owned by it
+	c.localTunIPv4, c.localTunIPv6, err = c.dhcp.RentIPForOwner(ctx, c.leaseName)
 	if err != nil {
 		return
 	}
+	recordJournal(JournalEntry{Kind: JournalDHCP, IPs: []string{c.localTunIPv4.IP.String(), c.localTunIPv6.IP.String()}, Owner: c.leaseName})
+	if err = annotateClientLease(ctx, c.clientset, c.managerNamespace(), c.leaseName, c.localTunIPv4.IP, c.localTunIPv6.IP); err != nil {
+		return
+	}
 
+	// sidecar only gets cert of CA to verify traffic manager, not private key
+	var cert string
+	if len(c.Workloads) != 0 {
+		var secret *v1.Secret
+		secret, err = c.clientset.CoreV1().Secrets(c.managerNamespace()).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+		if err != nil {
+			return
+		}
+		cert = string(secret.Data[config.TLSCACertKey])
+	}
 	for _, workload := range c.Workloads {
 		configInfo := util.PodRouteConfig{
-			LocalTunIPv4: c.localTunIPv4.IP.String(),
-			LocalTunIPv6: c.localTunIPv6.IP.String(),
+			LocalTunIPv4:            c.localTunIPv4.IP.String(),
+			LocalTunIPv6:            c.localTunIPv6.IP.String(),
+			TrafficManagerNamespace: c.ManagerNamespace,
+			TrafficManagerCert:      cert,
+			Workload:                c.Workload,
+			Weight:                  c.Weight,
+			Mirror:                  c.Mirror,
+			MirrorPercent:           c.MirrorPercent,
+			HealthCheckPath:         c.HealthCheckPath,
+		}
+		if configInfo.Fault, configInfo.DirectResponses, err = c.parseFaultRules(); err != nil {
+			return
 		}
 		// means mesh mode
-		if len(c.Headers) != 0 {
-			err = InjectVPNAndEnvoySidecar(ctx, c.factory, c.clientset.CoreV1().ConfigMaps(c.Namespace), c.Namespace, workload, configInfo, c.Headers)
+		if len(c.Headers) != 0 || c.Weight != 0 || c.Mirror {
+			err = InjectVPNAndEnvoySidecar(ctx, c.factory, c.clientset.CoreV1().ConfigMaps(c.managerNamespace()), c.Namespace, workload, configInfo, c.Headers)
 		} else {
 			err = InjectVPNSidecar(ctx, c.factory, c.Namespace, workload, configInfo)
 		}
@@ -133,15 +188,32 @@ func Rollback(f cmdutil.Factory, ns, workload string) {
 }
 
 func (c *ConnectOptions) DoConnect() (err error) {
-	c.dhcp = NewDHCPManager(c.clientset.CoreV1().ConfigMaps(c.Namespace), c.Namespace)
+	c.dhcp = NewDHCPManager(c.clientset.CoreV1().ConfigMaps(c.managerNamespace()), c.managerNamespace())
 	if err = c.dhcp.initDHCP(ctx); err != nil {
 		return
 	}
+	// last process may be killed without rollback, recover it before start
+	recoverStaleJournals(ctx, c.factory, c.clientset, c.config.Host)
+	if err = startJournal(c.clientset, c.config.Host, c.managerNamespace(), c.ManagerNamespace != ""); err != nil {
+		return
+	}
 	c.addCleanUpResourceHandler()
 	if err = c.getCIDR(ctx); err != nil {
 		return
 	}
-	if err = createOutboundPod(ctx, c.factory, c.clientset, c.Namespace); err != nil {
+	if err = c.mergeWorkload(ctx); err != nil {
+		return
+	}
+	if err = createOutboundPod(ctx, c.factory, c.clientset, c.managerNamespace(), c.ManagerNamespace != "", c.Workload); err != nil {
+		return
+	}
+	c.leaseName = "kubevpn-client-" + journal.ID
+	if err = createClientLease(ctx, c.clientset, c.managerNamespace(), c.leaseName); err != nil {
+		return fmt.Errorf("failed to create lease of client, err: %v", err)
+	}
+	recordJournal(JournalEntry{Kind: JournalLease, Name: c.leaseName})
+	go c.heartbeat(ctx)
+	if err = c.labelNamespace(ctx); err != nil {
 		return
 	}
 	if err = c.setImage(ctx); err != nil {
@@ -164,7 +236,12 @@ func (c *ConnectOptions) DoConnect() (err error) {
 	if err = c.addRouteDynamic(ctx); err != nil {
 		return
 	}
+	recordJournal(JournalEntry{Kind: JournalRoute, Tun: os.Getenv(config.EnvTunNameOrLUID)})
 	c.deleteFirewallRule(ctx)
+	recordJournal(JournalEntry{Kind: JournalDNS, Tun: os.Getenv(config.EnvTunNameOrLUID)})
+	// routes of --extra-domain and dns rules with route, deleted when exit
+	c.extraDomains = &extraDomains{ips: map[string][]net.IP{}, routed: sets.New[string]()}
+	RollbackFuncList = append(RollbackFuncList, c.deleteExtraRoutes)
 	if err = c.setupDNS(); err != nil {
 		return
 	}
@@ -179,7 +256,7 @@ func (c *ConnectOptions) DoConnect() (err error) {
 func (c *ConnectOptions) portForward(ctx context.Context, port string) error {
 	var readyChan = make(chan struct{}, 1)
 	var errChan = make(chan error, 1)
-	podInterface := c.clientset.CoreV1().Pods(c.Namespace)
+	podInterface := c.clientset.CoreV1().Pods(c.managerNamespace())
 	go func() {
 		var first = pointer.Bool(true)
 		for {
@@ -206,7 +283,7 @@ func (c *ConnectOptions) portForward(ctx context.Context, port string) error {
 					c.config,
 					c.restclient,
 					podName,
-					c.Namespace,
+					c.managerNamespace(),
 					port,
 					readyChan,
 					childCtx.Done(),
@@ -500,24 +577,16 @@ func (c *ConnectOptions) deleteFirewallRule(ctx context.Context) {
 		util.AddAllowFirewallRule()
 	}
 	RollbackFuncList = append(RollbackFuncList, util.DeleteAllowFirewallRule)
+	recordJournal(JournalEntry{Kind: JournalFirewall})
 	go util.DeleteBlockFirewallRule(ctx)
 }
 
 func (c *ConnectOptions) setupDNS() error {
-	const port = 53
-	pod, err := c.GetRunningPodList()
+	relovConf, err := c.dnsClientConfig()
 	if err != nil {
 		log.Errorln(err)
 		return err
 	}
-	relovConf, err := dns.GetDNSServiceIPFromPod(c.clientset, c.restclient, c.config, pod[0].GetName(), c.Namespace)
-	if err != nil {
-		log.Errorln(err)
-		return err
-	}
-	if relovConf.Port == "" {
-		relovConf.Port = strconv.Itoa(port)
-	}
 	ns := sets.New[string]()
 	list, err := c.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
 	if err == nil {
@@ -525,20 +594,100 @@ func (c *ConnectOptions) setupDNS() error {
 			ns.Insert(item.Name)
 		}
 	}
-	svc, err := c.clientset.CoreV1().Services(c.Namespace).List(ctx, metav1.ListOptions{})
-	if err == nil {
-		for _, item := range svc.Items {
-			ns.Insert(item.Name)
+	namespaces := c.dnsNamespaces()
+	for _, namespace := range namespaces {
+		svc, err := c.clientset.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+		if err == nil {
+			for _, item := range svc.Items {
+				ns.Insert(item.Name)
+			}
 		}
 	}
-	if err = dns.SetupDNS(relovConf, ns.UnsortedList()); err != nil {
+	opts, err := c.dnsOptions(ctx, relovConf)
+	if err != nil {
+		return err
+	}
+	opts.RouteFunc = c.updateRuleDomain
+	if err = dns.SetupDNS(relovConf, ns.UnsortedList(), opts); err != nil {
 		return err
 	}
-	// dump service in current namespace for support DNS resolve service:port
-	go dns.AddServiceNameToHosts(ctx, c.clientset.CoreV1().Services(c.Namespace))
+	// dump service in current namespace and --dns-namespaces for support DNS resolve service:port
+	go dns.AddServiceNameToHosts(ctx, c.clientset, namespaces)
 	return nil
 }
 
+// dnsClientConfig resolv.conf of traffic manager, dns server on local PC forwards queries to cluster dns of it
+func (c *ConnectOptions) dnsClientConfig() (*miekgdns.ClientConfig, error) {
+	const port = 53
+	pod, err := c.GetRunningPodList()
+	if err != nil {
+		return nil, err
+	}
+	relovConf, err := dns.GetDNSServiceIPFromPod(c.clientset, c.restclient, c.config, pod[0].GetName(), c.managerNamespace())
+	if err != nil {
+		return nil, err
+	}
+	// resolv.conf of cluster-wide traffic manager search its own namespace first, but should search current namespace
+	if c.ManagerNamespace != "" && c.ManagerNamespace != c.Namespace {
+		for i, s := range relovConf.Search {
+			if strings.HasPrefix(s, c.ManagerNamespace+".svc.") {
+				relovConf.Search[i] = c.Namespace + strings.TrimPrefix(s, c.ManagerNamespace)
+			}
+		}
+	}
+	if relovConf.Port == "" {
+		relovConf.Port = strconv.Itoa(port)
+	}
+	return relovConf, nil
+}
+
+// dnsOptions authority and split dns rules of dns server on local PC
+func (c *ConnectOptions) dnsOptions(ctx context.Context, relovConf *miekgdns.ClientConfig) (opts *dns.Options, err error) {
+	opts = &dns.Options{}
+	if c.DNSRulesFile != "" {
+		if opts.Rules, err = dns.ParseRulesFile(c.DNSRulesFile); err != nil {
+			return nil, err
+		}
+	}
+	if !c.ForwardDNSOnly {
+		opts.Authority, err = dns.NewAuthority(ctx, c.clientset, dns.ClusterDomain(relovConf.Search))
+		if err != nil {
+			log.Warnf("failed to answer cluster domain from informers, forward all queries to cluster dns, err: %v", err)
+			opts.Authority = nil
+		}
+	}
+	return opts, nil
+}
+
+// QueryDNS resolves name by same logic of dns server which kubevpn connect runs, but not adds routes of rules,
+// queries forwarded to cluster dns need tunnel of running kubevpn
+func (c *ConnectOptions) QueryDNS(ctx context.Context, name string, qtype uint16) (*dns.Trace, error) {
+	relovConf, err := c.dnsClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := c.dnsOptions(ctx, relovConf)
+	if err != nil {
+		return nil, err
+	}
+	return dns.Query(ctx, relovConf, opts, name, qtype), nil
+}
+
+// dnsNamespaces current namespace first, then --dns-namespaces in order, duplicated ones are removed
+func (c *ConnectOptions) dnsNamespaces() []string {
+	var result = []string{c.Namespace}
+	var seen = sets.New[string](c.Namespace)
+	for _, namespace := range c.DNSNamespaces {
+		namespace = strings.TrimSpace(namespace)
+		if namespace == "" || seen.Has(namespace) {
+			continue
+		}
+		seen.Insert(namespace)
+		result = append(result, namespace)
+	}
+	return result
+}
+
 func Run(ctx context.Context, servers []core.Server) error {
 	group, _ := errgroup.WithContext(ctx)
 	for i := range servers {
@@ -740,6 +889,30 @@ func SshJump(conf *util.SshConfig, flags *pflag.FlagSet) (err error) {
 // pod/productpage-without-controller --> pod/productpage-without-controller
 // service/productpage-without-pod --> controller/controllerName
 func (c *ConnectOptions) PreCheckResource() error {
+	if _, err := controlplane.ParseMatches(c.Headers); err != nil {
+		return fmt.Errorf("invalid headers, err: %v", err)
+	}
+	if c.Weight < 0 || c.Weight > 100 {
+		return fmt.Errorf("invalid weight %d, it should be in range [0, 100]", c.Weight)
+	}
+	if c.MirrorPercent < 0 || c.MirrorPercent > 100 {
+		return fmt.Errorf("invalid mirror percent %d, it should be in range [0, 100]", c.MirrorPercent)
+	}
+	// mirrored traffic still go to origin workloads, nothing to split by weight
+	if c.Mirror && c.Weight != 0 {
+		return fmt.Errorf("--weight not works with --mirror, use --mirror-percent to sample mirrored traffic")
+	}
+	if !c.Mirror && c.MirrorPercent != 0 {
+		return fmt.Errorf("--mirror-percent only works with --mirror")
+	}
+	fault, responses, err := c.parseFaultRules()
+	if err != nil {
+		return err
+	}
+	// only affect requests tagged by tester, not all traffic of workloads
+	if (fault != nil || len(responses) != 0) && len(c.Headers) == 0 {
+		return fmt.Errorf("fault and direct responses needs --headers to scope requests")
+	}
 	list, err := util.GetUnstructuredObjectList(c.factory, c.Namespace, c.Workloads)
 	if err != nil {
 		return err
@@ -799,8 +972,27 @@ func (c *ConnectOptions) PreCheckResource() error {
 	return nil
 }
 
+// parseFaultRules parse --fault and --rules-file, --fault overrides fault in rules file
+func (c *ConnectOptions) parseFaultRules() (*controlplane.Fault, []*controlplane.DirectResponse, error) {
+	var rules = &controlplane.RulesFile{}
+	if c.RulesFile != "" {
+		var err error
+		if rules, err = controlplane.ParseRulesFile(c.RulesFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	fault, err := controlplane.ParseFault(c.Fault)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid fault, err: %v", err)
+	}
+	if fault != nil {
+		rules.Fault = fault
+	}
+	return rules.Fault, rules.DirectResponses, nil
+}
+
 func (c *ConnectOptions) GetRunningPodList() ([]v1.Pod, error) {
-	list, err := c.clientset.CoreV1().Pods(c.Namespace).List(ctx, metav1.ListOptions{
+	list, err := c.clientset.CoreV1().Pods(c.managerNamespace()).List(ctx, metav1.ListOptions{
 		LabelSelector: fields.OneTermEqualSelector("app", config.ConfigMapPodTrafficManager).String(),
 	})
 	if err != nil {
@@ -856,130 +1048,111 @@ func (c *ConnectOptions) getCIDR(ctx context.Context) (err error) {
 		}
 	}()
 
-	// (1) get cidr from cache
-	var value string
-	value, err = c.dhcp.Get(ctx, config.KeyClusterIPv4POOLS)
-	if err == nil {
-		for _, s := range strings.Split(value, " ") {
-			_, cidr, _ := net.ParseCIDR(s)
-			if cidr != nil {
-				c.cidrs = util.Deduplicate(append(c.cidrs, cidr))
-			}
-		}
-	}
-	if len(c.cidrs) != 0 {
-		log.Infoln("got cidr from cache")
+	// (1) cidr supplied by user
+	if len(c.ClusterCIDR) != 0 {
+		c.cidrs, err = util.NewUserCIDRDetector(c.ClusterCIDR).Detect(ctx)
+		reportCIDR([]util.CIDRResult{{Detector: "user", Confidence: util.ConfidenceHigh, CIDRs: c.cidrs}})
 		return
 	}
 
-	// (2) get cidr from cni
-	c.cidrs, err = util.GetCIDRElegant(c.clientset, c.restclient, c.config, c.Namespace)
-	if err == nil {
-		s := sets.New[string]()
-		for _, cidr := range c.cidrs {
-			s.Insert(cidr.String())
+	// (2) get cidr from cache
+	if c.RefreshCIDR {
+		log.Infoln("refresh cidr, ignore cache")
+	} else {
+		var value string
+		value, err = c.dhcp.Get(ctx, config.KeyClusterIPv4POOLS)
+		if err == nil {
+			for _, s := range strings.Split(value, " ") {
+				_, cidr, _ := net.ParseCIDR(s)
+				if cidr != nil {
+					c.cidrs = util.Deduplicate(append(c.cidrs, cidr))
+				}
+			}
 		}
-		cidrs, _ := util.GetCIDRFromResourceUgly(c.clientset, c.Namespace)
-		for _, cidr := range cidrs {
-			s.Insert(cidr.String())
+		if len(c.cidrs) != 0 {
+			// cluster may add ip pool after cached
+			results := []util.CIDRResult{{Detector: "cache", Confidence: util.ConfidenceMedium, CIDRs: c.cidrs}}
+			// guessed cidr is not cached, guess it again
+			if cidrs, _ := util.GetCIDRFromResourceUgly(c.clientset, c.Namespace); len(cidrs) != 0 {
+				results = append(results, util.CIDRResult{Detector: "pod-ip", Confidence: util.ConfidenceLow, CIDRs: cidrs})
+				c.cidrs = util.Deduplicate(append(c.cidrs, cidrs...))
+			}
+			reportCIDR(results)
+			return
 		}
-		c.cidrs = util.Deduplicate(append(c.cidrs, cidrs...))
-		_ = c.dhcp.Set(config.KeyClusterIPv4POOLS, strings.Join(s.UnsortedList(), " "))
-		return
 	}
 
-	// (3) fallback to get cidr from node/pod/service
-	c.cidrs, err = util.GetCIDRFromResourceUgly(c.clientset, c.Namespace)
-	return
-}
-
-func (c *ConnectOptions) addExtraRoute(ctx context.Context) (err error) {
-	if len(c.ExtraDomain) == 0 {
-		return
-	}
-	var ips []string
-	ips, err = dns.GetDNSIPFromDnsPod(c.clientset)
+	// (3) get cidr from api objects, cluster info, node, calico, cilium, kube-proxy, eks and service
+	dynamicClient, err := c.factory.DynamicClient()
 	if err != nil {
-		return
-	}
-	if len(ips) == 0 {
-		err = fmt.Errorf("can't found any dns server")
-		return
-	}
-
-	var r routing.Router
-	r, err = netroute.New()
-	if err != nil {
-		return
+		return err
 	}
+	results := util.DetectCIDR(ctx, util.NewCIDRDetectors(c.clientset, dynamicClient, c.managerNamespace()))
 
-	var tunIface *net.Interface
-	tunIface, err = tun.GetInterface()
-	if err != nil {
-		return
+	// (4) get cidr from cni by privileged pod, if not found pod cidr from api objects with high confidence
+	switch {
+	case util.HasPodCIDR(results):
+	case c.NoPrivilegedProbe:
+		log.Warnf("can not detect pod cidr from api objects with high confidence, not create privileged pod %s because of --no-privileged-probe", config.CniNetName)
+	default:
+		cidrs, errs := util.GetCIDRElegant(c.clientset, c.restclient, c.config, c.managerNamespace())
+		if errs == nil {
+			results = append(results, util.CIDRResult{Detector: "cni-probe", Confidence: util.ConfidenceHigh, CIDRs: cidrs})
+		}
 	}
 
-	addRouteFunc := func(resource, ip string) {
-		if net.ParseIP(ip) == nil {
-			return
-		}
-		// if route is right, not need add route
-		iface, _, _, errs := r.Route(net.ParseIP(ip))
-		if errs == nil && tunIface.Name == iface.Name {
-			return
-		}
-		var mask net.IPMask
-		if net.ParseIP(ip).To4() != nil {
-			mask = net.CIDRMask(32, 32)
-		} else {
-			mask = net.CIDRMask(128, 128)
+	// (5) also add cidr from pod/service ip of current namespace, in case of detected cidr misses them
+	if cidrs, _ := util.GetCIDRFromResourceUgly(c.clientset, c.Namespace); len(cidrs) != 0 {
+		results = append(results, util.CIDRResult{Detector: "pod-ip", Confidence: util.ConfidenceLow, CIDRs: cidrs})
+	}
+	reportCIDR(results)
+	for _, r := range results {
+		c.cidrs = append(c.cidrs, r.CIDRs...)
+	}
+	c.cidrs = util.Deduplicate(c.cidrs)
+	if len(c.cidrs) == 0 {
+		return fmt.Errorf("can not detect any cidr of cluster, please special it by --cluster-cidr")
+	}
+	// only caches cidr detected from cluster config, guessed cidr may be wrong or stale, detect it again next time
+	s := sets.New[string]()
+	for _, r := range results {
+		if r.Confidence == util.ConfidenceLow {
+			continue
 		}
-		errs = tun.AddRoutes(types.Route{Dst: net.IPNet{IP: net.ParseIP(ip), Mask: mask}})
-		if errs != nil {
-			log.Debugf("[route] add route failed, domain: %s, ip: %s,err: %v", resource, ip, err)
+		for _, cidr := range r.CIDRs {
+			s.Insert(cidr.String())
 		}
 	}
+	if s.Len() != 0 {
+		_ = c.dhcp.Set(config.KeyClusterIPv4POOLS, strings.Join(sets.List(s), " "))
+	}
+	return nil
+}
 
-	client := &miekgdns.Client{Net: "udp", SingleInflight: true, DialTimeout: time.Second * 30}
-	for _, domain := range c.ExtraDomain {
-		for _, qType := range []uint16{miekgdns.TypeA, miekgdns.TypeAAAA} {
-			err = retry.OnError(
-				retry.DefaultRetry,
-				func(err error) bool {
-					return err != nil
-				},
-				func() error {
-					var answer *miekgdns.Msg
-					answer, _, err = client.ExchangeContext(ctx, &miekgdns.Msg{
-						MsgHdr: miekgdns.MsgHdr{
-							Id: uint16(rand.Intn(math.MaxUint16 + 1)),
-						},
-						Question: []miekgdns.Question{
-							{
-								Name:  domain + ".",
-								Qtype: qType,
-							},
-						},
-					}, fmt.Sprintf("%s:%d", ips[0], 53))
-					if err != nil {
-						return err
-					}
-					for _, rr := range answer.Answer {
-						switch a := rr.(type) {
-						case *miekgdns.A:
-							addRouteFunc(domain, a.A.String())
-						case *miekgdns.AAAA:
-							addRouteFunc(domain, a.AAAA.String())
-						}
-					}
-					return nil
-				})
-			if err != nil {
-				return err
-			}
+// reportCIDR prints which detection method found cidr and how confident it is
+func reportCIDR(results []util.CIDRResult) {
+	for _, r := range results {
+		log.Infof("cidr detected by %s, confidence %s: %v", r.Detector, r.Confidence, r.CIDRs)
+	}
+	confidence := reportConfidence(results)
+	log.Infof("cidr detection confidence: %s", confidence)
+	if confidence == util.ConfidenceLow {
+		log.Warnf("cidr is guessed from ip of pods, some pods may be unreachable, please special cidr by --cluster-cidr if so")
+	}
+}
+
+// reportConfidence highest confidence of results, cidr of all detectors are used
+func reportConfidence(results []util.CIDRResult) util.Confidence {
+	var confidence = util.ConfidenceLow
+	for _, r := range results {
+		switch {
+		case r.Confidence == util.ConfidenceHigh:
+			return util.ConfidenceHigh
+		case r.Confidence == util.ConfidenceMedium:
+			confidence = util.ConfidenceMedium
 		}
 	}
-	return
+	return confidence
 }
 
 func (c *ConnectOptions) GetKubeconfigPath() (string, error) {
@@ -1020,16 +1193,54 @@ func (c *ConnectOptions) GetKubeconfigPath() (string, error) {
 	return temp.Name(), nil
 }
 
+// managerNamespace namespace of traffic manager
+func (c *ConnectOptions) managerNamespace() string {
+	if c.ManagerNamespace != "" {
+		return c.ManagerNamespace
+	}
+	return c.Namespace
+}
+
+// mergeWorkload merge workload config from configmap of traffic manager namespace and flags
+func (c *ConnectOptions) mergeWorkload(ctx context.Context) error {
+	workload, err := util.GetWorkloadConfig(ctx, c.clientset.CoreV1().ConfigMaps(c.managerNamespace()))
+	if err != nil {
+		return err
+	}
+	c.Workload = workload.Merge(c.Workload)
+	return nil
+}
+
+// labelNamespace let webhook of cluster-wide traffic manager select current namespace,
+// namespace should be labeled by `kubevpn install --cluster-wide --namespaces`, only patch it if not labeled
+func (c *ConnectOptions) labelNamespace(ctx context.Context) error {
+	if c.ManagerNamespace == "" {
+		return nil
+	}
+	err := LabelNamespaces(ctx, c.clientset, c.ManagerNamespace, c.Namespace)
+	if apierrors.IsForbidden(err) {
+		// no permission to check or label it, maybe it is labeled by cluster admin already
+		log.Warnf("can not label namespace %s with %s=%s, make sure cluster admin labels it by `kubevpn install -n %s --cluster-wide --namespaces %s`, err: %v",
+			c.Namespace, config.LabelTrafficManager, c.ManagerNamespace, c.ManagerNamespace, c.Namespace, err)
+		return nil
+	}
+	return err
+}
+
 func (c ConnectOptions) GetClientset() *kubernetes.Clientset {
 	return c.clientset
 }
 
 // update to newer image
 func (c *ConnectOptions) UpdateImage(ctx context.Context) error {
-	deployment, err := c.clientset.AppsV1().Deployments(c.Namespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	deployment, err := c.clientset.AppsV1().Deployments(c.managerNamespace()).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
+	// image of pre-installed traffic manager is managed by cluster admin
+	if IsPreInstalled(deployment) {
+		return nil
+	}
 	origin := deployment.DeepCopy()
 	newImg, err := reference.ParseNormalizedNamed(config.Image)
 	if err != nil {
@@ -1073,19 +1284,23 @@ func (c *ConnectOptions) UpdateImage(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	_, err = c.clientset.AppsV1().Deployments(c.Namespace).Patch(ctx, config.ConfigMapPodTrafficManager, p.Type(), data, metav1.PatchOptions{})
+	_, err = c.clientset.AppsV1().Deployments(c.managerNamespace()).Patch(ctx, config.ConfigMapPodTrafficManager, p.Type(), data, metav1.PatchOptions{})
 	if err != nil {
 		return err
 	}
-	err = util.RolloutStatus(ctx, c.factory, c.Namespace, fmt.Sprintf("deployments/%s", config.ConfigMapPodTrafficManager), time.Minute*60)
+	err = util.RolloutStatus(ctx, c.factory, c.managerNamespace(), fmt.Sprintf("deployments/%s", config.ConfigMapPodTrafficManager), time.Minute*60)
 	return err
 }
 
 func (c *ConnectOptions) setImage(ctx context.Context) error {
-	deployment, err := c.clientset.AppsV1().Deployments(c.Namespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	deployment, err := c.clientset.AppsV1().Deployments(c.managerNamespace()).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
+	// image of pre-installed traffic manager is managed by cluster admin
+	if IsPreInstalled(deployment) {
+		return nil
+	}
 	newImg, err := reference.ParseNormalizedNamed(config.Image)
 	if err != nil {
 		return err
@@ -1123,7 +1338,7 @@ func (c *ConnectOptions) setImage(ctx context.Context) error {
 
 	r := c.factory.NewBuilder().
 		WithScheme(scheme.Scheme, scheme.Scheme.PrioritizedVersionsAllGroups()...).
-		NamespaceParam(c.Namespace).DefaultNamespace().
+		NamespaceParam(c.managerNamespace()).DefaultNamespace().
 		ResourceNames("deployments", deployment.Name).
 		ContinueOnError().
 		Latest().
@@ -1160,7 +1375,7 @@ func (c *ConnectOptions) setImage(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("failed to patch image update to pod template: %v", err)
 		}
-		err = util.RolloutStatus(ctx, c.factory, c.Namespace, fmt.Sprintf("%s/%s", p.Info.Mapping.Resource.GroupResource().String(), p.Info.Name), time.Minute*60)
+		err = util.RolloutStatus(ctx, c.factory, c.managerNamespace(), fmt.Sprintf("%s/%s", p.Info.Mapping.Resource.GroupResource().String(), p.Info.Name), time.Minute*60)
 		if err != nil {
 			return err
 		}
@@ -3,6 +3,8 @@ package handler
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 
@@ -13,6 +15,7 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"github.com/wencaiwulue/kubevpn/pkg/config"
@@ -62,8 +65,7 @@ func (d *DHCPManager) initDHCP(ctx context.Context) error {
 			Labels:    map[string]string{},
 		},
 		Data: map[string]string{
-			config.KeyEnvoy:    "",
-			config.KeyRefCount: "0",
+			config.KeyEnvoy: "",
 		},
 	}
 	_, err = d.client.Create(ctx, cm, metav1.CreateOptions{})
@@ -75,7 +77,7 @@ func (d *DHCPManager) initDHCP(ctx context.Context) error {
 
 func (d *DHCPManager) RentIPBaseNICAddress(ctx context.Context) (*net.IPNet, *net.IPNet, error) {
 	var v4, v6 net.IP
-	err := d.updateDHCPConfigMap(ctx, func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range) (err error) {
+	err := d.updateDHCPConfigMap(ctx, func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range, _ map[string]string) (err error) {
 		if v4, err = ipv4.AllocateNext(); err != nil {
 			return err
 		}
@@ -91,13 +93,34 @@ func (d *DHCPManager) RentIPBaseNICAddress(ctx context.Context) (*net.IPNet, *ne
 }
 
 func (d *DHCPManager) RentIPRandom(ctx context.Context) (*net.IPNet, *net.IPNet, error) {
+	return d.RentIPForOwner(ctx)
+}
+
+// RentIPForOwner rent ipv4 and ipv6, and bind the lease to first owner, owner is pod uid or namespace/podName.
+// one identity holds at most one pair of ip, if any of owners already holds it, return it instead of renting new one.
+// empty owners means the lease is not bound to any pod identity
+func (d *DHCPManager) RentIPForOwner(ctx context.Context, owners ...string) (*net.IPNet, *net.IPNet, error) {
 	var v4, v6 net.IP
-	err := d.updateDHCPConfigMap(ctx, func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range) (err error) {
-		if v4, err = ipv4.AllocateNext(); err != nil {
+	err := d.updateDHCPConfigMap(ctx, func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range, leases map[string]string) (err error) {
+		if len(owners) == 0 || owners[0] == "" {
+			if v4, err = ipv4.AllocateNext(); err != nil {
+				return err
+			}
+			v6, err = ipv6.AllocateNext()
 			return err
 		}
-		if v6, err = ipv6.AllocateNext(); err != nil {
-			return err
+		v4, v6 = leasedTo(leases, owners...)
+		if v4 == nil {
+			if v4, err = ipv4.AllocateNext(); err != nil {
+				return err
+			}
+			leases[v4.String()] = owners[0]
+		}
+		if v6 == nil {
+			if v6, err = ipv6.AllocateNext(); err != nil {
+				return err
+			}
+			leases[v6.String()] = owners[0]
 		}
 		return
 	})
@@ -108,24 +131,95 @@ func (d *DHCPManager) RentIPRandom(ctx context.Context) (*net.IPNet, *net.IPNet,
 	return &net.IPNet{IP: v4, Mask: d.cidr.Mask}, &net.IPNet{IP: v6, Mask: d.cidr6.Mask}, nil
 }
 
-func (d *DHCPManager) ReleaseIP(ctx context.Context, ips ...net.IP) error {
-	return d.updateDHCPConfigMap(ctx, func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range) error {
+// leasedTo ipv4 and ipv6 which leased to any of owners
+func leasedTo(leases map[string]string, owners ...string) (v4 net.IP, v6 net.IP) {
+	for ip, owner := range leases {
+		if owner == "" || !sets.New[string](owners...).Has(owner) {
+			continue
+		}
+		if parsed := net.ParseIP(ip); parsed == nil {
+			continue
+		} else if parsed.To4() != nil {
+			v4 = parsed.To4()
+		} else {
+			v6 = parsed
+		}
+	}
+	return
+}
+
+// RentIP rent specified ips and lease them to owner, fails if any of them is already rent by others
+func (d *DHCPManager) RentIP(ctx context.Context, owner string, ips ...net.IP) error {
+	return d.updateDHCPConfigMap(ctx, func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range, leases map[string]string) error {
 		for _, ip := range ips {
-			var use *ipallocator.Range
+			var use = ipv6
 			if ip.To4() != nil {
 				use = ipv4
-			} else {
-				use = ipv6
 			}
-			if err := use.Release(ip); err != nil {
-				return err
+			if err := use.Allocate(ip); err != nil {
+				return fmt.Errorf("failed to rent ip %s, err: %v", ip.String(), err)
+			}
+			if owner != "" {
+				leases[ip.String()] = owner
 			}
 		}
 		return nil
 	})
 }
 
-func (d *DHCPManager) updateDHCPConfigMap(ctx context.Context, f func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range) error) error {
+func (d *DHCPManager) ReleaseIP(ctx context.Context, ips ...net.IP) error {
+	return d.updateDHCPConfigMap(ctx, func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range, leases map[string]string) error {
+		return release(ipv4, ipv6, leases, ips...)
+	})
+}
+
+// ReleaseIPOwnedBy release ips only if all of them are leased to any of owners, ip without lease is never released
+func (d *DHCPManager) ReleaseIPOwnedBy(ctx context.Context, owners []string, ips ...net.IP) error {
+	return d.updateDHCPConfigMap(ctx, func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range, leases map[string]string) error {
+		for _, ip := range ips {
+			if o := leases[ip.String()]; o == "" || !sets.New[string](owners...).Has(o) {
+				return fmt.Errorf("ip %s is not leased to %v: %w", ip.String(), owners, errNotLeased)
+			}
+		}
+		return release(ipv4, ipv6, leases, ips...)
+	})
+}
+
+var errNotLeased = errors.New("ip is not leased")
+
+// ReleaseIPLeasedTo release ips one by one which are still leased to owner, skip others,
+// they may be released by gc loop of traffic manager, and rent by other client already
+func (d *DHCPManager) ReleaseIPLeasedTo(ctx context.Context, owner string, ips ...net.IP) error {
+	for _, ip := range ips {
+		err := d.ReleaseIPOwnedBy(ctx, []string{owner}, ip)
+		if errors.Is(err, errNotLeased) {
+			log.Debugf("ip %s is not leased to %s anymore, skip releasing it", ip.String(), owner)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func release(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range, leases map[string]string, ips ...net.IP) error {
+	for _, ip := range ips {
+		var use *ipallocator.Range
+		if ip.To4() != nil {
+			use = ipv4
+		} else {
+			use = ipv6
+		}
+		if err := use.Release(ip); err != nil {
+			return err
+		}
+		delete(leases, ip.String())
+	}
+	return nil
+}
+
+func (d *DHCPManager) updateDHCPConfigMap(ctx context.Context, f func(ipv4 *ipallocator.Range, ipv6 *ipallocator.Range, leases map[string]string) error) error {
 	cm, err := d.client.Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to get cm DHCP server, err: %v", err)
@@ -163,9 +257,21 @@ func (d *DHCPManager) updateDHCPConfigMap(ctx context.Context, f func(ipv4 *ipal
 			return err
 		}
 	}
-	if err = f(dhcp, dhcp6); err != nil {
+	var leases = make(map[string]string)
+	if str := cm.Data[config.KeyDHCPLease]; str != "" {
+		if err = json.Unmarshal([]byte(str), &leases); err != nil {
+			log.Warnf("failed to parse dhcp lease, ignore it, err: %v", err)
+			leases = make(map[string]string)
+		}
+	}
+	if err = f(dhcp, dhcp6, leases); err != nil {
+		return err
+	}
+	var leaseBytes []byte
+	if leaseBytes, err = json.Marshal(leases); err != nil {
 		return err
 	}
+	cm.Data[config.KeyDHCPLease] = string(leaseBytes)
 
 	for index, i := range []*ipallocator.Range{dhcp, dhcp6} {
 		var bytes []byte
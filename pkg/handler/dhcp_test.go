@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+)
+
+func newFakeDHCPManager() *DHCPManager {
+	clientset := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: config.ConfigMapPodTrafficManager, Namespace: "kubevpn"},
+	})
+	return NewDHCPManager(clientset.CoreV1().ConfigMaps("kubevpn"), "kubevpn")
+}
+
+func TestRentIPForOwner(t *testing.T) {
+	ctx := context.Background()
+	testDatas := []struct {
+		name string
+		// first rents for owners, then rents again for again
+		owners []string
+		again  []string
+		same   bool
+	}{
+		{name: "same owner holds one pair", owners: []string{"default/pod"}, again: []string{"default/pod"}, same: true},
+		{name: "alias of owner holds one pair", owners: []string{"default/pod"}, again: []string{"uid", "default/pod"}, same: true},
+		{name: "different owner", owners: []string{"default/pod"}, again: []string{"default/other"}, same: false},
+		{name: "no owner", owners: nil, again: nil, same: false},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			dhcp := newFakeDHCPManager()
+			v4, v6, err := dhcp.RentIPForOwner(ctx, data.owners...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v4Again, v6Again, err := dhcp.RentIPForOwner(ctx, data.again...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if same := v4.IP.Equal(v4Again.IP) && v6.IP.Equal(v6Again.IP); same != data.same {
+				t.Errorf("expect same: %v, first: %s %s, again: %s %s", data.same, v4, v6, v4Again, v6Again)
+			}
+		})
+	}
+}
+
+func TestReleaseIPOwnedBy(t *testing.T) {
+	ctx := context.Background()
+	testDatas := []struct {
+		name string
+		// ip is rented for rentOwners, and released by releaseOwners
+		rentOwners    []string
+		releaseOwners []string
+		expectErr     bool
+	}{
+		{name: "release by owner", rentOwners: []string{"default/pod"}, releaseOwners: []string{"uid", "default/pod"}},
+		{name: "release by uid", rentOwners: []string{"uid"}, releaseOwners: []string{"uid", "default/pod"}},
+		{name: "release by other pod", rentOwners: []string{"default/pod"}, releaseOwners: []string{"other-uid", "default/other"}, expectErr: true},
+		{name: "ip without lease", rentOwners: nil, releaseOwners: []string{"uid", "default/pod"}, expectErr: true},
+		{name: "empty owner", rentOwners: nil, releaseOwners: []string{""}, expectErr: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			dhcp := newFakeDHCPManager()
+			v4, v6, err := dhcp.RentIPForOwner(ctx, data.rentOwners...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = dhcp.ReleaseIPOwnedBy(ctx, data.releaseOwners, v4.IP, v6.IP)
+			if (err != nil) != data.expectErr {
+				t.Fatalf("expect error: %v, but got: %v", data.expectErr, err)
+			}
+			// ip is still in use if release is rejected, so next rent gets another ip
+			next, _, err := dhcp.RentIPRandom(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reused := next.IP.Equal(v4.IP); reused == data.expectErr {
+				t.Errorf("ip %s is released: %v, but expect: %v", v4.IP, reused, !data.expectErr)
+			}
+		})
+	}
+}
+
+func TestReleaseIPOwnedByPartial(t *testing.T) {
+	ctx := context.Background()
+	dhcp := newFakeDHCPManager()
+	v4, _, err := dhcp.RentIPForOwner(ctx, "default/pod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := dhcp.RentIPForOwner(ctx, "default/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one of ips is not owned, none of them is released
+	if err = dhcp.ReleaseIPOwnedBy(ctx, []string{"default/pod"}, v4.IP, other.IP); err == nil {
+		t.Fatalf("expect error when releasing ip %s of other pod", other.IP)
+	}
+	if err = dhcp.ReleaseIPOwnedBy(ctx, []string{"default/pod"}, v4.IP); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseIPLeasedTo(t *testing.T) {
+	ctx := context.Background()
+	dhcp := newFakeDHCPManager()
+	v4, v6, err := dhcp.RentIPForOwner(ctx, "kubevpn-client-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gc loop releases ip of client a, then client b rents the same ipv4
+	if err = dhcp.ReleaseIP(ctx, v4.IP); err != nil {
+		t.Fatal(err)
+	}
+	if err = dhcp.RentIP(ctx, "kubevpn-client-b", v4.IP); err != nil {
+		t.Fatal(err)
+	}
+	// recover of client a only releases ipv6 which is still leased to it
+	if err = dhcp.ReleaseIPLeasedTo(ctx, "kubevpn-client-a", v4.IP, v6.IP); err != nil {
+		t.Fatal(err)
+	}
+	if err = dhcp.ReleaseIPOwnedBy(ctx, []string{"kubevpn-client-b"}, v4.IP); err != nil {
+		t.Errorf("ip %s of client b is released, err: %v", v4.IP, err)
+	}
+	if err = dhcp.RentIP(ctx, "kubevpn-client-c", v6.IP); err != nil {
+		t.Errorf("ip %s is not released, err: %v", v6.IP, err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -40,11 +42,21 @@ import (
 )
 
 type DuplicateOptions struct {
-	Namespace   string
-	Headers     map[string]string
+	Namespace string
+	Headers   map[string]string
+	// Weight percentage of traffic to duplicate workloads, 0 means all
+	Weight      int
 	Workloads   []string
 	ExtraCIDR   []string
 	ExtraDomain []string
+	// ManagerNamespace is namespace of cluster-wide traffic manager
+	ManagerNamespace string
+	// NoPrivilegedProbe never create privileged pod for detecting cidr
+	NoPrivilegedProbe bool
+	// ClusterCIDR pod and service cidr supplied by user, skip detecting cidr
+	ClusterCIDR []string
+	// RefreshCIDR detect cidr again instead of using cached cidr
+	RefreshCIDR bool
 
 	TargetKubeconfig       string
 	TargetNamespace        string
@@ -181,8 +193,23 @@ func (d *DuplicateOptions) DoDuplicate(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		RollbackFuncList = append(RollbackFuncList, func() {
-			_ = client.Resource(object.Mapping.Resource).Namespace(d.TargetNamespace).Delete(context.Background(), u.GetName(), metav1.DeleteOptions{})
+		RollbackFuncList = append(RollbackFuncList, func() error {
+			err := client.Resource(object.Mapping.Resource).Namespace(d.TargetNamespace).Delete(context.Background(), u.GetName(), metav1.DeleteOptions{})
+			if k8serrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		})
+		var server string
+		if restConfig, errs := d.targetFactory.ToRESTConfig(); errs == nil {
+			server = restConfig.Host
+		}
+		recordJournal(JournalEntry{
+			Kind:      JournalDuplicate,
+			Namespace: d.TargetNamespace,
+			Resource:  fmt.Sprintf("%s.%s.%s", object.Mapping.Resource.Resource, object.Mapping.Resource.Version, object.Mapping.Resource.Group),
+			Name:      u.GetName(),
+			Server:    server,
 		})
 		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 			var volumesPath = append(path, "spec", "volumes")
@@ -265,15 +292,16 @@ func (d *DuplicateOptions) DoDuplicate(ctx context.Context) error {
 			container := &v1.Container{
 				Name:  config.ContainerSidecarVPN,
 				Image: config.Image,
-				Command: []string{
+				Command: append([]string{
 					"kubevpn",
 					"proxy",
 					workload,
 					"--kubeconfig", "/tmp/.kube/" + config.KUBECONFIG,
 					"--namespace", d.Namespace,
-					"--headers", labels.Set(d.Headers).String(),
+					"--weight", strconv.Itoa(d.Weight),
 					"--image", config.Image,
-				},
+					"--manager-namespace", d.ManagerNamespace,
+				}, headerArgs(d.Headers)...),
 				Args: nil,
 				Resources: v1.ResourceRequirements{
 					Requests: map[v1.ResourceName]resource.Quantity{
@@ -702,3 +730,17 @@ func (d *DuplicateOptions) replaceRegistry(u *unstructured.Unstructured) error {
 
 	return nil
 }
+
+// headerArgs repeats --headers for each header, value may contain ',', sorted so pod template is stable
+func headerArgs(headers map[string]string) []string {
+	var keys []string
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var args []string
+	for _, k := range keys {
+		args = append(args, "--headers", k+"="+headers[k])
+	}
+	return args
+}
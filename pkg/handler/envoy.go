@@ -51,9 +51,13 @@ func InjectVPNAndEnvoySidecar(ctx1 context.Context, factory cmdutil.Factory, cli
 	for _, container := range templateSpec.Spec.Containers {
 		port = append(port, container.Ports...)
 	}
-	nodeID := fmt.Sprintf("%s.%s", object.Mapping.Resource.GroupResource().String(), object.Name)
+	nodeID := envoyNodeID(object, c.TrafficManagerNamespace)
 
-	err = addEnvoyConfig(clientset, nodeID, c, headers, port)
+	var virtualNamespace string
+	if c.TrafficManagerNamespace != "" {
+		virtualNamespace = namespace
+	}
+	err = addEnvoyConfig(clientset, virtualNamespace, nodeID, c, headers, port)
 	if err != nil {
 		log.Warnln(err)
 		return err
@@ -66,11 +70,9 @@ func InjectVPNAndEnvoySidecar(ctx1 context.Context, factory cmdutil.Factory, cli
 	}
 	if containerNames.HasAll(config.ContainerSidecarVPN, config.ContainerSidecarEnvoyProxy) {
 		// add rollback func to remove envoy config
-		RollbackFuncList = append(RollbackFuncList, func() {
-			err := UnPatchContainer(factory, clientset, namespace, workloads, headers)
-			if err != nil {
-				log.Error(err)
-			}
+		recordJournal(JournalEntry{Kind: JournalMesh, Namespace: namespace, Workload: workloads, Headers: headers})
+		RollbackFuncList = append(RollbackFuncList, func() error {
+			return UnPatchContainer(factory, clientset, namespace, workloads, c.TrafficManagerNamespace, headers)
 		})
 		return nil
 	}
@@ -107,10 +109,9 @@ func InjectVPNAndEnvoySidecar(ctx1 context.Context, factory cmdutil.Factory, cli
 		return err
 	}
 
-	RollbackFuncList = append(RollbackFuncList, func() {
-		if err := UnPatchContainer(factory, clientset, namespace, workloads, headers); err != nil {
-			log.Error(err)
-		}
+	recordJournal(JournalEntry{Kind: JournalMesh, Namespace: namespace, Workload: workloads, Headers: headers})
+	RollbackFuncList = append(RollbackFuncList, func() error {
+		return UnPatchContainer(factory, clientset, namespace, workloads, c.TrafficManagerNamespace, headers)
 	})
 	if err != nil {
 		return err
@@ -119,7 +120,7 @@ func InjectVPNAndEnvoySidecar(ctx1 context.Context, factory cmdutil.Factory, cli
 	return err
 }
 
-func UnPatchContainer(factory cmdutil.Factory, mapInterface v12.ConfigMapInterface, namespace, workloads string, headers map[string]string) error {
+func UnPatchContainer(factory cmdutil.Factory, mapInterface v12.ConfigMapInterface, namespace, workloads, trafficManagerNamespace string, headers map[string]string) error {
 	object, err := util.GetUnstructuredObject(factory, namespace, workloads)
 	if err != nil {
 		return err
@@ -131,7 +132,7 @@ func UnPatchContainer(factory cmdutil.Factory, mapInterface v12.ConfigMapInterfa
 		return err
 	}
 
-	nodeID := fmt.Sprintf("%s.%s", object.Mapping.Resource.GroupResource().String(), object.Name)
+	nodeID := envoyNodeID(object, trafficManagerNamespace)
 
 	var empty bool
 	empty, err = removeEnvoyConfig(mapInterface, nodeID, headers)
@@ -168,7 +169,7 @@ func UnPatchContainer(factory cmdutil.Factory, mapInterface v12.ConfigMapInterfa
 	return err
 }
 
-func addEnvoyConfig(mapInterface v12.ConfigMapInterface, nodeID string, tunIP util.PodRouteConfig, headers map[string]string, port []v1.ContainerPort) error {
+func addEnvoyConfig(mapInterface v12.ConfigMapInterface, namespace, nodeID string, tunIP util.PodRouteConfig, headers map[string]string, port []v1.ContainerPort) error {
 	configMap, err := mapInterface.Get(context.Background(), config.ConfigMapPodTrafficManager, metav1.GetOptions{})
 	if err != nil {
 		return err
@@ -188,19 +189,32 @@ func addEnvoyConfig(mapInterface v12.ConfigMapInterface, nodeID string, tunIP ut
 	}
 	if index < 0 {
 		v = append(v, &controlplane.Virtual{
-			Uid:   nodeID,
-			Ports: port,
+			Uid:       nodeID,
+			Namespace: namespace,
+			Ports:     port,
 			Rules: []*controlplane.Rule{{
-				Headers:      headers,
-				LocalTunIPv4: tunIP.LocalTunIPv4,
-				LocalTunIPv6: tunIP.LocalTunIPv6,
+				Headers:         headers,
+				LocalTunIPv4:    tunIP.LocalTunIPv4,
+				LocalTunIPv6:    tunIP.LocalTunIPv6,
+				Weight:          uint32(tunIP.Weight),
+				Mirror:          tunIP.Mirror,
+				MirrorPercent:   uint32(tunIP.MirrorPercent),
+				HealthCheckPath: tunIP.HealthCheckPath,
+				Fault:           tunIP.Fault,
+				DirectResponses: tunIP.DirectResponses,
 			}},
 		})
 	} else {
 		v[index].Rules = append(v[index].Rules, &controlplane.Rule{
-			Headers:      headers,
-			LocalTunIPv4: tunIP.LocalTunIPv4,
-			LocalTunIPv6: tunIP.LocalTunIPv6,
+			Headers:         headers,
+			LocalTunIPv4:    tunIP.LocalTunIPv4,
+			LocalTunIPv6:    tunIP.LocalTunIPv6,
+			Weight:          uint32(tunIP.Weight),
+			Mirror:          tunIP.Mirror,
+			MirrorPercent:   uint32(tunIP.MirrorPercent),
+			HealthCheckPath: tunIP.HealthCheckPath,
+			Fault:           tunIP.Fault,
+			DirectResponses: tunIP.DirectResponses,
 		})
 		if v[index].Ports == nil {
 			v[index].Ports = port
@@ -261,6 +275,16 @@ func removeEnvoyConfig(mapInterface v12.ConfigMapInterface, nodeID string, heade
 	return empty, err
 }
 
+// envoyNodeID group.resource.name, cluster-wide traffic manager stores envoy config of all namespaces together,
+// so prefix it with namespace, namespace.group.resource.name
+func envoyNodeID(object *runtimeresource.Info, trafficManagerNamespace string) string {
+	nodeID := fmt.Sprintf("%s.%s", object.Mapping.Resource.GroupResource().String(), object.Name)
+	if trafficManagerNamespace != "" {
+		nodeID = fmt.Sprintf("%s.%s", object.Namespace, nodeID)
+	}
+	return nodeID
+}
+
 func contains(a map[string]string, sub map[string]string) bool {
 	for k, v := range sub {
 		if a[k] != v {
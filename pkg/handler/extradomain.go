@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	netroute "github.com/libp2p/go-netroute"
+	miekgdns "github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/wencaiwulue/kubevpn/pkg/dns"
+	"github.com/wencaiwulue/kubevpn/pkg/tun"
+)
+
+const (
+	// re-resolve extra domain after ttl of records, but not too often or too late
+	minResolveInterval = 5 * time.Second
+	maxResolveInterval = 5 * time.Minute
+)
+
+// extraDomains current ips of --extra-domain, and ips which routes are added by kubevpn
+type extraDomains struct {
+	lock   sync.Mutex
+	ips    map[string][]net.IP
+	routed sets.Set[string]
+}
+
+// addExtraRoute resolves --extra-domain by cluster dns and adds routes of them through tun,
+// then keeps re-resolving them following ttl of records, cloud endpoints like RDS rotate ip after failover
+func (c *ConnectOptions) addExtraRoute(ctx context.Context) (err error) {
+	if len(c.ExtraDomain) == 0 {
+		return
+	}
+	var ips []string
+	ips, err = dns.GetDNSIPFromDnsPod(c.clientset)
+	if err != nil {
+		return
+	}
+	if len(ips) == 0 {
+		err = fmt.Errorf("can't found any dns server")
+		return
+	}
+	server := net.JoinHostPort(ips[0], "53")
+	for _, domain := range c.ExtraDomain {
+		var ttl time.Duration
+		err = retry.OnError(
+			retry.DefaultRetry,
+			func(err error) bool {
+				return err != nil
+			},
+			func() error {
+				var result []net.IP
+				result, ttl, err = resolveDomain(ctx, server, domain)
+				if err != nil {
+					return err
+				}
+				c.updateExtraDomain(domain, result)
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+		go c.watchExtraDomain(ctx, server, domain, ttl)
+	}
+	return
+}
+
+// watchExtraDomain re-resolves domain once ttl expires, keeps old routes if failed
+func (c *ConnectOptions) watchExtraDomain(ctx context.Context, server, domain string, ttl time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ttl):
+		}
+		ips, next, err := resolveDomain(ctx, server, domain)
+		// dns server may return empty answer when it is broken, keep old routes
+		if err == nil && len(ips) == 0 && c.extraDomains.resolved(domain) {
+			err = fmt.Errorf("empty answer")
+		}
+		if err != nil {
+			log.Debugf("[route] failed to resolve domain %s, retry after %s, err: %v", domain, minResolveInterval, err)
+			ttl = minResolveInterval
+			continue
+		}
+		c.updateExtraDomain(domain, ips)
+		ttl = next
+	}
+}
+
+// updateRuleDomain answer of dns rule with route, answer of A and AAAA comes separately,
+// so only replaces ips of same family
+func (c *ConnectOptions) updateRuleDomain(domain string, qtype uint16, ips ...net.IP) {
+	e := c.extraDomains
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var result = append([]net.IP{}, ips...)
+	for _, ip := range e.ips[domain] {
+		if (ip.To4() != nil) != (qtype == miekgdns.TypeA) {
+			result = append(result, ip)
+		}
+	}
+	c.updateExtraDomainLocked(domain, result)
+}
+
+// updateExtraDomain adds routes of ips which are not routed yet, route failed to add last time is retried,
+// and deletes routes of ips which no domain resolves to anymore
+func (c *ConnectOptions) updateExtraDomain(domain string, ips []net.IP) {
+	e := c.extraDomains
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	c.updateExtraDomainLocked(domain, ips)
+}
+
+func (c *ConnectOptions) updateExtraDomainLocked(domain string, ips []net.IP) {
+	e := c.extraDomains
+	e.ips[domain] = ips
+	after := e.all()
+
+	var toAdd, toDelete []net.IP
+	for _, ip := range ips {
+		if !e.routed.Has(ip.String()) {
+			toAdd = append(toAdd, ip)
+		}
+	}
+	for _, ip := range sets.List(e.routed.Difference(after)) {
+		toDelete = append(toDelete, net.ParseIP(ip))
+	}
+	added := c.addRoutes(domain, toAdd...)
+	for _, ip := range added {
+		e.routed.Insert(ip.String())
+	}
+	deleted := c.deleteRoutes(domain, toDelete...)
+	for _, ip := range deleted {
+		e.routed.Delete(ip.String())
+	}
+	if len(added) != 0 || len(deleted) != 0 {
+		log.Infof("[route] domain %s resolves to %v, added: %v, deleted: %v", domain, ips, added, deleted)
+	}
+	var result = make([]string, 0, len(ips))
+	for _, ip := range ips {
+		result = append(result, ip.String())
+	}
+	sort.Strings(result)
+	recordExtraDomain(domain, result)
+}
+
+// deleteExtraRoutes deletes routes added for extra domains and dns rules
+func (c *ConnectOptions) deleteExtraRoutes() error {
+	e := c.extraDomains
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var ips []net.IP
+	for _, ip := range sets.List(e.routed) {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	for _, ip := range c.deleteRoutes("", ips...) {
+		e.routed.Delete(ip.String())
+	}
+	// routes are bound to tun device, operation system removes them with tun device anyway
+	return nil
+}
+
+// resolved domain resolves to any ip last time
+func (e *extraDomains) resolved(domain string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.ips[domain]) != 0
+}
+
+func (e *extraDomains) all() sets.Set[string] {
+	var result = sets.New[string]()
+	for _, ips := range e.ips {
+		for _, ip := range ips {
+			result.Insert(ip.String())
+		}
+	}
+	return result
+}
+
+// resolveDomain resolves A and AAAA records of domain, returns min ttl of them
+func resolveDomain(ctx context.Context, server, domain string) ([]net.IP, time.Duration, error) {
+	client := &miekgdns.Client{Net: "udp", SingleInflight: true, DialTimeout: time.Second * 30}
+	var ips []net.IP
+	var ttl = maxResolveInterval
+	for _, qType := range []uint16{miekgdns.TypeA, miekgdns.TypeAAAA} {
+		msg := new(miekgdns.Msg)
+		msg.SetQuestion(miekgdns.Fqdn(domain), qType)
+		answer, _, err := client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			return nil, 0, err
+		}
+		// eg: SERVFAIL or NXDOMAIN, keep old routes
+		if answer.Rcode != miekgdns.RcodeSuccess {
+			return nil, 0, fmt.Errorf("resolve %s %s failed, rcode: %s", domain, miekgdns.TypeToString[qType], miekgdns.RcodeToString[answer.Rcode])
+		}
+		for _, rr := range answer.Answer {
+			switch a := rr.(type) {
+			case *miekgdns.A:
+				ips = append(ips, a.A)
+			case *miekgdns.AAAA:
+				ips = append(ips, a.AAAA)
+			default:
+				continue
+			}
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	if ttl < minResolveInterval {
+		ttl = minResolveInterval
+	}
+	return ips, ttl, nil
+}
+
+// addRoutes adds route of ips which resolved from domain through tun, if it is not routed by tun yet,
+// returns ips which routes are added
+func (c *ConnectOptions) addRoutes(domain string, ips ...net.IP) (added []net.IP) {
+	if len(ips) == 0 {
+		return
+	}
+	r, err := netroute.New()
+	if err != nil {
+		log.Debugf("[route] failed to get route table, err: %v", err)
+		return
+	}
+	tunIface, err := tun.GetInterface()
+	if err != nil {
+		log.Debugf("[route] failed to get tun interface, err: %v", err)
+		return
+	}
+	for _, ip := range ips {
+		// if route is right, not need add route
+		iface, _, _, errs := r.Route(ip)
+		if errs == nil && tunIface.Name == iface.Name {
+			continue
+		}
+		errs = tun.AddRoutes(types.Route{Dst: hostIPNet(ip)})
+		if errs != nil {
+			log.Debugf("[route] add route failed, domain: %s, ip: %s, err: %v", domain, ip, errs)
+			continue
+		}
+		added = append(added, ip)
+	}
+	return
+}
+
+// deleteRoutes deletes route of ips through tun, returns ips which routes are deleted
+func (c *ConnectOptions) deleteRoutes(domain string, ips ...net.IP) (deleted []net.IP) {
+	for _, ip := range ips {
+		if err := tun.DeleteRoutes(types.Route{Dst: hostIPNet(ip)}); err != nil {
+			log.Debugf("[route] delete route failed, domain: %s, ip: %s, err: %v", domain, ip, err)
+			continue
+		}
+		deleted = append(deleted, ip)
+	}
+	return
+}
+
+func hostIPNet(ip net.IP) net.IPNet {
+	if ip.To4() != nil {
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -37,6 +37,7 @@ var (
 )
 
 func TestFunctions(t *testing.T) {
+	initClient(t)
 	kubevpnConnect(t)
 	t.Run(runtime.FuncForPC(reflect.ValueOf(pingPodIP).Pointer()).Name(), pingPodIP)
 	t.Run(runtime.FuncForPC(reflect.ValueOf(dialUDP).Pointer()).Name(), dialUDP)
@@ -280,7 +281,8 @@ func kubevpnConnect(t *testing.T) {
 	<-ctx.Done()
 }
 
-func init() {
+// initClient needs kubeconfig of a cluster, only tests against cluster call it, so other tests of package run without cluster
+func initClient(t *testing.T) {
 	var err error
 
 	configFlags := genericclioptions.NewConfigFlags(true)
@@ -288,16 +290,16 @@ func init() {
 	f := cmdutil.NewFactory(cmdutil.NewMatchVersionFlags(configFlags))
 
 	if c, err = f.ToRESTConfig(); err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 	if restclient, err = rest.RESTClientFor(c); err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 	if clientset, err = kubernetes.NewForConfig(c); err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 	if namespace, _, err = f.ToRawKubeConfigLoader().Namespace(); err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 }
 
@@ -0,0 +1,385 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	goversion "github.com/hashicorp/go-version"
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"sigs.k8s.io/yaml"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+// placeholders which will be replaced by helm template
+const (
+	namespacePlaceholder = "kubevpn-namespace-placeholder"
+	imagePlaceholder     = "kubevpn-image-placeholder"
+	crtPlaceholder       = "kubevpn-tls-crt-placeholder"
+	keyPlaceholder       = "kubevpn-tls-key-placeholder"
+	caCrtPlaceholder     = "kubevpn-ca-crt-placeholder"
+	caKeyPlaceholder     = "kubevpn-ca-key-placeholder"
+
+	// placeholders of workload config, see helmDeployment
+	replicasPlaceholder          = "kubevpn-replicas-placeholder"
+	resourcesPlaceholder         = "kubevpn-resources-placeholder"
+	nodeSelectorPlaceholder      = "kubevpn-node-selector-placeholder"
+	tolerationsPlaceholder       = "kubevpn-tolerations-placeholder"
+	affinityPlaceholder          = "kubevpn-affinity-placeholder"
+	priorityClassNamePlaceholder = "kubevpn-priority-class-name-placeholder"
+	annotationsPlaceholder       = "kubevpn-annotations-placeholder"
+	imagePullSecretsPlaceholder  = "kubevpn-image-pull-secrets-placeholder"
+	idleTimeoutPlaceholder       = "kubevpn-idle-timeout-placeholder"
+	clusterWidePlaceholder       = "kubevpn-cluster-wide-placeholder"
+	workloadPlaceholder          = "kubevpn-workload-placeholder"
+)
+
+// InstallTrafficManager pre-install traffic manager in namespace, it is marked as pre-installed,
+// so connect only reuse it and never delete it, user who connect needs no permission to create it.
+// if cluster-wide, label namespaces which use it, so user who connect needs no permission to patch namespace
+func InstallTrafficManager(ctx context.Context, factory cmdutil.Factory, clientset *kubernetes.Clientset, namespace string, clusterWide bool, namespaces []string, workload *util.WorkloadConfig) error {
+	certs, err := util.GenCertBundle(namespace)
+	if err != nil {
+		return err
+	}
+	manager := GenTrafficManager(namespace, config.Image, clusterWide, true, workload, certs)
+
+	ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		ns, err = clientset.CoreV1().Namespaces().Create(ctx, manager.Namespace, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	if ns.Labels["ns"] != namespace {
+		if ns.Labels == nil {
+			ns.Labels = map[string]string{}
+		}
+		ns.Labels["ns"] = namespace
+		if _, err = clientset.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	var create = []func() error{
+		func() error {
+			_, err := clientset.CoreV1().ServiceAccounts(namespace).Create(ctx, manager.ServiceAccount, metav1.CreateOptions{})
+			return err
+		},
+		func() error {
+			_, err := clientset.RbacV1().Roles(namespace).Create(ctx, manager.Role, metav1.CreateOptions{})
+			return err
+		},
+		func() error {
+			_, err := clientset.RbacV1().RoleBindings(namespace).Create(ctx, manager.RoleBinding, metav1.CreateOptions{})
+			return err
+		},
+		func() error {
+			_, err := clientset.RbacV1().ClusterRoles().Create(ctx, manager.ClusterRole, metav1.CreateOptions{})
+			return err
+		},
+		func() error {
+			_, err := clientset.RbacV1().ClusterRoleBindings().Create(ctx, manager.ClusterRoleBinding, metav1.CreateOptions{})
+			return err
+		},
+		func() error {
+			_, err := clientset.CoreV1().Services(namespace).Create(ctx, manager.Service, metav1.CreateOptions{})
+			return err
+		},
+		func() error {
+			_, err := clientset.CoreV1().Secrets(namespace).Create(ctx, manager.Secret, metav1.CreateOptions{})
+			return err
+		},
+		func() error {
+			_, err := clientset.CoreV1().ConfigMaps(namespace).Create(ctx, manager.ConfigMap, metav1.CreateOptions{})
+			return err
+		},
+		func() error {
+			_, err := clientset.AppsV1().Deployments(namespace).Create(ctx, manager.Deployment, metav1.CreateOptions{})
+			return err
+		},
+		func() error {
+			_, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Create(ctx, manager.Webhook, metav1.CreateOptions{})
+			return err
+		},
+	}
+	for _, f := range create {
+		if err = f(); err != nil && !k8serrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	if clusterWide {
+		if err = LabelNamespaces(ctx, clientset, namespace, namespaces...); err != nil {
+			return err
+		}
+	}
+	log.Infof("waiting traffic manager in namespace %s to be ready...", namespace)
+	return util.RolloutStatus(ctx, factory, namespace, fmt.Sprintf("deployments/%s", config.ConfigMapPodTrafficManager), time.Minute*60)
+}
+
+// LabelNamespaces label namespaces with config.LabelTrafficManager, let webhook of cluster-wide traffic manager select them
+func LabelNamespaces(ctx context.Context, clientset kubernetes.Interface, managerNamespace string, namespaces ...string) error {
+	for _, namespace := range namespaces {
+		ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if ns.Labels[config.LabelTrafficManager] == managerNamespace {
+			continue
+		}
+		p := []byte(fmt.Sprintf(`{"metadata":{"labels":{"%s":"%s"}}}`, config.LabelTrafficManager, managerNamespace))
+		if _, err = clientset.CoreV1().Namespaces().Patch(ctx, namespace, types.MergePatchType, p, metav1.PatchOptions{}); err != nil {
+			return err
+		}
+		log.Infof("label namespace %s with %s=%s", namespace, config.LabelTrafficManager, managerNamespace)
+	}
+	return nil
+}
+
+// GenHelmChart generate helm chart into dir from same resources which `kubevpn install` creates
+func GenHelmChart(dir string) error {
+	certs := &util.CertBundle{
+		CACrt: []byte(caCrtPlaceholder),
+		CAKey: []byte(caKeyPlaceholder),
+		Crt:   []byte(crtPlaceholder),
+		Key:   []byte(keyPlaceholder),
+	}
+	manager := GenTrafficManager(namespacePlaceholder, imagePlaceholder, false, true, nil, certs)
+	clusterWideWebhook := GenTrafficManager(namespacePlaceholder, imagePlaceholder, true, true, nil, certs).Webhook
+
+	var buf bytes.Buffer
+	// keep CA of installed secret on upgrade, otherwise every rendering generates a new CA,
+	// and sidecars which trust old CA can not connect to control-plane
+	buf.WriteString(`{{- $secret := (lookup "v1" "Secret" .Release.Namespace "` + config.ConfigMapPodTrafficManager + `").data | default dict }}
+{{- $ca := dict }}
+{{- if .Values.tls.caCrt }}
+{{- $ca = buildCustomCert (.Values.tls.caCrt | b64enc) (required "tls.caKey is required if tls.caCrt is set" .Values.tls.caKey | b64enc) }}
+{{- else if and (hasKey $secret "` + config.TLSCACertKey + `") (hasKey $secret "` + config.TLSCAKeyKey + `") }}
+{{- $ca = buildCustomCert (get $secret "` + config.TLSCACertKey + `") (get $secret "` + config.TLSCAKeyKey + `") }}
+{{- else }}
+{{- $ca = genCA "` + config.ConfigMapPodTrafficManager + `-ca" 3650 }}
+{{- end }}
+{{- $domain := printf "` + util.GetTlsDomain("%s") + `" .Release.Namespace }}
+{{- $cert := genSignedCert $domain nil (list "` + config.ConfigMapPodTrafficManager + `" (printf "` + config.ConfigMapPodTrafficManager + `.%s" .Release.Namespace) $domain) ` + fmt.Sprint(int(config.ServerCertValidity.Hours()/24)) + ` $ca }}
+`)
+	for _, object := range manager.Objects() {
+		switch o := object.(type) {
+		// namespace need to be labeled by user, helm can not manage release namespace
+		case *v1.Namespace:
+			continue
+		// webhook is different if cluster-wide, it is written below
+		case *admissionv1.MutatingWebhookConfiguration:
+			continue
+		case *appsv1.Deployment:
+			deployment, err := helmDeployment(o)
+			if err != nil {
+				return err
+			}
+			object = deployment
+		}
+		if err := writeYAML(&buf, object); err != nil {
+			return err
+		}
+	}
+	// clients which connect read scheduling and resources of sidecars, replicas of traffic manager from it
+	if err := writeYAML(&buf, &v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      config.ConfigMapWorkload,
+			Namespace: namespacePlaceholder,
+		},
+		Data: map[string]string{config.KeyWorkload: workloadPlaceholder},
+	}); err != nil {
+		return err
+	}
+	buf.WriteString("{{- if .Values.clusterWide }}\n")
+	if err := writeYAML(&buf, clusterWideWebhook); err != nil {
+		return err
+	}
+	buf.WriteString("{{- else }}\n")
+	if err := writeYAML(&buf, manager.Webhook); err != nil {
+		return err
+	}
+	buf.WriteString("{{- end }}\n")
+
+	template := strings.NewReplacer(
+		namespacePlaceholder, "{{ .Release.Namespace }}",
+		imagePlaceholder, "{{ .Values.image }}",
+		base64.StdEncoding.EncodeToString([]byte(crtPlaceholder)), "{{ $cert.Cert | b64enc }}",
+		base64.StdEncoding.EncodeToString([]byte(keyPlaceholder)), "{{ $cert.Key | b64enc }}",
+		base64.StdEncoding.EncodeToString([]byte(caCrtPlaceholder)), "{{ $ca.Cert | b64enc }}",
+		base64.StdEncoding.EncodeToString([]byte(caKeyPlaceholder)), "{{ $ca.Key | b64enc }}",
+		// json is also yaml, no need to care about indent
+		replicasPlaceholder, "{{ .Values.workload.replicas }}",
+		resourcesPlaceholder, "{{ toJson .Values.workload.resources }}",
+		nodeSelectorPlaceholder, "{{ toJson .Values.workload.nodeSelector }}",
+		tolerationsPlaceholder, "{{ toJson .Values.workload.tolerations }}",
+		affinityPlaceholder, "{{ toJson .Values.workload.affinity }}",
+		priorityClassNamePlaceholder, "{{ .Values.workload.priorityClassName | quote }}",
+		annotationsPlaceholder, "{{ toJson .Values.workload.annotations }}",
+		imagePullSecretsPlaceholder, "{{ toJson .Values.workload.imagePullSecrets }}",
+		idleTimeoutPlaceholder, "{{ .Values.workload.idleTimeout | quote }}",
+		clusterWidePlaceholder, "{{ .Values.clusterWide | quote }}",
+		workloadPlaceholder, "{{ toJson .Values.workload | quote }}",
+	).Replace(buf.String())
+
+	// defaults of traffic manager, user overrides part of them, helm merges values
+	defaults := manager.Deployment.Spec.Template.Spec
+	resources, err := yaml.Marshal(defaults.Containers[0].Resources)
+	if err != nil {
+		return err
+	}
+
+	version := "0.0.0"
+	if v, err := goversion.NewVersion(config.Version); err == nil {
+		version = v.String()
+	}
+	files := map[string]string{
+		"Chart.yaml": fmt.Sprintf(`apiVersion: v2
+name: kubevpn
+description: traffic manager of KubeVPN, generated by "kubevpn install --chart-dir", DO NOT EDIT
+type: application
+version: %s
+appVersion: %q
+`, version, config.Version),
+		"values.yaml": fmt.Sprintf(`# image of traffic manager
+image: %s
+# if true, namespace labeled with %s=<release namespace> can use this traffic manager,
+# connect with --manager-namespace <release namespace>
+clusterWide: false
+# internal CA of traffic manager, it signs cert of webhook, control-plane and envoy sidecars,
+# if empty, reuse CA of installed secret, or generate one on first install, cert of webhook and control-plane is rotated by traffic manager.
+# lookup is not available in "helm template" and "--dry-run", set them for these cases, or CA changes on every rendering
+tls:
+  caCrt: ""
+  caKey: ""
+# scheduling and resources of traffic manager and injected sidecars, it is also saved to configmap %s,
+# clients which connect read sidecarResources, imagePullSecrets and replicas from it
+workload:
+  # replicas of traffic manager, traffic manager scales back to it after scaled down to zero because of idle
+  replicas: %d
+  # traffic manager scales down to zero after no client for this duration, 0s means never
+  idleTimeout: %s
+  # resources of traffic manager containers
+  resources:
+%s  # resources of containers injected into workloads
+  sidecarResources: {}
+  nodeSelector: {}
+  tolerations: []
+  affinity: {}
+  priorityClassName: %s
+  # annotations of traffic manager pod
+  annotations: {}
+  # used by both traffic manager and sidecars
+  imagePullSecrets: []
+`, config.Image, config.LabelTrafficManager, config.ConfigMapWorkload, *manager.Deployment.Spec.Replicas,
+			(*util.WorkloadConfig)(nil).IdleTimeoutOrDefault(), indent(string(resources), "    "), defaults.PriorityClassName),
+		filepath.Join("templates", "traffic-manager.yaml"): template,
+		filepath.Join("templates", "NOTES.txt"): `Traffic manager is pre-installed in namespace {{ .Release.Namespace }}, label the namespace before connecting:
+
+  kubectl label namespace {{ .Release.Namespace }} ns={{ .Release.Namespace }}
+{{- if .Values.clusterWide }}
+
+Label every namespace which uses it, users who connect need no permission to patch namespace:
+
+  kubectl label namespace <namespace> ` + config.LabelTrafficManager + `={{ .Release.Namespace }}
+{{- end }}
+`,
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helmDeployment replace workload fields and cluster-wide of deployment with placeholders, they are rendered from values
+func helmDeployment(deployment *appsv1.Deployment) (*unstructured.Unstructured, error) {
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deployment)
+	if err != nil {
+		return nil, err
+	}
+	fields := []struct {
+		value interface{}
+		path  []string
+	}{
+		{replicasPlaceholder, []string{"spec", "replicas"}},
+		{nodeSelectorPlaceholder, []string{"spec", "template", "spec", "nodeSelector"}},
+		{tolerationsPlaceholder, []string{"spec", "template", "spec", "tolerations"}},
+		{affinityPlaceholder, []string{"spec", "template", "spec", "affinity"}},
+		{priorityClassNamePlaceholder, []string{"spec", "template", "spec", "priorityClassName"}},
+		{annotationsPlaceholder, []string{"spec", "template", "metadata", "annotations"}},
+		{imagePullSecretsPlaceholder, []string{"spec", "template", "spec", "imagePullSecrets"}},
+	}
+	for _, field := range fields {
+		if err = unstructured.SetNestedField(object, field.value, field.path...); err != nil {
+			return nil, err
+		}
+	}
+	containers, _, err := unstructured.NestedSlice(object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		container := c.(map[string]interface{})
+		container["resources"] = resourcesPlaceholder
+		env, _, _ := unstructured.NestedSlice(container, "env")
+		for _, e := range env {
+			switch envVar := e.(map[string]interface{}); envVar["name"] {
+			case config.EnvIdleTimeout:
+				envVar["value"] = idleTimeoutPlaceholder
+			case config.EnvClusterWide:
+				envVar["value"] = clusterWidePlaceholder
+			}
+		}
+		if err = unstructured.SetNestedSlice(container, env, "env"); err != nil {
+			return nil, err
+		}
+	}
+	if err = unstructured.SetNestedSlice(object, containers, "spec", "template", "spec", "containers"); err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+func indent(s, prefix string) string {
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line != "" {
+			buf.WriteString(prefix + line)
+		}
+	}
+	return buf.String()
+}
+
+func writeYAML(buf *bytes.Buffer, object runtime.Object) error {
+	data, err := yaml.Marshal(object)
+	if err != nil {
+		return err
+	}
+	buf.WriteString("---\n")
+	buf.Write(data)
+	return nil
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+func TestGenHelmChart(t *testing.T) {
+	dir := t.TempDir()
+	if err := GenHelmChart(dir); err != nil {
+		t.Fatal(err)
+	}
+	template, err := os.ReadFile(filepath.Join(dir, "templates", "traffic-manager.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(template), "placeholder") {
+		t.Fatalf("placeholder is not replaced:\n%s", template)
+	}
+	if strings.Contains(string(template), "kind: Namespace") {
+		t.Fatal("release namespace should not be managed by chart")
+	}
+	for _, s := range []string{"kind: ServiceAccount", "kind: Deployment", "kind: MutatingWebhookConfiguration", "{{ .Values.workload.replicas }}"} {
+		if !strings.Contains(string(template), s) {
+			t.Fatalf("template should contain %s", s)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "values.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values struct {
+		Workload interface{} `json:"workload"`
+	}
+	if err = yaml.Unmarshal(data, &values); err != nil {
+		t.Fatal(err)
+	}
+	// same as configmap which clients read
+	data, err = yaml.Marshal(values.Workload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var workload util.WorkloadConfig
+	if err = yaml.UnmarshalStrict(data, &workload); err != nil {
+		t.Fatal(err)
+	}
+	if workload.ReplicasOrDefault() != 1 || workload.Resources == nil || workload.PriorityClassName == "" {
+		t.Fatalf("unexpected default workload: %+v", workload)
+	}
+}
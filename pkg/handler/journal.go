@@ -0,0 +1,459 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	pkgresource "k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/kubernetes"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/dns"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+// kinds of journal entry
+const (
+	// JournalLease lease of client is created in namespace of traffic manager
+	JournalLease = "lease"
+	// JournalDHCP ip is rent from dhcp
+	JournalDHCP = "dhcp"
+	// JournalExchange vpn sidecar is injected into workload
+	JournalExchange = "exchange"
+	// JournalMesh vpn and envoy-proxy sidecar is injected into workload, and envoy rule is added
+	JournalMesh = "mesh"
+	// JournalDuplicate object is duplicated
+	JournalDuplicate = "duplicate"
+	// JournalRoute routes is added to tun device
+	JournalRoute = "route"
+	// JournalDNS dns config and hosts is modified
+	JournalDNS = "dns"
+	// JournalFirewall firewall rule is added
+	JournalFirewall = "firewall"
+)
+
+// JournalEntry is one mutation made by kubevpn
+type JournalEntry struct {
+	Kind      string            `json:"kind"`
+	Namespace string            `json:"namespace,omitempty"`
+	Workload  string            `json:"workload,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	IPs       []string          `json:"ips,omitempty"`
+	// Resource and Name of duplicated object, Server is api-server of cluster which object is duplicated into
+	Resource string `json:"resource,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Server   string `json:"server,omitempty"`
+	// Origin is original pod of workload without controller, or restore patch of controller
+	Origin json.RawMessage `json:"origin,omitempty"`
+	// Tun is name or luid of tun device
+	Tun string `json:"tun,omitempty"`
+	// Owner of dhcp lease, ips are released only if they are still leased to it
+	Owner string `json:"owner,omitempty"`
+}
+
+// Journal record every mutation, persisted on disk and in configmap of traffic manager,
+// if process is killed by SIGKILL or machine is down, `kubevpn recover` can replay it to rollback
+type Journal struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	PID      int    `json:"pid"`
+	// Server is api-server of cluster
+	Server           string         `json:"server"`
+	ManagerNamespace string         `json:"managerNamespace"`
+	ClusterWide      bool           `json:"clusterWide,omitempty"`
+	CreateTime       time.Time      `json:"createTime"`
+	Entries          []JournalEntry `json:"entries"`
+	// ExtraDomains current ips of --extra-domain which routes through tun, not a mutation, only for status
+	ExtraDomains map[string][]string `json:"extraDomains,omitempty"`
+
+	lock      sync.Mutex
+	clientset *kubernetes.Clientset
+}
+
+var journal *Journal
+
+func journalFilename(id string) string {
+	return filepath.Join(config.GetJournalDir(), id+".json")
+}
+
+func journalKey(id string) string {
+	return config.KeyJournalPrefix + id
+}
+
+// startJournal start a new journal, all mutation after it will be recorded
+func startJournal(clientset *kubernetes.Clientset, server, managerNamespace string, clusterWide bool) error {
+	hostname, _ := os.Hostname()
+	journal = &Journal{
+		ID:               uuid.New().String(),
+		Hostname:         hostname,
+		PID:              os.Getpid(),
+		Server:           server,
+		ManagerNamespace: managerNamespace,
+		ClusterWide:      clusterWide,
+		CreateTime:       time.Now(),
+		clientset:        clientset,
+	}
+	if err := os.MkdirAll(config.GetJournalDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create journal dir, err: %v", err)
+	}
+	return journal.persist()
+}
+
+// recordJournal append entry to journal and persist it
+func recordJournal(entry JournalEntry) {
+	if journal == nil {
+		return
+	}
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	journal.Entries = append(journal.Entries, entry)
+	if err := journal.persist(); err != nil {
+		log.Warnf("failed to persist journal, err: %v", err)
+	}
+}
+
+// recordExtraDomain update ips of extra domain in journal and persist it if changed
+func recordExtraDomain(domain string, ips []string) {
+	if journal == nil {
+		return
+	}
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	if journal.ExtraDomains == nil {
+		journal.ExtraDomains = map[string][]string{}
+	}
+	if old, ok := journal.ExtraDomains[domain]; ok && strings.Join(old, ",") == strings.Join(ips, ",") {
+		return
+	}
+	journal.ExtraDomains[domain] = ips
+	if err := journal.persist(); err != nil {
+		log.Warnf("failed to persist journal, err: %v", err)
+	}
+}
+
+// finishJournal all mutation is rollback, remove journal
+func finishJournal(ctx context.Context) {
+	if journal == nil {
+		return
+	}
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	journal.remove(ctx)
+	journal = nil
+}
+
+// keepJournal some mutation is failed to rollback, keep journal to recover it later
+func keepJournal() {
+	if journal == nil {
+		return
+	}
+	log.Warnf("some resources are failed to rollback, journal %s is kept, recover it by `kubevpn recover %s`", journal.ID, journal.ID)
+	journal = nil
+}
+
+func (j *Journal) persist() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	// write to temp file then rename, avoid broken journal if crash when writing
+	temp := journalFilename(j.ID) + ".tmp"
+	if err = os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(temp, journalFilename(j.ID)); err != nil {
+		return err
+	}
+	// also save in cluster, so journal is not lost if local disk is lost, forbidden is ignored
+	p, _ := json.Marshal(map[string]interface{}{"data": map[string]string{journalKey(j.ID): string(data)}})
+	_, err = j.clientset.CoreV1().ConfigMaps(j.ManagerNamespace).Patch(context.Background(), config.ConfigMapPodTrafficManager, types.MergePatchType, p, metav1.PatchOptions{})
+	if err != nil && !k8serrors.IsForbidden(err) && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (j *Journal) remove(ctx context.Context) {
+	_ = os.Remove(journalFilename(j.ID))
+	p := []byte(fmt.Sprintf(`{"data":{"%s":null}}`, journalKey(j.ID)))
+	_, _ = j.clientset.CoreV1().ConfigMaps(j.ManagerNamespace).Patch(ctx, config.ConfigMapPodTrafficManager, types.MergePatchType, p, metav1.PatchOptions{})
+}
+
+// Alive process which writes journal is still running, journal from other machine is treated as alive
+func (j *Journal) Alive() bool {
+	if j.PID == os.Getpid() {
+		return true
+	}
+	// can not detect process on other machine, treat it as alive
+	hostname, _ := os.Hostname()
+	if j.Hostname != hostname {
+		return true
+	}
+	return util.ProcessAlive(j.PID)
+}
+
+// ListLocalJournals list journals on disk which belongs to cluster server
+func ListLocalJournals(server string) ([]*Journal, error) {
+	entries, err := os.ReadDir(config.GetJournalDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []*Journal
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(config.GetJournalDir(), entry.Name()))
+		if err != nil {
+			log.Warnf("failed to read journal %s, err: %v", entry.Name(), err)
+			continue
+		}
+		var j Journal
+		if err = json.Unmarshal(content, &j); err != nil {
+			log.Warnf("failed to parse journal %s, err: %v", entry.Name(), err)
+			continue
+		}
+		if j.Server == server {
+			result = append(result, &j)
+		}
+	}
+	sort.Slice(result, func(i, k int) bool { return result[i].CreateTime.Before(result[k].CreateTime) })
+	return result, nil
+}
+
+// ListClusterJournals list journals in configmap of traffic manager, they may come from any machine
+func ListClusterJournals(ctx context.Context, clientset *kubernetes.Clientset, managerNamespace string) ([]*Journal, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(managerNamespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []*Journal
+	for key, value := range cm.Data {
+		if !strings.HasPrefix(key, config.KeyJournalPrefix) {
+			continue
+		}
+		var j Journal
+		if err = json.Unmarshal([]byte(value), &j); err != nil {
+			log.Warnf("failed to parse journal %s, err: %v", key, err)
+			continue
+		}
+		result = append(result, &j)
+	}
+	sort.Slice(result, func(i, k int) bool { return result[i].CreateTime.Before(result[k].CreateTime) })
+	return result, nil
+}
+
+// RecoverJournal replay journal in reverse order to rollback all mutation, then remove it
+func RecoverJournal(ctx context.Context, factory cmdutil.Factory, clientset *kubernetes.Clientset, j *Journal) error {
+	log.Infof("recovering journal %s, created by pid %d on %s at %s", j.ID, j.PID, j.Hostname, j.CreateTime.Format(time.RFC3339))
+	var trafficManagerNamespace string
+	if j.ClusterWide {
+		trafficManagerNamespace = j.ManagerNamespace
+	}
+	var errs []string
+	var failed []JournalEntry
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		entry := j.Entries[i]
+		// object is deleted by others, nothing to rollback
+		if err := recoverEntry(ctx, factory, clientset, j, trafficManagerNamespace, entry); err != nil && !k8serrors.IsNotFound(err) {
+			log.Warnf("failed to recover %s %s, err: %v", entry.Kind, entry.Workload+entry.Name, err)
+			errs = append(errs, err.Error())
+			failed = append([]JournalEntry{entry}, failed...)
+		}
+	}
+	j.clientset = clientset
+	if len(errs) != 0 {
+		// only keep failed entries, retry them next time
+		j.Entries = failed
+		if err := j.persist(); err != nil {
+			log.Warnf("failed to persist journal %s, err: %v", j.ID, err)
+		}
+		return fmt.Errorf("journal %s is recovered with errors, failed entries are kept: %s", j.ID, strings.Join(errs, "; "))
+	}
+	j.remove(ctx)
+	return nil
+}
+
+func recoverEntry(ctx context.Context, factory cmdutil.Factory, clientset *kubernetes.Clientset, j *Journal, trafficManagerNamespace string, entry JournalEntry) error {
+	mapInterface := clientset.CoreV1().ConfigMaps(j.ManagerNamespace)
+	switch entry.Kind {
+	case JournalLease:
+		return deleteClientLease(ctx, clientset, j.ManagerNamespace, entry.Name)
+	case JournalDHCP:
+		// ips may be released by gc loop of traffic manager and rent by other client, never release them without owner
+		if entry.Owner == "" {
+			log.Warnf("owner of ip %v is unknown, leave them to gc loop of traffic manager", entry.IPs)
+			return nil
+		}
+		var ips = make([]net.IP, 0, len(entry.IPs))
+		for _, ip := range entry.IPs {
+			ips = append(ips, net.ParseIP(ip))
+		}
+		return NewDHCPManager(mapInterface, j.ManagerNamespace).ReleaseIPLeasedTo(ctx, entry.Owner, ips...)
+	case JournalMesh:
+		return UnPatchContainer(factory, mapInterface, entry.Namespace, entry.Workload, trafficManagerNamespace, entry.Headers)
+	case JournalExchange:
+		return recoverExchange(factory, entry)
+	case JournalDuplicate:
+		if entry.Server != j.Server {
+			return fmt.Errorf("object %s %s/%s is duplicated into cluster %s, please recover with kubeconfig of it", entry.Resource, entry.Namespace, entry.Name, entry.Server)
+		}
+		client, err := factory.DynamicClient()
+		if err != nil {
+			return err
+		}
+		gvr, _ := schema.ParseResourceArg(entry.Resource)
+		if gvr == nil {
+			return fmt.Errorf("invalid resource %s", entry.Resource)
+		}
+		err = client.Resource(*gvr).Namespace(entry.Namespace).Delete(ctx, entry.Name, metav1.DeleteOptions{})
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	case JournalRoute:
+		// routes are bound to tun device, operation system removes them with tun device when process exit
+		log.Debugf("routes are bound to tun device %s, no needs to recover", entry.Tun)
+		return nil
+	case JournalDNS:
+		if entry.Tun != "" {
+			_ = os.Setenv(config.EnvTunNameOrLUID, entry.Tun)
+		}
+		dns.CancelDNS()
+		return nil
+	case JournalFirewall:
+		return util.DeleteAllowFirewallRule()
+	default:
+		return fmt.Errorf("unknown journal kind %s", entry.Kind)
+	}
+}
+
+// recoverExchange remove vpn sidecar, recreate original pod if workload is pod without controller
+func recoverExchange(factory cmdutil.Factory, entry JournalEntry) error {
+	object, err := util.GetUnstructuredObject(factory, entry.Namespace, entry.Workload)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	helper := pkgresource.NewHelper(object.Client, object.Mapping)
+	if object.Mapping.Resource.Resource == "pods" {
+		var pod v1.Pod
+		if err = json.Unmarshal(entry.Origin, &pod); err != nil {
+			return err
+		}
+		CleanupUselessInfo(&pod)
+		return createAfterDeletePod(factory, &pod, helper)
+	}
+	if err = removeInboundContainer(factory, entry.Namespace, entry.Workload); err != nil {
+		return err
+	}
+	if len(entry.Origin) != 0 {
+		_, err = helper.Patch(object.Namespace, object.Name, types.JSONPatchType, entry.Origin, &metav1.PatchOptions{})
+	}
+	return err
+}
+
+// recoverStaleJournals recover journals on disk of this cluster, which process is not running anymore
+func recoverStaleJournals(ctx context.Context, factory cmdutil.Factory, clientset *kubernetes.Clientset, server string) {
+	journals, err := ListLocalJournals(server)
+	if err != nil {
+		log.Warnf("failed to list journals, err: %v", err)
+		return
+	}
+	for _, j := range journals {
+		if j.Alive() {
+			continue
+		}
+		if err = RecoverJournal(ctx, factory, clientset, j); err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+// Recover replay journals of this cluster which process is not running anymore,
+// if id is special, recover it even if it comes from another machine, eg: laptop is broken
+func (c *ConnectOptions) Recover(ctx context.Context, id string) error {
+	if id == "" {
+		recoverStaleJournals(ctx, c.factory, c.clientset, c.config.Host)
+		return nil
+	}
+	journals, err := c.ListJournals(ctx)
+	if err != nil {
+		return err
+	}
+	for _, j := range journals {
+		if j.ID != id {
+			continue
+		}
+		if j.PID == os.Getpid() {
+			return fmt.Errorf("journal %s belongs to current process", id)
+		}
+		return RecoverJournal(ctx, c.factory, c.clientset, j)
+	}
+	return fmt.Errorf("journal %s not found", id)
+}
+
+// Status journals of running kubevpn on this machine which connect to this cluster
+func (c *ConnectOptions) Status() ([]*Journal, error) {
+	local, err := ListLocalJournals(c.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	var result []*Journal
+	for _, j := range local {
+		if j.Alive() {
+			result = append(result, j)
+		}
+	}
+	return result, nil
+}
+
+// ListJournals list journals on disk and in cluster, journal on disk is preferred
+func (c *ConnectOptions) ListJournals(ctx context.Context) ([]*Journal, error) {
+	local, err := ListLocalJournals(c.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := ListClusterJournals(ctx, c.clientset, c.managerNamespace())
+	if err != nil {
+		return nil, err
+	}
+	var result = local
+	for _, r := range remote {
+		var found bool
+		for _, l := range local {
+			if l.ID == r.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
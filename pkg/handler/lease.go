@@ -0,0 +1,365 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	v12 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/kubectl/pkg/util/podutils"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/yaml"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/controlplane"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+// createClientLease create lease of client in traffic manager namespace, traffic manager is alive as long as any lease is alive
+func createClientLease(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string) error {
+	hostname, _ := os.Hostname()
+	now := metav1.NewMicroTime(time.Now())
+	_, err := clientset.CoordinationV1().Leases(namespace).Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{config.LabelClientLease: "true"},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       pointer.String(fmt.Sprintf("%s/%d", hostname, os.Getpid())),
+			LeaseDurationSeconds: pointer.Int32(config.LeaseDurationSeconds),
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// annotateClientLease record ip of client, gc loop releases them if lease expired
+func annotateClientLease(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string, ips ...net.IP) error {
+	var s []string
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	p := []byte(fmt.Sprintf(`{"metadata":{"annotations":{"%s":"%s"}}}`, config.AnnotationClientIPs, strings.Join(s, ",")))
+	_, err := clientset.CoordinationV1().Leases(namespace).Patch(ctx, name, types.MergePatchType, p, metav1.PatchOptions{})
+	return err
+}
+
+// heartbeat renew lease of client until ctx done, lease may be expired and collected by traffic manager,
+// eg: laptop sleeps, then re-create it and reclaim ip, if can not, disconnect
+func (c *ConnectOptions) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * config.LeaseRenewSeconds)
+	defer ticker.Stop()
+	var lastRenew = time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p := []byte(fmt.Sprintf(`{"spec":{"renewTime":"%s"}}`, metav1.NewMicroTime(time.Now()).Format(metav1.RFC3339Micro)))
+			_, err := c.clientset.CoordinationV1().Leases(c.managerNamespace()).Patch(ctx, c.leaseName, types.MergePatchType, p, metav1.PatchOptions{})
+			if err == nil {
+				lastRenew = time.Now()
+				continue
+			}
+			if k8serrors.IsNotFound(err) {
+				log.Warnf("lease %s is expired and collected by traffic manager, ip and envoy rules are released, try to reclaim it", c.leaseName)
+				if err = c.reclaimLease(ctx); err != nil {
+					log.Errorf("failed to reclaim lease %s, disconnecting, please reconnect, err: %v", c.leaseName, err)
+					Cleanup(syscall.SIGTERM)
+					return
+				}
+				log.Infof("lease %s is re-created, ip is reclaimed", c.leaseName)
+				lastRenew = time.Now()
+				continue
+			}
+			if time.Since(lastRenew) > time.Second*config.LeaseDurationSeconds {
+				log.Warnf("failed to renew lease %s for %s, it may be collected by traffic manager, err: %v", c.leaseName, time.Since(lastRenew).Round(time.Second), err)
+			} else {
+				log.Debugf("failed to renew lease %s, err: %v", c.leaseName, err)
+			}
+		}
+	}
+}
+
+// reclaimLease re-create lease, and rent ip which is released by traffic manager again,
+// envoy rules of mesh mode are removed by traffic manager, can not be reclaimed
+func (c *ConnectOptions) reclaimLease(ctx context.Context) error {
+	if len(c.Workloads) != 0 && (len(c.Headers) != 0 || c.Weight != 0 || c.Mirror) {
+		return fmt.Errorf("envoy rules of %v are removed", c.Workloads)
+	}
+	if err := createClientLease(ctx, c.clientset, c.managerNamespace(), c.leaseName); err != nil {
+		return err
+	}
+	if c.localTunIPv4 == nil || c.localTunIPv6 == nil {
+		return nil
+	}
+	ips := []net.IP{c.localTunIPv4.IP, c.localTunIPv6.IP}
+	// ip may be rent by other client after released
+	if err := c.dhcp.RentIP(ctx, c.leaseName, ips...); err != nil {
+		_ = deleteClientLease(ctx, c.clientset, c.managerNamespace(), c.leaseName)
+		return err
+	}
+	return annotateClientLease(ctx, c.clientset, c.managerNamespace(), c.leaseName, ips...)
+}
+
+func deleteClientLease(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string) error {
+	err := clientset.CoordinationV1().Leases(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// liveClientLeases count lease which is not expired
+func liveClientLeases(ctx context.Context, clientset *kubernetes.Clientset, namespace string) (live []coordinationv1.Lease, stale []coordinationv1.Lease, err error) {
+	list, err := clientset.CoordinationV1().Leases(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fields.OneTermEqualSelector(config.LabelClientLease, "true").String(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, lease := range list.Items {
+		if isLeaseExpired(lease, time.Now()) {
+			stale = append(stale, lease)
+		} else {
+			live = append(live, lease)
+		}
+	}
+	return
+}
+
+// hasOtherLiveLease any live client lease except self, self may be not deleted
+func hasOtherLiveLease(ctx context.Context, clientset *kubernetes.Clientset, namespace, self string) (bool, error) {
+	live, _, err := liveClientLeases(ctx, clientset, namespace)
+	if err != nil {
+		return false, err
+	}
+	for _, lease := range live {
+		if lease.Name != self {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isLeaseExpired(lease coordinationv1.Lease, now time.Time) bool {
+	renew := lease.CreationTimestamp.Time
+	if lease.Spec.RenewTime != nil {
+		renew = lease.Spec.RenewTime.Time
+	}
+	duration := int32(config.LeaseDurationSeconds)
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = *lease.Spec.LeaseDurationSeconds
+	}
+	return renew.Add(time.Duration(duration) * time.Second).Before(now)
+}
+
+// GarbageCollect runs in traffic manager, remove stale client leases, release their ip and envoy rules,
+// scale traffic manager down to zero if no live lease and no sidecar for idleTimeout, zero idleTimeout means never,
+// sidecars are only in namespace of traffic manager unless it is cluster-wide
+func GarbageCollect(ctx context.Context, clientset *kubernetes.Clientset, namespace string, clusterWide bool, idleTimeout time.Duration) {
+	ticker := time.NewTicker(time.Second * config.LeaseRenewSeconds)
+	defer ticker.Stop()
+	var lastActive = time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		live, stale, err := liveClientLeases(ctx, clientset, namespace)
+		if err != nil {
+			log.Errorf("failed to list client leases, err: %v", err)
+			continue
+		}
+		for _, lease := range stale {
+			if err = collectClientLease(ctx, clientset, namespace, lease); err != nil {
+				log.Errorf("failed to collect lease %s, err: %v", lease.Name, err)
+			}
+		}
+		if len(live) != 0 {
+			lastActive = time.Now()
+			continue
+		}
+		if idleTimeout <= 0 || time.Since(lastActive) < idleTimeout {
+			continue
+		}
+		// sidecar connects to traffic manager, can not scale down
+		var injected bool
+		injected, err = hasSidecar(ctx, clientset, namespace, clusterWide)
+		if err != nil || injected {
+			lastActive = time.Now()
+			continue
+		}
+		log.Infof("no client for %s, scale traffic manager down to zero", idleTimeout.String())
+		if err = scaleDown(ctx, clientset, namespace); err != nil {
+			log.Errorf("failed to scale traffic manager down, err: %v", err)
+		}
+	}
+}
+
+// collectClientLease release ip and envoy rules of client, then delete lease
+func collectClientLease(ctx context.Context, clientset *kubernetes.Clientset, namespace string, lease coordinationv1.Lease) error {
+	log.Infof("lease %s of %s is expired, collect it", lease.Name, pointer.StringDeref(lease.Spec.HolderIdentity, ""))
+	mapInterface := clientset.CoreV1().ConfigMaps(namespace)
+	var ips []net.IP
+	for _, s := range strings.Split(lease.Annotations[config.AnnotationClientIPs], ",") {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) != 0 {
+		if err := removeEnvoyRulesOf(ctx, mapInterface, ips...); err != nil {
+			return err
+		}
+		if err := NewDHCPManager(mapInterface, namespace).ReleaseIPLeasedTo(ctx, lease.Name, ips...); err != nil {
+			return err
+		}
+	}
+	return deleteClientLease(ctx, clientset, namespace, lease.Name)
+}
+
+// removeEnvoyRulesOf remove envoy rules which route traffic to ips, keep virtual, because sidecar is still there
+func removeEnvoyRulesOf(ctx context.Context, mapInterface v12.ConfigMapInterface, ips ...net.IP) error {
+	cm, err := mapInterface.Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	var v []*controlplane.Virtual
+	if err = yaml.Unmarshal([]byte(cm.Data[config.KeyEnvoy]), &v); err != nil {
+		return err
+	}
+	var changed bool
+	for _, virtual := range v {
+		for i := 0; i < len(virtual.Rules); i++ {
+			for _, ip := range ips {
+				if virtual.Rules[i].LocalTunIPv4 == ip.String() || virtual.Rules[i].LocalTunIPv6 == ip.String() {
+					virtual.Rules = append(virtual.Rules[:i], virtual.Rules[i+1:]...)
+					i--
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	bytes, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	cm.Data[config.KeyEnvoy] = string(bytes)
+	_, err = mapInterface.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// hasSidecar any envoy rule exists or any pod is injected with vpn sidecar,
+// sidecar may be in any namespace if traffic manager is cluster-wide
+func hasSidecar(ctx context.Context, clientset *kubernetes.Clientset, namespace string, clusterWide bool) (bool, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	var v []*controlplane.Virtual
+	if err = yaml.Unmarshal([]byte(cm.Data[config.KeyEnvoy]), &v); err != nil {
+		return false, err
+	}
+	if len(v) != 0 {
+		return true, nil
+	}
+	podNamespace := namespace
+	if clusterWide {
+		podNamespace = metav1.NamespaceAll
+	}
+	list, err := clientset.CoreV1().Pods(podNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, pod := range list.Items {
+		if pod.DeletionTimestamp != nil || pod.Labels["app"] == config.ConfigMapPodTrafficManager {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if container.Name == config.ContainerSidecarVPN {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// scaleDown scale traffic manager down to zero, record replicas in annotation, scale up restores it if replicas is not configured
+func scaleDown(ctx context.Context, clientset *kubernetes.Clientset, namespace string) error {
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	var replicas int32 = 1
+	if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas > 0 {
+		replicas = *deployment.Spec.Replicas
+	}
+	p := []byte(fmt.Sprintf(`{"metadata":{"annotations":{"%s":"%d"}},"spec":{"replicas":0}}`, config.AnnotationReplicas, replicas))
+	_, err = clientset.AppsV1().Deployments(namespace).Patch(ctx, config.ConfigMapPodTrafficManager, types.MergePatchType, p, metav1.PatchOptions{})
+	return err
+}
+
+// scaleUpIfNeeded traffic manager may be scaled down by gc loop, scale it up to configured replicas,
+// or replicas before scaled down if not configured, and wait it ready
+func scaleUpIfNeeded(ctx context.Context, clientset *kubernetes.Clientset, namespace string, workload *util.WorkloadConfig) error {
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	if err != nil || deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != 0 {
+		return nil
+	}
+	replicas := workload.ReplicasOrDefault()
+	if workload == nil || workload.Replicas == nil {
+		if i, errs := strconv.Atoi(deployment.Annotations[config.AnnotationReplicas]); errs == nil && i > 0 {
+			replicas = int32(i)
+		}
+	}
+	log.Infof("traffic manager is scaled down because of idle, scale it up to %d replicas...", replicas)
+	p := []byte(fmt.Sprintf(`{"spec":{"replicas":%d}}`, replicas))
+	_, err = clientset.AppsV1().Deployments(namespace).Patch(ctx, config.ConfigMapPodTrafficManager, types.MergePatchType, p, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to scale traffic manager up, err: %v", err)
+	}
+	return waitPodReady(ctx, clientset.CoreV1().Pods(namespace))
+}
+
+func waitPodReady(ctx context.Context, podInterface v12.PodInterface) error {
+	ctx2, cancelFunc := context.WithTimeout(ctx, time.Minute*10)
+	defer cancelFunc()
+	ticker := time.NewTicker(time.Second * 2)
+	defer ticker.Stop()
+	for {
+		list, err := podInterface.List(ctx2, metav1.ListOptions{
+			LabelSelector: fields.OneTermEqualSelector("app", config.ConfigMapPodTrafficManager).String(),
+		})
+		if err == nil {
+			for i := range list.Items {
+				if list.Items[i].DeletionTimestamp == nil && podutils.IsPodReady(&list.Items[i]) {
+					return nil
+				}
+			}
+		}
+		select {
+		case <-ctx2.Done():
+			return fmt.Errorf("wait traffic manager to be ready timeout")
+		case <-ticker.C:
+		}
+	}
+}
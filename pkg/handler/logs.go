@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/controlplane"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+type LogsOptions struct {
+	Namespace string
+	Workloads []string
+	// ManagerNamespace is namespace of cluster-wide traffic manager, empty means traffic manager in Namespace
+	ManagerNamespace string
+
+	factory    cmdutil.Factory
+	clientset  *kubernetes.Clientset
+	restclient *rest.RESTClient
+	config     *rest.Config
+}
+
+func (l *LogsOptions) InitClient(f cmdutil.Factory) (err error) {
+	l.factory = f
+	if l.config, err = l.factory.ToRESTConfig(); err != nil {
+		return
+	}
+	if l.restclient, err = l.factory.RESTClient(); err != nil {
+		return
+	}
+	if l.clientset, err = l.factory.KubernetesClientSet(); err != nil {
+		return
+	}
+	if l.Namespace, _, err = l.factory.ToRawKubeConfigLoader().Namespace(); err != nil {
+		return
+	}
+	return
+}
+
+func (l *LogsOptions) managerNamespace() string {
+	if l.ManagerNamespace != "" {
+		return l.ManagerNamespace
+	}
+	return l.Namespace
+}
+
+// DoLogs stream access log of envoy sidecar of workloads from control-plane until ctx done,
+// requests which hit rules of other local PC are filtered out
+func (l *LogsOptions) DoLogs(ctx context.Context, fn func(*controlplane.AccessLog)) error {
+	ips, err := util.GetLocalTunIPs()
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("can not find tun device of kubevpn, please connect to cluster and proxy workloads with --headers first")
+	}
+	query := url.Values{}
+	for _, ip := range ips {
+		query.Add("ip", ip)
+	}
+	for _, workload := range l.Workloads {
+		object, err := util.GetUnstructuredObject(l.factory, l.Namespace, workload)
+		if err != nil {
+			return err
+		}
+		query.Add("node", envoyNodeID(object, l.ManagerNamespace))
+	}
+
+	list, err := l.clientset.CoreV1().Pods(l.managerNamespace()).List(ctx, metav1.ListOptions{
+		LabelSelector: fields.OneTermEqualSelector("app", config.ConfigMapPodTrafficManager).String(),
+	})
+	if err != nil {
+		return err
+	}
+	var podName string
+	for _, pod := range list.Items {
+		if pod.DeletionTimestamp == nil && util.AllContainerIsRunning(&pod) {
+			podName = pod.Name
+			break
+		}
+	}
+	if podName == "" {
+		return fmt.Errorf("can not find running pod of %s in namespace %s", config.ConfigMapPodTrafficManager, l.managerNamespace())
+	}
+
+	port := util.GetAvailableTCPPortOrDie()
+	readyChan := make(chan struct{})
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- util.PortForwardPod(l.config, l.restclient, podName, l.managerNamespace(), fmt.Sprintf("%d:%d", port, config.AccessLogPort), readyChan, stopChan)
+	}()
+	select {
+	case <-readyChan:
+	case err = <-errChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/logs?%s", port, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to stream access log, status: %d", resp.StatusCode)
+	}
+	log.Debugf("streaming access log of %v, local ip: %v", l.Workloads, ips)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var accessLog controlplane.AccessLog
+		if err = json.Unmarshal(scanner.Bytes(), &accessLog); err != nil {
+			log.Warnf("failed to parse access log, err: %v", err)
+			continue
+		}
+		fn(&accessLog)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
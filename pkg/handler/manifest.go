@@ -0,0 +1,435 @@
+package handler
+
+import (
+	"net"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+// TrafficManager is all resources of traffic manager, createOutboundPod creates them,
+// and `kubevpn install --dry-run` renders them for pre-installation
+type TrafficManager struct {
+	Namespace          *v1.Namespace
+	ServiceAccount     *v1.ServiceAccount
+	Role               *rbacv1.Role
+	RoleBinding        *rbacv1.RoleBinding
+	ClusterRole        *rbacv1.ClusterRole
+	ClusterRoleBinding *rbacv1.ClusterRoleBinding
+	Service            *v1.Service
+	Secret             *v1.Secret
+	ConfigMap          *v1.ConfigMap
+	Deployment         *appsv1.Deployment
+	Webhook            *admissionv1.MutatingWebhookConfiguration
+}
+
+// Objects resources in creating order
+func (t *TrafficManager) Objects() []runtime.Object {
+	return []runtime.Object{
+		t.Namespace,
+		t.ServiceAccount,
+		t.Role,
+		t.RoleBinding,
+		t.ClusterRole,
+		t.ClusterRoleBinding,
+		t.Service,
+		t.Secret,
+		t.ConfigMap,
+		t.Deployment,
+		t.Webhook,
+	}
+}
+
+// IsPreInstalled traffic manager is installed by `kubevpn install` or GitOps, client should reuse it and never delete it
+func IsPreInstalled(deployment *appsv1.Deployment) bool {
+	return deployment != nil && deployment.Annotations[config.AnnotationPreInstalled] == "true"
+}
+
+// GenTrafficManager generate resources of traffic manager in namespace, certs is internal CA and server cert of webhook and control-plane,
+// workload customizes scheduling and resources of deployment
+func GenTrafficManager(namespace, image string, clusterWide bool, preInstalled bool, workload *util.WorkloadConfig, certs *util.CertBundle) *TrafficManager {
+	innerIpv4CIDR := net.IPNet{IP: config.RouterIP, Mask: config.CIDR.Mask}
+	innerIpv6CIDR := net.IPNet{IP: config.RouterIP6, Mask: config.CIDR6.Mask}
+	var annotations map[string]string
+	if preInstalled {
+		annotations = map[string]string{config.AnnotationPreInstalled: "true"}
+	}
+
+	udp8422 := "8422-for-udp"
+	tcp10800 := "10800-for-tcp"
+	tcp9002 := "9002-for-envoy"
+	tcp80 := "80-for-webhook"
+
+	var Resources = workload.TrafficManagerResources(v1.ResourceRequirements{
+		Requests: map[v1.ResourceName]resource.Quantity{
+			v1.ResourceCPU:    resource.MustParse("500m"),
+			v1.ResourceMemory: resource.MustParse("512Mi"),
+		},
+		Limits: map[v1.ResourceName]resource.Quantity{
+			v1.ResourceCPU:    resource.MustParse("2000m"),
+			v1.ResourceMemory: resource.MustParse("2048Mi"),
+		},
+	})
+
+	// same as namespace label
+	namespaceSelector := &metav1.LabelSelector{MatchLabels: map[string]string{"ns": namespace}}
+	if clusterWide {
+		namespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{config.LabelTrafficManager: namespace}}
+	}
+
+	manager := &TrafficManager{
+		Namespace: &v1.Namespace{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   namespace,
+				Labels: map[string]string{"ns": namespace},
+			},
+		},
+		ServiceAccount: &v1.ServiceAccount{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      config.ConfigMapPodTrafficManager,
+				Namespace: namespace,
+			},
+			AutomountServiceAccountToken: pointer.Bool(true),
+		},
+		Role: &rbacv1.Role{
+			TypeMeta: metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      config.ConfigMapPodTrafficManager,
+				Namespace: namespace,
+			},
+			Rules: []rbacv1.PolicyRule{{
+				Verbs:         []string{"get", "list", "watch", "create", "update", "patch", "delete"},
+				APIGroups:     []string{""},
+				Resources:     []string{"configmaps", "secrets"},
+				ResourceNames: []string{config.ConfigMapPodTrafficManager},
+			}, {
+				// collect stale lease of client
+				Verbs:     []string{"get", "list", "watch", "delete"},
+				APIGroups: []string{"coordination.k8s.io"},
+				Resources: []string{"leases"},
+			}, {
+				// scale down to zero if idle
+				Verbs:         []string{"get", "patch"},
+				APIGroups:     []string{"apps"},
+				Resources:     []string{"deployments"},
+				ResourceNames: []string{config.ConfigMapPodTrafficManager},
+			}},
+		},
+		RoleBinding: &rbacv1.RoleBinding{
+			TypeMeta: metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      config.ConfigMapPodTrafficManager,
+				Namespace: namespace,
+			},
+			Subjects: []rbacv1.Subject{{
+				Kind: "ServiceAccount",
+				//APIGroup:  "rbac.authorization.k8s.io",
+				Name:      config.ConfigMapPodTrafficManager,
+				Namespace: namespace,
+			}},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "Role",
+				Name:     config.ConfigMapPodTrafficManager,
+			},
+		},
+		// using TokenReview to authenticate sidecar
+		ClusterRole: &rbacv1.ClusterRole{
+			TypeMeta: metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: config.ConfigMapPodTrafficManager + "." + namespace,
+			},
+			Rules: []rbacv1.PolicyRule{{
+				Verbs:     []string{"create"},
+				APIGroups: []string{"authentication.k8s.io"},
+				Resources: []string{"tokenreviews"},
+			}, {
+				// check sidecar which rents ip, and find sidecar before scale down, sidecar may be in any namespace
+				Verbs:     []string{"get", "list"},
+				APIGroups: []string{""},
+				Resources: []string{"pods"},
+			}, {
+				// check namespace of sidecar which rents ip is served by this traffic manager
+				Verbs:     []string{"get"},
+				APIGroups: []string{""},
+				Resources: []string{"namespaces"},
+			}},
+		},
+		ClusterRoleBinding: &rbacv1.ClusterRoleBinding{
+			TypeMeta: metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: config.ConfigMapPodTrafficManager + "." + namespace,
+			},
+			Subjects: []rbacv1.Subject{{
+				Kind:      "ServiceAccount",
+				Name:      config.ConfigMapPodTrafficManager,
+				Namespace: namespace,
+			}},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "ClusterRole",
+				Name:     config.ConfigMapPodTrafficManager + "." + namespace,
+			},
+		},
+		Service: &v1.Service{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      config.ConfigMapPodTrafficManager,
+				Namespace: namespace,
+			},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{{
+					Name:       udp8422,
+					Protocol:   v1.ProtocolUDP,
+					Port:       8422,
+					TargetPort: intstr.FromInt(8422),
+				}, {
+					Name:       tcp10800,
+					Protocol:   v1.ProtocolTCP,
+					Port:       10800,
+					TargetPort: intstr.FromInt(10800),
+				}, {
+					Name:       tcp9002,
+					Protocol:   v1.ProtocolTCP,
+					Port:       9002,
+					TargetPort: intstr.FromInt(9002),
+				}, {
+					Name:       tcp80,
+					Protocol:   v1.ProtocolTCP,
+					Port:       80,
+					TargetPort: intstr.FromInt(80),
+				}},
+				Selector: map[string]string{"app": config.ConfigMapPodTrafficManager},
+				Type:     v1.ServiceTypeClusterIP,
+			},
+		},
+		// reason why not use v1.SecretTypeTls is because it needs key called tls.crt and tls.key, keep key names for compatibility,
+		// it is only mounted into traffic manager, sidecars only get cert of CA
+		Secret: &v1.Secret{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      config.ConfigMapPodTrafficManager,
+				Namespace: namespace,
+			},
+			Data: map[string][]byte{
+				config.TLSCertKey:       certs.Crt,
+				config.TLSPrivateKeyKey: certs.Key,
+				config.TLSCACertKey:     certs.CACrt,
+				config.TLSCAKeyKey:      certs.CAKey,
+			},
+			Type: v1.SecretTypeOpaque,
+		},
+		ConfigMap: &v1.ConfigMap{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      config.ConfigMapPodTrafficManager,
+				Namespace: namespace,
+			},
+			Data: map[string]string{
+				config.KeyEnvoy: "",
+			},
+		},
+		Deployment: &appsv1.Deployment{
+			TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        config.ConfigMapPodTrafficManager,
+				Namespace:   namespace,
+				Annotations: annotations,
+			},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: pointer.Int32(workload.ReplicasOrDefault()),
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": config.ConfigMapPodTrafficManager},
+				},
+				Template: v1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Labels: map[string]string{"app": config.ConfigMapPodTrafficManager},
+					},
+					Spec: v1.PodSpec{
+						ServiceAccountName: config.ConfigMapPodTrafficManager,
+						// keys are mounted as files instead of env, kubelet updates files after cert is rotated
+						Volumes: []v1.Volume{{
+							Name: config.VolumeTLS,
+							VolumeSource: v1.VolumeSource{
+								Secret: &v1.SecretVolumeSource{
+									SecretName:  config.ConfigMapPodTrafficManager,
+									DefaultMode: pointer.Int32(0400),
+								},
+							},
+						}},
+						Containers: []v1.Container{
+							{
+								Name:    config.ContainerSidecarVPN,
+								Image:   image,
+								Command: []string{"/bin/sh", "-c"},
+								Args: []string{`
+sysctl -w net.ipv4.ip_forward=1
+sysctl -w net.ipv6.conf.all.disable_ipv6=0
+sysctl -w net.ipv6.conf.all.forwarding=1
+update-alternatives --set iptables /usr/sbin/iptables-legacy
+iptables -F
+ip6tables -F
+iptables -P INPUT ACCEPT
+ip6tables -P INPUT ACCEPT
+iptables -P FORWARD ACCEPT
+ip6tables -P FORWARD ACCEPT
+iptables -t nat -A POSTROUTING -s ${CIDR4} -o eth0 -j MASQUERADE
+ip6tables -t nat -A POSTROUTING -s ${CIDR6} -o eth0 -j MASQUERADE
+kubevpn serve -L "tcp://:10800" -L "tun://:8422?net=${TunIPv4}" --debug=true`,
+								},
+								Env: []v1.EnvVar{
+									{
+										Name:  "CIDR4",
+										Value: config.CIDR.String(),
+									},
+									{
+										Name:  "CIDR6",
+										Value: config.CIDR6.String(),
+									},
+									{
+										Name:  config.EnvInboundPodTunIPv4,
+										Value: innerIpv4CIDR.String(),
+									},
+									{
+										Name:  config.EnvInboundPodTunIPv6,
+										Value: innerIpv6CIDR.String(),
+									},
+								},
+								Ports: []v1.ContainerPort{{
+									Name:          udp8422,
+									ContainerPort: 8422,
+									Protocol:      v1.ProtocolUDP,
+								}, {
+									Name:          tcp10800,
+									ContainerPort: 10800,
+									Protocol:      v1.ProtocolTCP,
+								}},
+								Resources:       Resources,
+								ImagePullPolicy: v1.PullIfNotPresent,
+								SecurityContext: &v1.SecurityContext{
+									Capabilities: &v1.Capabilities{
+										Add: []v1.Capability{
+											"NET_ADMIN",
+											//"SYS_MODULE",
+										},
+									},
+									RunAsUser:  pointer.Int64(0),
+									Privileged: pointer.Bool(true),
+								},
+							},
+							{
+								Name:    config.ContainerSidecarControlPlane,
+								Image:   image,
+								Command: []string{"kubevpn"},
+								Args:    []string{"control-plane"},
+								VolumeMounts: []v1.VolumeMount{{
+									Name:      config.VolumeTLS,
+									ReadOnly:  true,
+									MountPath: config.TLSMountPath,
+								}},
+								Ports: []v1.ContainerPort{{
+									Name:          tcp9002,
+									ContainerPort: 9002,
+									Protocol:      v1.ProtocolTCP,
+								}},
+								Env: []v1.EnvVar{{
+									Name: config.EnvPodNamespace,
+									ValueFrom: &v1.EnvVarSource{
+										FieldRef: &v1.ObjectFieldSelector{
+											FieldPath: "metadata.namespace",
+										},
+									},
+								}},
+								ImagePullPolicy: v1.PullIfNotPresent,
+								Resources:       Resources,
+							},
+							{
+								Name:    "webhook",
+								Image:   image,
+								Command: []string{"kubevpn"},
+								Args:    []string{"webhook"},
+								VolumeMounts: []v1.VolumeMount{{
+									Name:      config.VolumeTLS,
+									ReadOnly:  true,
+									MountPath: config.TLSMountPath,
+								}},
+								Ports: []v1.ContainerPort{{
+									Name:          tcp80,
+									ContainerPort: 80,
+									Protocol:      v1.ProtocolTCP,
+								}},
+								Env: []v1.EnvVar{{
+									Name: config.EnvPodNamespace,
+									ValueFrom: &v1.EnvVarSource{
+										FieldRef: &v1.ObjectFieldSelector{
+											FieldPath: "metadata.namespace",
+										},
+									},
+								}, {
+									Name:  config.EnvIdleTimeout,
+									Value: workload.IdleTimeoutOrDefault().String(),
+								}, {
+									Name:  config.EnvClusterWide,
+									Value: strconv.FormatBool(clusterWide),
+								}},
+								ImagePullPolicy: v1.PullIfNotPresent,
+								Resources:       Resources,
+							},
+						},
+						RestartPolicy:     v1.RestartPolicyAlways,
+						PriorityClassName: "system-cluster-critical",
+					},
+				},
+			},
+		},
+		Webhook: &admissionv1.MutatingWebhookConfiguration{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "MutatingWebhookConfiguration"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: config.ConfigMapPodTrafficManager + "." + namespace,
+			},
+			Webhooks: []admissionv1.MutatingWebhook{{
+				Name: config.ConfigMapPodTrafficManager + ".naison.io", // no sense
+				ClientConfig: admissionv1.WebhookClientConfig{
+					Service: &admissionv1.ServiceReference{
+						Namespace: namespace,
+						Name:      config.ConfigMapPodTrafficManager,
+						Path:      pointer.String("/pods"),
+						Port:      pointer.Int32(80),
+					},
+					// server cert is rotated by traffic manager, CA is not
+					CABundle: certs.CACrt,
+				},
+				Rules: []admissionv1.RuleWithOperations{{
+					Operations: []admissionv1.OperationType{admissionv1.Create, admissionv1.Delete},
+					Rule: admissionv1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"pods"},
+						Scope:       (*admissionv1.ScopeType)(pointer.String(string(admissionv1.NamespacedScope))),
+					},
+				}},
+				FailurePolicy:           (*admissionv1.FailurePolicyType)(pointer.String(string(admissionv1.Ignore))),
+				NamespaceSelector:       namespaceSelector,
+				SideEffects:             (*admissionv1.SideEffectClass)(pointer.String(string(admissionv1.SideEffectClassNone))),
+				TimeoutSeconds:          nil,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+				ReinvocationPolicy:      (*admissionv1.ReinvocationPolicyType)(pointer.String(string(admissionv1.NeverReinvocationPolicy))),
+			}},
+		},
+	}
+	workload.ApplyTrafficManager(&manager.Deployment.Spec.Template)
+	return manager
+}
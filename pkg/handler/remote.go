@@ -6,27 +6,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
 	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	admissionv1 "k8s.io/api/admissionregistration/v1"
-	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
-	rbacv1 "k8s.io/api/rbac/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/wait"
 	pkgresource "k8s.io/cli-runtime/pkg/resource"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/util/cert"
 	"k8s.io/client-go/util/retry"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 	"k8s.io/kubectl/pkg/polymorphichelpers"
@@ -38,18 +31,30 @@ import (
 	"github.com/wencaiwulue/kubevpn/pkg/util"
 )
 
-func createOutboundPod(ctx context.Context, factory cmdutil.Factory, clientset *kubernetes.Clientset, namespace string) (err error) {
-	innerIpv4CIDR := net.IPNet{IP: config.RouterIP, Mask: config.CIDR.Mask}
-	innerIpv6CIDR := net.IPNet{IP: config.RouterIP6, Mask: config.CIDR6.Mask}
+// createOutboundPod create traffic manager in namespace, if clusterWide is true, traffic manager accepts clients and sidecars from any namespace
+// which labeled with config.LabelTrafficManager, workload customizes scheduling and resources of it
+func createOutboundPod(ctx context.Context, factory cmdutil.Factory, clientset *kubernetes.Clientset, namespace string, clusterWide bool, workload *util.WorkloadConfig) (err error) {
+	// pre-installed by `kubevpn install` or GitOps, user may not have permission to create or delete it, so only reuse it
+	deploy, err := clientset.AppsV1().Deployments(namespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	// traffic manager may be scaled down to zero by gc loop because of idle
+	if err == nil {
+		if err = scaleUpIfNeeded(ctx, clientset, namespace, workload); err != nil {
+			log.Warnln(err)
+		}
+	}
+	if deploy != nil && IsPreInstalled(deploy) {
+		_, err = polymorphichelpers.AttachablePodForObjectFn(factory, deploy, 2*time.Second)
+		if err != nil {
+			return fmt.Errorf("traffic manager is pre-installed in namespace %s, but it is not ready, err: %v", namespace, err)
+		}
+		log.Infoln("traffic manager is pre-installed, reuse it")
+		return nil
+	}
 
 	service, err := clientset.CoreV1().Services(namespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
 	if err == nil {
 		_, err = polymorphichelpers.AttachablePodForObjectFn(factory, service, 2*time.Second)
 		if err == nil {
-			_, err = updateRefCount(ctx, clientset.CoreV1().ConfigMaps(namespace), config.ConfigMapPodTrafficManager, 1)
-			if err != nil {
-				return
-			}
 			log.Infoln("traffic manager already exist, reuse it")
 			return nil
 		}
@@ -59,6 +64,8 @@ func createOutboundPod(ctx context.Context, factory cmdutil.Factory, clientset *
 		_ = clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(ctx, config.ConfigMapPodTrafficManager+"."+namespace, options)
 		_ = clientset.RbacV1().RoleBindings(namespace).Delete(ctx, config.ConfigMapPodTrafficManager, options)
 		_ = clientset.RbacV1().Roles(namespace).Delete(ctx, config.ConfigMapPodTrafficManager, options)
+		_ = clientset.RbacV1().ClusterRoleBindings().Delete(ctx, config.ConfigMapPodTrafficManager+"."+namespace, options)
+		_ = clientset.RbacV1().ClusterRoles().Delete(ctx, config.ConfigMapPodTrafficManager+"."+namespace, options)
 		_ = clientset.CoreV1().ServiceAccounts(namespace).Delete(ctx, config.ConfigMapPodTrafficManager, options)
 		_ = clientset.CoreV1().Services(namespace).Delete(ctx, config.ConfigMapPodTrafficManager, options)
 		_ = clientset.AppsV1().Deployments(namespace).Delete(ctx, config.ConfigMapPodTrafficManager, options)
@@ -85,282 +92,63 @@ func createOutboundPod(ctx context.Context, factory cmdutil.Factory, clientset *
 		return err
 	}
 
+	var certs *util.CertBundle
+	certs, err = util.GenCertBundle(namespace)
+	if err != nil {
+		return err
+	}
+	manager := GenTrafficManager(namespace, config.Image, clusterWide, false, workload, certs)
+
 	// 2) create serviceAccount
-	_, err = clientset.CoreV1().ServiceAccounts(namespace).Create(ctx, &v1.ServiceAccount{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      config.ConfigMapPodTrafficManager,
-			Namespace: namespace,
-		},
-		AutomountServiceAccountToken: pointer.Bool(true),
-	}, metav1.CreateOptions{})
+	_, err = clientset.CoreV1().ServiceAccounts(namespace).Create(ctx, manager.ServiceAccount, metav1.CreateOptions{})
 	if err != nil {
 		return err
 	}
 
 	// 3) create roles
-	_, err = clientset.RbacV1().Roles(namespace).Create(ctx, &rbacv1.Role{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      config.ConfigMapPodTrafficManager,
-			Namespace: namespace,
-		},
-		Rules: []rbacv1.PolicyRule{{
-			Verbs:         []string{"get", "list", "watch", "create", "update", "patch", "delete"},
-			APIGroups:     []string{""},
-			Resources:     []string{"configmaps", "secrets"},
-			ResourceNames: []string{config.ConfigMapPodTrafficManager},
-		}},
-	}, metav1.CreateOptions{})
+	_, err = clientset.RbacV1().Roles(namespace).Create(ctx, manager.Role, metav1.CreateOptions{})
 	if err != nil {
 		return err
 	}
 
 	// 4) create roleBinding
-	_, err = clientset.RbacV1().RoleBindings(namespace).Create(ctx, &rbacv1.RoleBinding{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      config.ConfigMapPodTrafficManager,
-			Namespace: namespace,
-		},
-		Subjects: []rbacv1.Subject{{
-			Kind: "ServiceAccount",
-			//APIGroup:  "rbac.authorization.k8s.io",
-			Name:      config.ConfigMapPodTrafficManager,
-			Namespace: namespace,
-		}},
-		RoleRef: rbacv1.RoleRef{
-			APIGroup: "rbac.authorization.k8s.io",
-			Kind:     "Role",
-			Name:     config.ConfigMapPodTrafficManager,
-		},
-	}, metav1.CreateOptions{})
+	_, err = clientset.RbacV1().RoleBindings(namespace).Create(ctx, manager.RoleBinding, metav1.CreateOptions{})
 	if err != nil {
 		return err
 	}
 
-	udp8422 := "8422-for-udp"
-	tcp10800 := "10800-for-tcp"
-	tcp9002 := "9002-for-envoy"
-	tcp80 := "80-for-webhook"
-	_, err = clientset.CoreV1().Services(namespace).Create(ctx, &v1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      config.ConfigMapPodTrafficManager,
-			Namespace: namespace,
-		},
-		Spec: v1.ServiceSpec{
-			Ports: []v1.ServicePort{{
-				Name:       udp8422,
-				Protocol:   v1.ProtocolUDP,
-				Port:       8422,
-				TargetPort: intstr.FromInt(8422),
-			}, {
-				Name:       tcp10800,
-				Protocol:   v1.ProtocolTCP,
-				Port:       10800,
-				TargetPort: intstr.FromInt(10800),
-			}, {
-				Name:       tcp9002,
-				Protocol:   v1.ProtocolTCP,
-				Port:       9002,
-				TargetPort: intstr.FromInt(9002),
-			}, {
-				Name:       tcp80,
-				Protocol:   v1.ProtocolTCP,
-				Port:       80,
-				TargetPort: intstr.FromInt(80),
-			}},
-			Selector: map[string]string{"app": config.ConfigMapPodTrafficManager},
-			Type:     v1.ServiceTypeClusterIP,
-		},
-	}, metav1.CreateOptions{})
+	// 5) create clusterRole and clusterRoleBinding, using TokenReview to authenticate sidecar
+	_, err = clientset.RbacV1().ClusterRoles().Create(ctx, manager.ClusterRole, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		// rules may be changed by new version
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			clusterRole, err := clientset.RbacV1().ClusterRoles().Get(ctx, manager.ClusterRole.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			clusterRole.Rules = manager.ClusterRole.Rules
+			_, err = clientset.RbacV1().ClusterRoles().Update(ctx, clusterRole, metav1.UpdateOptions{})
+			return err
+		})
+	}
 	if err != nil {
 		return err
 	}
-
-	var Resources = v1.ResourceRequirements{
-		Requests: map[v1.ResourceName]resource.Quantity{
-			v1.ResourceCPU:    resource.MustParse("500m"),
-			v1.ResourceMemory: resource.MustParse("512Mi"),
-		},
-		Limits: map[v1.ResourceName]resource.Quantity{
-			v1.ResourceCPU:    resource.MustParse("2000m"),
-			v1.ResourceMemory: resource.MustParse("2048Mi"),
-		},
+	_, err = clientset.RbacV1().ClusterRoleBindings().Create(ctx, manager.ClusterRoleBinding, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return err
 	}
 
-	domain := util.GetTlsDomain(namespace)
-	var crt, key []byte
-	crt, key, err = cert.GenerateSelfSignedCertKey(domain, nil, nil)
+	_, err = clientset.CoreV1().Services(namespace).Create(ctx, manager.Service, metav1.CreateOptions{})
 	if err != nil {
 		return err
 	}
 
-	// reason why not use v1.SecretTypeTls is because it needs key called tls.crt and tls.key, but tls.key can not as env variable
-	// ➜  ~ export tls.key=a
-	//export: not valid in this context: tls.key
-	secret := &v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      config.ConfigMapPodTrafficManager,
-			Namespace: namespace,
-		},
-		Data: map[string][]byte{
-			config.TLSCertKey:       crt,
-			config.TLSPrivateKeyKey: key,
-		},
-		Type: v1.SecretTypeOpaque,
-	}
-	_, err = clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
-
+	_, err = clientset.CoreV1().Secrets(namespace).Create(ctx, manager.Secret, metav1.CreateOptions{})
 	if err != nil && !k8serrors.IsAlreadyExists(err) {
 		return err
 	}
 
-	deployment := &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      config.ConfigMapPodTrafficManager,
-			Namespace: namespace,
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: pointer.Int32(1),
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{"app": config.ConfigMapPodTrafficManager},
-			},
-			Template: v1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{"app": config.ConfigMapPodTrafficManager},
-				},
-				Spec: v1.PodSpec{
-					ServiceAccountName: config.ConfigMapPodTrafficManager,
-					Volumes: []v1.Volume{{
-						Name: config.VolumeEnvoyConfig,
-						VolumeSource: v1.VolumeSource{
-							ConfigMap: &v1.ConfigMapVolumeSource{
-								LocalObjectReference: v1.LocalObjectReference{
-									Name: config.ConfigMapPodTrafficManager,
-								},
-								Items: []v1.KeyToPath{
-									{
-										Key:  config.KeyEnvoy,
-										Path: "envoy-config.yaml",
-									},
-								},
-								Optional: pointer.Bool(false),
-							},
-						},
-					}},
-					Containers: []v1.Container{
-						{
-							Name:    config.ContainerSidecarVPN,
-							Image:   config.Image,
-							Command: []string{"/bin/sh", "-c"},
-							Args: []string{`
-sysctl -w net.ipv4.ip_forward=1
-sysctl -w net.ipv6.conf.all.disable_ipv6=0
-sysctl -w net.ipv6.conf.all.forwarding=1
-update-alternatives --set iptables /usr/sbin/iptables-legacy
-iptables -F
-ip6tables -F
-iptables -P INPUT ACCEPT
-ip6tables -P INPUT ACCEPT
-iptables -P FORWARD ACCEPT
-ip6tables -P FORWARD ACCEPT
-iptables -t nat -A POSTROUTING -s ${CIDR4} -o eth0 -j MASQUERADE
-ip6tables -t nat -A POSTROUTING -s ${CIDR6} -o eth0 -j MASQUERADE
-kubevpn serve -L "tcp://:10800" -L "tun://:8422?net=${TunIPv4}" --debug=true`,
-							},
-							EnvFrom: []v1.EnvFromSource{{
-								SecretRef: &v1.SecretEnvSource{
-									LocalObjectReference: v1.LocalObjectReference{
-										Name: config.ConfigMapPodTrafficManager,
-									},
-								},
-							}},
-							Env: []v1.EnvVar{
-								{
-									Name:  "CIDR4",
-									Value: config.CIDR.String(),
-								},
-								{
-									Name:  "CIDR6",
-									Value: config.CIDR6.String(),
-								},
-								{
-									Name:  config.EnvInboundPodTunIPv4,
-									Value: innerIpv4CIDR.String(),
-								},
-								{
-									Name:  config.EnvInboundPodTunIPv6,
-									Value: innerIpv6CIDR.String(),
-								},
-							},
-							Ports: []v1.ContainerPort{{
-								Name:          udp8422,
-								ContainerPort: 8422,
-								Protocol:      v1.ProtocolUDP,
-							}, {
-								Name:          tcp10800,
-								ContainerPort: 10800,
-								Protocol:      v1.ProtocolTCP,
-							}},
-							Resources:       Resources,
-							ImagePullPolicy: v1.PullIfNotPresent,
-							SecurityContext: &v1.SecurityContext{
-								Capabilities: &v1.Capabilities{
-									Add: []v1.Capability{
-										"NET_ADMIN",
-										//"SYS_MODULE",
-									},
-								},
-								RunAsUser:  pointer.Int64(0),
-								Privileged: pointer.Bool(true),
-							},
-						},
-						{
-							Name:    config.ContainerSidecarControlPlane,
-							Image:   config.Image,
-							Command: []string{"kubevpn"},
-							Args:    []string{"control-plane", "--watchDirectoryFilename", "/etc/envoy/envoy-config.yaml"},
-							Ports: []v1.ContainerPort{{
-								Name:          tcp9002,
-								ContainerPort: 9002,
-								Protocol:      v1.ProtocolTCP,
-							}},
-							VolumeMounts: []v1.VolumeMount{
-								{
-									Name:      config.VolumeEnvoyConfig,
-									ReadOnly:  true,
-									MountPath: "/etc/envoy",
-								},
-							},
-							ImagePullPolicy: v1.PullIfNotPresent,
-							Resources:       Resources,
-						},
-						{
-							Name:    "webhook",
-							Image:   config.Image,
-							Command: []string{"kubevpn"},
-							Args:    []string{"webhook"},
-							Ports: []v1.ContainerPort{{
-								Name:          tcp80,
-								ContainerPort: 80,
-								Protocol:      v1.ProtocolTCP,
-							}},
-							EnvFrom: []v1.EnvFromSource{{
-								SecretRef: &v1.SecretEnvSource{
-									LocalObjectReference: v1.LocalObjectReference{
-										Name: config.ConfigMapPodTrafficManager,
-									},
-								},
-							}},
-							Env:             []v1.EnvVar{},
-							ImagePullPolicy: v1.PullIfNotPresent,
-							Resources:       Resources,
-						},
-					},
-					RestartPolicy:     v1.RestartPolicyAlways,
-					PriorityClassName: "system-cluster-critical",
-				},
-			},
-		},
-	}
 	watchStream, err := clientset.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
 		LabelSelector: fields.OneTermEqualSelector("app", config.ConfigMapPodTrafficManager).String(),
 	})
@@ -368,7 +156,7 @@ kubevpn serve -L "tcp://:10800" -L "tun://:8422?net=${TunIPv4}" --debug=true`,
 		return err
 	}
 	defer watchStream.Stop()
-	if _, err = clientset.AppsV1().Deployments(namespace).Create(ctx, deployment, metav1.CreateOptions{}); err != nil {
+	if _, err = clientset.AppsV1().Deployments(namespace).Create(ctx, manager.Deployment, metav1.CreateOptions{}); err != nil {
 		return err
 	}
 	var last string
@@ -406,48 +194,11 @@ out:
 			return errors.New(fmt.Sprintf("wait pod %s to be ready timeout", config.ConfigMapPodTrafficManager))
 		}
 	}
-	_, err = clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Create(ctx, &admissionv1.MutatingWebhookConfiguration{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      config.ConfigMapPodTrafficManager + "." + namespace,
-			Namespace: namespace,
-		},
-		Webhooks: []admissionv1.MutatingWebhook{{
-			Name: config.ConfigMapPodTrafficManager + ".naison.io", // no sense
-			ClientConfig: admissionv1.WebhookClientConfig{
-				Service: &admissionv1.ServiceReference{
-					Namespace: namespace,
-					Name:      config.ConfigMapPodTrafficManager,
-					Path:      pointer.String("/pods"),
-					Port:      pointer.Int32(80),
-				},
-				CABundle: crt,
-			},
-			Rules: []admissionv1.RuleWithOperations{{
-				Operations: []admissionv1.OperationType{admissionv1.Create, admissionv1.Delete},
-				Rule: admissionv1.Rule{
-					APIGroups:   []string{""},
-					APIVersions: []string{"v1"},
-					Resources:   []string{"pods"},
-					Scope:       (*admissionv1.ScopeType)(pointer.String(string(admissionv1.NamespacedScope))),
-				},
-			}},
-			FailurePolicy: (*admissionv1.FailurePolicyType)(pointer.String(string(admissionv1.Ignore))),
-			// same as above label ns
-			NamespaceSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"ns": namespace}},
-			SideEffects:             (*admissionv1.SideEffectClass)(pointer.String(string(admissionv1.SideEffectClassNone))),
-			TimeoutSeconds:          nil,
-			AdmissionReviewVersions: []string{"v1", "v1beta1"},
-			ReinvocationPolicy:      (*admissionv1.ReinvocationPolicyType)(pointer.String(string(admissionv1.NeverReinvocationPolicy))),
-		}},
-	}, metav1.CreateOptions{})
+	_, err = clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Create(ctx, manager.Webhook, metav1.CreateOptions{})
 	if err != nil && !k8serrors.IsForbidden(err) && !k8serrors.IsAlreadyExists(err) {
 		return fmt.Errorf("failed to create MutatingWebhookConfigurations, err: %v", err)
 	}
-	_, err = updateRefCount(ctx, clientset.CoreV1().ConfigMaps(namespace), config.ConfigMapPodTrafficManager, 1)
-	if err != nil {
-		return
-	}
-	return
+	return nil
 }
 
 func InjectVPNSidecar(ctx1 context.Context, factory cmdutil.Factory, namespace, workloads string, config util.PodRouteConfig) error {
@@ -483,12 +234,12 @@ func InjectVPNSidecar(ctx1 context.Context, factory cmdutil.Factory, namespace,
 			return err
 		}
 
-		RollbackFuncList = append(RollbackFuncList, func() {
+		originPod, _ := json.Marshal(&v1.Pod{ObjectMeta: origin.ObjectMeta, Spec: origin.Spec})
+		recordJournal(JournalEntry{Kind: JournalExchange, Namespace: namespace, Workload: workloads, Origin: originPod})
+		RollbackFuncList = append(RollbackFuncList, func() error {
 			p2 := &v1.Pod{ObjectMeta: origin.ObjectMeta, Spec: origin.Spec}
 			CleanupUselessInfo(p2)
-			if err = createAfterDeletePod(factory, p2, helper); err != nil {
-				log.Error(err)
-			}
+			return createAfterDeletePod(factory, p2, helper)
 		})
 	} else
 	// controllers
@@ -507,15 +258,18 @@ func InjectVPNSidecar(ctx1 context.Context, factory cmdutil.Factory, namespace,
 			return err
 		}
 
-		RollbackFuncList = append(RollbackFuncList, func() {
-			if err = removeInboundContainer(factory, namespace, workloads); err != nil {
-				log.Error(err)
+		restore, _ := json.Marshal(restorePatch)
+		recordJournal(JournalEntry{Kind: JournalExchange, Namespace: namespace, Workload: workloads, Origin: restore})
+		RollbackFuncList = append(RollbackFuncList, func() error {
+			if err := removeInboundContainer(factory, namespace, workloads); err != nil {
+				return err
 			}
 			b, _ := json.Marshal(restorePatch)
-			if _, err = helper.Patch(object.Namespace, object.Name, types.JSONPatchType, b, &metav1.PatchOptions{}); err != nil {
+			if _, err := helper.Patch(object.Namespace, object.Name, types.JSONPatchType, b, &metav1.PatchOptions{}); err != nil {
 				log.Warnf("error while restore probe of resource: %s %s, ignore, err: %v",
 					object.Mapping.GroupVersionKind.GroupKind().String(), object.Name, err)
 			}
+			return nil
 		})
 	}
 	if err != nil {
@@ -19,7 +19,7 @@ import (
 // 1, get all proxy-resources from configmap
 // 2, cleanup all containers
 func (c *ConnectOptions) Reset(ctx context.Context) error {
-	cm, err := c.clientset.CoreV1().ConfigMaps(c.Namespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	cm, err := c.clientset.CoreV1().ConfigMaps(c.managerNamespace()).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
 	if err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
@@ -31,11 +31,16 @@ func (c *ConnectOptions) Reset(ctx context.Context) error {
 				return err
 			}
 			for _, virtual := range v {
+				namespace, uid := c.Namespace, virtual.Uid
+				// namespace.deployments.apps.ry-server --> deployments.apps.ry-server
+				if virtual.Namespace != "" {
+					namespace, uid = virtual.Namespace, strings.TrimPrefix(uid, virtual.Namespace+".")
+				}
 				// deployments.apps.ry-server --> deployments.apps/ry-server
-				lastIndex := strings.LastIndex(virtual.Uid, ".")
-				uid := virtual.Uid[:lastIndex] + "/" + virtual.Uid[lastIndex+1:]
+				lastIndex := strings.LastIndex(uid, ".")
+				uid = uid[:lastIndex] + "/" + uid[lastIndex+1:]
 				for _, rule := range virtual.Rules {
-					err = UnPatchContainer(c.factory, c.clientset.CoreV1().ConfigMaps(c.Namespace), c.Namespace, uid, rule.Headers)
+					err = UnPatchContainer(c.factory, c.clientset.CoreV1().ConfigMaps(c.managerNamespace()), namespace, uid, c.ManagerNamespace, rule.Headers)
 					if err != nil {
 						log.Error(err)
 						continue
@@ -44,7 +49,7 @@ func (c *ConnectOptions) Reset(ctx context.Context) error {
 			}
 		}
 	}
-	cleanup(ctx, c.clientset, c.Namespace, config.ConfigMapPodTrafficManager, false)
+	cleanup(ctx, c.clientset, c.managerNamespace(), config.ConfigMapPodTrafficManager, false)
 	var cli *client.Client
 	if cli, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation()); err != nil {
 		return nil
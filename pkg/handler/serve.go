@@ -1,10 +1,14 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -15,7 +19,7 @@ import (
 
 func Complete(route *core.Route) error {
 	if v, ok := os.LookupEnv(config.EnvInboundPodTunIPv4); ok && v == "" {
-		namespace := os.Getenv(config.EnvPodNamespace)
+		namespace := trafficManagerNamespace()
 		if namespace == "" {
 			return fmt.Errorf("can not get namespace")
 		}
@@ -24,8 +28,11 @@ func Complete(route *core.Route) error {
 		if err != nil {
 			return fmt.Errorf("can not new req, err: %v", err)
 		}
+		if err = setAuthorization(req); err != nil {
+			return err
+		}
 		req.Header.Set(config.HeaderPodName, os.Getenv(config.EnvPodName))
-		req.Header.Set(config.HeaderPodNamespace, namespace)
+		req.Header.Set(config.HeaderPodNamespace, os.Getenv(config.EnvPodNamespace))
 		var ip []byte
 		ip, err = util.DoReq(req)
 		if err != nil {
@@ -61,16 +68,116 @@ func Complete(route *core.Route) error {
 }
 
 func Final() error {
-	namespace := os.Getenv(config.EnvPodNamespace)
-	url := fmt.Sprintf("https://%s:80%s", util.GetTlsDomain(namespace), config.APIReleaseIP)
+	url := fmt.Sprintf("https://%s:80%s", util.GetTlsDomain(trafficManagerNamespace()), config.APIReleaseIP)
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		return fmt.Errorf("can not new req, err: %v", err)
 	}
+	if err = setAuthorization(req); err != nil {
+		return err
+	}
 	req.Header.Set(config.HeaderPodName, os.Getenv(config.EnvPodName))
-	req.Header.Set(config.HeaderPodNamespace, namespace)
+	req.Header.Set(config.HeaderPodNamespace, os.Getenv(config.EnvPodNamespace))
 	req.Header.Set(config.HeaderIPv4, os.Getenv(config.EnvInboundPodTunIPv4))
 	req.Header.Set(config.HeaderIPv6, os.Getenv(config.EnvInboundPodTunIPv6))
 	_, err = util.DoReq(req)
 	return err
 }
+
+// CertResponse client cert of envoy sidecar issued by traffic manager
+type CertResponse struct {
+	CA  string `json:"ca"`
+	Crt string `json:"crt"`
+	Key string `json:"key"`
+}
+
+// RenewEnvoyCert issue client cert of envoy sidecar from traffic manager, write it into dir as envoy sds files,
+// and renew it before expiry, envoy watches dir and reloads it
+func RenewEnvoyCert(ctx context.Context, dir string) {
+	for ctx.Err() == nil {
+		next := time.Second * 5
+		if renewAt, err := issueEnvoyCert(dir); err != nil {
+			log.Errorf("failed to issue cert of envoy, retry after %s, err: %v", next, err)
+		} else {
+			next = time.Until(renewAt)
+			log.Infof("issued cert of envoy, renew it at %s", renewAt.Format(time.RFC3339))
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(next):
+		}
+	}
+}
+
+func issueEnvoyCert(dir string) (time.Time, error) {
+	url := fmt.Sprintf("https://%s:80%s", util.GetTlsDomain(trafficManagerNamespace()), config.APIIssueCert)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("can not new req, err: %v", err)
+	}
+	if err = setAuthorization(req); err != nil {
+		return time.Time{}, err
+	}
+	body, err := util.DoReq(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var resp CertResponse
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return time.Time{}, err
+	}
+	renewAt, err := util.RenewAt([]byte(resp.Crt))
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert := map[string]any{
+		"name": "xds_client_cert",
+		"tls_certificate": map[string]any{
+			"certificate_chain": map[string]string{"inline_string": resp.Crt},
+			"private_key":       map[string]string{"inline_string": resp.Key},
+		},
+	}
+	ca := map[string]any{
+		"name": "xds_ca",
+		"validation_context": map[string]any{
+			"trusted_ca": map[string]string{"inline_string": resp.CA},
+		},
+	}
+	// write ca first, envoy starts once both files exist
+	if err = writeSDS(dir, config.EnvoyTLSCAFile, ca); err != nil {
+		return time.Time{}, err
+	}
+	return renewAt, writeSDS(dir, config.EnvoyTLSCertFile, cert)
+}
+
+// writeSDS write envoy sds file by rename, envoy only reloads it on move event of watched directory
+func writeSDS(dir, name string, secret map[string]any) error {
+	secret["@type"] = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret"
+	content, err := json.Marshal(map[string]any{"resources": []any{secret}})
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	if err = os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// setAuthorization traffic manager only trust projected service account token, not header POD_NAME and POD_NAMESPACE
+func setAuthorization(req *http.Request) error {
+	token, err := util.GetToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set(config.HeaderAuthorization, "Bearer "+token)
+	return nil
+}
+
+// trafficManagerNamespace cluster-wide traffic manager is in other namespace
+func trafficManagerNamespace() string {
+	if namespace := os.Getenv(config.EnvTrafficManagerNamespace); namespace != "" {
+		return namespace
+	}
+	return os.Getenv(config.EnvPodNamespace)
+}
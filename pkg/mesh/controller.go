@@ -1,6 +1,7 @@
 package mesh
 
 import (
+	"bytes"
 	_ "embed"
 
 	log "github.com/sirupsen/logrus"
@@ -24,12 +25,15 @@ func RemoveContainers(spec *v1.PodTemplateSpec) {
 			i--
 		}
 	}
+	util.RemoveTokenVolume(&spec.Spec)
+	removeEnvoyTLSVolume(&spec.Spec)
 }
 
 // todo envoy support ipv6
 func AddMeshContainer(spec *v1.PodTemplateSpec, nodeId string, c util.PodRouteConfig) {
 	// remove envoy proxy containers if already exist
 	RemoveContainers(spec)
+	env := c.TrafficManagerEnv()
 	spec.Spec.Containers = append(spec.Spec.Containers, v1.Container{
 		Name:    config.ContainerSidecarVPN,
 		Image:   config.Image,
@@ -51,14 +55,7 @@ iptables -t nat -A POSTROUTING ! -p icmp ! -s 127.0.0.1 ! -d ${CIDR4} -j MASQUER
 ip6tables -t nat -A POSTROUTING ! -p icmp ! -s 0:0:0:0:0:0:0:1 ! -d ${CIDR6} -j MASQUERADE
 kubevpn serve -L "tun:/localhost:8422?net=${TunIPv4}&route=${CIDR4}" -F "tcp://${TrafficManagerService}:10800"`,
 		},
-		EnvFrom: []v1.EnvFromSource{{
-			SecretRef: &v1.SecretEnvSource{
-				LocalObjectReference: v1.LocalObjectReference{
-					Name: config.ConfigMapPodTrafficManager,
-				},
-			},
-		}},
-		Env: []v1.EnvVar{
+		Env: append(env, []v1.EnvVar{
 			{
 				Name:  "CIDR4",
 				Value: config.CIDR.String(),
@@ -77,7 +74,11 @@ kubevpn serve -L "tun:/localhost:8422?net=${TunIPv4}&route=${CIDR4}" -F "tcp://$
 			},
 			{
 				Name:  "TrafficManagerService",
-				Value: config.ConfigMapPodTrafficManager,
+				Value: c.TrafficManagerService(),
+			},
+			{
+				Name:  config.EnvEnvoyTLSDir,
+				Value: config.EnvoyTLSMountPath,
 			},
 			{
 				Name: config.EnvPodNamespace,
@@ -95,8 +96,12 @@ kubevpn serve -L "tun:/localhost:8422?net=${TunIPv4}&route=${CIDR4}" -F "tcp://$
 					},
 				},
 			},
-		},
-		Resources: v1.ResourceRequirements{
+		}...),
+		VolumeMounts: []v1.VolumeMount{util.TokenVolumeMount(), {
+			Name:      config.VolumeEnvoyTLS,
+			MountPath: config.EnvoyTLSMountPath,
+		}},
+		Resources: c.Workload.SidecarResourcesOrDefault(v1.ResourceRequirements{
 			Requests: map[v1.ResourceName]resource.Quantity{
 				v1.ResourceCPU:    resource.MustParse("128m"),
 				v1.ResourceMemory: resource.MustParse("128Mi"),
@@ -105,7 +110,7 @@ kubevpn serve -L "tun:/localhost:8422?net=${TunIPv4}&route=${CIDR4}" -F "tcp://$
 				v1.ResourceCPU:    resource.MustParse("256m"),
 				v1.ResourceMemory: resource.MustParse("256Mi"),
 			},
-		},
+		}),
 		ImagePullPolicy: v1.PullIfNotPresent,
 		SecurityContext: &v1.SecurityContext{
 			Capabilities: &v1.Capabilities{
@@ -119,24 +124,34 @@ kubevpn serve -L "tun:/localhost:8422?net=${TunIPv4}&route=${CIDR4}" -F "tcp://$
 		},
 	})
 	spec.Spec.Containers = append(spec.Spec.Containers, v1.Container{
-		Name:  config.ContainerSidecarEnvoyProxy,
-		Image: config.Image,
-		Command: []string{
-			"envoy",
-			"-l",
-			"error",
-			"--base-id",
-			"1",
-			"--service-node",
-			nodeId,
-			"--service-cluster",
-			nodeId,
-			"--config-yaml",
+		Name:    config.ContainerSidecarEnvoyProxy,
+		Image:   config.Image,
+		Command: []string{"/bin/sh", "-c"},
+		// wait for client cert which vpn sidecar issues from traffic manager, control-plane requires mTLS
+		Args: []string{`
+while [ ! -f ${EnvoyTLSDir}/` + config.EnvoyTLSCAFile + ` ] || [ ! -f ${EnvoyTLSDir}/` + config.EnvoyTLSCertFile + ` ]; do sleep 1; done
+exec envoy -l error --base-id 1 --service-node ${NodeID} --service-cluster ${NodeID} --config-yaml "${EnvoyConfig}"`,
 		},
-		Args: []string{
-			string(envoyConfig),
+		Env: []v1.EnvVar{
+			{
+				Name:  config.EnvEnvoyTLSDir,
+				Value: config.EnvoyTLSMountPath,
+			},
+			{
+				Name:  "NodeID",
+				Value: nodeId,
+			},
+			{
+				Name:  "EnvoyConfig",
+				Value: string(bytes.ReplaceAll(envoyConfig, []byte(`"`+config.ConfigMapPodTrafficManager+`"`), []byte(`"`+c.TrafficManagerService()+`"`))),
+			},
 		},
-		Resources: v1.ResourceRequirements{
+		VolumeMounts: []v1.VolumeMount{{
+			Name:      config.VolumeEnvoyTLS,
+			ReadOnly:  true,
+			MountPath: config.EnvoyTLSMountPath,
+		}},
+		Resources: c.Workload.SidecarResourcesOrDefault(v1.ResourceRequirements{
 			Requests: map[v1.ResourceName]resource.Quantity{
 				v1.ResourceCPU:    resource.MustParse("128m"),
 				v1.ResourceMemory: resource.MustParse("128Mi"),
@@ -145,9 +160,32 @@ kubevpn serve -L "tun:/localhost:8422?net=${TunIPv4}&route=${CIDR4}" -F "tcp://$
 				v1.ResourceCPU:    resource.MustParse("256m"),
 				v1.ResourceMemory: resource.MustParse("256Mi"),
 			},
-		},
+		}),
 		ImagePullPolicy: v1.PullIfNotPresent,
 	})
+	util.AddTokenVolume(&spec.Spec)
+	addEnvoyTLSVolume(&spec.Spec)
+	c.Workload.AddImagePullSecrets(&spec.Spec)
+}
+
+// addEnvoyTLSVolume vpn sidecar writes client cert of envoy into it
+func addEnvoyTLSVolume(spec *v1.PodSpec) {
+	removeEnvoyTLSVolume(spec)
+	spec.Volumes = append(spec.Volumes, v1.Volume{
+		Name: config.VolumeEnvoyTLS,
+		VolumeSource: v1.VolumeSource{
+			EmptyDir: &v1.EmptyDirVolumeSource{Medium: v1.StorageMediumMemory},
+		},
+	})
+}
+
+func removeEnvoyTLSVolume(spec *v1.PodSpec) {
+	for i := 0; i < len(spec.Volumes); i++ {
+		if spec.Volumes[i].Name == config.VolumeEnvoyTLS {
+			spec.Volumes = append(spec.Volumes[:i], spec.Volumes[i+1:]...)
+			i--
+		}
+	}
 }
 
 func init() {
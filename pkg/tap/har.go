@@ -0,0 +1,265 @@
+package tap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tapv3 "github.com/envoyproxy/go-control-plane/envoy/data/tap/v3"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+)
+
+// HAR http archive, http://www.softwareishard.com/blog/har-12-spec
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string   `json:"version"`
+	Creator Creator  `json:"creator"`
+	Entries []*Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry one request and response, it is also one line of jsonl file
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"`
+	Request         Request   `json:"request"`
+	Response        Response  `json:"response"`
+	// Workload which request is recorded from
+	Workload string `json:"_workload,omitempty"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// Encoding is not in HAR spec, base64 if body is binary
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Body decode body of request
+func (p *PostData) Body() ([]byte, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if p.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(p.Text)
+	}
+	return []byte(p.Text), nil
+}
+
+// ToEntry convert envoy tap trace to har entry
+func ToEntry(trace *tapv3.HttpBufferedTrace, workload string) *Entry {
+	entry := &Entry{StartedDateTime: time.Now(), Workload: workload}
+	req, resp := trace.GetRequest(), trace.GetResponse()
+
+	var scheme, authority, path = "http", "", "/"
+	for _, header := range req.GetHeaders() {
+		switch header.GetKey() {
+		case ":method":
+			entry.Request.Method = header.GetValue()
+		case ":scheme":
+			scheme = header.GetValue()
+		case ":authority":
+			authority = header.GetValue()
+		case ":path":
+			path = header.GetValue()
+		default:
+			entry.Request.Headers = append(entry.Request.Headers, NameValue{Name: header.GetKey(), Value: header.GetValue()})
+		}
+	}
+	entry.Request.URL = fmt.Sprintf("%s://%s%s", scheme, authority, path)
+	entry.Request.HTTPVersion = "HTTP/1.1"
+	entry.Request.HeadersSize = -1
+	if _, query, found := strings.Cut(path, "?"); found {
+		for _, kv := range strings.Split(query, "&") {
+			k, v, _ := strings.Cut(kv, "=")
+			entry.Request.QueryString = append(entry.Request.QueryString, NameValue{Name: k, Value: v})
+		}
+	}
+	if body := bodyBytes(req.GetBody()); len(body) != 0 {
+		text, encoding := encodeBody(body)
+		entry.Request.PostData = &PostData{MimeType: headerValue(entry.Request.Headers, "content-type"), Text: text, Encoding: encoding}
+		entry.Request.BodySize = len(body)
+	}
+
+	for _, header := range resp.GetHeaders() {
+		if header.GetKey() == ":status" {
+			entry.Response.Status, _ = strconv.Atoi(header.GetValue())
+			entry.Response.StatusText = http.StatusText(entry.Response.Status)
+			continue
+		}
+		entry.Response.Headers = append(entry.Response.Headers, NameValue{Name: header.GetKey(), Value: header.GetValue()})
+	}
+	body := bodyBytes(resp.GetBody())
+	text, encoding := encodeBody(body)
+	entry.Response.Content = Content{Size: len(body), MimeType: headerValue(entry.Response.Headers, "content-type"), Text: text, Encoding: encoding}
+	entry.Response.HTTPVersion = "HTTP/1.1"
+	entry.Response.HeadersSize = -1
+	entry.Response.BodySize = len(body)
+	return entry
+}
+
+func bodyBytes(body *tapv3.Body) []byte {
+	if body == nil {
+		return nil
+	}
+	if b := body.GetAsBytes(); b != nil {
+		return b
+	}
+	return []byte(body.GetAsString())
+}
+
+func encodeBody(body []byte) (text string, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func headerValue(headers []NameValue, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// Writer write entries to file, .har file is rewritten after each entry, others are jsonl which appends one entry per line
+type Writer struct {
+	path string
+	har  *HAR
+	file *os.File
+}
+
+func NewWriter(path string) (*Writer, error) {
+	w := &Writer{path: path}
+	if IsHAR(path) {
+		w.har = &HAR{Log: Log{Version: "1.2", Creator: Creator{Name: "kubevpn", Version: config.Version}, Entries: []*Entry{}}}
+		return w, w.flush()
+	}
+	var err error
+	w.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return w, err
+}
+
+func (w *Writer) Write(entry *Entry) error {
+	if w.har == nil {
+		bytes, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = w.file.Write(append(bytes, '\n'))
+		return err
+	}
+	w.har.Log.Entries = append(w.har.Log.Entries, entry)
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	bytes, err := json.MarshalIndent(w.har, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to temp file then rename, file is always complete even if interrupted
+	tmp := w.path + ".tmp"
+	if err = os.WriteFile(tmp, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
+
+func (w *Writer) Close() error {
+	if w.file != nil {
+		return w.file.Close()
+	}
+	return nil
+}
+
+func IsHAR(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".har")
+}
+
+// ReadEntries read entries from .har or jsonl file
+func ReadEntries(path string) ([]*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if IsHAR(path) {
+		var har HAR
+		if err = json.NewDecoder(f).Decode(&har); err != nil {
+			return nil, fmt.Errorf("failed to parse har file %s, err: %v", path, err)
+		}
+		return har.Log.Entries, nil
+	}
+	var entries []*Entry
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		bytes, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(bytes))) != 0 {
+			var entry Entry
+			if errs := json.Unmarshal(bytes, &entry); errs != nil {
+				return nil, fmt.Errorf("failed to parse line %d of %s, err: %v", line, path, errs)
+			}
+			entries = append(entries, &entry)
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package tap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	tapv3 "github.com/envoyproxy/go-control-plane/envoy/data/tap/v3"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/controlplane"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+type RecordOptions struct {
+	Namespace string
+	Workloads []string
+	// Output .har file or jsonl file
+	Output string
+	// MaxBodyBytes body larger than it will be truncated
+	MaxBodyBytes int
+
+	factory    cmdutil.Factory
+	clientset  *kubernetes.Clientset
+	restclient *rest.RESTClient
+	config     *rest.Config
+}
+
+func (r *RecordOptions) InitClient(f cmdutil.Factory) (err error) {
+	r.factory = f
+	if r.config, err = r.factory.ToRESTConfig(); err != nil {
+		return
+	}
+	if r.restclient, err = r.factory.RESTClient(); err != nil {
+		return
+	}
+	if r.clientset, err = r.factory.KubernetesClientSet(); err != nil {
+		return
+	}
+	if r.Namespace, _, err = r.factory.ToRawKubeConfigLoader().Namespace(); err != nil {
+		return
+	}
+	return
+}
+
+// DoRecord start tap session on envoy sidecar of all pods of workloads, write request and response into output until ctx done,
+// requests which hit rules of other local PC are not recorded
+func (r *RecordOptions) DoRecord(ctx context.Context) error {
+	ips, err := util.GetLocalTunIPs()
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("can not find tun device of kubevpn, please connect to cluster and proxy workloads with --headers first")
+	}
+	writer, err := NewWriter(r.Output)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	var lock sync.Mutex
+	var write = func(entry *Entry) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err := writer.Write(entry); err != nil {
+			log.Errorf("failed to write %s, err: %v", r.Output, err)
+			return
+		}
+		log.Infof("%s %s %s %d", entry.Workload, entry.Request.Method, entry.Request.URL, entry.Response.Status)
+	}
+
+	var wg sync.WaitGroup
+	for _, workload := range r.Workloads {
+		pods, err := r.getMeshPods(ctx, workload)
+		if err != nil {
+			return err
+		}
+		for _, pod := range pods {
+			wg.Add(1)
+			go func(workload string, pod v1.Pod) {
+				defer wg.Done()
+				if err := r.tapPod(ctx, pod, ips, func(entry *Entry) {
+					entry.Workload = workload
+					write(entry)
+				}); err != nil && ctx.Err() == nil {
+					log.Errorf("failed to record pod %s, err: %v", pod.Name, err)
+				}
+			}(workload, pod)
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// getMeshPods pods of workload which injected envoy sidecar, only mesh mode has envoy
+func (r *RecordOptions) getMeshPods(ctx context.Context, workload string) ([]v1.Pod, error) {
+	object, err := util.GetUnstructuredObject(r.factory, r.Namespace, workload)
+	if err != nil {
+		return nil, err
+	}
+	templateSpec, _, err := util.GetPodTemplateSpecPath(object.Object.(*unstructured.Unstructured))
+	if err != nil {
+		return nil, err
+	}
+	list, err := r.clientset.CoreV1().Pods(r.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(templateSpec.Labels).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var pods []v1.Pod
+	for _, pod := range list.Items {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if container.Name == config.ContainerSidecarEnvoyProxy {
+				pods = append(pods, pod)
+				break
+			}
+		}
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("can not find running pod with container %s of %s, please proxy it with --headers first", config.ContainerSidecarEnvoyProxy, workload)
+	}
+	return pods, nil
+}
+
+// tapPod port-forward envoy admin port, start a streaming tap session, envoy sends a trace after each request is finished,
+// only traffic of rules which route to ips is tapped
+func (r *RecordOptions) tapPod(ctx context.Context, pod v1.Pod, ips []string, fn func(*Entry)) error {
+	port := util.GetAvailableTCPPortOrDie()
+	readyChan := make(chan struct{})
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- util.PortForwardPod(r.config, r.restclient, pod.Name, pod.Namespace, fmt.Sprintf("%d:%d", port, config.EnvoyAdminPort), readyChan, stopChan)
+	}()
+	select {
+	case <-readyChan:
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	body := tapRequest(ips, r.MaxBodyBytes)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/tap", port), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to start tap session, status: %d, body: %s", resp.StatusCode, string(b))
+	}
+	log.Infof("recording pod %s", pod.Name)
+
+	// traces are concatenated json objects
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var raw json.RawMessage
+		if err = decoder.Decode(&raw); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		var trace tapv3.TraceWrapper
+		if err = (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(raw, &trace); err != nil {
+			log.Warnf("failed to parse trace, err: %v", err)
+			continue
+		}
+		if t := trace.GetHttpBufferedTrace(); t != nil {
+			fn(ToEntry(t, ""))
+		}
+	}
+}
+
+// tapRequest body of envoy admin api /tap, match response header tagged by route of rule, route name is ip_port
+func tapRequest(ips []string, maxBodyBytes int) string {
+	var rules strings.Builder
+	for _, ip := range ips {
+		rules.WriteString(fmt.Sprintf(`
+        - http_response_headers_match:
+            headers:
+              - name: %s
+                string_match:
+                  prefix: %q`, controlplane.HeaderRoute, ip+"_"))
+	}
+	return fmt.Sprintf(`
+config_id: %s
+tap_config:
+  match:
+    or_match:
+      rules:%s
+  output_config:
+    max_buffered_rx_bytes: %d
+    max_buffered_tx_bytes: %d
+    sinks:
+      - streaming_admin: {}
+`, controlplane.TapConfigID, rules.String(), maxBodyBytes, maxBodyBytes)
+}
@@ -0,0 +1,107 @@
+package tap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// hop-by-hop headers and headers added by envoy, not replay them
+var skipHeaders = sets.New[string]("connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "te", "content-length",
+	"x-forwarded-proto", "x-request-id", "x-envoy-expected-rq-timeout-ms", "x-envoy-original-path")
+
+type ReplayOptions struct {
+	File string
+	// To address of local process, eg: localhost:8080
+	To string
+}
+
+// ReplayResult result of one replayed request
+type ReplayResult struct {
+	Entry    *Entry
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+// DoReplay re-send requests in file to local process one by one, keep original path, query, headers and body
+func (r *ReplayOptions) DoReplay(ctx context.Context, fn func(ReplayResult)) error {
+	entries, err := ReadEntries(r.File)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no request in file %s", r.File)
+	}
+	to := r.To
+	if !strings.Contains(to, "://") {
+		to = "http://" + to
+	}
+	target, err := url.Parse(to)
+	if err != nil {
+		return fmt.Errorf("invalid address %s, err: %v", r.To, err)
+	}
+	client := &http.Client{
+		// not follow redirect, same as recorded
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fn(replay(ctx, client, target, entry))
+	}
+	return nil
+}
+
+func replay(ctx context.Context, client *http.Client, target *url.URL, entry *Entry) ReplayResult {
+	result := ReplayResult{Entry: entry}
+	origin, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		result.Err = fmt.Errorf("invalid url %s, err: %v", entry.Request.URL, err)
+		return result
+	}
+	u := *origin
+	u.Scheme, u.Host = target.Scheme, target.Host
+	body, err := entry.Request.PostData.Body()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req, err := http.NewRequestWithContext(ctx, entry.Request.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	for _, header := range entry.Request.Headers {
+		if skipHeaders.Has(strings.ToLower(header.Name)) {
+			continue
+		}
+		req.Header.Add(header.Name, header.Value)
+	}
+	// keep original host, service may route by it
+	req.Host = origin.Host
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	result.Status = resp.StatusCode
+	if resp.StatusCode != entry.Response.Status {
+		log.Debugf("status of %s %s is %d, but recorded is %d", entry.Request.Method, entry.Request.URL, resp.StatusCode, entry.Response.Status)
+	}
+	return result
+}
@@ -139,6 +139,12 @@ func AddRoutes(routes ...types.Route) error {
 	return addTunRoutes(env, routes...)
 }
 
+// DeleteRoutes for outer called
+func DeleteRoutes(routes ...types.Route) error {
+	env := os.Getenv(config.EnvTunNameOrLUID)
+	return deleteTunRoutes(env, routes...)
+}
+
 func GetInterface() (*net.Interface, error) {
 	return getInterface()
 }
@@ -104,6 +104,28 @@ func addTunRoutes(ifName string, routes ...types.Route) error {
 	return nil
 }
 
+func deleteTunRoutes(ifName string, routes ...types.Route) error {
+	for _, route := range routes {
+		if route.Dst.String() == "" {
+			continue
+		}
+		var cmd string
+		// ipv4
+		if route.Dst.IP.To4() != nil {
+			cmd = fmt.Sprintf("route delete -net %s -interface %s", route.Dst.String(), ifName)
+		} else { // ipv6
+			cmd = fmt.Sprintf("route delete -inet6 %s -interface %s", route.Dst.String(), ifName)
+		}
+		log.Debugf("[tun] %s", cmd)
+		args := strings.Split(cmd, " ")
+		err := exec.Command(args[0], args[1:]...).Run()
+		if err != nil {
+			return fmt.Errorf("%s: %v", cmd, err)
+		}
+	}
+	return nil
+}
+
 func getInterface() (*net.Interface, error) {
 	return net.InterfaceByName(os.Getenv(config.EnvTunNameOrLUID))
 }
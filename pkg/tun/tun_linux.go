@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/exec"
+	"strings"
 	"syscall"
 
 	"github.com/containernetworking/cni/pkg/types"
@@ -113,6 +115,20 @@ func addTunRoutes(ifName string, routes ...types.Route) error {
 	return nil
 }
 
+func deleteTunRoutes(ifName string, routes ...types.Route) error {
+	for _, route := range routes {
+		if route.Dst.String() == "" {
+			continue
+		}
+		cmd := exec.Command("ip", "route", "del", route.Dst.String(), "dev", ifName)
+		log.Debugf("[tun] %s", strings.Join(cmd.Args, " "))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %v, output: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
 func getInterface() (*net.Interface, error) {
 	return net.InterfaceByName(os.Getenv(config.EnvTunNameOrLUID))
 }
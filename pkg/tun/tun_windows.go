@@ -126,6 +126,37 @@ func addTunRoutes(luid string, routes ...types.Route) error {
 	return nil
 }
 
+func deleteTunRoutes(luid string, routes ...types.Route) error {
+	parseUint, err := strconv.ParseUint(luid, 10, 64)
+	if err != nil {
+		return err
+	}
+	ifName := winipcfg.LUID(parseUint)
+	for _, route := range routes {
+		if route.Dst.String() == "" {
+			continue
+		}
+		var gw = net.IPv4zero
+		if route.Dst.IP.To4() == nil {
+			gw = net.IPv6zero
+		}
+		prefix, err := netip.ParsePrefix(route.Dst.String())
+		if err != nil {
+			return err
+		}
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(gw.String())
+		if err != nil {
+			return err
+		}
+		err = ifName.DeleteRoute(prefix, addr)
+		if err != nil && err != windows.ERROR_NOT_FOUND {
+			return err
+		}
+	}
+	return nil
+}
+
 type winTunConn struct {
 	ifce  wireguardtun.Device
 	addr  net.Addr
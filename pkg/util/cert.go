@@ -0,0 +1,195 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+)
+
+// CertBundle internal CA of traffic manager and server cert of webhook and control-plane signed by it
+type CertBundle struct {
+	CACrt []byte
+	CAKey []byte
+	Crt   []byte
+	Key   []byte
+}
+
+// GenCertBundle generate internal CA and server cert of traffic manager in namespace
+func GenCertBundle(namespace string) (*CertBundle, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := cert.NewSelfSignedCACert(cert.Config{CommonName: config.ConfigMapPodTrafficManager + "-ca"}, caKey)
+	if err != nil {
+		return nil, err
+	}
+	caKeyPEM, err := keyutil.MarshalPrivateKeyToPEM(caKey)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &CertBundle{CACrt: pem.EncodeToMemory(&pem.Block{Type: cert.CertificateBlockType, Bytes: caCert.Raw}), CAKey: caKeyPEM}
+	bundle.Crt, bundle.Key, err = IssueServerCert(bundle.CACrt, bundle.CAKey, namespace)
+	return bundle, err
+}
+
+// TrafficManagerDNSNames dns names of traffic manager service, sidecar in same namespace uses short name
+func TrafficManagerDNSNames(namespace string) []string {
+	return []string{
+		config.ConfigMapPodTrafficManager,
+		config.ConfigMapPodTrafficManager + "." + namespace,
+		GetTlsDomain(namespace),
+	}
+}
+
+// IssueServerCert issue cert of webhook and control-plane
+func IssueServerCert(caCrt, caKey []byte, namespace string) ([]byte, []byte, error) {
+	return IssueCert(caCrt, caKey, GetTlsDomain(namespace), TrafficManagerDNSNames(namespace), x509.ExtKeyUsageServerAuth, config.ServerCertValidity)
+}
+
+// IssueCert issue cert signed by CA
+func IssueCert(caCrt, caKey []byte, commonName string, dnsNames []string, usage x509.ExtKeyUsage, validity time.Duration) ([]byte, []byte, error) {
+	ca, err := tls.X509KeyPair(caCrt, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CA, err: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		// tolerate clock skew
+		NotBefore:   now.Add(-5 * time.Minute),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), ca.PrivateKey.(crypto.Signer))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := keyutil.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: cert.CertificateBlockType, Bytes: der}), keyPEM, nil
+}
+
+// RenewAt time to renew cert, after two thirds of its validity
+func RenewAt(crt []byte) (time.Time, error) {
+	block, _ := pem.Decode(crt)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("invalid cert")
+	}
+	c, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return c.NotBefore.Add(c.NotAfter.Sub(c.NotBefore) * 2 / 3), nil
+}
+
+// ServerTLSConfig tls config of server, load cert from secret which mounted in dir, reload it once kubelet updates files,
+// if clientAuth is true, client must present cert signed by internal CA
+func ServerTLSConfig(dir string, clientAuth bool) (*tls.Config, error) {
+	loader := &certLoader{dir: dir}
+	if _, err := loader.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c, err := loader.load()
+			if err != nil {
+				return nil, err
+			}
+			return &c.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := loader.load()
+			if err != nil {
+				return nil, err
+			}
+			conf := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{c.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if clientAuth {
+				conf.ClientAuth, conf.ClientCAs = tls.RequireAndVerifyClientCert, c.pool
+			}
+			return conf, nil
+		},
+	}, nil
+}
+
+type loadedCert struct {
+	cert tls.Certificate
+	pool *x509.CertPool
+}
+
+type certLoader struct {
+	dir     string
+	lock    sync.Mutex
+	modTime time.Time
+	current *loadedCert
+}
+
+// load reload cert if file is changed, kubelet updates secret volume by replacing symlink
+func (l *certLoader) load() (*loadedCert, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	info, err := os.Stat(filepath.Join(l.dir, config.TLSCertKey))
+	if err != nil {
+		return nil, err
+	}
+	if l.current != nil && info.ModTime().Equal(l.modTime) {
+		return l.current, nil
+	}
+	crt, err := os.ReadFile(filepath.Join(l.dir, config.TLSCertKey))
+	if err != nil {
+		return nil, err
+	}
+	key, err := os.ReadFile(filepath.Join(l.dir, config.TLSPrivateKeyKey))
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if ca, err := os.ReadFile(filepath.Join(l.dir, config.TLSCACertKey)); err == nil {
+		pool.AppendCertsFromPEM(ca)
+	}
+	l.current, l.modTime = &loadedCert{cert: pair, pool: pool}, info.ModTime()
+	return l.current, nil
+}
@@ -26,7 +26,7 @@ func GetCIDRElegant(clientset *kubernetes.Clientset, restclient *rest.RESTClient
 	}()
 
 	log.Infoln("get cidr from cluster info...")
-	info, err := getCIDRByDumpClusterInfo(clientset)
+	info, err := getCIDRByDumpClusterInfo(context.Background(), clientset)
 	if err == nil {
 		log.Infoln("get cidr from cluster info ok")
 		result = append(result, info...)
@@ -128,3 +128,22 @@ func GetCIDRFromResourceUgly(clientset *kubernetes.Clientset, namespace string)
 
 	return cidrs, nil
 }
+
+// GetLocalTunIPs ip of tun device which is in kubevpn cidr
+func GetLocalTunIPs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if config.CIDR.Contains(ipNet.IP) || config.CIDR6.Contains(ipNet.IP) {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	return ips, nil
+}
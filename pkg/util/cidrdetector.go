@@ -0,0 +1,367 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Confidence how much cidr detected by detector can be trusted
+type Confidence string
+
+const (
+	// ConfidenceHigh cidr is configured cidr of cluster, eg: ip pool of cni
+	ConfidenceHigh Confidence = "high"
+	// ConfidenceMedium cidr is part of cluster cidr, or may be stale
+	ConfidenceMedium Confidence = "medium"
+	// ConfidenceLow cidr is guessed from ip of pods, may miss pods on other nodes
+	ConfidenceLow Confidence = "low"
+)
+
+// CIDRDetector detects pod or service cidr of cluster from one source
+type CIDRDetector interface {
+	// Name of source, eg: node, calico
+	Name() string
+	Confidence() Confidence
+	Detect(ctx context.Context) ([]*net.IPNet, error)
+}
+
+// CIDRResult cidr detected by detector
+type CIDRResult struct {
+	Detector   string
+	Confidence Confidence
+	CIDRs      []*net.IPNet
+}
+
+// DetectCIDR runs detectors in order, detector fails or finds nothing is skipped
+func DetectCIDR(ctx context.Context, detectors []CIDRDetector) (result []CIDRResult) {
+	for _, d := range detectors {
+		cidrs, err := d.Detect(ctx)
+		if err != nil {
+			log.Debugf("failed to get cidr from %s, err: %v", d.Name(), err)
+			continue
+		}
+		if len(cidrs) == 0 {
+			log.Debugf("get no cidr from %s", d.Name())
+			continue
+		}
+		log.Infof("get cidr from %s: %v", d.Name(), cidrs)
+		result = append(result, CIDRResult{Detector: d.Name(), Confidence: d.Confidence(), CIDRs: Deduplicate(cidrs)})
+	}
+	return
+}
+
+// serviceDetectors detectors which only find service cidr
+var serviceDetectors = sets.New[string]("cluster-info-service", "service")
+
+// HasPodCIDR any high confidence detector finds pod cidr, medium or low one may miss part of it, eg: node, eks
+func HasPodCIDR(results []CIDRResult) bool {
+	for _, r := range results {
+		if r.Confidence == ConfidenceHigh && !serviceDetectors.Has(r.Detector) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCIDRDetectors detectors only read api objects, not need privileged pod or exec
+func NewCIDRDetectors(clientset kubernetes.Interface, dynamicClient dynamic.Interface, namespace string) []CIDRDetector {
+	return []CIDRDetector{
+		&clusterInfoDetector{clientset: clientset},
+		&clusterInfoDetector{clientset: clientset, service: true},
+		&nodeDetector{clientset: clientset},
+		&calicoDetector{client: dynamicClient},
+		&ciliumDetector{clientset: clientset, client: dynamicClient},
+		&kubeProxyDetector{clientset: clientset},
+		&eksDetector{clientset: clientset},
+		&serviceDetector{clientset: clientset, namespace: namespace},
+	}
+}
+
+// NewUserCIDRDetector cidr supplied by user, eg: --cluster-cidr
+func NewUserCIDRDetector(cidrs []string) CIDRDetector {
+	return &userDetector{cidrs: cidrs}
+}
+
+type userDetector struct {
+	cidrs []string
+}
+
+func (d *userDetector) Name() string { return "user" }
+
+func (d *userDetector) Confidence() Confidence { return ConfidenceHigh }
+
+func (d *userDetector) Detect(context.Context) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, s := range d.cidrs {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s, err: %v", s, err)
+		}
+		result = append(result, cidr)
+	}
+	return result, nil
+}
+
+// clusterInfoDetector --cluster-cidr, or --service-cluster-ip-range if service, of control plane pods in kube-system,
+// not visible on managed cluster
+type clusterInfoDetector struct {
+	clientset kubernetes.Interface
+	service   bool
+}
+
+func (d *clusterInfoDetector) Name() string {
+	if d.service {
+		return "cluster-info-service"
+	}
+	return "cluster-info"
+}
+
+func (d *clusterInfoDetector) Confidence() Confidence { return ConfidenceHigh }
+
+func (d *clusterInfoDetector) Detect(ctx context.Context) ([]*net.IPNet, error) {
+	if d.service {
+		return getCIDRByDumpClusterInfo(ctx, d.clientset, flagServiceCIDR)
+	}
+	return getCIDRByDumpClusterInfo(ctx, d.clientset, flagClusterCIDR)
+}
+
+// nodeDetector pod cidr allocated to nodes, spec.podCIDRs
+type nodeDetector struct {
+	clientset kubernetes.Interface
+}
+
+func (d *nodeDetector) Name() string { return "node" }
+
+// Confidence podCIDR of node is not used by some cni, eg: minikube
+func (d *nodeDetector) Confidence() Confidence { return ConfidenceMedium }
+
+func (d *nodeDetector) Detect(ctx context.Context) ([]*net.IPNet, error) {
+	nodeList, err := d.clientset.CoreV1().Nodes().List(ctx, v1.ListOptions{ResourceVersion: "0"})
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, node := range nodeList.Items {
+		list = append(list, node.Spec.PodCIDR)
+		list = append(list, node.Spec.PodCIDRs...)
+	}
+	return parseCIDRs(list...), nil
+}
+
+var (
+	calicoIPPools    = schema.GroupVersionResource{Group: "crd.projectcalico.org", Version: "v1", Resource: "ippools"}
+	calicoAPIIPPools = schema.GroupVersionResource{Group: "projectcalico.org", Version: "v3", Resource: "ippools"}
+	ciliumNodes      = schema.GroupVersionResource{Group: "cilium.io", Version: "v2", Resource: "ciliumnodes"}
+)
+
+// calicoDetector cidr of enabled calico IPPools, from crd, or calico api server if crd is not readable
+type calicoDetector struct {
+	client dynamic.Interface
+}
+
+func (d *calicoDetector) Name() string { return "calico" }
+
+func (d *calicoDetector) Confidence() Confidence { return ConfidenceHigh }
+
+func (d *calicoDetector) Detect(ctx context.Context) ([]*net.IPNet, error) {
+	list, err := d.client.Resource(calicoIPPools).List(ctx, v1.ListOptions{})
+	if err != nil {
+		list, err = d.client.Resource(calicoAPIIPPools).List(ctx, v1.ListOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cidrs []string
+	for _, item := range list.Items {
+		if disabled, _, _ := unstructured.NestedBool(item.Object, "spec", "disabled"); disabled {
+			continue
+		}
+		cidr, _, _ := unstructured.NestedString(item.Object, "spec", "cidr")
+		cidrs = append(cidrs, cidr)
+	}
+	return parseCIDRs(cidrs...), nil
+}
+
+// ciliumDetector pod cidr of CiliumNode ipam, and cluster pool of cilium-config
+type ciliumDetector struct {
+	clientset kubernetes.Interface
+	client    dynamic.Interface
+}
+
+func (d *ciliumDetector) Name() string { return "cilium" }
+
+func (d *ciliumDetector) Confidence() Confidence { return ConfidenceHigh }
+
+func (d *ciliumDetector) Detect(ctx context.Context) ([]*net.IPNet, error) {
+	var cidrs []string
+	list, err := d.client.Resource(ciliumNodes).List(ctx, v1.ListOptions{})
+	if err == nil {
+		for _, item := range list.Items {
+			podCIDRs, _, _ := unstructured.NestedStringSlice(item.Object, "spec", "ipam", "podCIDRs")
+			cidrs = append(cidrs, podCIDRs...)
+		}
+	}
+	cm, errs := d.clientset.CoreV1().ConfigMaps(v1.NamespaceSystem).Get(ctx, "cilium-config", v1.GetOptions{})
+	if errs == nil {
+		for _, key := range []string{"cluster-pool-ipv4-cidr", "cluster-pool-ipv6-cidr"} {
+			// multiple pools are separated by space
+			cidrs = append(cidrs, strings.Fields(cm.Data[key])...)
+		}
+	}
+	if err != nil && errs != nil {
+		return nil, err
+	}
+	return parseCIDRs(cidrs...), nil
+}
+
+// kubeProxyDetector clusterCIDR of kube-proxy config, kubeadm stores it in kube-system/kube-proxy
+type kubeProxyDetector struct {
+	clientset kubernetes.Interface
+}
+
+func (d *kubeProxyDetector) Name() string { return "kube-proxy" }
+
+func (d *kubeProxyDetector) Confidence() Confidence { return ConfidenceHigh }
+
+func (d *kubeProxyDetector) Detect(ctx context.Context) ([]*net.IPNet, error) {
+	cm, err := d.clientset.CoreV1().ConfigMaps(v1.NamespaceSystem).Get(ctx, "kube-proxy", v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var result []*net.IPNet
+	for _, content := range cm.Data {
+		var conf struct {
+			ClusterCIDR string `json:"clusterCIDR"`
+		}
+		if err = yaml.Unmarshal([]byte(content), &conf); err != nil {
+			continue
+		}
+		result = append(result, parseCIDRs(strings.Split(conf.ClusterCIDR, ",")...)...)
+	}
+	return result, nil
+}
+
+const (
+	// pod ips of EKS are aggregated within /16 or /48, VPC cidr is /16 at most
+	eksGroupBitsV4 = 16
+	eksGroupBitsV6 = 48
+	// too many cidrs means pod ips are scattered, route of them is not reliable, let cni probe detect it
+	maxEKSCIDRs = 8
+)
+
+// eksDetector pods of EKS VPC CNI get ip from subnets of VPC, which is not visible from api,
+// ENIConfig of custom networking only refers subnet id, so aggregate pod ips of all namespaces if aws-node is running
+type eksDetector struct {
+	clientset kubernetes.Interface
+}
+
+func (d *eksDetector) Name() string { return "eks-vpc-cni" }
+
+func (d *eksDetector) Confidence() Confidence { return ConfidenceLow }
+
+func (d *eksDetector) Detect(ctx context.Context) ([]*net.IPNet, error) {
+	if _, err := d.clientset.AppsV1().DaemonSets(v1.NamespaceSystem).Get(ctx, "aws-node", v1.GetOptions{}); err != nil {
+		return nil, err
+	}
+	podList, err := d.clientset.CoreV1().Pods(v1.NamespaceAll).List(ctx, v1.ListOptions{ResourceVersion: "0"})
+	if err != nil {
+		return nil, err
+	}
+	result := aggregateIPs(podIPs(podList.Items))
+	if len(result) > maxEKSCIDRs {
+		return nil, fmt.Errorf("pod ips spread over %d cidrs, more than %d", len(result), maxEKSCIDRs)
+	}
+	return result, nil
+}
+
+// serviceDetector service cidr from error message of creating service with invalid cluster ip
+type serviceDetector struct {
+	clientset kubernetes.Interface
+	namespace string
+}
+
+func (d *serviceDetector) Name() string { return "service" }
+
+func (d *serviceDetector) Confidence() Confidence { return ConfidenceHigh }
+
+func (d *serviceDetector) Detect(context.Context) ([]*net.IPNet, error) {
+	cidr, err := getServiceCIDRByCreateSvc(d.clientset.CoreV1().Services(d.namespace))
+	if err != nil {
+		return nil, err
+	}
+	return []*net.IPNet{cidr}, nil
+}
+
+// podIPs ips of pods which are not host network
+func podIPs(pods []v12.Pod) (result []net.IP) {
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork {
+			continue
+		}
+		s := sets.New[string]().Insert(pod.Status.PodIP)
+		for _, p := range pod.Status.PodIPs {
+			s.Insert(p.IP)
+		}
+		for _, t := range sets.List(s) {
+			if ip := net.ParseIP(t); ip != nil {
+				result = append(result, ip)
+			}
+		}
+	}
+	return
+}
+
+// aggregateIPs groups ips by /16 or /48, returns smallest cidr covering each group, but not smaller than /24 or /64
+func aggregateIPs(ips []net.IP) (result []*net.IPNet) {
+	var groups = make(map[string]*net.IPNet)
+	var keys []string
+	for _, ip := range ips {
+		bits, group, ones := 128, eksGroupBitsV6, 64
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits, group, ones = 32, eksGroupBitsV4, 24
+		}
+		key := ip.Mask(net.CIDRMask(group, bits)).String()
+		cidr, ok := groups[key]
+		if !ok {
+			mask := net.CIDRMask(ones, bits)
+			groups[key] = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+			keys = append(keys, key)
+			continue
+		}
+		// widen cidr until it covers ip, stops at group at last
+		ones, _ = cidr.Mask.Size()
+		for !cidr.Contains(ip) {
+			ones--
+			cidr.Mask = net.CIDRMask(ones, bits)
+			cidr.IP = cidr.IP.Mask(cidr.Mask)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result = append(result, groups[key])
+	}
+	return
+}
+
+func parseCIDRs(list ...string) (result []*net.IPNet) {
+	for _, s := range list {
+		if _, cidr, err := net.ParseCIDR(strings.TrimSpace(s)); err == nil {
+			result = append(result, cidr)
+		}
+	}
+	return
+}
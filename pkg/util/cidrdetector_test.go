@@ -0,0 +1,211 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAggregateIPs(t *testing.T) {
+	testDatas := []struct {
+		name   string
+		ips    []string
+		expect []string
+	}{
+		{name: "one ip", ips: []string{"10.0.1.5"}, expect: []string{"10.0.1.0/24"}},
+		{name: "same /24", ips: []string{"10.0.1.5", "10.0.1.200"}, expect: []string{"10.0.1.0/24"}},
+		{name: "adjacent /24", ips: []string{"10.0.0.5", "10.0.1.5"}, expect: []string{"10.0.0.0/23"}},
+		{name: "subnets of vpc", ips: []string{"10.0.1.5", "10.0.64.5", "10.0.128.5"}, expect: []string{"10.0.0.0/16"}},
+		{name: "secondary cidr", ips: []string{"10.0.1.5", "100.64.3.5", "100.64.9.1"}, expect: []string{"10.0.1.0/24", "100.64.0.0/20"}},
+		{name: "ipv6", ips: []string{"2600:1f14::1", "2600:1f14:0:1::1"}, expect: []string{"2600:1f14::/63"}},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			var ips []net.IP
+			for _, s := range data.ips {
+				ips = append(ips, net.ParseIP(s))
+			}
+			var got []string
+			for _, cidr := range aggregateIPs(ips) {
+				got = append(got, cidr.String())
+			}
+			if !reflect.DeepEqual(got, data.expect) {
+				t.Errorf("expect: %v, but got: %v", data.expect, got)
+			}
+		})
+	}
+}
+
+func TestEKSDetector(t *testing.T) {
+	awsNode := &appsv1.DaemonSet{ObjectMeta: v1.ObjectMeta{Name: "aws-node", Namespace: v1.NamespaceSystem}}
+	pod := func(name, ip string, hostNetwork bool) *v12.Pod {
+		return &v12.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       v12.PodSpec{HostNetwork: hostNetwork},
+			Status:     v12.PodStatus{PodIP: ip, PodIPs: []v12.PodIP{{IP: ip}}},
+		}
+	}
+	var scattered = []runtime.Object{awsNode}
+	for i := 0; i <= maxEKSCIDRs; i++ {
+		scattered = append(scattered, pod(fmt.Sprintf("pod-%d", i), fmt.Sprintf("10.%d.0.1", i), false))
+	}
+	testDatas := []struct {
+		name      string
+		objects   []runtime.Object
+		expect    []string
+		expectErr bool
+	}{
+		{name: "not eks", objects: []runtime.Object{pod("a", "10.0.1.5", false)}, expectErr: true},
+		{
+			name:    "pods across nodes",
+			objects: []runtime.Object{awsNode, pod("a", "10.0.1.5", false), pod("b", "10.0.2.5", false), pod("c", "10.0.3.5", false)},
+			expect:  []string{"10.0.0.0/22"},
+		},
+		{name: "host network is skipped", objects: []runtime.Object{awsNode, pod("a", "10.0.1.5", false), pod("b", "192.168.0.5", true)}, expect: []string{"10.0.1.0/24"}},
+		{name: "scattered pod ips", objects: scattered, expectErr: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			d := &eksDetector{clientset: fake.NewSimpleClientset(data.objects...)}
+			cidrs, err := d.Detect(context.Background())
+			if (err != nil) != data.expectErr {
+				t.Fatalf("expect error: %v, but got: %v", data.expectErr, err)
+			}
+			var got []string
+			for _, cidr := range cidrs {
+				got = append(got, cidr.String())
+			}
+			if !reflect.DeepEqual(got, data.expect) {
+				t.Errorf("expect: %v, but got: %v", data.expect, got)
+			}
+		})
+	}
+}
+
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		calicoIPPools:    "IPPoolList",
+		calicoAPIIPPools: "IPPoolList",
+		ciliumNodes:      "CiliumNodeList",
+	}, objects...)
+}
+
+func newUnstructured(gvr schema.GroupVersionResource, kind, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": gvr.GroupVersion().String(),
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name},
+		"spec":       spec,
+	}}
+}
+
+func TestCIDRDetectors(t *testing.T) {
+	controlPlane := fake.NewSimpleClientset(&v12.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "kube-controller-manager", Namespace: v1.NamespaceSystem},
+		Spec: v12.PodSpec{Containers: []v12.Container{{
+			Command: []string{"kube-controller-manager", "--cluster-cidr=10.233.64.0/18", "--service-cluster-ip-range=10.233.0.0/18"},
+		}}},
+	})
+	testDatas := []struct {
+		name      string
+		detector  CIDRDetector
+		expect    []string
+		expectErr bool
+	}{
+		{name: "cluster-info", detector: &clusterInfoDetector{clientset: controlPlane}, expect: []string{"10.233.64.0/18"}},
+		{name: "cluster-info service", detector: &clusterInfoDetector{clientset: controlPlane, service: true}, expect: []string{"10.233.0.0/18"}},
+		{
+			name: "node",
+			detector: &nodeDetector{clientset: fake.NewSimpleClientset(
+				&v12.Node{ObjectMeta: v1.ObjectMeta{Name: "a"}, Spec: v12.NodeSpec{PodCIDR: "10.244.0.0/24", PodCIDRs: []string{"10.244.0.0/24", "fd00:10:244::/64"}}},
+				&v12.Node{ObjectMeta: v1.ObjectMeta{Name: "b"}, Spec: v12.NodeSpec{PodCIDR: "10.244.1.0/24"}},
+			)},
+			expect: []string{"10.244.0.0/24", "fd00:10:244::/64", "10.244.1.0/24"},
+		},
+		{
+			name: "calico",
+			detector: &calicoDetector{client: newFakeDynamicClient(
+				newUnstructured(calicoIPPools, "IPPool", "default-ipv4-ippool", map[string]interface{}{"cidr": "10.233.64.0/18"}),
+				newUnstructured(calicoIPPools, "IPPool", "disabled", map[string]interface{}{"cidr": "10.10.0.0/16", "disabled": true}),
+			)},
+			expect: []string{"10.233.64.0/18"},
+		},
+		{name: "no calico", detector: &calicoDetector{client: newFakeDynamicClient()}},
+		{
+			name: "cilium",
+			detector: &ciliumDetector{
+				clientset: fake.NewSimpleClientset(&v12.ConfigMap{
+					ObjectMeta: v1.ObjectMeta{Name: "cilium-config", Namespace: v1.NamespaceSystem},
+					Data:       map[string]string{"cluster-pool-ipv4-cidr": "10.0.0.0/8 172.16.0.0/12"},
+				}),
+				client: newFakeDynamicClient(newUnstructured(ciliumNodes, "CiliumNode", "a", map[string]interface{}{
+					"ipam": map[string]interface{}{"podCIDRs": []interface{}{"10.0.1.0/24"}},
+				})),
+			},
+			expect: []string{"10.0.1.0/24", "10.0.0.0/8", "172.16.0.0/12"},
+		},
+		{
+			name: "kube-proxy",
+			detector: &kubeProxyDetector{clientset: fake.NewSimpleClientset(&v12.ConfigMap{
+				ObjectMeta: v1.ObjectMeta{Name: "kube-proxy", Namespace: v1.NamespaceSystem},
+				Data:       map[string]string{"config.conf": "apiVersion: kubeproxy.config.k8s.io/v1alpha1\nclusterCIDR: 10.244.0.0/16,fd00:10:244::/56\nmode: iptables\n"},
+			})},
+			expect: []string{"10.244.0.0/16", "fd00:10:244::/56"},
+		},
+		{name: "no kube-proxy", detector: &kubeProxyDetector{clientset: fake.NewSimpleClientset()}, expectErr: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			cidrs, err := data.detector.Detect(context.Background())
+			if (err != nil) != data.expectErr {
+				t.Fatalf("expect error: %v, but got: %v", data.expectErr, err)
+			}
+			var got []string
+			for _, cidr := range Deduplicate(cidrs) {
+				got = append(got, cidr.String())
+			}
+			if !reflect.DeepEqual(got, data.expect) {
+				t.Errorf("expect: %v, but got: %v", data.expect, got)
+			}
+		})
+	}
+}
+
+func TestHasPodCIDR(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.233.0.0/18")
+	testDatas := []struct {
+		name    string
+		results []CIDRResult
+		expect  bool
+	}{
+		{name: "nothing"},
+		{name: "only service cidr", results: []CIDRResult{
+			{Detector: "cluster-info-service", Confidence: ConfidenceHigh, CIDRs: []*net.IPNet{cidr}},
+			{Detector: "service", Confidence: ConfidenceHigh, CIDRs: []*net.IPNet{cidr}},
+		}},
+		{name: "node and eks", results: []CIDRResult{
+			{Detector: "node", Confidence: ConfidenceMedium, CIDRs: []*net.IPNet{cidr}},
+			{Detector: "eks", Confidence: ConfidenceLow, CIDRs: []*net.IPNet{cidr}},
+		}},
+		{name: "cluster-info", results: []CIDRResult{{Detector: "cluster-info", Confidence: ConfidenceHigh, CIDRs: []*net.IPNet{cidr}}}, expect: true},
+		{name: "calico", results: []CIDRResult{{Detector: "calico", Confidence: ConfidenceHigh, CIDRs: []*net.IPNet{cidr}}}, expect: true},
+	}
+	for _, data := range testDatas {
+		t.Run(data.name, func(t *testing.T) {
+			if got := HasPodCIDR(data.results); got != data.expect {
+				t.Errorf("expect: %v, but got: %v", data.expect, got)
+			}
+		})
+	}
+}
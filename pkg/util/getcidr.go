@@ -26,9 +26,9 @@ import (
 
 // root     22008 21846 14 Jan18 ?        6-22:53:35 kube-apiserver --advertise-address=10.56.95.185 --allow-privileged=true --anonymous-auth=True --apiserver-count=3 --authorization-mode=Node,RBAC --bind-address=0.0.0.0 --client-ca-file=/etc/kubernetes/ssl/ca.crt --default-not-ready-toleration-seconds=300 --default-unreachable-toleration-seconds=300 --enable-admission-plugins=NodeRestriction --enable-aggregator-routing=False --enable-bootstrap-token-auth=true --endpoint-reconciler-type=lease --etcd-cafile=/etc/ssl/etcd/ssl/ca.pem --etcd-certfile=/etc/ssl/etcd/ssl/node-kube-control-1.pem --etcd-keyfile=/etc/ssl/etcd/ssl/node-kube-control-1-key.pem --etcd-servers=https://10.56.95.185:2379,https://10.56.95.186:2379,https://10.56.95.187:2379 --etcd-servers-overrides=/events#https://10.56.95.185:2381;https://10.56.95.186:2381;https://10.56.95.187:2381 --event-ttl=1h0m0s --insecure-port=0 --kubelet-certificate-authority=/etc/kubernetes/ssl/kubelet/kubelet-ca.crt --kubelet-client-certificate=/etc/kubernetes/ssl/apiserver-kubelet-client.crt --kubelet-client-key=/etc/kubernetes/ssl/apiserver-kubelet-client.key --kubelet-preferred-address-types=InternalDNS,InternalIP,Hostname,ExternalDNS,ExternalIP --profiling=False --proxy-client-cert-file=/etc/kubernetes/ssl/front-proxy-client.crt --proxy-client-key-file=/etc/kubernetes/ssl/front-proxy-client.key --request-timeout=1m0s --requestheader-allowed-names=front-proxy-client --requestheader-client-ca-file=/etc/kubernetes/ssl/front-proxy-ca.crt --requestheader-extra-headers-prefix=X-Remote-Extra- --requestheader-group-headers=X-Remote-Group --requestheader-username-headers=X-Remote-User --secure-port=6443 --service-account-issuer=https://kubernetes.default.svc.cluster.local --service-account-key-file=/etc/kubernetes/ssl/sa.pub --service-account-signing-key-file=/etc/kubernetes/ssl/sa.key --service-cluster-ip-range=10.233.0.0/18 --service-node-port-range=30000-32767 --storage-backend=etcd3 --tls-cert-file=/etc/kubernetes/ssl/apiserver.crt --tls-private-key-file=/etc/kubernetes/ssl/apiserver.key
 // ref: https://kubernetes.io/docs/concepts/services-networking/dual-stack/#configure-ipv4-ipv6-dual-stack
-// get cidr by dump cluster info
-func getCIDRByDumpClusterInfo(clientset *kubernetes.Clientset) ([]*net.IPNet, error) {
-	podList, err := clientset.CoreV1().Pods(v1.NamespaceSystem).List(context.Background(), v1.ListOptions{})
+// get cidr by dump cluster info, only cidr of flags if flags is not empty
+func getCIDRByDumpClusterInfo(ctx context.Context, clientset kubernetes.Interface, flags ...string) ([]*net.IPNet, error) {
+	podList, err := clientset.CoreV1().Pods(v1.NamespaceSystem).List(ctx, v1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -41,8 +41,11 @@ func getCIDRByDumpClusterInfo(clientset *kubernetes.Clientset) ([]*net.IPNet, er
 	}
 
 	var result []*net.IPNet
+	if len(flags) == 0 {
+		flags = []string{flagClusterCIDR, flagServiceCIDR}
+	}
 	for _, s := range list {
-		result = append(result, parseCIDRFromString(s)...)
+		result = append(result, parseCIDRFromFlag(s, flags...)...)
 	}
 	return Deduplicate(result), nil
 }
@@ -332,7 +335,22 @@ kube-proxy:
 --cluster-cidr=<IPv4 CIDR>,<IPv6 CIDR>
 */
 func parseCIDRFromString(content string) (result []*net.IPNet) {
-	if strings.Contains(content, "cluster-cidr") || strings.Contains(content, "service-cluster-ip-range") {
+	return parseCIDRFromFlag(content, flagClusterCIDR, flagServiceCIDR)
+}
+
+const (
+	// flagClusterCIDR pod cidr
+	flagClusterCIDR = "cluster-cidr"
+	// flagServiceCIDR service cidr
+	flagServiceCIDR = "service-cluster-ip-range"
+)
+
+func parseCIDRFromFlag(content string, flags ...string) (result []*net.IPNet) {
+	var found bool
+	for _, flag := range flags {
+		found = found || strings.Contains(content, flag)
+	}
+	if found {
 		split := strings.Split(content, "=")
 		if len(split) == 2 {
 			cidrList := split[1]
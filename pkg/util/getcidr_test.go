@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -40,7 +41,7 @@ func before() {
 
 func TestByDumpClusterInfo(t *testing.T) {
 	before()
-	info, err := getCIDRByDumpClusterInfo(clientset)
+	info, err := getCIDRByDumpClusterInfo(context.Background(), clientset)
 	if err != nil {
 		t.Error(err)
 	}
@@ -12,7 +12,8 @@ func DeleteBlockFirewallRule(_ context.Context) {
 func AddAllowFirewallRule() {
 }
 
-func DeleteAllowFirewallRule() {
+func DeleteAllowFirewallRule() error {
+	return nil
 }
 
 func FindAllowFirewallRule() bool {
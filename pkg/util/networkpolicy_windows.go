@@ -4,6 +4,7 @@ package util
 
 import (
 	"context"
+	"fmt"
 	"os/exec"
 	"syscall"
 	"time"
@@ -59,7 +60,7 @@ func AddAllowFirewallRule() {
 	}
 }
 
-func DeleteAllowFirewallRule() {
+func DeleteAllowFirewallRule() error {
 	// netsh advfirewall firewall delete rule name=kubevpn-traffic-manager
 	cmd := exec.Command("netsh", []string{
 		"advfirewall",
@@ -78,7 +79,9 @@ func DeleteAllowFirewallRule() {
 			s = string(out)
 		}
 		log.Errorf("error while exec command: %s, out: %s", cmd.Args, s)
+		return fmt.Errorf("failed to delete firewall rule %s, out: %s", config.ConfigMapPodTrafficManager, s)
 	}
+	return nil
 }
 
 func FindAllowFirewallRule() bool {
@@ -17,11 +17,53 @@ import (
 	"k8s.io/kubectl/pkg/cmd/util"
 
 	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/controlplane"
 )
 
 type PodRouteConfig struct {
 	LocalTunIPv4 string
 	LocalTunIPv6 string
+	// TrafficManagerNamespace is namespace of cluster-wide traffic manager, empty means traffic manager is in same namespace
+	TrafficManagerNamespace string
+	// TrafficManagerCert is cert of internal CA of traffic manager, sidecar uses it to verify traffic manager
+	TrafficManagerCert string
+	// Workload customizes resources and image pull secrets of sidecar
+	Workload *WorkloadConfig
+	// Weight percentage of matched traffic to local PC in mesh mode, 0 means all
+	Weight int
+	// Mirror shadow traffic to local PC in mesh mode, response of local PC is ignored
+	Mirror bool
+	// MirrorPercent percentage of matched traffic mirrored to local PC, 0 means all
+	MirrorPercent int
+	// HealthCheckPath http health check path of local PC in mesh mode, empty means tcp health check
+	HealthCheckPath string
+	// Fault inject delay or abort into matched traffic in mesh mode
+	Fault *controlplane.Fault
+	// DirectResponses canned response for matched traffic in mesh mode
+	DirectResponses []*controlplane.DirectResponse
+}
+
+// TrafficManagerService address of traffic manager service which sidecar connect to
+func (c PodRouteConfig) TrafficManagerService() string {
+	if c.TrafficManagerNamespace == "" {
+		return config.ConfigMapPodTrafficManager
+	}
+	return config.ConfigMapPodTrafficManager + "." + c.TrafficManagerNamespace
+}
+
+// TrafficManagerEnv env which sidecar needs to talk to traffic manager, only cert of CA, private keys in secret are not exposed to sidecar
+func (c PodRouteConfig) TrafficManagerEnv() []corev1.EnvVar {
+	env := []corev1.EnvVar{{
+		Name:  config.TLSCACertKey,
+		Value: c.TrafficManagerCert,
+	}}
+	if c.TrafficManagerNamespace != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  config.EnvTrafficManagerNamespace,
+			Value: c.TrafficManagerNamespace,
+		})
+	}
+	return env
 }
 
 func PrintStatus(pod *corev1.Pod, writer io.Writer) {
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/pointer"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+)
+
+// AddTokenVolume add projected service account token volume, sidecar use it to authenticate itself to traffic manager
+func AddTokenVolume(spec *corev1.PodSpec) {
+	RemoveTokenVolume(spec)
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: config.VolumeToken,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{
+					ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+						Audience:          config.TokenAudience,
+						ExpirationSeconds: pointer.Int64(config.TokenExpirationSeconds),
+						Path:              config.TokenFilename,
+					},
+				}},
+			},
+		},
+	})
+}
+
+func RemoveTokenVolume(spec *corev1.PodSpec) {
+	for i := 0; i < len(spec.Volumes); i++ {
+		if spec.Volumes[i].Name == config.VolumeToken {
+			spec.Volumes = append(spec.Volumes[:i], spec.Volumes[i+1:]...)
+			i--
+		}
+	}
+}
+
+func TokenVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      config.VolumeToken,
+		ReadOnly:  true,
+		MountPath: config.TokenMountPath,
+	}
+}
+
+// GetToken read projected service account token, kubelet will rotate it before expiry, so read it every time
+func GetToken() (string, error) {
+	content, err := os.ReadFile(filepath.Join(config.TokenMountPath, config.TokenFilename))
+	if err != nil {
+		return "", fmt.Errorf("can not read service account token, err: %v", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -17,6 +17,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	dockerterm "github.com/moby/term"
@@ -231,6 +232,19 @@ func IsWindows() bool {
 	return runtime.GOOS == "windows"
 }
 
+// ProcessAlive whether process of pid is running on this machine
+func ProcessAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// on windows, FindProcess returns error if process not exist
+	if IsWindows() {
+		return true
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
 func GetUnstructuredObject(f cmdutil.Factory, namespace string, workloads string) (*runtimeresource.Info, error) {
 	do := f.NewBuilder().
 		Unstructured().
@@ -563,9 +577,10 @@ func CanI(clientset *kubernetes.Clientset, sa, ns string, resource *rbacv1.Polic
 }
 
 func DoReq(request *http.Request) (body []byte, err error) {
-	cert, ok := os.LookupEnv(config.TLSCertKey)
+	// cert of webhook is signed by internal CA of traffic manager
+	cert, ok := os.LookupEnv(config.TLSCACertKey)
 	if !ok {
-		return nil, fmt.Errorf("can not get %s from env", config.TLSCertKey)
+		return nil, fmt.Errorf("can not get %s from env", config.TLSCACertKey)
 	}
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM([]byte(cert))
@@ -0,0 +1,234 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v12 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+)
+
+// WorkloadConfig scheduling and resources of traffic manager and injected sidecars,
+// cluster admin can set it in configmap config.ConfigMapWorkload, flags override it
+type WorkloadConfig struct {
+	// Resources of traffic manager containers
+	Resources         *corev1.ResourceRequirements `json:"resources,omitempty"`
+	NodeSelector      map[string]string            `json:"nodeSelector,omitempty"`
+	Tolerations       []corev1.Toleration          `json:"tolerations,omitempty"`
+	Affinity          *corev1.Affinity             `json:"affinity,omitempty"`
+	PriorityClassName string                       `json:"priorityClassName,omitempty"`
+	// Annotations of traffic manager pod
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// ImagePullSecrets is used by both traffic manager and sidecars
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// SidecarResources of containers injected into workloads
+	SidecarResources *corev1.ResourceRequirements `json:"sidecarResources,omitempty"`
+	// IdleTimeout traffic manager scales down to zero after no client for this duration, zero means never
+	IdleTimeout *metav1.Duration `json:"idleTimeout,omitempty"`
+	// Replicas of traffic manager, traffic manager scales back to it after scaled down to zero because of idle
+	Replicas *int32 `json:"replicas,omitempty"`
+}
+
+// GetWorkloadConfig read workload config from configmap, not found or forbidden means not set
+func GetWorkloadConfig(ctx context.Context, mapInterface v12.ConfigMapInterface) (*WorkloadConfig, error) {
+	cm, err := mapInterface.Get(ctx, config.ConfigMapWorkload, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || apierrors.IsForbidden(err) {
+		return &WorkloadConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var w WorkloadConfig
+	if err = yaml.Unmarshal([]byte(cm.Data[config.KeyWorkload]), &w); err != nil {
+		return nil, fmt.Errorf("failed to parse %s of configmap %s, err: %v", config.KeyWorkload, config.ConfigMapWorkload, err)
+	}
+	return &w, nil
+}
+
+// Merge return a new config, non-empty fields of o override w
+func (w *WorkloadConfig) Merge(o *WorkloadConfig) *WorkloadConfig {
+	var result WorkloadConfig
+	if w != nil {
+		result = *w
+	}
+	if o == nil {
+		return &result
+	}
+	result.Resources = mergeResources(result.Resources, o.Resources)
+	result.SidecarResources = mergeResources(result.SidecarResources, o.SidecarResources)
+	if len(o.NodeSelector) != 0 {
+		result.NodeSelector = o.NodeSelector
+	}
+	if len(o.Tolerations) != 0 {
+		result.Tolerations = o.Tolerations
+	}
+	if o.Affinity != nil {
+		result.Affinity = o.Affinity
+	}
+	if o.PriorityClassName != "" {
+		result.PriorityClassName = o.PriorityClassName
+	}
+	if len(o.Annotations) != 0 {
+		result.Annotations = o.Annotations
+	}
+	if len(o.ImagePullSecrets) != 0 {
+		result.ImagePullSecrets = o.ImagePullSecrets
+	}
+	if o.IdleTimeout != nil {
+		result.IdleTimeout = o.IdleTimeout
+	}
+	if o.Replicas != nil {
+		result.Replicas = o.Replicas
+	}
+	return &result
+}
+
+// IdleTimeoutOrDefault idle timeout of traffic manager, default is config.DefaultIdleTimeout
+func (w *WorkloadConfig) IdleTimeoutOrDefault() time.Duration {
+	if w == nil || w.IdleTimeout == nil {
+		return config.DefaultIdleTimeout
+	}
+	return w.IdleTimeout.Duration
+}
+
+// ReplicasOrDefault replicas of traffic manager, default is 1
+func (w *WorkloadConfig) ReplicasOrDefault() int32 {
+	if w == nil || w.Replicas == nil {
+		return 1
+	}
+	return *w.Replicas
+}
+
+// TrafficManagerResources resources of traffic manager containers, override def by resource name
+func (w *WorkloadConfig) TrafficManagerResources(def corev1.ResourceRequirements) corev1.ResourceRequirements {
+	if w == nil {
+		return def
+	}
+	return *mergeResources(&def, w.Resources)
+}
+
+// SidecarResourcesOrDefault resources of sidecar containers, override def by resource name
+func (w *WorkloadConfig) SidecarResourcesOrDefault(def corev1.ResourceRequirements) corev1.ResourceRequirements {
+	if w == nil {
+		return def
+	}
+	return *mergeResources(&def, w.SidecarResources)
+}
+
+// ApplyTrafficManager set scheduling fields to pod template of traffic manager
+func (w *WorkloadConfig) ApplyTrafficManager(template *corev1.PodTemplateSpec) {
+	if w == nil {
+		return
+	}
+	if len(w.NodeSelector) != 0 {
+		template.Spec.NodeSelector = w.NodeSelector
+	}
+	if len(w.Tolerations) != 0 {
+		template.Spec.Tolerations = w.Tolerations
+	}
+	if w.Affinity != nil {
+		template.Spec.Affinity = w.Affinity
+	}
+	if w.PriorityClassName != "" {
+		template.Spec.PriorityClassName = w.PriorityClassName
+	}
+	for k, v := range w.Annotations {
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		template.Annotations[k] = v
+	}
+	w.AddImagePullSecrets(&template.Spec)
+}
+
+// AddImagePullSecrets add image pull secrets to pod spec if not exist
+func (w *WorkloadConfig) AddImagePullSecrets(spec *corev1.PodSpec) {
+	if w == nil {
+		return
+	}
+	for _, secret := range w.ImagePullSecrets {
+		var found bool
+		for _, reference := range spec.ImagePullSecrets {
+			if reference.Name == secret.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			spec.ImagePullSecrets = append(spec.ImagePullSecrets, secret)
+		}
+	}
+}
+
+func mergeResources(base, override *corev1.ResourceRequirements) *corev1.ResourceRequirements {
+	if override == nil {
+		return base
+	}
+	if base == nil {
+		return override.DeepCopy()
+	}
+	result := base.DeepCopy()
+	for name, quantity := range override.Requests {
+		if result.Requests == nil {
+			result.Requests = corev1.ResourceList{}
+		}
+		result.Requests[name] = quantity
+	}
+	for name, quantity := range override.Limits {
+		if result.Limits == nil {
+			result.Limits = corev1.ResourceList{}
+		}
+		result.Limits[name] = quantity
+	}
+	return result
+}
+
+// ParseResourceList parse flag like cpu=500m,memory=512Mi
+func ParseResourceList(m map[string]string) (corev1.ResourceList, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	list := corev1.ResourceList{}
+	for name, value := range m {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity %s of resource %s, err: %v", value, name, err)
+		}
+		list[corev1.ResourceName(name)] = quantity
+	}
+	return list, nil
+}
+
+// ParseToleration parse flag like key=value:NoSchedule, key:NoSchedule or key=value
+func ParseToleration(s string) (corev1.Toleration, error) {
+	var toleration corev1.Toleration
+	keyValue, effect, found := strings.Cut(s, ":")
+	if found {
+		switch corev1.TaintEffect(effect) {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+			toleration.Effect = corev1.TaintEffect(effect)
+		default:
+			return toleration, fmt.Errorf("invalid taint effect %s of toleration %s", effect, s)
+		}
+	}
+	key, value, found := strings.Cut(keyValue, "=")
+	if key == "" {
+		return toleration, fmt.Errorf("invalid toleration %s, key is empty", s)
+	}
+	toleration.Key = key
+	if found {
+		toleration.Operator = corev1.TolerationOpEqual
+		toleration.Value = value
+	} else {
+		toleration.Operator = corev1.TolerationOpExists
+	}
+	return toleration, nil
+}
@@ -0,0 +1,100 @@
+package webhook
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/handler"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
+)
+
+// issueCert issue client cert for envoy sidecar, envoy uses it to talk to control-plane with mTLS
+func (d *dhcpServer) issueCert(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	id, err := d.authenticate(ctx, r)
+	if err != nil {
+		log.Errorf("failed to authenticate issue cert request, err: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	caCrt, err := os.ReadFile(filepath.Join(config.TLSMountPath, config.TLSCACertKey))
+	if err != nil {
+		log.Errorf("can not read CA, err: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	caKey, err := os.ReadFile(filepath.Join(config.TLSMountPath, config.TLSCAKeyKey))
+	if err != nil {
+		log.Errorf("can not read CA key, err: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	crt, key, err := util.IssueCert(caCrt, caKey, id.String(), nil, x509.ExtKeyUsageClientAuth, config.ClientCertValidity)
+	if err != nil {
+		log.Errorf("failed to issue cert for pod %s, err: %v", id.String(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof("issued cert for pod %s", id.String())
+	bytes, _ := json.Marshal(handler.CertResponse{CA: string(caCrt), Crt: string(crt), Key: string(key)})
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(bytes); err != nil {
+		log.Error(err)
+	}
+}
+
+// rotateCert rotate server cert of webhook and control-plane in secret before expiry,
+// kubelet updates mounted files, and servers reload it
+func rotateCert(ctx context.Context, clientset *kubernetes.Clientset, namespace string) {
+	ticker := time.NewTicker(time.Minute * 10)
+	defer ticker.Stop()
+	for {
+		if err := rotateCertOnce(ctx, clientset, namespace); err != nil {
+			log.Errorf("failed to rotate cert, err: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func rotateCertOnce(ctx context.Context, clientset *kubernetes.Clientset, namespace string) error {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, config.ConfigMapPodTrafficManager, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if len(secret.Data[config.TLSCAKeyKey]) == 0 {
+		return fmt.Errorf("secret %s has no CA, it is created by old version, please reset traffic manager", secret.Name)
+	}
+	renewAt, err := util.RenewAt(secret.Data[config.TLSCertKey])
+	if err != nil {
+		return err
+	}
+	if time.Now().Before(renewAt) {
+		return nil
+	}
+	crt, key, err := util.IssueServerCert(secret.Data[config.TLSCACertKey], secret.Data[config.TLSCAKeyKey], namespace)
+	if err != nil {
+		return err
+	}
+	secret.Data[config.TLSCertKey] = crt
+	secret.Data[config.TLSPrivateKeyKey] = key
+	if _, err = clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.Infof("rotated cert of traffic manager")
+	return nil
+}
@@ -5,36 +5,80 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/cmd/util/podcmd"
 
 	"github.com/wencaiwulue/kubevpn/pkg/config"
 	"github.com/wencaiwulue/kubevpn/pkg/handler"
 )
 
+const (
+	serviceAccountUsernamePrefix = "system:serviceaccount:"
+	// podNameKey and podUIDKey are keys of extra info, which kube-apiserver sets for pod bound token
+	podNameKey = "authentication.kubernetes.io/pod-name"
+	podUIDKey  = "authentication.kubernetes.io/pod-uid"
+)
+
 type dhcpServer struct {
 	f         util.Factory
 	clientset *kubernetes.Clientset
+	namespace string
+}
+
+// identity is the caller pod, it comes from TokenReview, not from header
+type identity struct {
+	namespace string
+	podName   string
+	uid       string
+	// lease which webhook rents ip for when admitting pod, from annotation of pod
+	lease string
+}
+
+func (i identity) String() string {
+	return i.namespace + "/" + i.podName
+}
+
+// owners of lease which identity holds, webhook rents ip for uid of admission request because name and uid
+// of pod may be not assigned when admitting, rent ip api rents for pod uid
+func (i identity) owners() []string {
+	if i.lease != "" {
+		return []string{i.uid, i.String(), i.lease}
+	}
+	return []string{i.uid, i.String()}
 }
 
 func (d *dhcpServer) rentIP(w http.ResponseWriter, r *http.Request) {
-	podName := r.Header.Get(config.HeaderPodName)
-	namespace := r.Header.Get(config.HeaderPodNamespace)
 	ctx := context.Background()
+	id, err := d.authenticate(ctx, r)
+	if err != nil {
+		log.Errorf("failed to authenticate rent ip request, err: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err = d.authorize(ctx, id); err != nil {
+		log.Errorf("pod %s is not allowed to rent ip, err: %v", id.String(), err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 
-	log.Infof("handling rent ip request, pod name: %s, ns: %s", podName, namespace)
-	cmi := d.clientset.CoreV1().ConfigMaps(namespace)
-	dhcp := handler.NewDHCPManager(cmi, namespace)
-	v4, v6, err := dhcp.RentIPRandom(ctx)
+	log.Infof("handling rent ip request, pod name: %s, ns: %s", id.podName, id.namespace)
+	ns := dhcpNamespace(d.namespace, id.namespace)
+	dhcp := handler.NewDHCPManager(d.clientset.CoreV1().ConfigMaps(ns), ns)
+	v4, v6, err := dhcp.RentIPForOwner(ctx, id.owners()...)
 	if err != nil {
 		log.Error(err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
-	// todo patch annotation
 	_, err = w.Write([]byte(fmt.Sprintf("%s,%s", v4.String(), v6.String())))
 	if err != nil {
 		log.Error(err)
@@ -42,8 +86,13 @@ func (d *dhcpServer) rentIP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (d *dhcpServer) releaseIP(w http.ResponseWriter, r *http.Request) {
-	podName := r.Header.Get(config.HeaderPodName)
-	namespace := r.Header.Get(config.HeaderPodNamespace)
+	ctx := context.Background()
+	id, err := d.authenticate(ctx, r)
+	if err != nil {
+		log.Errorf("failed to authenticate release ip request, err: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
 	var ips []net.IP
 	for _, s := range []string{r.Header.Get(config.HeaderIPv4), r.Header.Get(config.HeaderIPv6)} {
@@ -55,13 +104,87 @@ func (d *dhcpServer) releaseIP(w http.ResponseWriter, r *http.Request) {
 		ips = append(ips, ip)
 	}
 
-	log.Infof("handling release ip request, pod name: %s, ns: %s", podName, namespace)
-	cmi := d.clientset.CoreV1().ConfigMaps(namespace)
-	dhcp := handler.NewDHCPManager(cmi, namespace)
-	if err := dhcp.ReleaseIP(context.Background(), ips...); err != nil {
+	// pod may be deleted already, then only release ip which leased to uid or name of it
+	if pod, errs := d.getPod(ctx, id); errs == nil {
+		id.lease = pod.Annotations[config.AnnotationDHCPLease]
+	}
+	log.Infof("handling release ip request, pod name: %s, ns: %s", id.podName, id.namespace)
+	ns := dhcpNamespace(d.namespace, id.namespace)
+	dhcp := handler.NewDHCPManager(d.clientset.CoreV1().ConfigMaps(ns), ns)
+	if err = dhcp.ReleaseIPOwnedBy(ctx, id.owners(), ips...); err != nil {
 		log.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// authenticate validate projected service account token by TokenReview, and get pod identity from it
+func (d *dhcpServer) authenticate(ctx context.Context, r *http.Request) (*identity, error) {
+	auth := r.Header.Get(config.HeaderAuthorization)
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	if auth == "" || token == "" || token == auth {
+		return nil, fmt.Errorf("bearer token not found")
+	}
+	review, err := d.clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: []string{config.TokenAudience},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		return nil, fmt.Errorf("token is not authenticated: %s", review.Status.Error)
+	}
+	if !sets.New[string](review.Status.Audiences...).Has(config.TokenAudience) {
+		return nil, fmt.Errorf("token audience %v not contains %s", review.Status.Audiences, config.TokenAudience)
+	}
+	// system:serviceaccount:<namespace>:<name>
+	parts := strings.Split(strings.TrimPrefix(review.Status.User.Username, serviceAccountUsernamePrefix), ":")
+	if !strings.HasPrefix(review.Status.User.Username, serviceAccountUsernamePrefix) || len(parts) != 2 {
+		return nil, fmt.Errorf("username %s is not a service account", review.Status.User.Username)
+	}
+	namespace := parts[0]
+	podName := review.Status.User.Extra[podNameKey]
+	podUID := review.Status.User.Extra[podUIDKey]
+	if len(podName) == 0 || podName[0] == "" || len(podUID) == 0 || podUID[0] == "" {
+		return nil, fmt.Errorf("token of %s is not bound to any pod", review.Status.User.Username)
+	}
+	return &identity{namespace: namespace, podName: podName[0], uid: podUID[0]}, nil
+}
+
+// authorize only pod which injected vpn sidecar, in namespace served by this traffic manager can rent ip
+func (d *dhcpServer) authorize(ctx context.Context, id *identity) error {
+	if d.namespace != "" && id.namespace != d.namespace {
+		ns, err := d.clientset.CoreV1().Namespaces().Get(ctx, id.namespace, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if ns.Labels[config.LabelTrafficManager] != d.namespace {
+			return fmt.Errorf("namespace %s is not served by traffic manager in namespace %s", id.namespace, d.namespace)
+		}
+	}
+	pod, err := d.getPod(ctx, id)
+	if err != nil {
+		return err
+	}
+	if container, _ := podcmd.FindContainerByName(pod, config.ContainerSidecarVPN); container == nil {
+		return fmt.Errorf("pod %s has no container %s", id.String(), config.ContainerSidecarVPN)
+	}
+	id.lease = pod.Annotations[config.AnnotationDHCPLease]
+	return nil
+}
+
+// getPod pod of identity, uid must be same, pod with same name may be re-created
+func (d *dhcpServer) getPod(ctx context.Context, id *identity) (*corev1.Pod, error) {
+	pod, err := d.clientset.CoreV1().Pods(id.namespace).Get(ctx, id.podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if string(pod.UID) != id.uid {
+		return nil, fmt.Errorf("uid of pod %s is %s, not %s", id.String(), pod.UID, id.uid)
+	}
+	return pod, nil
+}
@@ -1,12 +1,14 @@
 package webhook
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/admission/v1"
@@ -16,12 +18,16 @@ import (
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 
 	"github.com/wencaiwulue/kubevpn/pkg/config"
+	"github.com/wencaiwulue/kubevpn/pkg/handler"
+	"github.com/wencaiwulue/kubevpn/pkg/util"
 )
 
 // admissionReviewHandler is a handler to handle business logic, holding an util.Factory
 type admissionReviewHandler struct {
 	f         cmdutil.Factory
 	clientset *kubernetes.Clientset
+	// namespace of traffic manager, DHCP state is stored in it
+	namespace string
 }
 
 // admitv1beta1Func handles a v1beta1 admission
@@ -128,37 +134,46 @@ func Main(f cmdutil.Factory) error {
 	if err != nil {
 		return err
 	}
-	h := &admissionReviewHandler{f: f, clientset: clientset}
+	namespace := os.Getenv(config.EnvPodNamespace)
+	h := &admissionReviewHandler{f: f, clientset: clientset, namespace: namespace}
 
 	http.HandleFunc("/pods", func(w http.ResponseWriter, r *http.Request) { serve(w, r, newDelegateToV1AdmitHandler(h.admitPods)) })
 	http.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) { _, _ = w.Write([]byte("ok")) })
 
-	s := &dhcpServer{f: f, clientset: clientset}
+	s := &dhcpServer{f: f, clientset: clientset, namespace: namespace}
 	http.HandleFunc(config.APIRentIP, s.rentIP)
 	http.HandleFunc(config.APIReleaseIP, s.releaseIP)
+	http.HandleFunc(config.APIIssueCert, s.issueCert)
 
-	var pairs []tls.Certificate
-	pairs, err = getSSLKeyPairs()
+	// collect stale client and scale down if idle
+	idleTimeout := config.DefaultIdleTimeout
+	if v, ok := os.LookupEnv(config.EnvIdleTimeout); ok {
+		if idleTimeout, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("failed to parse env %s, err: %v", config.EnvIdleTimeout, err)
+		}
+	}
+	var clusterWide bool
+	if v, ok := os.LookupEnv(config.EnvClusterWide); ok {
+		if clusterWide, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("failed to parse env %s, err: %v", config.EnvClusterWide, err)
+		}
+	}
+	go handler.GarbageCollect(context.Background(), clientset, namespace, clusterWide, idleTimeout)
+
+	go rotateCert(context.Background(), clientset, namespace)
+
+	tlsConfig, err := util.ServerTLSConfig(config.TLSMountPath, false)
 	if err != nil {
 		return err
 	}
-	server := &http.Server{Addr: fmt.Sprintf(":%d", 80), TLSConfig: &tls.Config{Certificates: pairs}}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", 80), TLSConfig: tlsConfig}
 	return server.ListenAndServeTLS("", "")
 }
 
-func getSSLKeyPairs() ([]tls.Certificate, error) {
-	cert, ok := os.LookupEnv(config.TLSCertKey)
-	if !ok {
-		return nil, fmt.Errorf("can not get %s from env", config.TLSCertKey)
-	}
-	var key string
-	key, ok = os.LookupEnv(config.TLSPrivateKeyKey)
-	if !ok {
-		return nil, fmt.Errorf("can not get %s from env", config.TLSPrivateKeyKey)
-	}
-	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
-	if err != nil {
-		return nil, fmt.Errorf("failed to load certificate and key ,err: %v", err)
+// dhcpNamespace cluster-wide traffic manager stores DHCP state in its own namespace
+func dhcpNamespace(namespace, requestNamespace string) string {
+	if namespace != "" {
+		return namespace
 	}
-	return []tls.Certificate{pair}, nil
+	return requestNamespace
 }
@@ -10,7 +10,6 @@ import (
 	log "github.com/sirupsen/logrus"
 	"k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/kubectl/pkg/cmd/util/podcmd"
 
@@ -47,23 +46,31 @@ func (h *admissionReviewHandler) admitPods(ar v1.AdmissionReview) *v1.AdmissionR
 		var found bool
 		for i := 0; i < len(pod.Spec.Containers); i++ {
 			if pod.Spec.Containers[i].Name == config.ContainerSidecarVPN {
+				// lease annotation is only set by webhook, never trust the one from request
+				if _, ok := pod.Annotations[config.AnnotationDHCPLease]; ok {
+					found = true
+					delete(pod.Annotations, config.AnnotationDHCPLease)
+				}
 				var v4, v6 *net.IPNet
 				for j := 0; j < len(pod.Spec.Containers[i].Env); j++ {
 					pair := pod.Spec.Containers[i].Env[j]
 					if pair.Name == config.EnvInboundPodTunIPv4 && pair.Value == "" {
 						found = true
-						cmi := h.clientset.CoreV1().ConfigMaps(ar.Request.Namespace)
-						dhcp := handler.NewDHCPManager(cmi, ar.Request.Namespace)
-						v4, v6, err = dhcp.RentIPRandom(context.Background())
+						// name and uid of pod may be not assigned when admitting, eg: generateName,
+						// so lease is owned by uid of admission request, record it in annotation of pod
+						owner := string(ar.Request.UID)
+						if pod.Annotations == nil {
+							pod.Annotations = map[string]string{}
+						}
+						pod.Annotations[config.AnnotationDHCPLease] = owner
+						ns := dhcpNamespace(h.namespace, ar.Request.Namespace)
+						dhcp := handler.NewDHCPManager(h.clientset.CoreV1().ConfigMaps(ns), ns)
+						v4, v6, err = dhcp.RentIPForOwner(context.Background(), owner)
 						if err != nil {
 							log.Errorf("rent ip random failed, err: %v", err)
 							return toV1AdmissionResponse(err)
 						}
-						var name string
-						if accessor, errT := meta.Accessor(ar.Request.Object); errT == nil {
-							name = accessor.GetName()
-						}
-						log.Infof("rent ipv4: %s ipv6: %s for pod %s in namespace: %s", v4.String(), v6.String(), name, ar.Request.Namespace)
+						log.Infof("rent ipv4: %s ipv6: %s for lease %s in namespace: %s", v4.String(), v6.String(), owner, ar.Request.Namespace)
 					}
 				}
 				for j := 0; j < len(pod.Spec.Containers[i].Env); j++ {
@@ -128,12 +135,17 @@ func (h *admissionReviewHandler) admitPods(ar v1.AdmissionReview) *v1.AdmissionR
 					}
 				}
 			}
-			cmi := h.clientset.CoreV1().ConfigMaps(ar.Request.Namespace)
-			err := handler.NewDHCPManager(cmi, ar.Request.Namespace).ReleaseIP(context.Background(), ips...)
+			// only release ip which leased to this pod, ip in spec is not trusted
+			owners := []string{string(pod.UID), ar.Request.Namespace + "/" + pod.Name}
+			if lease := pod.Annotations[config.AnnotationDHCPLease]; lease != "" {
+				owners = append(owners, lease)
+			}
+			ns := dhcpNamespace(h.namespace, ar.Request.Namespace)
+			err := handler.NewDHCPManager(h.clientset.CoreV1().ConfigMaps(ns), ns).ReleaseIPOwnedBy(context.Background(), owners, ips...)
 			if err != nil {
 				log.Errorf("release ip to dhcp err: %v, ips: %v", err, ips)
 			} else {
-				log.Errorf("release ip to dhcp ok, ip: %v", ips)
+				log.Infof("release ip to dhcp ok, ip: %v", ips)
 			}
 		}
 		return &v1.AdmissionResponse{